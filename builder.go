@@ -2,6 +2,7 @@ package imagebuilder
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -80,6 +81,9 @@ type Run struct {
 }
 
 type Executor interface {
+	// Preserve should arrange for the contents of a volume to be restored
+	// after every later Run. It is only called when the builder's
+	// VolumeSemantics is VolumeSemanticsDocker.
 	Preserve(path string) error
 	// EnsureContainerPath should ensure that the directory exists, creating any components required
 	EnsureContainerPath(path string) error
@@ -91,6 +95,46 @@ type Executor interface {
 	UnrecognizedInstruction(step *Step) error
 }
 
+// ContextExecutor is an Executor whose operations can be interrupted by
+// cancelling a context. When an executor implements it, Builder.RunContext
+// calls these methods in place of their Executor counterparts.
+type ContextExecutor interface {
+	Executor
+	PreserveContext(ctx context.Context, path string) error
+	EnsureContainerPathAsContext(ctx context.Context, path, user string, mode *os.FileMode) error
+	CopyContext(ctx context.Context, excludes []string, copies ...Copy) error
+	RunContext(ctx context.Context, run Run, config docker.Config) error
+}
+
+// contextExecutor adapts a ContextExecutor to the Executor interface by
+// supplying a context to each of its operations.
+type contextExecutor struct {
+	ContextExecutor
+	ctx context.Context
+}
+
+func (e contextExecutor) Preserve(path string) error {
+	return e.PreserveContext(e.ctx, path)
+}
+
+func (e contextExecutor) EnsureContainerPathAs(path, user string, mode *os.FileMode) error {
+	return e.EnsureContainerPathAsContext(e.ctx, path, user, mode)
+}
+
+func (e contextExecutor) Copy(excludes []string, copies ...Copy) error {
+	if err := e.ctx.Err(); err != nil {
+		return err
+	}
+	return e.CopyContext(e.ctx, excludes, copies...)
+}
+
+func (e contextExecutor) Run(run Run, config docker.Config) error {
+	if err := e.ctx.Err(); err != nil {
+		return err
+	}
+	return e.RunContext(e.ctx, run, config)
+}
+
 type logExecutor struct{}
 
 func (logExecutor) Preserve(path string) error {
@@ -155,6 +199,44 @@ func (noopExecutor) UnrecognizedInstruction(step *Step) error {
 	return nil
 }
 
+// VolumeSemantics controls what happens to changes which are made beneath a
+// path declared with VOLUME by later RUN instructions.
+type VolumeSemantics int
+
+const (
+	// VolumeSemanticsDocker discards the changes, as the classic docker
+	// builder does. The executor is asked to Preserve each volume so that
+	// it can restore its contents after every RUN.
+	VolumeSemanticsDocker VolumeSemantics = iota
+	// VolumeSemanticsBuildKit keeps the changes, as BuildKit does. VOLUME
+	// only updates the image's configuration, and nothing is preserved.
+	VolumeSemanticsBuildKit
+)
+
+// ParseVolumeSemantics returns the VolumeSemantics named "docker" or
+// "buildkit".
+func ParseVolumeSemantics(s string) (VolumeSemantics, error) {
+	switch strings.ToLower(s) {
+	case "docker", "classic", "":
+		return VolumeSemanticsDocker, nil
+	case "buildkit":
+		return VolumeSemanticsBuildKit, nil
+	default:
+		return VolumeSemanticsDocker, fmt.Errorf("unrecognized volume semantics %q, must be docker or buildkit", s)
+	}
+}
+
+func (v VolumeSemantics) String() string {
+	switch v {
+	case VolumeSemanticsDocker:
+		return "docker"
+	case VolumeSemanticsBuildKit:
+		return "buildkit"
+	default:
+		return fmt.Sprintf("VolumeSemantics(%d)", int(v))
+	}
+}
+
 type VolumeSet []string
 
 func (s *VolumeSet) Add(path string) bool {
@@ -466,6 +548,7 @@ func extractNameFromNode(node *parser.Node) (string, bool) {
 
 func (b *Builder) builderForStage(globalArgsList []string) *Builder {
 	stageBuilder := newBuilderWithGlobalAllowedArgs(b.UserArgs, b.HeadingArgs, b.BuiltinArgDefaults, globalArgsList)
+	stageBuilder.VolumeSemantics = b.VolumeSemantics
 	return stageBuilder
 }
 
@@ -500,6 +583,10 @@ type Builder struct {
 
 	Volumes  VolumeSet
 	Excludes []string
+	// VolumeSemantics controls whether changes made beneath a VOLUME by
+	// later RUN instructions are discarded, which requires the executor to
+	// Preserve the volume, or kept.
+	VolumeSemantics VolumeSemantics
 
 	PendingVolumes VolumeSet
 	PendingRuns    []Run
@@ -582,6 +669,24 @@ func (b *Builder) Step() *Step {
 // optimization hint that allows the builder to avoid performing
 // unnecessary work.
 func (b *Builder) Run(step *Step, exec Executor, noRunsRemaining bool) error {
+	return b.RunContext(context.Background(), step, exec, noRunsRemaining)
+}
+
+// RunContext is like Run, but stops before starting any new operation once
+// ctx is cancelled. If exec implements ContextExecutor, ctx is passed to it.
+//
+// Errors are returned as a *StepError.
+func (b *Builder) RunContext(ctx context.Context, step *Step, exec Executor, noRunsRemaining bool) error {
+	return newStepError(step.Original, step.startLine, step.endLine, b.runContext(ctx, step, exec, noRunsRemaining))
+}
+
+func (b *Builder) runContext(ctx context.Context, step *Step, exec Executor, noRunsRemaining bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ce, ok := exec.(ContextExecutor); ok {
+		exec = contextExecutor{ContextExecutor: ce, ctx: ctx}
+	}
 	fn, ok := evaluateTable[step.Command]
 	if !ok {
 		return exec.UnrecognizedInstruction(step)
@@ -596,10 +701,11 @@ func (b *Builder) Run(step *Step, exec Executor, noRunsRemaining bool) error {
 	b.PendingRuns = nil
 
 	// Once a VOLUME is defined, future ADD/COPY instructions are
-	// all that may mutate that path. Instruct the executor to preserve
-	// the path. The executor must handle invalidating preserved info.
+	// all that may mutate that path, unless BuildKit's semantics were
+	// requested. Instruct the executor to preserve the path. The executor
+	// must handle invalidating preserved info.
 	for _, path := range b.PendingVolumes {
-		if b.Volumes.Add(path) && !noRunsRemaining {
+		if b.Volumes.Add(path) && !noRunsRemaining && b.VolumeSemantics == VolumeSemanticsDocker {
 			if err := exec.Preserve(path); err != nil {
 				return err
 			}
@@ -802,9 +908,10 @@ var builtinAllowedBuildArgs = map[string]bool{
 }
 
 // ParseIgnoreReader returns a list of the excludes in the provided file
-// which uses the .dockerignore format
-// extracted from fsouza/go-dockerclient and modified to drop comments and
-// empty lines.
+// which uses the .dockerignore format. As with docker, a line is a comment if
+// it starts with #, surrounding whitespace is dropped, and each pattern is
+// cleaned and made relative to the root of the context, keeping any leading !
+// which re-includes what an earlier pattern excluded.
 func ParseIgnoreReader(r io.Reader) ([]string, error) {
 	var excludes []string
 
@@ -812,14 +919,30 @@ func ParseIgnoreReader(r io.Reader) ([]string, error) {
 	if err != nil {
 		return excludes, err
 	}
+	ignores = bytes.TrimPrefix(ignores, []byte("\xef\xbb\xbf"))
 	for _, ignore := range strings.Split(string(ignores), "\n") {
-		if len(ignore) == 0 || ignore[0] == '#' {
+		if strings.HasPrefix(ignore, "#") {
+			continue
+		}
+		ignore = strings.TrimSpace(ignore)
+		if len(ignore) == 0 {
 			continue
 		}
-		ignore = strings.Trim(ignore, "/")
+		invert := ignore[0] == '!'
+		if invert {
+			ignore = strings.TrimSpace(ignore[1:])
+		}
 		if len(ignore) > 0 {
-			excludes = append(excludes, ignore)
+			ignore = strings.TrimLeft(filepath.ToSlash(filepath.Clean(ignore)), "/")
+			if len(ignore) == 0 {
+				// the root of the context can't be excluded
+				continue
+			}
+		}
+		if invert {
+			ignore = "!" + ignore
 		}
+		excludes = append(excludes, ignore)
 	}
 	return excludes, nil
 }
@@ -838,14 +961,37 @@ func ParseIgnore(path string) ([]string, error) {
 
 // ParseDockerIgnore returns a list of the excludes in the .containerignore or .dockerignore file.
 func ParseDockerignore(root string) ([]string, error) {
-	excludes, err := ParseIgnore(filepath.Join(root, ".containerignore"))
-	if err != nil && os.IsNotExist(err) {
-		excludes, err = ParseIgnore(filepath.Join(root, ".dockerignore"))
+	return ParseDockerignoreFor(root, "")
+}
+
+// DockerfileIgnoreFiles returns the ignore files named after dockerfile, next
+// to it, in the order of their precedence. They let Dockerfiles which share a
+// context exclude different files from it.
+func DockerfileIgnoreFiles(dockerfile string) []string {
+	if dockerfile == "" {
+		return nil
 	}
-	if err != nil && os.IsNotExist(err) {
-		return excludes, nil
+	return []string{dockerfile + ".containerignore", dockerfile + ".dockerignore"}
+}
+
+// DockerignoreFiles returns the ignore files which can apply to a build of
+// dockerfile using the context in root, in the order of their precedence.
+// Only the first one of them which exists is used.
+func DockerignoreFiles(root, dockerfile string) []string {
+	return append(DockerfileIgnoreFiles(dockerfile), filepath.Join(root, ".containerignore"), filepath.Join(root, ".dockerignore"))
+}
+
+// ParseDockerignoreFor returns a list of the excludes in the first of the
+// ignore files returned by DockerignoreFiles which exists.
+func ParseDockerignoreFor(root, dockerfile string) ([]string, error) {
+	for _, file := range DockerignoreFiles(root, dockerfile) {
+		excludes, err := ParseIgnore(file)
+		if err != nil && os.IsNotExist(err) {
+			continue
+		}
+		return excludes, err
 	}
-	return excludes, err
+	return nil, nil
 }
 
 // ExportEnv creates an export statement for a shell that contains all of the
@@ -2,7 +2,9 @@ package imagebuilder
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -818,6 +820,236 @@ func (e *testExecutor) UnrecognizedInstruction(step *Step) error {
 	return e.Err
 }
 
+type testContextExecutor struct {
+	testExecutor
+	Contexts []context.Context
+}
+
+func (e *testContextExecutor) PreserveContext(ctx context.Context, path string) error {
+	e.Contexts = append(e.Contexts, ctx)
+	return e.Preserve(path)
+}
+
+func (e *testContextExecutor) EnsureContainerPathAsContext(ctx context.Context, path, user string, mode *os.FileMode) error {
+	e.Contexts = append(e.Contexts, ctx)
+	return e.EnsureContainerPathAs(path, user, mode)
+}
+
+func (e *testContextExecutor) CopyContext(ctx context.Context, excludes []string, copies ...Copy) error {
+	e.Contexts = append(e.Contexts, ctx)
+	return e.Copy(excludes, copies...)
+}
+
+func (e *testContextExecutor) RunContext(ctx context.Context, run Run, config docker.Config) error {
+	e.Contexts = append(e.Contexts, ctx)
+	return e.Run(run, config)
+}
+
+func TestRunContext(t *testing.T) {
+	node, err := ParseDockerfile(strings.NewReader("FROM busybox\nVOLUME /data\nCOPY . /\nRUN true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "value")
+	b := NewBuilder(nil)
+	if _, err := b.From(node); err != nil {
+		t.Fatal(err)
+	}
+	e := &testContextExecutor{}
+	for _, child := range node.Children {
+		step := b.Step()
+		if err := step.Resolve(child); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.RunContext(ctx, step, e, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(e.Preserved) != 1 || len(e.Copies) != 1 || len(e.Runs) != 1 {
+		t.Fatalf("unexpected operations: %#v", e.testExecutor)
+	}
+	if len(e.Contexts) == 0 {
+		t.Fatalf("expected the context to be passed to the executor")
+	}
+	for _, c := range e.Contexts {
+		if c.Value(key{}) != "value" {
+			t.Errorf("executor was passed a different context")
+		}
+	}
+
+	// nothing is started once the context has been cancelled
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	step := b.Step()
+	if err := step.Resolve(node.Children[len(node.Children)-1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.RunContext(cancelled, step, e, false); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if len(e.Runs) != 1 {
+		t.Errorf("expected no more commands to be run, got %d", len(e.Runs))
+	}
+}
+
+func TestVolumeSemantics(t *testing.T) {
+	testCases := []struct {
+		Dockerfile string
+		Semantics  VolumeSemantics
+		Preserved  []string
+	}{
+		{
+			Dockerfile: "FROM busybox\nVOLUME /data\nRUN true\n",
+			Semantics:  VolumeSemanticsDocker,
+			Preserved:  []string{"/data"},
+		},
+		{
+			Dockerfile: "FROM busybox\nVOLUME /data\nRUN true\n",
+			Semantics:  VolumeSemanticsBuildKit,
+		},
+		{
+			Dockerfile: "FROM busybox AS base\nFROM base\nVOLUME /data /cache\nRUN true\n",
+			Semantics:  VolumeSemanticsDocker,
+			Preserved:  []string{"/data", "/cache"},
+		},
+		{
+			Dockerfile: "FROM busybox AS base\nFROM base\nVOLUME /data /cache\nRUN true\n",
+			Semantics:  VolumeSemanticsBuildKit,
+		},
+	}
+	for i, test := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			node, err := ParseDockerfile(strings.NewReader(test.Dockerfile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := NewBuilder(nil)
+			b.VolumeSemantics = test.Semantics
+			stages, err := NewStages(node, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stage := stages[len(stages)-1]
+			if stage.Builder.VolumeSemantics != test.Semantics {
+				t.Fatalf("expected the stage to use %s semantics, got %s", test.Semantics, stage.Builder.VolumeSemantics)
+			}
+			if _, err := stage.Builder.From(stage.Node); err != nil {
+				t.Fatal(err)
+			}
+			e := &testExecutor{}
+			for _, child := range stage.Node.Children {
+				step := stage.Builder.Step()
+				if err := step.Resolve(child); err != nil {
+					t.Fatal(err)
+				}
+				if err := stage.Builder.Run(step, e, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !reflect.DeepEqual(test.Preserved, e.Preserved) {
+				t.Errorf("expected %v to be preserved, got %v", test.Preserved, e.Preserved)
+			}
+			if !stage.Builder.Volumes.Has("/data") {
+				t.Errorf("expected the volume to be recorded either way")
+			}
+		})
+	}
+}
+
+func TestParseVolumeSemantics(t *testing.T) {
+	testCases := []struct {
+		Value     string
+		Semantics VolumeSemantics
+		Err       bool
+	}{
+		{Value: "", Semantics: VolumeSemanticsDocker},
+		{Value: "docker", Semantics: VolumeSemanticsDocker},
+		{Value: "BuildKit", Semantics: VolumeSemanticsBuildKit},
+		{Value: "podman", Err: true},
+	}
+	for i, test := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			semantics, err := ParseVolumeSemantics(test.Value)
+			if (err != nil) != test.Err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if semantics != test.Semantics {
+				t.Errorf("expected %s, got %s", test.Semantics, semantics)
+			}
+		})
+	}
+}
+
+func TestStepError(t *testing.T) {
+	testCases := []struct {
+		Dockerfile string
+		Err        error
+		Message    string
+		Original   string
+		Line       int
+		ExitCode   int
+	}{
+		{
+			Dockerfile: "FROM busybox\nRUN false\n",
+			Err:        &ExitError{Args: []string{"false"}, ExitCode: 3},
+			Message:    "RUN false (line 2): running 'false' failed with exit code 3",
+			Original:   "RUN false",
+			Line:       2,
+			ExitCode:   3,
+		},
+		{
+			Dockerfile: "FROM busybox\n\nCOPY . /\n",
+			Err:        errors.New("no space left on device"),
+			Message:    "COPY . / (line 3): no space left on device",
+			Original:   "COPY . /",
+			Line:       3,
+		},
+		{
+			Dockerfile: "FROM busybox\nENV A=1\nUSER\n",
+			Message:    "USER (line 3): USER requires exactly one argument",
+			Original:   "USER",
+			Line:       3,
+		},
+	}
+	for i, test := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			node, err := ParseDockerfile(strings.NewReader(test.Dockerfile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := NewBuilder(nil)
+			if _, err := b.From(node); err != nil {
+				t.Fatal(err)
+			}
+			e := &testExecutor{}
+			for _, child := range node.Children {
+				step := b.Step()
+				if err = step.Resolve(child); err != nil {
+					break
+				}
+				e.Err = test.Err
+				if err = b.Run(step, e, false); err != nil {
+					break
+				}
+			}
+			var stepErr *StepError
+			if !errors.As(err, &stepErr) {
+				t.Fatalf("expected a step error, got %v", err)
+			}
+			if err.Error() != test.Message {
+				t.Errorf("expected %q, got %q", test.Message, err.Error())
+			}
+			if stepErr.Original != test.Original || stepErr.ExitCode != test.ExitCode {
+				t.Errorf("unexpected step error: %#v", stepErr)
+			}
+			if test.Err != nil && !errors.Is(err, test.Err) {
+				t.Errorf("expected the step error to wrap %v", test.Err)
+			}
+		})
+	}
+}
+
 func TestBuilder(t *testing.T) {
 	testCases := []struct {
 		Args         map[string]string
@@ -892,8 +1124,8 @@ func TestBuilder(t *testing.T) {
 			Dockerfile: "dockerclient/testdata/Dockerfile.unknown",
 			From:       "mirror.gcr.io/busybox",
 			Unrecognized: []Step{
-				{Command: "health", Message: "HEALTH ", Original: "HEALTH NONE", Args: []string{""}, Flags: []string{}, Env: []string{}},
-				{Command: "unrecognized", Message: "UNRECOGNIZED ", Original: "UNRECOGNIZED", Args: []string{""}, Env: []string{}},
+				{Command: "health", Message: "HEALTH ", Original: "HEALTH NONE", Args: []string{""}, Flags: []string{}, Env: []string{}, startLine: 2, endLine: 2},
+				{Command: "unrecognized", Message: "UNRECOGNIZED ", Original: "UNRECOGNIZED", Args: []string{""}, Env: []string{}, startLine: 3, endLine: 3},
 			},
 			Config: docker.Config{
 				Image: "mirror.gcr.io/busybox",
@@ -1233,6 +1465,98 @@ func TestRunWithMultiArg(t *testing.T) {
 	t.Logf(node.Dump())
 }
 
+func TestParseDockerignoreFor(t *testing.T) {
+	testCases := []struct {
+		files  map[string]string
+		expect []string
+	}{
+		{
+			files:  map[string]string{".dockerignore": "root\n"},
+			expect: []string{"root"},
+		},
+		{
+			files:  map[string]string{".dockerignore": "root\n", "sub/Dockerfile.dockerignore": "dockerfile\n"},
+			expect: []string{"dockerfile"},
+		},
+		{
+			files:  map[string]string{".containerignore": "root\n", "sub/Dockerfile.dockerignore": "dockerfile\n", "sub/Dockerfile.containerignore": "containerfile\n"},
+			expect: []string{"containerfile"},
+		},
+		{
+			// an ignore file for another Dockerfile doesn't apply
+			files:  map[string]string{".dockerignore": "root\n", "sub/Other.dockerignore": "other\n"},
+			expect: []string{"root"},
+		},
+		{
+			files: map[string]string{},
+		},
+	}
+	for i, test := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range test.files {
+				name = filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			excludes, err := ParseDockerignoreFor(dir, filepath.Join(dir, "sub", "Dockerfile"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(excludes, test.expect) {
+				t.Errorf("expected %v, got %v", test.expect, excludes)
+			}
+		})
+	}
+}
+
+func TestIgnoreMatcher(t *testing.T) {
+	testCases := []struct {
+		patterns []string
+		path     string
+		included bool
+		pattern  string
+	}{
+		{patterns: nil, path: "file", included: true},
+		{patterns: []string{"file"}, path: "file", included: false, pattern: "file"},
+		{patterns: []string{"file"}, path: "/file", included: false, pattern: "file"},
+		{patterns: []string{"file"}, path: "./other/../file", included: false, pattern: "file"},
+		{patterns: []string{"file"}, path: "other", included: true},
+		{patterns: []string{"dir"}, path: "dir/sub/file", included: false, pattern: "dir"},
+		{patterns: []string{"*.go"}, path: "dir/main.go", included: true},
+		{patterns: []string{"**/*.go"}, path: "dir/sub/main.go", included: false, pattern: "**/*.go"},
+		{patterns: []string{"**/*.go"}, path: "main.go", included: false, pattern: "**/*.go"},
+		{patterns: []string{"*", "!keep"}, path: "keep", included: true, pattern: "!keep"},
+		{patterns: []string{"*", "!keep"}, path: "other", included: false, pattern: "*"},
+		{patterns: []string{"!keep", "*"}, path: "keep", included: false, pattern: "*"},
+		{patterns: []string{"dir", "!dir/keep"}, path: "dir/keep/file", included: true, pattern: "!dir/keep"},
+		{patterns: []string{"dir", "!dir/keep"}, path: "dir/other", included: false, pattern: "dir"},
+		{patterns: []string{"dir"}, path: ".", included: true},
+	}
+	for i, test := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			m, err := NewIgnoreMatcher(test.patterns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			included, pattern, err := m.Included(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if included != test.included || pattern != test.pattern {
+				t.Errorf("expected %s to be included=%t by %q, got included=%t by %q", test.path, test.included, test.pattern, included, pattern)
+			}
+		})
+	}
+	if _, err := NewIgnoreMatcher([]string{"!"}); err == nil {
+		t.Errorf("expected an error for an illegal exclusion pattern")
+	}
+}
+
 func TestParseDockerignore(t *testing.T) {
 	dir, err := ioutil.TempDir("", "dockerignore*")
 	if err != nil {
@@ -1252,8 +1576,10 @@ func TestParseDockerignore(t *testing.T) {
 			result: []string{"third", "fourth"},
 		},
 		{
+			// only lines which start with # are comments, but whitespace
+			// around patterns is dropped
 			input:  []string{"", "first", "second", "", " #third", "#invalid pattern which shouldn't matter ("},
-			result: []string{"first", "second", " #third"},
+			result: []string{"first", "second", "#third"},
 		},
 		{
 			input:  []string{"", "first", "second", "", "#third", ""},
@@ -1267,6 +1593,14 @@ func TestParseDockerignore(t *testing.T) {
 			input:  []string{"/first", "second/", "/third/", "///fourth//", "fif/th#", "/"},
 			result: []string{"first", "second", "third", "fourth", "fif/th#"},
 		},
+		{
+			input:  []string{"\xef\xbb\xbffirst\r", "second  \t", "a/../b/./c", "**/*.go"},
+			result: []string{"first", "second", "b/c", "**/*.go"},
+		},
+		{
+			input:  []string{"*", "!keep", "! /also/keep/ ", "!"},
+			result: []string{"*", "!keep", "!also/keep", "!"},
+		},
 	}
 
 	testIgnore := func(ignorefile string) {
@@ -3,11 +3,11 @@ package dockerclient
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -112,7 +112,7 @@ func NewLazyArchive(fn CreateFileFunc) io.ReadCloser {
 	return pr
 }
 
-func archiveFromURL(src, dst, tempDir string, check DirectoryCheck) (io.Reader, io.Closer, error) {
+func archiveFromURL(ctx context.Context, src, dst, tempDir string, check DirectoryCheck, downloader *Downloader) (io.Reader, io.Closer, error) {
 	// get filename from URL
 	u, err := url.Parse(src)
 	if err != nil {
@@ -122,49 +122,31 @@ func archiveFromURL(src, dst, tempDir string, check DirectoryCheck) (io.Reader,
 	if base == "." {
 		return nil, nil, fmt.Errorf("cannot determine filename from url: %s", u)
 	}
-	resp, err := http.Get(src)
+	f, err := downloader.Fetch(ctx, src, tempDir)
 	if err != nil {
 		return nil, nil, err
 	}
 	archive := NewLazyArchive(func() (*tar.Header, io.ReadCloser, bool, error) {
-		if resp.StatusCode >= 400 {
-			return nil, nil, false, fmt.Errorf("server returned a status code >= 400: %s", resp.Status)
-		}
-
 		header := &tar.Header{
-			Name: sourceToDestinationName(path.Base(u.Path), dst, false),
-			Mode: 0600,
-		}
-		r := resp.Body
-		if resp.ContentLength == -1 {
-			f, err := ioutil.TempFile(tempDir, "url")
-			if err != nil {
-				return nil, nil, false, fmt.Errorf("unable to create temporary file for source URL: %v", err)
-			}
-			n, err := io.Copy(f, resp.Body)
-			if err != nil {
-				f.Close()
-				return nil, nil, false, fmt.Errorf("unable to download source URL: %v", err)
-			}
-			if err := f.Close(); err != nil {
-				return nil, nil, false, fmt.Errorf("unable to write source URL: %v", err)
-			}
-			f, err = os.Open(f.Name())
-			if err != nil {
-				return nil, nil, false, fmt.Errorf("unable to open downloaded source URL: %v", err)
-			}
-			r = f
-			header.Size = n
-		} else {
-			header.Size = resp.ContentLength
+			Name:    sourceToDestinationName(path.Base(u.Path), dst, false),
+			Mode:    0600,
+			Size:    f.Size,
+			ModTime: f.ModTime,
 		}
-		return header, r, false, nil
+		return header, ioutil.NopCloser(f), false, nil
 	})
-	return archive, closers{resp.Body.Close, archive.Close}, nil
+	return archive, closers{f.Close, archive.Close}, nil
 }
 
-func archiveFromDisk(directory string, src, dst string, allowDownload bool, excludes []string, check DirectoryCheck) (io.Reader, io.Closer, error) {
+func archiveFromDisk(directory string, src, dst string, allowDownload bool, excludes []string, check DirectoryCheck, opts copyOptions) (io.Reader, io.Closer, error) {
 	var err error
+	var pivot string
+	if opts.Parents {
+		pivot, src = splitParentsPivot(src)
+		if src == "" {
+			src = "."
+		}
+	}
 	if filepath.IsAbs(src) {
 		src, err = filepath.Rel(directory, filepath.Join(directory, src))
 		if err != nil {
@@ -178,7 +160,7 @@ func archiveFromDisk(directory string, src, dst string, allowDownload bool, excl
 	}
 
 	// special case when we are archiving a single file at the root
-	if len(infos) == 1 && !infos[0].FileInfo.IsDir() && (infos[0].Path == "." || infos[0].Path == "/") {
+	if !opts.Parents && len(infos) == 1 && !infos[0].FileInfo.IsDir() && (infos[0].Path == "." || infos[0].Path == "/") {
 		klog.V(5).Infof("Archiving a file instead of a directory from %s", directory)
 		infos[0].Path = filepath.Base(directory)
 		infos[0].FromDir = false
@@ -189,6 +171,18 @@ func archiveFromDisk(directory string, src, dst string, allowDownload bool, excl
 	if err != nil {
 		return nil, nil, err
 	}
+	if opts.Parents {
+		// keep each item's leading directories, starting below the pivot
+		trimmedDst := trimTrailingSlash(trimLeadingPath(dst))
+		options.RebaseNames = make(map[string]string)
+		for _, includeFile := range options.IncludeFiles {
+			options.RebaseNames[includeFile] = path.Join(trimmedDst, trimPathSegments(filepath.ToSlash(includeFile), pivot))
+		}
+	}
+	copyExcluded, err := newCopyExcludeFunc(opts.Excludes, dst)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	pipeReader, pipeWriter := io.Pipe() // the archive we're creating
 
@@ -200,7 +194,7 @@ func archiveFromDisk(directory string, src, dst string, allowDownload bool, excl
 		defer tw.Close()
 		var nonArchives []string
 		for _, includeFile := range includeFiles {
-			if allowDownload && src != "." && src != "/" && isArchivePath(filepath.Join(directory, includeFile)) {
+			if allowDownload && src != "." && src != "/" && isContextArchive(directory, includeFile) {
 				// it's an archive -> copy each item to the
 				// archive being written to the pipe writer
 				klog.V(4).Infof("Extracting %s", includeFile)
@@ -218,16 +212,22 @@ func archiveFromDisk(directory string, src, dst string, allowDownload bool, excl
 					tr := tar.NewReader(dc)
 					hdr, err := tr.Next()
 					for err == nil {
+						if err := checkArchiveEntry(includeFile, hdr, false); err != nil {
+							return err
+						}
+						original := hdr.Name
 						if renamed, ok := options.RebaseNames[includeFile]; ok {
 							hdr.Name = strings.TrimSuffix(renamed, includeFile) + hdr.Name
 							if hdr.Typeflag == tar.TypeLink {
 								hdr.Linkname = strings.TrimSuffix(renamed, includeFile) + hdr.Linkname
 							}
 						}
-						tw.WriteHeader(hdr)
-						_, err = io.Copy(tw, tr)
-						if err != nil {
-							break
+						if !copyExcluded(hdr.Name, original) {
+							tw.WriteHeader(hdr)
+							_, err = io.Copy(tw, tr)
+							if err != nil {
+								break
+							}
 						}
 						hdr, err = tr.Next()
 					}
@@ -254,12 +254,24 @@ func archiveFromDisk(directory string, src, dst string, allowDownload bool, excl
 			}
 			defer rc.Close()
 			tr := tar.NewReader(rc)
+			written := make(map[string]bool)
 			hdr, err := tr.Next()
 			for err == nil {
-				tw.WriteHeader(hdr)
-				_, err = io.Copy(tw, tr)
-				if err != nil {
-					break
+				if !copyExcluded(hdr.Name, hdr.Name) {
+					var body io.Reader
+					body, err = linkFromDisk(opts.links, directory, archivedFrom(hdr.Name, options.RebaseNames), hdr, tr, written)
+					if err != nil {
+						break
+					}
+					tw.WriteHeader(hdr)
+					_, err = io.Copy(tw, body)
+					if c, ok := body.(io.Closer); ok {
+						c.Close()
+					}
+					if err != nil {
+						break
+					}
+					written[hdr.Name] = true
 				}
 				hdr, err = tr.Next()
 			}
@@ -281,7 +293,72 @@ func archiveFromDisk(directory string, src, dst string, allowDownload bool, excl
 	return readWrapper, readWrapper, err
 }
 
-func archiveFromFile(file string, src, dst string, excludes []string, check DirectoryCheck) (io.Reader, io.Closer, error) {
+// archivedFrom returns the path of the file which TarWithOptions archived as
+// name, given the names that it replaced.
+func archivedFrom(name string, rebaseNames map[string]string) string {
+	source, longest := name, -1
+	for original, rebased := range rebaseNames {
+		if len(rebased) <= longest {
+			continue
+		}
+		if name == rebased {
+			source, longest = original, len(rebased)
+		} else if strings.HasPrefix(name, rebased+"/") {
+			source, longest = original+name[len(rebased):], len(rebased)
+		}
+	}
+	return source
+}
+
+// linkFromDisk keeps h, an entry which was archived from source, a path in
+// directory, linked to the other names of the same file which the instruction
+// copies, and returns what should be written as its content. A hard link to
+// a name which wasn't written, because it was excluded, is replaced with the
+// content of the file, unless another of its names was copied.
+func linkFromDisk(links *hardlinks, directory, source string, h *tar.Header, body io.Reader, written map[string]bool) (io.Reader, error) {
+	if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeLink {
+		return body, nil
+	}
+	fi, err := os.Lstat(filepath.Join(directory, filepath.FromSlash(source)))
+	if err != nil {
+		return body, nil
+	}
+	id, ok := hardlinkID(fi)
+	if !ok || (h.Typeflag == tar.TypeLink && written[h.Linkname]) {
+		return body, nil
+	}
+	if target, ok := links.target(id, h.Name, true); ok {
+		makeHardlink(h, target)
+		return bytes.NewReader(nil), nil
+	}
+	links.copied(id, h.Name, true)
+	if h.Typeflag == tar.TypeLink {
+		f, err := os.Open(filepath.Join(directory, filepath.FromSlash(source)))
+		if err != nil {
+			return nil, err
+		}
+		h.Typeflag, h.Linkname, h.Size = tar.TypeReg, "", fi.Size()
+		return f, nil
+	}
+	return body, nil
+}
+
+func archiveFromFile(file string, src, dst string, excludes []string, check DirectoryCheck, opts copyOptions) (io.Reader, io.Closer, error) {
+	index, err := newArchiveIndex(file, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	r, closer, err := archiveFromIndex(index, src, dst, excludes, check, opts)
+	if err != nil {
+		index.Close()
+		return nil, nil, err
+	}
+	return r, closers{closer.Close, index.Close}, nil
+}
+
+// archiveFromIndex archives src from an indexed context archive. Only the
+// entries which match src are read.
+func archiveFromIndex(index *archiveIndex, src, dst string, excludes []string, check DirectoryCheck, opts copyOptions) (io.Reader, io.Closer, error) {
 	var err error
 	if filepath.IsAbs(src) {
 		src, err = filepath.Rel(filepath.Dir(src), src)
@@ -289,47 +366,40 @@ func archiveFromFile(file string, src, dst string, excludes []string, check Dire
 			return nil, nil, err
 		}
 	}
+	if leavesArchiveRoot(filepath.ToSlash(src)) {
+		return nil, nil, &ContextEscapeError{Path: src, Reason: "it has more .. components than parent directories"}
+	}
 
 	refetch := func(pw *io.PipeWriter) {
-		f, err := os.Open(file)
-		if err != nil {
-			pw.CloseWithError(err)
-			return
-		}
-		defer f.Close()
-		dc, err := archive.DecompressStream(f)
-		if err != nil {
-			pw.CloseWithError(err)
-			return
-		}
-		defer dc.Close()
-		_, err = io.Copy(pw, dc)
+		_, err := io.Copy(pw, index.Reader())
 		pw.CloseWithError(err)
 	}
 
-	mapper, _, err := newArchiveMapper(src, dst, excludes, false, true, check, refetch, true)
+	mapper, archiveRoot, err := newArchiveMapper(src, dst, excludes, false, true, check, refetch, true, opts)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, nil, err
+	// names in the context archive are relative to its top, rather than to
+	// the parent of the directory the source is found in
+	mapper.origin = "/"
+	if opts.Parents {
+		mapper.prefix, mapper.root = "", ""
+	} else if root := strings.Trim(path.Clean(archiveRoot), "/"); root != "." {
+		mapper.prefix = root
 	}
 
-	r, err := transformArchive(f, true, mapper.Filter)
+	r := index.Filter(mapper.Filter)
 	cc := newCloser(func() error {
-		err := f.Close()
 		if mapper.foundItems == 0 {
 			return fmt.Errorf("%s: %w", src, os.ErrNotExist)
 		}
-		return err
+		return nil
 	})
-	return r, cc, err
+	return r, cc, nil
 }
 
-func archiveFromContainer(in io.Reader, src, dst string, excludes []string, check DirectoryCheck, refetch FetchArchiveFunc, assumeDstIsDirectory bool) (io.ReadCloser, string, error) {
-	mapper, archiveRoot, err := newArchiveMapper(src, dst, excludes, true, false, check, refetch, assumeDstIsDirectory)
+func archiveFromContainer(in io.Reader, src, dst string, excludes []string, check DirectoryCheck, refetch FetchArchiveFunc, assumeDstIsDirectory bool, opts copyOptions) (io.ReadCloser, string, error) {
+	mapper, archiveRoot, err := newArchiveMapper(src, dst, excludes, true, false, check, refetch, assumeDstIsDirectory, opts)
 	if err != nil {
 		return nil, "", err
 	}
@@ -366,17 +436,16 @@ func transformArchive(r io.Reader, compressed bool, fn TransformFileFunc) (io.Re
 // a (file) -> test
 // a (dir)  -> test/
 // a (file) -> test/
-func archivePathMapper(src, dst string, isDestDir bool) (fn func(itemCount *int, name string, isDir bool) (string, bool, error)) {
+func archivePathMapper(src, dst string, isDestDir bool) (fn func(itemCount *int, name string, isDir bool) (string, bool, error), err error) {
 	srcPattern := filepath.Clean(src)
 	if srcPattern == "." {
 		srcPattern = "*"
 	}
-	pattern := filepath.Base(srcPattern)
 
-	klog.V(6).Infof("creating mapper for srcPattern=%s pattern=%s dst=%s isDestDir=%t", srcPattern, pattern, dst, isDestDir)
+	klog.V(6).Infof("creating mapper for srcPattern=%s dst=%s isDestDir=%t", srcPattern, dst, isDestDir)
 
 	// no wildcards
-	if !containsWildcards(pattern) {
+	if !containsWildcards(srcPattern) {
 		return func(itemCount *int, name string, isDir bool) (string, bool, error) {
 			// when extracting from the working directory, Docker prefaces with ./
 			if strings.HasPrefix(name, "."+string(filepath.Separator)) {
@@ -402,69 +471,116 @@ func archivePathMapper(src, dst string, isDestDir bool) (fn func(itemCount *int,
 				return "", false, nil
 			}
 			return filepath.Join(dst, remainder), true, nil
-		}
+		}, nil
 	}
 
-	// root with pattern
-	prefix := filepath.Dir(srcPattern)
-	if prefix == "." {
-		return func(itemCount *int, name string, isDir bool) (string, bool, error) {
-			// match only on the first segment under the prefix
-			var firstSegment = name
-			if i := strings.Index(name, string(filepath.Separator)); i != -1 {
-				firstSegment = name[:i]
-			}
-			ok, _ := filepath.Match(pattern, firstSegment)
-			if !ok {
+	// with pattern: a match, and everything under it, goes under the destination
+	glob, err := newCopyGlob(srcPattern)
+	if err != nil {
+		return nil, err
+	}
+	return func(itemCount *int, name string, isDir bool) (string, bool, error) {
+		if len(splitGlobName(name)) == 0 {
+			// the directory being copied from, when all of it is copied
+			if srcPattern != "*" {
 				return "", false, nil
 			}
-			if !isDestDir && !isDir { // the destination is not a directory, put this right there
-				if itemCount != nil && *itemCount != 0 { // but we've already written something there
-					return "", false, dstNeedsToBeDirectoryError // tell the caller to start over
-				}
-				return dst, true, nil
+			return dst, true, nil
+		}
+		match, ok := glob.Matched(name)
+		if !ok {
+			return "", false, nil
+		}
+		if !isDestDir && !isDir { // the destination is not a directory, put this right there
+			if itemCount != nil && *itemCount != 0 { // but we've already written something there
+				return "", false, dstNeedsToBeDirectoryError // tell the caller to start over
 			}
-			return filepath.Join(dst, name), true, nil
+			return dst, true, nil
 		}
-	}
-	prefix += string(filepath.Separator)
+		remainder := strings.TrimPrefix(strings.TrimPrefix(path.Clean(filepath.ToSlash(name)), match), "/")
+		return filepath.Join(dst, path.Base(match), remainder), true, nil
+	}, nil
+}
 
-	// nested with pattern
+// parentsPathMapper maps items for COPY --parents. Names are relative to
+// root, which is relative to the top of the source. Items which match glob,
+// and everything under them, are placed under dst, keeping their leading directories below pivot.
+func (m *archiveMapper) parentsPathMapper(pivot string, glob *copyGlob, dst string) func(itemCount *int, name string, isDir bool) (string, bool, error) {
 	return func(_ *int, name string, isDir bool) (string, bool, error) {
-		remainder := strings.TrimPrefix(name, prefix)
-		if remainder == name {
-			return "", false, nil
-		}
-		// match only on the first segment under the prefix
-		var firstSegment = remainder
-		if i := strings.Index(remainder, string(filepath.Separator)); i != -1 {
-			firstSegment = remainder[:i]
+		name = strings.TrimPrefix(path.Clean("/"+path.Join(m.root, name)), "/")
+		// leading directories of matches are left for the daemon to create
+		if len(glob.segments) > 0 {
+			if _, ok := glob.Matched(name); !ok {
+				return "", false, nil
+			}
 		}
-		ok, _ := filepath.Match(pattern, firstSegment)
-		if !ok {
+		name = trimPathSegments(name, pivot)
+		if name == "" {
 			return "", false, nil
 		}
-		return filepath.Join(dst, remainder), true, nil
+		return path.Join(dst, name), true, nil
 	}
 }
 
 type archiveMapper struct {
+	source       string
 	exclude      *fileutils.PatternMatcher
+	copyExcluded func(name, original string) bool
 	rename       func(itemCount *int, name string, isDir bool) (string, bool, error)
 	prefix       string
+	root         string
 	dst          string
 	resetDstMode bool
 	resetOwners  bool
 	foundItems   int
 	refetch      FetchArchiveFunc
 	renameLinks  map[string]string
+	// origin is the directory which the names of entries in the archive
+	// are relative to, so that an entry can be identified in links.
+	origin     string
+	links      *hardlinks
+	idMappings *idtools.IDMappings
 }
 
-func newArchiveMapper(src, dst string, excludes []string, resetDstMode, resetOwners bool, check DirectoryCheck, refetch FetchArchiveFunc, assumeDstIsDirectory bool) (*archiveMapper, string, error) {
+func newArchiveMapper(src, dst string, excludes []string, resetDstMode, resetOwners bool, check DirectoryCheck, refetch FetchArchiveFunc, assumeDstIsDirectory bool, opts copyOptions) (*archiveMapper, string, error) {
 	ex, err := fileutils.NewPatternMatcher(excludes)
 	if err != nil {
 		return nil, "", err
 	}
+	copyExcluded, err := newCopyExcludeFunc(opts.Excludes, dst)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if opts.Parents {
+		// start from the deepest directory that can't be affected by wildcards
+		pivot, pattern := splitParentsPivot(src)
+		glob, err := newCopyGlob(pattern)
+		if err != nil {
+			return nil, "", err
+		}
+		m := &archiveMapper{
+			source:       src,
+			exclude:      ex,
+			copyExcluded: copyExcluded,
+			root:         glob.root(),
+			dst:          path.Clean(dst),
+			resetDstMode: resetDstMode,
+			resetOwners:  resetOwners,
+			refetch:      refetch,
+			renameLinks:  make(map[string]string),
+		}
+		if m.root != "" {
+			m.prefix = path.Base(m.root)
+		}
+		m.rename = m.parentsPathMapper(pivot, glob, m.dst)
+		archiveRoot := "/"
+		if m.root != "" {
+			archiveRoot = "/" + m.root + "/"
+		}
+		m.origin, m.links, m.idMappings = path.Dir(path.Clean(archiveRoot)), opts.links, opts.idMappings
+		return m, archiveRoot, nil
+	}
 
 	isDestDir := strings.HasSuffix(dst, "/") || path.Base(dst) == "." || strings.HasSuffix(src, "/") || path.Base(src) == "." || assumeDstIsDirectory
 	dst = path.Clean(dst)
@@ -494,6 +610,21 @@ func newArchiveMapper(src, dst string, excludes []string, resetDstMode, resetOwn
 		src = path.Clean(src)
 		srcPattern = path.Base(src)
 		archiveRoot = path.Dir(src)
+		if containsWildcards(src) {
+			// start from the deepest directory that can't be affected by
+			// wildcards, and match the rest of the source under it
+			glob, err := newCopyGlob(src)
+			if err != nil {
+				return nil, "", err
+			}
+			archiveRoot, srcPattern = glob.root(), glob.relative()
+			if archiveRoot == "" {
+				archiveRoot = "."
+			}
+			if path.IsAbs(src) {
+				archiveRoot = path.Join("/", archiveRoot)
+			}
+		}
 		if archiveRoot != "/" && archiveRoot != "." {
 			prefix = path.Base(archiveRoot)
 		}
@@ -502,10 +633,15 @@ func newArchiveMapper(src, dst string, excludes []string, resetDstMode, resetOwn
 		archiveRoot += "/"
 	}
 
-	mapperFn := archivePathMapper(srcPattern, dst, isDestDir)
+	mapperFn, err := archivePathMapper(srcPattern, dst, isDestDir)
+	if err != nil {
+		return nil, "", err
+	}
 
 	return &archiveMapper{
+		source:       src,
 		exclude:      ex,
+		copyExcluded: copyExcluded,
 		rename:       mapperFn,
 		prefix:       prefix,
 		dst:          dst,
@@ -513,16 +649,31 @@ func newArchiveMapper(src, dst string, excludes []string, resetDstMode, resetOwn
 		resetOwners:  resetOwners,
 		refetch:      refetch,
 		renameLinks:  make(map[string]string),
+		origin:       path.Dir(path.Clean("/" + archiveRoot)),
+		links:        opts.links,
+		idMappings:   opts.idMappings,
 	}, archiveRoot, nil
 }
 
-func (m *archiveMapper) Filter(h *tar.Header, r io.Reader) ([]byte, bool, bool, error) {
+// setOwners gives h the owner it should be copied with: root, if the owners
+// of entries are reset, or otherwise the owner it has in the source, in terms
+// of IDs in the container.
+func (m *archiveMapper) setOwners(h *tar.Header) error {
 	if m.resetOwners {
 		h.Uid, h.Gid = 0, 0
+		return nil
 	}
+	return mapToContainer(m.idMappings, h)
+}
+
+func (m *archiveMapper) Filter(h *tar.Header, r io.Reader) ([]byte, bool, bool, error) {
 	// Trim a leading path, the prefix segment (which has no leading or trailing slashes), and
 	// the final leader segment. Depending on the segment, Docker could return /prefix/ or prefix/.
 	h.Name = strings.TrimPrefix(h.Name, "/")
+	if err := checkArchiveEntry(m.source, h, true); err != nil {
+		return nil, false, true, err
+	}
+	id := path.Join(m.origin, h.Name)
 	if !strings.HasPrefix(h.Name, m.prefix) {
 		return nil, false, true, nil
 	}
@@ -544,6 +695,12 @@ func (m *archiveMapper) Filter(h *tar.Header, r io.Reader) ([]byte, bool, bool,
 	if ok, _ := m.exclude.Matches(h.Name); ok {
 		return nil, false, true, nil
 	}
+	if m.copyExcluded(newName, h.Name) {
+		return nil, false, true, nil
+	}
+	if err := m.setOwners(h); err != nil {
+		return nil, false, true, err
+	}
 
 	m.foundItems++
 
@@ -553,7 +710,19 @@ func (m *archiveMapper) Filter(h *tar.Header, r io.Reader) ([]byte, bool, bool,
 		h.Mode = (h.Mode & ^0o777) | 0o755
 	}
 
+	if h.Typeflag == tar.TypeReg {
+		// another source may have copied this file already, as the
+		// target of a hard link
+		if target, ok := m.links.target(id, h.Name, false); ok {
+			klog.V(6).Infof("Replaced %s with a link to %s", h.Name, target)
+			makeHardlink(h, target)
+			return nil, true, false, nil
+		}
+		m.links.copied(id, h.Name, false)
+	}
+
 	if h.Typeflag == tar.TypeLink {
+		targetID := path.Join(m.origin, strings.TrimPrefix(h.Linkname, "/"))
 		if newTarget, ok := m.renameLinks[h.Linkname]; ok {
 			// we already replaced the original link target, so make this a link to the file we copied
 			klog.V(6).Infof("Replaced link target %s -> %s: ok=%t", h.Linkname, newTarget, ok)
@@ -580,7 +749,7 @@ func (m *archiveMapper) Filter(h *tar.Header, r io.Reader) ([]byte, bool, bool,
 				}
 			}
 			if !needReplacement {
-				if ok, _ := m.exclude.Matches(linkName); ok {
+				if ok, _ := m.exclude.Matches(linkName); ok || m.copyExcluded(newTarget, linkName) {
 					// link target was skipped based on excludes
 					needReplacement = true
 				}
@@ -589,6 +758,11 @@ func (m *archiveMapper) Filter(h *tar.Header, r io.Reader) ([]byte, bool, bool,
 				// the link target was passed along, everything's fine
 				klog.V(6).Infof("Transform link target %s -> %s: ok=%t skip=%t", h.Linkname, newTarget, ok, true)
 				h.Linkname = newTarget
+				m.links.copied(targetID, newTarget, true)
+			} else if target, ok := m.links.target(targetID, h.Name, true); ok {
+				// another source copied the link target
+				klog.V(6).Infof("Transform link target %s -> %s copied by another source", h.Linkname, target)
+				h.Linkname = target
 			} else {
 				// the link target wasn't passed along, splice it back in as this file
 				if m.refetch == nil {
@@ -605,24 +779,22 @@ func (m *archiveMapper) Filter(h *tar.Header, r io.Reader) ([]byte, bool, bool,
 					pr.Close()
 					return nil, false, true, fmt.Errorf("needed to create %q as a hard link to %q, but got error refetching %q: %v", h.Name, h.Linkname, h.Linkname, err)
 				}
-				buf, err := ioutil.ReadAll(pr)
+				buf, err := ioutil.ReadAll(tr2)
 				pr.Close()
 				if err != nil {
 					return nil, false, true, fmt.Errorf("needed to create %q as a hard link to %q, but got error refetching contents of %q: %v", h.Name, h.Linkname, h.Linkname, err)
 				}
 				m.renameLinks[h.Linkname] = h.Name
+				m.links.copied(targetID, h.Name, true)
 				h.Typeflag = tar.TypeReg
 				h.Size, h.Mode = rehdr.Size, rehdr.Mode
 				h.Uid, h.Gid = rehdr.Uid, rehdr.Gid
+				if err := m.setOwners(h); err != nil {
+					return nil, false, true, err
+				}
 				h.Uname, h.Gname = rehdr.Uname, rehdr.Gname
 				h.ModTime, h.AccessTime, h.ChangeTime = rehdr.ModTime, rehdr.AccessTime, rehdr.ChangeTime
-				h.Xattrs = nil
-				for k, v := range rehdr.Xattrs {
-					if h.Xattrs != nil {
-						h.Xattrs = make(map[string]string)
-					}
-					h.Xattrs[k] = v
-				}
+				copyXattrs(h, rehdr)
 				klog.V(6).Infof("Transform link %s -> reg %s", h.Linkname, h.Name)
 				h.Linkname = ""
 				return buf, true, false, nil
@@ -662,11 +834,7 @@ func archiveOptionsFor(directory string, infos []CopyInfo, dst string, excludes
 			if ok, _ := pm.Matches(info.Path); ok {
 				continue
 			}
-			infoPath := info.Path
-			if directory != "" {
-				infoPath = filepath.Join(directory, infoPath)
-			}
-			if allowDownload && isArchivePath(infoPath) {
+			if allowDownload && isContextArchive(directory, info.Path) {
 				dstIsDir = true
 				break
 			}
@@ -715,6 +883,99 @@ func archiveOptionsFor(directory string, infos []CopyInfo, dst string, excludes
 	return options, nil
 }
 
+// copyOptions are settings from an ADD or COPY instruction which affect which
+// items are selected from a source, and where they are placed.
+type copyOptions struct {
+	// Parents preserves the leading directories of the items being
+	// copied, relative to the top of the source or to its pivot point.
+	Parents bool
+	// Excludes are patterns, matched against the location of each item
+	// relative to the destination, of items to leave out.
+	Excludes []string
+	// links keeps items which are hard links to one another linked, across
+	// all of the sources of the instruction. It may be nil.
+	links *hardlinks
+	// idMappings translates the owners of items read from a container,
+	// which the daemon reports as the IDs it stores them with, into IDs in
+	// the container. It may be nil.
+	idMappings *idtools.IDMappings
+	// KeepGitDir keeps the .git directory of a git repository being copied.
+	KeepGitDir bool
+	// Checksum is the full ID of the commit which a git repository being
+	// copied must be checked out at, if it is set.
+	Checksum string
+}
+
+// splitParentsPivot splits the source of a COPY --parents at its pivot point,
+// a path component named ".", returning the leading directories which will not
+// be preserved, and the entire path with the pivot removed. Neither value has
+// a leading or trailing slash.
+func splitParentsPivot(src string) (string, string) {
+	src = strings.TrimLeft(filepath.ToSlash(src), "/")
+	for strings.HasPrefix(src, "./") {
+		src = strings.TrimLeft(src[2:], "/")
+	}
+	var pivot string
+	if i := strings.Index(src, "/./"); i != -1 {
+		pivot = path.Clean(src[:i])
+		src = src[:i] + src[i+2:]
+	} else if strings.HasSuffix(src, "/.") {
+		pivot = path.Clean(src)
+	}
+	pattern := path.Clean(src)
+	if pattern == "." {
+		pattern = ""
+	}
+	if pivot == "." {
+		pivot = ""
+	}
+	return pivot, pattern
+}
+
+// trimPathSegments removes as many leading components from name as there are
+// components in prefix.
+func trimPathSegments(name, prefix string) string {
+	if prefix == "" {
+		return name
+	}
+	segments := strings.Split(name, "/")
+	n := len(strings.Split(prefix, "/"))
+	if n >= len(segments) {
+		return ""
+	}
+	return path.Join(segments[n:]...)
+}
+
+// newCopyExcludeFunc returns a function which reports whether an item which
+// would be written to name, and which was read from original, should be left
+// out because it matches one of the patterns passed to --exclude. Patterns are
+// matched against the item's location relative to dst, or against the base
+// name of its source if it is being written to dst itself.
+func newCopyExcludeFunc(patterns []string, dst string) (func(name, original string) bool, error) {
+	if len(patterns) == 0 {
+		return func(string, string) bool { return false }, nil
+	}
+	pm, err := fileutils.NewPatternMatcher(patterns)
+	if err != nil {
+		return nil, fmt.Errorf("parsing --exclude patterns: %w", err)
+	}
+	clean := func(p string) string {
+		return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(p)), "/")
+	}
+	dst = clean(dst)
+	return func(name, original string) bool {
+		rel := clean(name)
+		switch {
+		case rel == dst:
+			rel = path.Base(clean(original))
+		case dst != "":
+			rel = strings.TrimPrefix(rel, dst+"/")
+		}
+		ok, _ := pm.Matches(rel)
+		return ok
+	}, nil
+}
+
 func sourceToDestinationName(src, dst string, forceDir bool) string {
 	switch {
 	case forceDir, strings.HasSuffix(dst, "/"), path.Base(dst) == ".":
@@ -2,13 +2,16 @@ package dockerclient
 
 import (
 	"archive/tar"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
 	"testing"
 
@@ -115,6 +118,24 @@ func Test_archiveFromFile(t *testing.T) {
 	defer os.Remove(f.Name())
 
 	testArchive := f.Name()
+
+	f, err = ioutil.TempFile("", "test-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err = archive.TarWithOptions("testdata/parents", &archive.TarOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	parentsArchive := f.Name()
 	testCases := []struct {
 		file     string
 		gen      *archiveGenerator
@@ -122,6 +143,7 @@ func Test_archiveFromFile(t *testing.T) {
 		closeErr error
 		dst      string
 		excludes []string
+		opts     copyOptions
 		expect   []string
 		check    map[string]bool
 	}{
@@ -272,6 +294,71 @@ func Test_archiveFromFile(t *testing.T) {
 			src:      "subdir/no-such-file",
 			closeErr: os.ErrNotExist,
 		},
+		{
+			file: parentsArchive,
+			src:  "packages/*/package.json",
+			dst:  "/app/",
+			opts: copyOptions{Parents: true},
+			expect: []string{
+				"/app/packages/a/package.json",
+				"/app/packages/b/package.json",
+			},
+		},
+		{
+			file: parentsArchive,
+			src:  "packages/./*/package.json",
+			dst:  "/app/",
+			opts: copyOptions{Parents: true},
+			expect: []string{
+				"/app/a/package.json",
+				"/app/b/package.json",
+			},
+		},
+		{
+			file: parentsArchive,
+			src:  "./packages/a/src",
+			dst:  "/app",
+			opts: copyOptions{Parents: true},
+			expect: []string{
+				"/app/packages/a/src",
+				"/app/packages/a/src/index.js",
+			},
+		},
+		{
+			file: parentsArchive,
+			src:  ".",
+			dst:  "/app",
+			opts: copyOptions{Parents: true, Excludes: []string{"packages/a", "**/*.md"}},
+			expect: []string{
+				"/app/packages",
+				"/app/packages/b",
+				"/app/packages/b/package.json",
+			},
+		},
+		{
+			file: parentsArchive,
+			src:  "packages/*/README.md",
+			dst:  "/app/",
+			opts: copyOptions{Parents: true, Excludes: []string{"*.md"}},
+			expect: []string{
+				"/app/packages/b/README.md",
+			},
+		},
+		{
+			file:   testArchive,
+			src:    "subdir",
+			dst:    "test",
+			opts:   copyOptions{Excludes: []string{"file*"}},
+			expect: []string{"test"},
+		},
+		{
+			// excluding everything a pattern matched is the same as not matching
+			file:     testArchive,
+			src:      "fil?",
+			dst:      "test",
+			opts:     copyOptions{Excludes: []string{"*"}},
+			closeErr: os.ErrNotExist,
+		},
 	}
 	for i := range testCases {
 		testCase := testCases[i]
@@ -282,6 +369,7 @@ func Test_archiveFromFile(t *testing.T) {
 				testCase.dst,
 				testCase.excludes,
 				testDirectoryCheck(testCase.check),
+				testCase.opts,
 			)
 			if err != nil {
 				t.Fatal(err)
@@ -317,6 +405,7 @@ func Test_archiveFromContainer(t *testing.T) {
 		closeErr error
 		dst      string
 		excludes []string
+		opts     copyOptions
 		expect   []string
 		path     string
 		check    map[string]bool
@@ -488,6 +577,41 @@ func Test_archiveFromContainer(t *testing.T) {
 			path:     "/a",
 			closeErr: os.ErrNotExist,
 		},
+		{
+			gen:  newArchiveGenerator().Dir("src/").Dir("src/a").File("src/a/package.json").File("src/a/index.js").Dir("src/b").File("src/b/package.json"),
+			src:  "/src/*/package.json",
+			dst:  "/app/",
+			opts: copyOptions{Parents: true},
+			path: "/src",
+			expect: []string{
+				"/app/src/a/package.json",
+				"/app/src/b/package.json",
+			},
+		},
+		{
+			gen:  newArchiveGenerator().Dir("src/").Dir("src/a").File("src/a/package.json").File("src/a/index.js").Dir("src/b").File("src/b/package.json"),
+			src:  "/src/./a",
+			dst:  "/app/",
+			opts: copyOptions{Parents: true},
+			path: "/src",
+			expect: []string{
+				"/app/a",
+				"/app/a/index.js",
+				"/app/a/package.json",
+			},
+		},
+		{
+			gen:  newArchiveGenerator().Dir("src/").Dir("src/a").File("src/a/package.json").File("src/a/index.js").Dir("src/b").File("src/b/package.json"),
+			src:  "/src/",
+			dst:  "/app/",
+			opts: copyOptions{Excludes: []string{"*/index.js", "b"}},
+			path: "/src",
+			expect: []string{
+				"/app",
+				"/app/a",
+				"/app/a/package.json",
+			},
+		},
 	}
 	for i := range testCases {
 		testCase := testCases[i]
@@ -503,6 +627,7 @@ func Test_archiveFromContainer(t *testing.T) {
 					pw.CloseWithError(err)
 				},
 				false,
+				testCase.opts,
 			)
 			if err != nil {
 				t.Fatal(err)
@@ -533,3 +658,286 @@ func Test_archiveFromContainer(t *testing.T) {
 		})
 	}
 }
+
+func Test_archiveFromDisk(t *testing.T) {
+	testCases := []struct {
+		dir    string
+		src    string
+		dst    string
+		opts   copyOptions
+		expect []string
+	}{
+		{
+			dir:    "testdata/parents",
+			src:    "packages/*/package.json",
+			dst:    "/app/",
+			expect: []string{"app/package.json", "app/package.json"},
+		},
+		{
+			dir:  "testdata/parents",
+			src:  "packages/*/package.json",
+			dst:  "/app/",
+			opts: copyOptions{Parents: true},
+			expect: []string{
+				"app/packages/a/package.json",
+				"app/packages/b/package.json",
+			},
+		},
+		{
+			dir:  "testdata/parents",
+			src:  "/packages/./*/package.json",
+			dst:  "/app",
+			opts: copyOptions{Parents: true},
+			expect: []string{
+				"app/a/package.json",
+				"app/b/package.json",
+			},
+		},
+		{
+			dir:  "testdata/parents",
+			src:  "packages/a/./src",
+			dst:  "/app/",
+			opts: copyOptions{Parents: true},
+			expect: []string{
+				"app/src/",
+				"app/src/index.js",
+			},
+		},
+		{
+			dir:  "testdata/parents",
+			src:  "packages/b",
+			dst:  "/b/",
+			opts: copyOptions{Excludes: []string{"*.md"}},
+			expect: []string{
+				"b/",
+				"b/package.json",
+			},
+		},
+		{
+			dir:  "testdata/parents",
+			src:  "packages",
+			dst:  "/pkg/",
+			opts: copyOptions{Excludes: []string{"a/src", "**/README.md"}},
+			expect: []string{
+				"pkg/",
+				"pkg/a/",
+				"pkg/a/package.json",
+				"pkg/b/",
+				"pkg/b/package.json",
+			},
+		},
+		{
+			dir:  "testdata/parents",
+			src:  ".",
+			dst:  "/app",
+			opts: copyOptions{Parents: true, Excludes: []string{"**/a", "packages/b/*.md"}},
+			expect: []string{
+				"app/packages/",
+				"app/packages/b/",
+				"app/packages/b/package.json",
+			},
+		},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			r, c, err := archiveFromDisk(testCase.dir, testCase.src, testCase.dst, false, nil, testDirectoryCheck(nil), testCase.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr := tar.NewReader(r)
+			var found []string
+			for {
+				h, err := tr.Next()
+				if err != nil {
+					if err == io.EOF {
+						break
+					}
+					t.Fatal(err)
+				}
+				found = append(found, h.Name)
+			}
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(found)
+			if !reflect.DeepEqual(testCase.expect, found) {
+				t.Errorf("unexpected files:\n%v\n%v", testCase.expect, found)
+			}
+		})
+	}
+}
+
+func TestArchiveIndex(t *testing.T) {
+	testCases := []struct {
+		compression archive.Compression
+		fixture     string
+		temp        bool
+	}{
+		{compression: archive.Uncompressed},
+		{compression: archive.Gzip, temp: true},
+		{compression: archive.Zstd, temp: true},
+		{fixture: "testdata/dir.tar.xz", temp: true},
+	}
+	for i, test := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			dir := t.TempDir()
+			var rc io.ReadCloser
+			var err error
+			if test.fixture != "" {
+				rc, err = os.Open(test.fixture)
+			} else {
+				rc, err = archive.TarWithOptions("testdata/dir", &archive.TarOptions{Compression: test.compression})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := filepath.Join(dir, "context.tar")
+			f, err := os.Create(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.Copy(f, rc); err != nil {
+				t.Fatal(err)
+			}
+			rc.Close()
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			tempDir := filepath.Join(dir, "temp")
+			if err := os.Mkdir(tempDir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			index, err := newArchiveIndex(file, tempDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if index.temp != test.temp {
+				t.Errorf("expected a temporary copy to be %t, got %t", test.temp, index.temp)
+			}
+
+			// every entry can be read on its own
+			var names []string
+			r := index.Filter(func(h *tar.Header, r io.Reader) ([]byte, bool, bool, error) {
+				names = append(names, h.Name)
+				if path.Clean(h.Name) != "file" {
+					return nil, false, true, nil
+				}
+				data, err := ioutil.ReadAll(r)
+				if err != nil {
+					return nil, false, false, err
+				}
+				return append([]byte("replaced "), data...), true, false, nil
+			})
+			tr := tar.NewReader(r)
+			h, err := tr.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			original, err := ioutil.ReadFile("testdata/dir/file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path.Clean(h.Name) != "file" || string(data) != "replaced "+string(original) {
+				t.Errorf("unexpected entry %s: %q", h.Name, data)
+			}
+			if _, err := tr.Next(); err != io.EOF {
+				t.Errorf("expected one entry, got %v", err)
+			}
+			if len(names) != len(index.entries) || len(names) < 4 {
+				t.Errorf("expected every entry to be filtered, got %v", names)
+			}
+
+			// the whole archive is available uncompressed
+			count := 0
+			tr = tar.NewReader(index.Reader())
+			for {
+				if _, err := tr.Next(); err != nil {
+					if err != io.EOF {
+						t.Fatal(err)
+					}
+					break
+				}
+				count++
+			}
+			if count != len(index.entries) {
+				t.Errorf("expected %d entries, got %d", len(index.entries), count)
+			}
+
+			// entries can be found by name
+			if h := index.Stat("/subdir/"); h == nil || h.Typeflag != tar.TypeDir {
+				t.Errorf("expected subdir to be a directory, got %#v", h)
+			}
+			if h := index.Stat("missing"); h != nil {
+				t.Errorf("expected no entry for a missing file, got %#v", h)
+			}
+			fr, err := index.Open("subdir/file2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err = ioutil.ReadAll(fr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			original, err = ioutil.ReadFile("testdata/dir/subdir/file2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != string(original) {
+				t.Errorf("unexpected content of subdir/file2: %q", data)
+			}
+
+			// a compressed archive is decompressed into a directory
+			// which only the current user can use, and a file which
+			// someone else put in the temporary directory is ignored
+			spooled, _ := filepath.Glob(filepath.Join(tempDir, "*"))
+			if test.temp != (len(spooled) == 1) {
+				t.Errorf("unexpected spooled files %v", spooled)
+			}
+			if test.temp {
+				fi, err := os.Stat(filepath.Dir(index.file.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if runtime.GOOS != "windows" && fi.Mode().Perm() != 0o700 {
+					t.Errorf("expected the spool directory to be private, got %v", fi.Mode())
+				}
+			}
+			compressed, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			planted := filepath.Join(tempDir, fmt.Sprintf("imagebuilder-context-%x.tar", sha256.Sum256(compressed)))
+			if err := ioutil.WriteFile(planted, []byte("planted"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			reused, err := newArchiveIndex(file, tempDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.temp && reused.file.Name() == index.file.Name() {
+				t.Errorf("expected %s not to be shared", index.file.Name())
+			}
+			if len(reused.entries) != len(index.entries) {
+				t.Errorf("expected %d entries, got %d", len(index.entries), len(reused.entries))
+			}
+			if err := os.Remove(planted); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := index.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := reused.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if temp, _ := filepath.Glob(filepath.Join(tempDir, "*")); len(temp) > 0 {
+				t.Errorf("expected temporary files to be removed, found %v", temp)
+			}
+		})
+	}
+}
@@ -2,7 +2,6 @@ package dockerclient
 
 import (
 	"archive/tar"
-	"bufio"
 	"bytes"
 	"context"
 	"crypto/rand"
@@ -11,19 +10,24 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	dockerregistrytypes "github.com/docker/docker/api/types/registry"
 	docker "github.com/fsouza/go-dockerclient"
+	"go.podman.io/storage/pkg/idtools"
 	"k8s.io/klog"
 
 	"github.com/openshift/imagebuilder"
+	"github.com/openshift/imagebuilder/dockerfile/command"
 	"github.com/openshift/imagebuilder/dockerfile/parser"
 	"github.com/openshift/imagebuilder/imageprogress"
+	"github.com/openshift/imagebuilder/usergroup"
 )
 
 // NewClientFromEnv is exposed to simplify getting a client when vendoring this library.
@@ -43,6 +47,16 @@ type ClientExecutor struct {
 	Name string
 	// Named is a map of other named executors.
 	Named map[string]*ClientExecutor
+	// NamedContexts are build contexts, in addition to the main one, which
+	// FROM and COPY --from can refer to by name, in preference to stages and
+	// images with the same name.
+	NamedContexts map[string]*NamedContext
+
+	// AllowLocalGitRepositories allows ADD to copy from, and FetchContext to
+	// build from, git repositories named by file:// URLs. Since a Dockerfile
+	// could then read any repository on the local system, this is only meant
+	// for tests.
+	AllowLocalGitRepositories bool
 
 	// TempDir is the temporary directory to use for storing file
 	// contents. If unset, the default temporary directory for the
@@ -50,12 +64,18 @@ type ClientExecutor struct {
 	TempDir string
 	// Client is a client to a Docker daemon.
 	Client *docker.Client
+	// APIVersion is the API version which Client was created to request
+	// from the daemon, if it requests one (see docker.NewVersionedClient).
+	// Features which the daemon only offers in later versions are not used.
+	APIVersion docker.APIVersion
 	// Directory is the context directory to build from, will use
 	// the current working directory if not set. Ignored if
 	// ContextArchive is set.
 	Directory string
-	// A compressed or uncompressed tar archive that should be used
-	// as the build context.
+	// A tar archive that should be used as the build context, either
+	// uncompressed or compressed with gzip, bzip2, xz or zstd. It is
+	// indexed once, and a compressed archive is decompressed into
+	// TempDir, so that sources can be read from it in any order.
 	ContextArchive string
 	// Excludes are a list of file patterns that should be excluded
 	// from the context. Will be set to the contents of the
@@ -72,11 +92,56 @@ type ClientExecutor struct {
 	// IgnoreUnrecognizedInstructions, if true, allows instructions
 	// that are not yet supported to be ignored (will be printed)
 	IgnoreUnrecognizedInstructions bool
-	// StrictVolumeOwnership if true will fail the build if a RUN
-	// command follows a VOLUME command, since this client cannot
-	// guarantee that the restored contents of the VOLUME directory
-	// will have the right permissions.
+	// VolumeSemantics, if set, controls whether changes which RUN
+	// instructions make beneath a VOLUME are discarded, as the classic docker
+	// builder does, or kept, as BuildKit does. It is applied to each Builder
+	// which the executor prepares, in place of the Builder's own setting.
+	VolumeSemantics *imagebuilder.VolumeSemantics
+	// Xattrs controls which extended attributes of the content copied by
+	// ADD and COPY instructions are kept. By default, they are kept, except
+	// for SELinux labels.
+	Xattrs XattrPolicy
+	// IDMappings, if set, translates the user and group IDs which files
+	// have inside the build container into the IDs which are sent to and
+	// read from the daemon in archives. It's applied to content copied by
+	// ADD and COPY, including with --chown, and to paths which are created
+	// in the container. Docker translates ownership itself, both when it is
+	// run with --userns-remap and when it is run rootless, so this is only
+	// an override for a daemon which is known to store IDs differently, and
+	// must not be set for one which translates them.
+	IDMappings *idtools.IDMappings
+	// Downloader fetches the URLs which ADD instructions copy from. The
+	// default Downloader is used if it is nil.
+	Downloader *Downloader
+	// StrictVolumeOwnership used to fail the build if a RUN command
+	// followed a VOLUME command, since the restored contents of the
+	// VOLUME directory would lose their ownership.
+	//
+	// Deprecated: ownership is now preserved, and this is ignored.
 	StrictVolumeOwnership bool
+	// RunTimeout, if set, limits how long each RUN instruction may take
+	// before it is killed.
+	RunTimeout time.Duration
+	// StageTimeout, if set, limits how long each stage may take to build.
+	StageTimeout time.Duration
+	// BuildTimeout, if set, limits how long the entire build may take.
+	BuildTimeout time.Duration
+	// KeepOnFailure, if true, leaves the build container in place when an
+	// instruction fails, and describes it and the environment the
+	// instruction ran in on ErrOut.
+	KeepOnFailure bool
+	// Breakpoints are the lines of the Dockerfile before which the build
+	// pauses, after describing the build container as KeepOnFailure does.
+	Breakpoints []int
+	// DebugShell, if set, is a command which is run interactively in the
+	// build container, in the environment of the current instruction, when
+	// the build pauses or fails. The build continues from a breakpoint when
+	// it exits. After a failure the build container is kept until it exits,
+	// or for good if KeepOnFailure is set.
+	DebugShell []string
+	// DebugIn is the input for DebugShell. If DebugShell is not set, the
+	// build continues from a breakpoint once a line is read from it.
+	DebugIn io.Reader
 	// TransientMounts are a set of mounts from outside the build
 	// to the inside that will not be part of the final image. Any
 	// content created inside the mount's destinationPath will be
@@ -110,6 +175,10 @@ type ClientExecutor struct {
 	HostConfig *docker.HostConfig
 	// LogFn is an optional command to log information to the end user
 	LogFn func(format string, args ...interface{})
+	// EventFn is an optional function which is called with an Event
+	// whenever the build makes progress. It may be called from more than
+	// one goroutine at a time.
+	EventFn func(Event)
 
 	// Deferred is a list of operations that must be cleaned up at
 	// the end of execution. Use Release() to invoke all of these.
@@ -118,6 +187,39 @@ type ClientExecutor struct {
 	// Volumes handles saving and restoring volumes after RUN
 	// commands are executed.
 	Volumes *ContainerVolumeTracker
+
+	// containerOptions are the options used to create Container, if we
+	// created it, so that it can be recreated on top of a new image.
+	containerOptions *docker.CreateContainerOptions
+	// step is the instruction which is being executed.
+	step stepInfo
+	// position is the position of the stage which this executor builds.
+	position int
+	// keptContainer is the ID of a container which was left in place for
+	// debugging, which Release will not remove.
+	keptContainer string
+	// serverVersion is the API version of the daemon, once it is known.
+	serverVersion docker.APIVersion
+	// runMounts are the volumes which the build container was created with
+	// to hold the content of RUN --mount options, if it needed them.
+	runMounts *runMountVolumes
+	// partialLoads records whether the daemon can load image archives which
+	// leave out layers it already has, once it is known.
+	partialLoads *bool
+	// paths caches what is known about paths in the build container.
+	paths *pathCache
+	// uploads is the content being uploaded to a container by COPY
+	// instructions, which hasn't been flushed yet.
+	uploads *uploadBatch
+	// batchUploads is set while a COPY instruction is followed by another
+	// one which can add to the same upload.
+	batchUploads bool
+	// context is the indexed build context, which is shared by every stage.
+	context *buildContext
+	// users resolves user specifications against the databases in the
+	// build container, usersContainer, until something changes them.
+	users          *usergroup.Resolver
+	usersContainer string
 }
 
 // NoAuthFn can be used for AuthFn when no authentication is required in Docker.
@@ -137,19 +239,77 @@ func NewClientExecutor(client *docker.Client) *ClientExecutor {
 
 // DefaultExcludes reads the default list of excluded file patterns from the
 // context directory's .containerignore file if it exists, or from the context
-// directory's .dockerignore file, if it exists.
+// directory's .dockerignore file, if it exists. If ContextArchive is set, the
+// files are read from it instead.
 func (e *ClientExecutor) DefaultExcludes() error {
+	return e.DefaultExcludesFor("")
+}
+
+// DefaultExcludesFor is like DefaultExcludes, but an ignore file named after
+// dockerfile, next to it, takes precedence over the context's ignore files.
+func (e *ClientExecutor) DefaultExcludesFor(dockerfile string) error {
+	for _, file := range imagebuilder.DockerfileIgnoreFiles(dockerfile) {
+		excludes, err := imagebuilder.ParseIgnore(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		klog.V(4).Infof("Using ignore file %s for %s", file, dockerfile)
+		e.Excludes = excludes
+		return nil
+	}
+	if len(e.ContextArchive) > 0 {
+		index, err := e.contextIndex()
+		if err != nil {
+			return err
+		}
+		for _, name := range []string{".containerignore", ".dockerignore"} {
+			r, err := index.Open(name)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			e.Excludes, err = imagebuilder.ParseIgnoreReader(r)
+			return err
+		}
+		e.Excludes = nil
+		return nil
+	}
 	var err error
 	e.Excludes, err = imagebuilder.ParseDockerignore(e.Directory)
 	return err
 }
 
+// contextIndex returns the index of ContextArchive, which is created the
+// first time it is needed and shared with the executors of other stages.
+func (e *ClientExecutor) contextIndex() (*archiveIndex, error) {
+	return e.archiveIndex(e.ContextArchive)
+}
+
+// archiveIndex returns the index of the archive in file, which is created the
+// first time it is needed and shared with the executors of other stages.
+func (e *ClientExecutor) archiveIndex(file string) (*archiveIndex, error) {
+	if e.context == nil {
+		e.context = &buildContext{}
+		e.Deferred = append(e.Deferred, e.context.Close)
+	}
+	return e.context.archiveIndex(file, e.TempDir)
+}
+
 // WithName creates a new child executor that will be used whenever a COPY statement
 // uses --from=NAME or --from=POSITION.
 func (e *ClientExecutor) WithName(name string, position int) *ClientExecutor {
 	if e.Named == nil {
 		e.Named = make(map[string]*ClientExecutor)
 	}
+	if e.context == nil {
+		e.context = &buildContext{}
+		e.Deferred = append(e.Deferred, e.context.Close)
+	}
 	e.Deferred = append([]func() error{func() error {
 		stage, ok := e.Named[strconv.Itoa(position)]
 		if !ok {
@@ -169,6 +329,14 @@ func (e *ClientExecutor) WithName(name string, position int) *ClientExecutor {
 	copied.Image = nil
 	copied.Volumes = nil
 	copied.Committed = nil
+	copied.containerOptions = nil
+	copied.runMounts = nil
+	copied.step = stepInfo{}
+	copied.position = position
+	copied.keptContainer = ""
+	copied.paths = nil
+	copied.uploads = nil
+	copied.batchUploads = false
 
 	child := &copied
 	e.Named[name] = child
@@ -179,51 +347,69 @@ func (e *ClientExecutor) WithName(name string, position int) *ClientExecutor {
 // Stages executes all of the provided stages, starting from the base image. It returns the executor of the last stage
 // or an error if a stage fails.
 func (e *ClientExecutor) Stages(b *imagebuilder.Builder, stages imagebuilder.Stages, from string) (*ClientExecutor, error) {
+	return e.StagesContext(context.Background(), b, stages, from)
+}
+
+// StagesContext is like Stages, but stops building once ctx is cancelled.
+func (e *ClientExecutor) StagesContext(ctx context.Context, b *imagebuilder.Builder, stages imagebuilder.Stages, from string) (*ClientExecutor, error) {
+	start := time.Now()
+	e.emit(Event{Type: EventBuildStart})
+	stageExecutor, err := e.stages(ctx, b, stages, from)
+	e.emit(Event{Type: EventBuildFinish, Duration: time.Since(start), Error: errorString(err)})
+	return stageExecutor, err
+}
+
+func (e *ClientExecutor) stages(ctx context.Context, b *imagebuilder.Builder, stages imagebuilder.Stages, from string) (*ClientExecutor, error) {
+	if e.BuildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.BuildTimeout)
+		defer cancel()
+	}
+	// stages are built in order, so a stage can only be built after one
+	// which precedes it
+	after := make([]string, len(stages))
+	for i, stage := range stages {
+		name, err := stageAfter(b, stage)
+		if err != nil {
+			return nil, fmt.Errorf("error: Determining base image: %v", err)
+		}
+		if name == "" {
+			continue
+		}
+		if _, ok := stages[:i].ByName(name); !ok {
+			if _, ok := stages.ByName(name); ok {
+				return nil, fmt.Errorf("error: stage %s can not be built after stage %s, which is not an earlier stage", stage.Name, name)
+			}
+			return nil, fmt.Errorf("error: Unable to find stage %s, which stage %s is to be built after", name, stage.Name)
+		}
+		after[i] = name
+	}
+
 	var stageExecutor *ClientExecutor
 	for i, stage := range stages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		stageExecutor = e.WithName(stage.Name, stage.Position)
 
 		var stageFrom string
 		if i == 0 {
 			stageFrom = from
 		} else {
+			b.After = ""
 			from, err := b.From(stage.Node)
 			if err != nil {
 				return nil, fmt.Errorf("error: Determining base image: %v", err)
 			}
-			if b.After != "" {
-				return nil, fmt.Errorf("the --after flag in FROM is not supported by the dockerclient executor")
-			}
-			if prereq := e.Named[from]; prereq != nil {
+			if _, ok := e.NamedContexts[from]; ok {
+				klog.V(4).Infof("Using the build context %s as image", from)
+			} else if prereq := e.Named[from]; prereq != nil {
 				b, ok := stages[:i].ByName(from)
 				if !ok {
 					return nil, fmt.Errorf("error: Unable to find stage %s builder", from)
 				}
-				if prereq.Committed == nil {
-					config := b.Builder.Config()
-					if prereq.Container.State.Running {
-						klog.V(4).Infof("Stopping container %s ...", prereq.Container.ID)
-						if err := e.Client.StopContainer(prereq.Container.ID, 0); err != nil {
-							return nil, fmt.Errorf("unable to stop build container: %v", err)
-						}
-						prereq.Container.State.Running = false
-						// Starting the container may perform escaping of args, so to be consistent
-						// we also set that here
-						config.ArgsEscaped = true
-					}
-					image, err := e.Client.CommitContainer(docker.CommitContainerOptions{
-						Container: prereq.Container.ID,
-						Run:       config,
-					})
-					if err != nil {
-						return nil, fmt.Errorf("unable to commit stage %s container: %v", from, err)
-					}
-					klog.V(4).Infof("Committed %s to %s as basis for image %q: %#v", prereq.Container.ID, image.ID, from, config)
-					// deleting this image will fail with an "image has dependent child images" error
-					// if it ends up being an ancestor of the final image, so don't bother returning
-					// errors from this specific removeImage() call
-					prereq.Deferred = append([]func() error{func() error { e.removeImage(image.ID); return nil }}, prereq.Deferred...)
-					prereq.Committed = image
+				if err := e.commitStage(ctx, prereq, b.Builder, from); err != nil {
+					return nil, err
 				}
 				klog.V(4).Infof("Using image %s based on previous stage %s as image", prereq.Committed.ID, from)
 				from = prereq.Committed.ID
@@ -231,11 +417,37 @@ func (e *ClientExecutor) Stages(b *imagebuilder.Builder, stages imagebuilder.Sta
 			stageFrom = from
 		}
 
-		if err := stageExecutor.Prepare(stage.Builder, stage.Node, stageFrom); err != nil {
-			return nil, fmt.Errorf("error: preparing stage using %q as base: %v", stageFrom, err)
+		if after[i] != "" {
+			prereq, ok := e.Named[after[i]]
+			if !ok {
+				return nil, fmt.Errorf("error: Unable to find stage %s, which stage %s is to be built after", after[i], stage.Name)
+			}
+			b, _ := stages[:i].ByName(after[i])
+			if err := e.commitStage(ctx, prereq, b.Builder, after[i]); err != nil {
+				return nil, err
+			}
+			klog.V(4).Infof("Building stage %s after stage %s", stage.Name, after[i])
+		}
+
+		stageCtx, cancel := ctx, context.CancelFunc(func() {})
+		if e.StageTimeout > 0 {
+			stageCtx, cancel = context.WithTimeout(ctx, e.StageTimeout)
 		}
-		if err := stageExecutor.Execute(stage.Builder, stage.Node); err != nil {
-			return nil, fmt.Errorf("error: running stage: %v", err)
+		stageStart := time.Now()
+		stageExecutor.emit(Event{Type: EventStageStart, Image: stageFrom})
+		err := func() error {
+			if err := stageExecutor.PrepareContext(stageCtx, stage.Builder, stage.Node, stageFrom); err != nil {
+				return fmt.Errorf("error: preparing stage using %q as base: %w", stageFrom, e.describeTimeout(ctx, stageCtx, stage.Name, err))
+			}
+			if err := stageExecutor.ExecuteContext(stageCtx, stage.Builder, stage.Node); err != nil {
+				return fmt.Errorf("error: running stage: %w", e.describeTimeout(ctx, stageCtx, stage.Name, err))
+			}
+			return nil
+		}()
+		cancel()
+		stageExecutor.emit(Event{Type: EventStageFinish, Duration: time.Since(stageStart), Error: errorString(err)})
+		if err != nil {
+			return nil, err
 		}
 
 		// remember the outcome of the stage execution on the container config in case
@@ -245,6 +457,69 @@ func (e *ClientExecutor) Stages(b *imagebuilder.Builder, stages imagebuilder.Sta
 	return stageExecutor, nil
 }
 
+// describeTimeout adds an explanation of which timeout expired, if one did, to
+// an error returned while building a stage.
+func (e *ClientExecutor) describeTimeout(buildCtx, stageCtx context.Context, stage string, err error) error {
+	switch {
+	case !errors.Is(stageCtx.Err(), context.DeadlineExceeded):
+		return err
+	case errors.Is(buildCtx.Err(), context.DeadlineExceeded):
+		if e.BuildTimeout > 0 {
+			return fmt.Errorf("build exceeded its timeout of %s: %w", e.BuildTimeout, err)
+		}
+		return err
+	default:
+		return fmt.Errorf("stage %s exceeded its timeout of %s: %w", stage, e.StageTimeout, err)
+	}
+}
+
+// stageAfter returns the name of the stage which the stage's FROM instruction
+// says it should be built after, if one was specified with --after, without
+// consuming the instruction.
+func stageAfter(b *imagebuilder.Builder, stage imagebuilder.Stage) (string, error) {
+	copied := *b
+	copied.After = ""
+	node := &parser.Node{Children: append([]*parser.Node{}, stage.Node.Children...)}
+	if _, err := copied.From(node); err != nil {
+		return "", err
+	}
+	return copied.After, nil
+}
+
+// commitStage commits the container of a completed stage, if it hasn't been
+// committed already, so that later stages can use the result.
+func (e *ClientExecutor) commitStage(ctx context.Context, prereq *ClientExecutor, b *imagebuilder.Builder, name string) error {
+	if prereq.Committed != nil {
+		return nil
+	}
+	config := b.Config()
+	if prereq.Container.State.Running {
+		klog.V(4).Infof("Stopping container %s ...", prereq.Container.ID)
+		if err := e.Client.StopContainerWithContext(prereq.Container.ID, 0, ctx); err != nil {
+			return fmt.Errorf("unable to stop build container: %v", err)
+		}
+		prereq.Container.State.Running = false
+		// Starting the container may perform escaping of args, so to be consistent
+		// we also set that here
+		config.ArgsEscaped = true
+	}
+	image, err := e.Client.CommitContainer(docker.CommitContainerOptions{
+		Container: prereq.Container.ID,
+		Run:       config,
+		Context:   ctx,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to commit stage %s container: %v", name, err)
+	}
+	klog.V(4).Infof("Committed %s to %s as basis for image %q: %#v", prereq.Container.ID, image.ID, name, config)
+	// deleting this image will fail with an "image has dependent child images" error
+	// if it ends up being an ancestor of the final image, so don't bother returning
+	// errors from this specific removeImage() call
+	prereq.Deferred = append([]func() error{func() error { e.removeImage(image.ID); return nil }}, prereq.Deferred...)
+	prereq.Committed = image
+	return nil
+}
+
 // Build is a helper method to perform a Docker build against the
 // provided Docker client. It will load the image if not specified,
 // create a container if one does not already exist, and start a
@@ -252,18 +527,43 @@ func (e *ClientExecutor) Stages(b *imagebuilder.Builder, stages imagebuilder.Sta
 // any containers it creates directly, and set the e.Committed.ID field
 // to the generated image.
 func (e *ClientExecutor) Build(b *imagebuilder.Builder, node *parser.Node, from string) error {
+	return e.BuildContext(context.Background(), b, node, from)
+}
+
+// BuildContext is like Build, but stops building once ctx is cancelled. Any
+// containers and images which were created are still cleaned up.
+func (e *ClientExecutor) BuildContext(ctx context.Context, b *imagebuilder.Builder, node *parser.Node, from string) (err error) {
 	defer e.Release()
-	if err := e.Prepare(b, node, from); err != nil {
+	start := time.Now()
+	e.emit(Event{Type: EventBuildStart})
+	defer func() {
+		e.emit(Event{Type: EventBuildFinish, Duration: time.Since(start), Error: errorString(err)})
+	}()
+	if e.BuildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.BuildTimeout)
+		defer cancel()
+	}
+	if err := e.PrepareContext(ctx, b, node, from); err != nil {
 		return err
 	}
-	if err := e.Execute(b, node); err != nil {
+	if err := e.ExecuteContext(ctx, b, node); err != nil {
 		return err
 	}
-	return e.Commit(b)
+	return e.CommitContext(ctx, b)
 }
 
 func (e *ClientExecutor) Prepare(b *imagebuilder.Builder, node *parser.Node, from string) error {
+	return e.PrepareContext(context.Background(), b, node, from)
+}
+
+// PrepareContext is like Prepare, but abandons pulling the base image or
+// creating the build container if ctx is cancelled.
+func (e *ClientExecutor) PrepareContext(ctx context.Context, b *imagebuilder.Builder, node *parser.Node, from string) error {
 	var err error
+	if e.VolumeSemantics != nil {
+		b.VolumeSemantics = *e.VolumeSemantics
+	}
 
 	// identify the base image
 	if len(from) == 0 {
@@ -272,24 +572,35 @@ func (e *ClientExecutor) Prepare(b *imagebuilder.Builder, node *parser.Node, fro
 			return err
 		}
 		if b.After != "" {
-			return fmt.Errorf("the --after flag in FROM is not supported by the dockerclient executor")
+			// Stages() takes care of ordering stages, so all we can do
+			// here is check that the stage has already been built
+			if _, ok := e.Named[b.After]; !ok {
+				return fmt.Errorf("unable to find stage %s, which this stage is to be built after", b.After)
+			}
 		}
 	}
 
 	// load the image
 	if e.Image == nil {
+		if named, ok := e.NamedContexts[from]; ok {
+			image, err := e.namedContextImage(ctx, from, named, b.Platform)
+			if err != nil {
+				return err
+			}
+			from = image
+		}
 		if from == imagebuilder.NoBaseImageSpecifier {
 			if runtime.GOOS == "windows" {
 				return fmt.Errorf("building from scratch images is not supported")
 			}
-			from, err = e.CreateScratchImage()
+			from, err = e.createScratchImage(ctx)
 			if err != nil {
 				return fmt.Errorf("unable to create a scratch image for this build: %v", err)
 			}
 			e.Deferred = append([]func() error{func() error { return e.removeImage(from) }}, e.Deferred...)
 		}
 		klog.V(4).Infof("Retrieving image %q", from)
-		e.Image, err = e.LoadImageWithPlatform(from, b.Platform)
+		e.Image, err = e.LoadImageWithPlatformContext(ctx, from, b.Platform)
 		if err != nil {
 			return err
 		}
@@ -319,41 +630,86 @@ func (e *ClientExecutor) Prepare(b *imagebuilder.Builder, node *parser.Node, fro
 	}
 
 	// create a container to execute in, if necessary
-	mustStart := b.RequiresStart(node)
+	// a shell can only be started in a container which is kept running
+	mustStart := b.RequiresStart(node) || len(e.DebugShell) > 0
 	if e.Container == nil {
 		opts := docker.CreateContainerOptions{
 			Config: &docker.Config{
 				Image: from,
 			},
 			HostConfig: &docker.HostConfig{},
+			Context:    ctx,
 		}
 		if e.HostConfig != nil {
 			opts.HostConfig = e.HostConfig
 		}
 		originalBinds := opts.HostConfig.Binds
 
+		// the daemon would mount a volume at each of the image's volumes,
+		// which can't be replaced or committed, so the container is created
+		// from a copy of the image which has none. The committed image still
+		// declares them, since they're part of the builder's configuration.
+		// With BuildKit's semantics changes beneath them are kept, and with
+		// docker's they are preserved, as if they had been declared by the
+		// Dockerfile. Creating the copy relies on loading an archive without
+		// the image's layers, which containerd's image store doesn't allow.
+		var imageVolumes []string
+		if e.Image.Config != nil && len(e.Image.Config.Volumes) > 0 {
+			if e.loadsPartialImageArchives() {
+				image, err := e.createImageWithoutVolumes(ctx, e.Image.ID)
+				if err != nil {
+					return fmt.Errorf("unable to create a copy of image %s without volumes: %v", from, err)
+				}
+				opts.Config.Image = image
+				if b.VolumeSemantics != imagebuilder.VolumeSemanticsBuildKit {
+					for path := range e.Image.Config.Volumes {
+						imageVolumes = append(imageVolumes, path)
+					}
+				}
+			} else {
+				e.warn("the daemon uses containerd's image store, so the volumes which image %s declares are mounted during the build, and nothing written beneath them is kept", from)
+			}
+		}
+
+		var keepalive []byte
+		var transientVolume, keepaliveVolume string
 		if mustStart {
+			// keep the container running with a process of our own, rather
+			// than relying on the image to provide one
+			if len(e.Command) == 0 && e.Image != nil {
+				keepalive = keepaliveBinary(e.Image.OS, e.Image.Architecture)
+			}
+
 			// Transient mounts only make sense on images that will be running processes
 			if len(e.TransientMounts) > 0 {
-				volumeName, err := randSeq(imageSafeCharacters, 24)
+				var err error
+				transientVolume, sharedMount, err = e.createTemporaryVolume(ctx)
 				if err != nil {
-					return err
+					return fmt.Errorf("unable to create volume to mount secrets: %v", err)
 				}
-				v, err := e.Client.CreateVolume(docker.CreateVolumeOptions{Name: volumeName})
+				opts.HostConfig.Binds = append(opts.HostConfig.Binds, transientVolume+":"+e.ContainerTransientMount)
+			}
+			// the keepalive process gets a volume of its own, since the
+			// volume it is in stays mounted for the whole build
+			if keepalive != nil {
+				var err error
+				keepaliveVolume, _, err = e.createTemporaryVolume(ctx)
 				if err != nil {
-					return fmt.Errorf("unable to create volume to mount secrets: %v", err)
+					return fmt.Errorf("unable to create volume for keepalive process: %v", err)
 				}
-				e.Deferred = append([]func() error{func() error { return e.Client.RemoveVolume(volumeName) }}, e.Deferred...)
-				sharedMount = v.Mountpoint
-				opts.HostConfig.Binds = append(opts.HostConfig.Binds, volumeName+":"+e.ContainerTransientMount)
+				opts.HostConfig.Binds = append(opts.HostConfig.Binds, keepaliveVolume+":"+keepaliveUploadDir)
 			}
 
 			// TODO: windows support
-			if len(e.Command) > 0 {
+			switch {
+			case len(e.Command) > 0:
 				opts.Config.Cmd = e.Command
 				opts.Config.Entrypoint = nil
-			} else {
-				// TODO; replace me with a better default command
+			case keepalive != nil:
+				opts.Config.Cmd = []string{"#(imagebuilder)"}
+				opts.Config.Entrypoint = []string{path.Join(keepaliveDir, keepaliveName)}
+			default:
+				// there's no keepalive process for this platform
 				opts.Config.Cmd = []string{"# (imagebuilder)\n/bin/sleep 86400"}
 				opts.Config.Entrypoint = append([]string{}, defaultShell...)
 			}
@@ -364,15 +720,28 @@ func (e *ClientExecutor) Prepare(b *imagebuilder.Builder, node *parser.Node, fro
 		}
 
 		// copy any source content into the temporary mount path
-		if mustStart && len(e.TransientMounts) > 0 {
-			if len(sharedMount) == 0 {
+		if mustStart && (len(transientVolume) > 0 || len(keepaliveVolume) > 0) {
+			if len(sharedMount) == 0 && len(e.TransientMounts) > 0 {
 				return fmt.Errorf("no mount point available for temporary mounts")
 			}
-			binds, err := e.PopulateTransientMounts(opts, e.TransientMounts, sharedMount)
+			binds, err := e.populateTransientMounts(ctx, opts, e.TransientMounts, keepalive, sharedMount)
 			if err != nil {
 				return err
 			}
 			opts.HostConfig.Binds = append(originalBinds, binds...)
+			if keepalive != nil {
+				opts.HostConfig.Binds = append(opts.HostConfig.Binds, keepaliveVolume+":"+keepaliveDir+":ro")
+			}
+		}
+
+		var runMounts *runMountVolumes
+		if mustStart && requiresRunMounts(node) {
+			var binds []string
+			var err error
+			if runMounts, binds, err = e.createRunMountVolumes(ctx); err != nil {
+				return err
+			}
+			opts.HostConfig.Binds = append(opts.HostConfig.Binds, binds...)
 		}
 
 		klog.V(4).Infof("Creating container with %#v %#v", opts.Config, opts.HostConfig)
@@ -381,12 +750,17 @@ func (e *ClientExecutor) Prepare(b *imagebuilder.Builder, node *parser.Node, fro
 			return fmt.Errorf("unable to create build container: %v", err)
 		}
 		e.Container = container
+		e.containerOptions = &opts
+		e.runMounts = runMounts
 		e.Deferred = append([]func() error{func() error { return e.removeContainer(container.ID) }}, e.Deferred...)
+		for _, path := range imageVolumes {
+			e.volumeTracker().Add(path)
+		}
 	}
 
 	// TODO: lazy start
 	if mustStart && !e.Container.State.Running {
-		if err := e.Client.StartContainer(e.Container.ID, nil); err != nil {
+		if err := e.Client.StartContainerWithContext(e.Container.ID, nil, ctx); err != nil {
 			return fmt.Errorf("unable to start build container: %v", err)
 		}
 		e.Container.State.Running = true
@@ -398,10 +772,23 @@ func (e *ClientExecutor) Prepare(b *imagebuilder.Builder, node *parser.Node, fro
 // Execute performs all of the provided steps against the initialized container. May be
 // invoked multiple times for a given container.
 func (e *ClientExecutor) Execute(b *imagebuilder.Builder, node *parser.Node) error {
+	return e.ExecuteContext(context.Background(), b, node)
+}
+
+// ExecuteContext is like Execute, but stops at the first step which is
+// interrupted by ctx being cancelled.
+func (e *ClientExecutor) ExecuteContext(ctx context.Context, b *imagebuilder.Builder, node *parser.Node) (err error) {
+	defer func() { e.step = stepInfo{} }()
+	defer func() {
+		e.batchUploads = false
+		if flushErr := e.flushUploads(); err == nil && flushErr != nil {
+			err = flushErr
+		}
+	}()
 	for i, child := range node.Children {
 		step := b.Step()
 		if err := step.Resolve(child); err != nil {
-			return err
+			return e.stepError(child, err)
 		}
 		klog.V(4).Infof("step: %s", step.Original)
 		if e.LogFn != nil {
@@ -410,7 +797,38 @@ func (e *ClientExecutor) Execute(b *imagebuilder.Builder, node *parser.Node) err
 		}
 		noRunsRemaining := !b.RequiresStart(&parser.Node{Children: node.Children[i+1:]})
 
-		if err := b.Run(step, e, noRunsRemaining); err != nil {
+		e.step = stepInfo{step: i + 1, instruction: step.Original, line: child.StartLine}
+		if e.isBreakpoint(child.StartLine) && e.Container != nil {
+			if err := e.debugBreakpoint(ctx, step, child.StartLine, debugConfig(b, step)); err != nil {
+				return e.stepError(child, err)
+			}
+		}
+		e.emit(Event{Type: EventStepStart})
+		warnings := len(b.Warnings)
+		start := time.Now()
+		e.batchUploads = uploadsContinue(node.Children[i+1:])
+		err := b.RunContext(ctx, step, e, noRunsRemaining)
+		if err == nil && step.Command == command.User && !noRunsRemaining {
+			// fail here, rather than when the user is needed by RUN
+			if userErr := e.checkUser(ctx, b.RunConfig.User); userErr != nil {
+				err = fmt.Errorf("USER %s: %w", b.RunConfig.User, userErr)
+			}
+		}
+		if err != nil {
+			stepErr := e.stepError(child, err)
+			if errors.Is(err, context.DeadlineExceeded) {
+				stepErr.Err = fmt.Errorf("timed out after %s: %w", time.Since(start).Round(time.Millisecond), stepErr.Err)
+			}
+			err = stepErr
+			if e.KeepOnFailure || len(e.DebugShell) > 0 {
+				e.debugFailure(ctx, step, child.StartLine, debugConfig(b, step), err)
+			}
+		}
+		for _, warning := range b.Warnings[min(warnings, len(b.Warnings)):] {
+			e.emit(Event{Type: EventWarning, Message: warning})
+		}
+		e.emit(Event{Type: EventStepFinish, Duration: time.Since(start), Error: errorString(err)})
+		if err != nil {
 			return err
 		}
 	}
@@ -418,14 +836,35 @@ func (e *ClientExecutor) Execute(b *imagebuilder.Builder, node *parser.Node) err
 	return nil
 }
 
+// stepError returns err as an *imagebuilder.StepError which describes the
+// instruction in node and the stage it is a part of.
+func (e *ClientExecutor) stepError(node *parser.Node, err error) *imagebuilder.StepError {
+	var stepErr *imagebuilder.StepError
+	if !errors.As(err, &stepErr) {
+		stepErr = &imagebuilder.StepError{Original: node.Original, Err: err}
+	}
+	stepErr.Stage, stepErr.Position = e.Name, e.position
+	stepErr.StartLine, stepErr.EndLine = node.StartLine, node.EndLine
+	return stepErr
+}
+
 // Commit saves the completed build as an image with the provided tag. It will
 // stop the container, commit the image, and then remove the container.
 func (e *ClientExecutor) Commit(b *imagebuilder.Builder) error {
+	return e.CommitContext(context.Background(), b)
+}
+
+// CommitContext is like Commit, but abandons the commit if ctx is cancelled.
+// Temporary containers and images are still cleaned up.
+func (e *ClientExecutor) CommitContext(ctx context.Context, b *imagebuilder.Builder) (err error) {
+	if err := e.flushUploads(); err != nil {
+		return err
+	}
 	config := b.Config()
 
 	if e.Container.State.Running {
 		klog.V(4).Infof("Stopping container %s ...", e.Container.ID)
-		if err := e.Client.StopContainer(e.Container.ID, 0); err != nil {
+		if err := e.Client.StopContainerWithContext(e.Container.ID, 0, ctx); err != nil {
 			return fmt.Errorf("unable to stop build container: %v", err)
 		}
 		e.Container.State.Running = false
@@ -460,6 +899,7 @@ func (e *ClientExecutor) Commit(b *imagebuilder.Builder) error {
 		Run:        config,
 		Repository: repository,
 		Tag:        tag,
+		Context:    ctx,
 	})
 	if err != nil {
 		return fmt.Errorf("unable to commit build container: %v", err)
@@ -467,13 +907,21 @@ func (e *ClientExecutor) Commit(b *imagebuilder.Builder) error {
 
 	e.Committed = image
 	klog.V(4).Infof("Committed %s to %s", e.Container.ID, image.ID)
+	defer func() {
+		var tags []string
+		if len(e.Tag) > 0 {
+			tags = append([]string{e.Tag}, e.AdditionalTags...)
+		}
+		e.emit(Event{Type: EventCommit, Image: image.ID, Tags: tags, Error: errorString(err)})
+	}()
 
 	if len(e.Tag) > 0 {
 		for _, s := range e.AdditionalTags {
 			repository, tag := docker.ParseRepositoryTag(s)
 			err := e.Client.TagImage(image.ID, docker.TagImageOptions{
-				Repo: repository,
-				Tag:  tag,
+				Repo:    repository,
+				Tag:     tag,
+				Context: ctx,
 			})
 			if err != nil {
 				e.Deferred = append([]func() error{func() error { return e.removeImage(image.ID) }}, e.Deferred...)
@@ -489,13 +937,39 @@ func (e *ClientExecutor) Commit(b *imagebuilder.Builder) error {
 	return nil
 }
 
+// createTemporaryVolume creates a volume which is removed when the build is
+// released, and returns its name and its location on the daemon's host.
+func (e *ClientExecutor) createTemporaryVolume(ctx context.Context) (string, string, error) {
+	name, err := randSeq(imageSafeCharacters, 24)
+	if err != nil {
+		return "", "", err
+	}
+	v, err := e.Client.CreateVolume(docker.CreateVolumeOptions{Name: name, Context: ctx})
+	if err != nil {
+		return "", "", err
+	}
+	e.Deferred = append([]func() error{func() error { return e.Client.RemoveVolume(name) }}, e.Deferred...)
+	return name, v.Mountpoint, nil
+}
+
 func (e *ClientExecutor) PopulateTransientMounts(opts docker.CreateContainerOptions, transientMounts []Mount, sharedMount string) ([]string, error) {
+	return e.populateTransientMounts(context.Background(), opts, transientMounts, nil, sharedMount)
+}
+
+func (e *ClientExecutor) populateTransientMounts(ctx context.Context, opts docker.CreateContainerOptions, transientMounts []Mount, keepalive []byte, sharedMount string) ([]string, error) {
+	opts.Context = ctx
 	container, err := e.Client.CreateContainer(opts)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create transient container: %v", err)
 	}
 	defer e.removeContainer(container.ID)
 
+	if keepalive != nil {
+		if err := e.uploadKeepalive(ctx, container, keepalive); err != nil {
+			return nil, fmt.Errorf("unable to copy keepalive process into container: %v", err)
+		}
+	}
+
 	var copies []imagebuilder.Copy
 	for i, mount := range transientMounts {
 		copies = append(copies, imagebuilder.Copy{
@@ -504,7 +978,7 @@ func (e *ClientExecutor) PopulateTransientMounts(opts docker.CreateContainerOpti
 			Dest:   filepath.Join(e.ContainerTransientMount, strconv.Itoa(i)),
 		})
 	}
-	if err := e.CopyContainer(container, nil, copies...); err != nil {
+	if err := e.copyContainer(ctx, container, nil, copies...); err != nil {
 		return nil, fmt.Errorf("unable to copy transient context into container: %v", err)
 	}
 
@@ -516,8 +990,40 @@ func (e *ClientExecutor) PopulateTransientMounts(opts docker.CreateContainerOpti
 	return binds, nil
 }
 
+// uploadKeepalive writes the keepalive process into its volume, which is
+// mounted at keepaliveUploadDir in container.
+func (e *ClientExecutor) uploadKeepalive(ctx context.Context, container *docker.Container, keepalive []byte) error {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	h := &tar.Header{
+		Name:     keepaliveName,
+		Typeflag: tar.TypeReg,
+		Mode:     0o755,
+		Size:     int64(len(keepalive)),
+		ModTime:  time.Now(),
+	}
+	if err := mapToHost(e.IDMappings, h); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(h); err != nil {
+		return err
+	}
+	if _, err := tw.Write(keepalive); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return e.Client.UploadToContainer(container.ID, docker.UploadToContainerOptions{
+		InputStream: buf,
+		Path:        keepaliveUploadDir,
+		Context:     ctx,
+	})
+}
+
 // Release deletes any items started by this executor.
 func (e *ClientExecutor) Release() []error {
+	e.abortUploads(fmt.Errorf("the build was released"))
 	errs := e.Volumes.Release()
 	for _, fn := range e.Deferred {
 		if err := fn(); err != nil {
@@ -530,6 +1036,10 @@ func (e *ClientExecutor) Release() []error {
 
 // removeContainer removes the provided container ID
 func (e *ClientExecutor) removeContainer(id string) error {
+	if id == e.keptContainer {
+		klog.V(4).Infof("Keeping container %s for debugging", id)
+		return nil
+	}
 	e.Client.StopContainer(id, 0)
 	err := e.Client.RemoveContainer(docker.RemoveContainerOptions{
 		ID:            id,
@@ -555,6 +1065,10 @@ func (e *ClientExecutor) removeImage(id string) error {
 // CreateScratchImage creates a new, zero byte layer that is identical to "scratch"
 // except that the resulting image will have two layers.
 func (e *ClientExecutor) CreateScratchImage() (string, error) {
+	return e.createScratchImage(context.Background())
+}
+
+func (e *ClientExecutor) createScratchImage(ctx context.Context) (string, error) {
 	random, err := randSeq(imageSafeCharacters, 24)
 	if err != nil {
 		return "", err
@@ -569,9 +1083,51 @@ func (e *ClientExecutor) CreateScratchImage() (string, error) {
 		Repository:  name,
 		Source:      "-",
 		InputStream: buf,
+		Context:     ctx,
 	})
 }
 
+// createImageWithoutVolumes loads a copy of image into the daemon which has
+// the same layers and configuration, other than declaring no volumes, and
+// returns its ID. The copy's configuration is built from what the daemon
+// reports when the image is inspected, so none of the image's layers have to
+// be read. The copy is removed when the build is released.
+func (e *ClientExecutor) createImageWithoutVolumes(ctx context.Context, image string) (string, error) {
+	config, diffIDs, err := e.imageConfig(ctx, image, true)
+	if err != nil {
+		return "", err
+	}
+	loaded, err := e.loadImageArchive(ctx, "imagebuilder-novolumes-", func(w io.Writer, tag string) error {
+		return writeImageArchive(w, config, diffIDs, tag, "")
+	})
+	if err != nil {
+		return "", err
+	}
+	klog.V(4).Infof("Created image %s, a copy of %s without volumes", loaded.ID, image)
+	return loaded.ID, nil
+}
+
+// loadsPartialImageArchives returns true if the daemon can load an image
+// archive which leaves out layers that it already has. A daemon which keeps
+// images in containerd's image store needs every layer to be included.
+func (e *ClientExecutor) loadsPartialImageArchives() bool {
+	if e.partialLoads == nil {
+		supported := true
+		info, err := e.Client.Info()
+		if err != nil {
+			klog.V(4).Infof("Unable to determine the daemon's image store, assuming it is not containerd's: %v", err)
+		} else {
+			for _, status := range info.DriverStatus {
+				if status[0] == "driver-type" && strings.HasPrefix(status[1], "io.containerd.snapshotter") {
+					supported = false
+				}
+			}
+		}
+		e.partialLoads = &supported
+	}
+	return *e.partialLoads
+}
+
 // imageSafeCharacters are characters allowed to be part of a Docker image name.
 const imageSafeCharacters = "abcdefghijklmnopqrstuvwxyz0123456789"
 
@@ -601,6 +1157,12 @@ func (e *ClientExecutor) LoadImage(from string) (*docker.Image, error) {
 // LoadImage checks the client for an image matching from. If not found,
 // attempts to pull the image with specified platform string.
 func (e *ClientExecutor) LoadImageWithPlatform(from string, platform string) (*docker.Image, error) {
+	return e.LoadImageWithPlatformContext(context.Background(), from, platform)
+}
+
+// LoadImageWithPlatformContext is like LoadImageWithPlatform, but abandons
+// any pull which is in progress if ctx is cancelled.
+func (e *ClientExecutor) LoadImageWithPlatformContext(ctx context.Context, from string, platform string) (*docker.Image, error) {
 	image, err := e.Client.InspectImage(from)
 	if err == nil {
 		return image, nil
@@ -653,10 +1215,15 @@ func (e *ClientExecutor) LoadImageWithPlatform(from string, platform string) (*d
 				OutputStream:  pullWriter,
 				Platform:      platform,
 				RawJSONStream: true,
+				Context:       ctx,
 			}
 			if klog.V(5) {
 				pullImageOptions.OutputStream = os.Stderr
 				pullImageOptions.RawJSONStream = false
+			} else if e.EventFn != nil {
+				pullEvents := newPullEventWriter(from, e.emit)
+				defer pullEvents.Close()
+				pullImageOptions.OutputStream = io.MultiWriter(pullWriter, pullEvents)
 			}
 			authConfig := docker.AuthConfiguration{Username: config.Username, ServerAddress: config.ServerAddress, Password: config.Password}
 			pullErr = e.Client.PullImage(pullImageOptions, authConfig)
@@ -675,35 +1242,53 @@ func (e *ClientExecutor) LoadImageWithPlatform(from string, platform string) (*d
 }
 
 func (e *ClientExecutor) Preserve(path string) error {
-	if e.Volumes == nil {
-		e.Volumes = NewContainerVolumeTracker()
-	}
+	return e.PreserveContext(context.Background(), path)
+}
 
-	if err := e.EnsureContainerPath(path); err != nil {
+// PreserveContext implements imagebuilder.ContextExecutor.
+func (e *ClientExecutor) PreserveContext(ctx context.Context, path string) error {
+	if err := e.createOrReplaceContainerPathWithOwner(ctx, path, 0, 0, nil); err != nil {
 		return err
 	}
 
-	e.Volumes.Add(path)
+	e.volumeTracker().Add(path)
 	return nil
 }
 
+// volumeTracker returns the tracker for preserved paths, creating it if needed.
+func (e *ClientExecutor) volumeTracker() *ContainerVolumeTracker {
+	if e.Volumes == nil {
+		e.Volumes = NewContainerVolumeTracker()
+		e.Volumes.idMappings = e.IDMappings
+	}
+	return e.Volumes
+}
+
 func (e *ClientExecutor) EnsureContainerPath(path string) error {
-	return e.createOrReplaceContainerPathWithOwner(path, 0, 0, nil)
+	return e.createOrReplaceContainerPathWithOwner(context.Background(), path, 0, 0, nil)
 }
 
 func (e *ClientExecutor) EnsureContainerPathAs(path, user string, mode *os.FileMode) error {
+	return e.EnsureContainerPathAsContext(context.Background(), path, user, mode)
+}
+
+// EnsureContainerPathAsContext implements imagebuilder.ContextExecutor.
+func (e *ClientExecutor) EnsureContainerPathAsContext(ctx context.Context, path, user string, mode *os.FileMode) error {
 	uid, gid := 0, 0
 
-	u, g, err := e.getUser(user)
+	u, g, err := e.getUser(ctx, user)
 	if err == nil {
 		uid = u
 		gid = g
 	}
 
-	return e.createOrReplaceContainerPathWithOwner(path, uid, gid, mode)
+	return e.createOrReplaceContainerPathWithOwner(ctx, path, uid, gid, mode)
 }
 
-func (e *ClientExecutor) createOrReplaceContainerPathWithOwner(path string, uid, gid int, mode *os.FileMode) error {
+func (e *ClientExecutor) createOrReplaceContainerPathWithOwner(ctx context.Context, path string, uid, gid int, mode *os.FileMode) error {
+	if err := e.flushUploads(); err != nil {
+		return err
+	}
 	if mode == nil {
 		m := os.FileMode(0755)
 		mode = &m
@@ -717,44 +1302,45 @@ func (e *ClientExecutor) createOrReplaceContainerPathWithOwner(path string, uid,
 		opts := docker.UploadToContainerOptions{
 			InputStream: reader,
 			Path:        "/",
-			Context:     context.TODO(),
+			Context:     ctx,
 		}
 		go func() {
 			defer writer.Close()
 			tarball := tar.NewWriter(writer)
 			defer tarball.Close()
-			writerErr = tarball.WriteHeader(&tar.Header{
+			h := &tar.Header{
 				Name:     dest,
 				Typeflag: tar.TypeDir,
 				Mode:     int64(*mode),
 				Uid:      uid,
 				Gid:      gid,
-			})
+			}
+			if writerErr = mapToHost(e.IDMappings, h); writerErr != nil {
+				return
+			}
+			writerErr = tarball.WriteHeader(h)
 		}()
 		klog.V(4).Infof("Uploading empty archive to %q", dest)
 		err := e.Client.UploadToContainer(e.Container.ID, opts)
 		if err != nil {
+			e.pathCache().invalidate()
 			return fmt.Errorf("unable to ensure existence of preserved path %s: %v", dest, err)
 		}
 		if writerErr != nil {
+			e.pathCache().invalidate()
 			return fmt.Errorf("error generating tarball to ensure existence of preserved path %s: %v", dest, writerErr)
 		}
+		e.pathCache().created(e.Container.ID, dest)
 		return nil
 	}
-	readPath := func(dest string) error {
-		if !strings.HasSuffix(dest, "/") {
-			dest = dest + "/"
-		}
-		err := e.Client.DownloadFromContainer(e.Container.ID, docker.DownloadFromContainerOptions{
-			Path:         dest,
-			OutputStream: ioutil.Discard,
-		})
-		return err
-	}
 	var pathsToCreate []string
 	pathToCheck := path
 	for {
-		if err := readPath(pathToCheck); err != nil {
+		info, err := e.pathCache().stat(ctx, e.Client, e.Container.ID, pathToCheck)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil || !info.dir {
 			pathsToCreate = append([]string{pathToCheck}, pathsToCreate...)
 		}
 		if filepath.Dir(pathToCheck) == pathToCheck {
@@ -773,25 +1359,118 @@ func (e *ClientExecutor) createOrReplaceContainerPathWithOwner(path string, uid,
 func (e *ClientExecutor) UnrecognizedInstruction(step *imagebuilder.Step) error {
 	if e.IgnoreUnrecognizedInstructions {
 		e.LogFn("warning: Unknown instruction: %s", strings.ToUpper(step.Command))
+		e.emit(Event{Type: EventWarning, Message: fmt.Sprintf("Unknown instruction: %s", strings.ToUpper(step.Command))})
 		return nil
 	}
 	return fmt.Errorf("Unknown instruction: %s", strings.ToUpper(step.Command))
 }
 
 // Run executes a single Run command against the current container using exec().
-// Since exec does not allow ENV or WORKINGDIR to be set, we force the execution of
-// the user command into a shell and perform those operations before. Since RUN
-// requires /bin/sh, we can use both 'cd' and 'export'.
+// The command is run as it was written, with the environment and working
+// directory set through the exec's options. Those can't be set if either the
+// daemon's API version or the one the client requests is older than 1.35, so
+// then the command is wrapped in a shell which sets them before running it
+// (see shellEnvironment).
 func (e *ClientExecutor) Run(run imagebuilder.Run, config docker.Config) error {
+	return e.RunContext(context.Background(), run, config)
+}
+
+// execEnvironmentVersion is the first API version in which the daemon can set
+// both the environment and the working directory of an exec.
+var execEnvironmentVersion = docker.APIVersion{1, 35}
+
+// execSupportsEnvironment returns true if the daemon can set the environment
+// and working directory of a command which is run in the build container, so
+// that it doesn't need to be wrapped in a shell which sets them. The daemon
+// treats a request as it would have in the version the client asks for, so
+// that has to be recent enough as well.
+func (e *ClientExecutor) execSupportsEnvironment(ctx context.Context) bool {
+	if e.serverVersion == nil {
+		env, err := e.Client.VersionWithContext(ctx)
+		if err != nil {
+			klog.V(4).Infof("Unable to determine the API version of the daemon: %v", err)
+			return false
+		}
+		version, err := docker.NewAPIVersion(env.Get("ApiVersion"))
+		if err != nil {
+			klog.V(4).Infof("Unable to parse the API version of the daemon: %v", err)
+			return false
+		}
+		e.serverVersion = version
+	}
+	version := e.serverVersion
+	if e.APIVersion != nil && e.APIVersion.LessThan(version) {
+		version = e.APIVersion
+	}
+	return version.GreaterThanOrEqualTo(execEnvironmentVersion)
+}
+
+// shellEnvironment returns a command which runs args in the working directory
+// and with the environment from config, for daemons which can't set them on
+// an exec. If shell is true, args already starts with defaultShell and its
+// last argument is the script to run.
+func shellEnvironment(args []string, shell bool, defaultShell []string, config docker.Config) []string {
+	if len(config.WorkingDir) == 0 && len(config.Env) == 0 || len(args) == 0 {
+		return args
+	}
+	if shell {
+		script := args[len(args)-1]
+		if len(config.WorkingDir) > 0 {
+			script = fmt.Sprintf("cd %s && %s", imagebuilder.BashQuote(config.WorkingDir), script)
+		}
+		if len(config.Env) > 0 {
+			script = imagebuilder.ExportEnv(config.Env) + script
+		}
+		return append(append([]string{}, args[:len(args)-1]...), script)
+	}
+	setup := "exec \"$@\""
+	if len(config.WorkingDir) > 0 {
+		setup = fmt.Sprintf("cd %s && %s", imagebuilder.BashQuote(config.WorkingDir), setup)
+	}
+	if len(config.Env) > 0 {
+		setup = imagebuilder.ExportEnv(config.Env) + setup
+	}
+	newArgs := make([]string, 0, len(args)+4)
+	newArgs = append(newArgs, defaultShell...)
+	newArgs = append(newArgs, setup, "")
+	newArgs = append(newArgs, args...)
+	return newArgs
+}
+
+// errRunKilled is returned when the build container was killed to stop a
+// command which exceeded RunTimeout.
+var errRunKilled = errors.New("the build container was killed to stop it")
+
+// RunContext implements imagebuilder.ContextExecutor. If ctx is cancelled,
+// or RunTimeout expires, while the command is running, the build container is
+// killed, since the daemon offers no way to stop a process started using exec
+// and a command can't be relied on to stop the processes it started. The
+// container can't be used afterwards, so the build can't continue in it or
+// be debugged. The content of RUN
+// --mount options is linked into the build container while the command runs
+// (see runWithMounts).
+func (e *ClientExecutor) RunContext(ctx context.Context, run imagebuilder.Run, config docker.Config) error {
 	if len(run.Files) > 0 {
 		return fmt.Errorf("Heredoc syntax is not supported")
 	}
-	if len(run.Mounts) > 0 {
-		return fmt.Errorf("RUN --mount not supported")
-	}
 	if run.Network != "" {
 		return fmt.Errorf("RUN --network not supported")
 	}
+	if len(run.Mounts) > 0 {
+		return e.runWithMounts(ctx, run, config)
+	}
+	// the command can change anything in the container's filesystem
+	defer e.pathCache().invalidate()
+	defer e.users.Invalidate()
+	if err := e.flushUploads(); err != nil {
+		return err
+	}
+	parent := ctx
+	if e.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.RunTimeout)
+		defer cancel()
+	}
 
 	args := make([]string, len(run.Args))
 	copy(args, run.Args)
@@ -810,39 +1489,17 @@ func (e *ClientExecutor) Run(run imagebuilder.Run, config docker.Config) error {
 		}
 		// TODO: implement windows ENV
 		args = append(defaultShell, args...)
+		config.Env, config.WorkingDir = nil, ""
 	} else {
 		if run.Shell {
-			if len(config.WorkingDir) > 0 {
-				args[0] = fmt.Sprintf("cd %s && %s", imagebuilder.BashQuote(config.WorkingDir), args[0])
-			}
-			if len(config.Env) > 0 {
-				args[0] = imagebuilder.ExportEnv(config.Env) + args[0]
-			}
 			args = append(defaultShell, args...)
-		} else {
-			switch {
-			case len(config.WorkingDir) == 0 && len(config.Env) == 0:
-				// no change necessary
-			case len(args) > 0:
-				setup := "exec \"$@\""
-				if len(config.WorkingDir) > 0 {
-					setup = fmt.Sprintf("cd %s && %s", imagebuilder.BashQuote(config.WorkingDir), setup)
-				}
-				if len(config.Env) > 0 {
-					setup = imagebuilder.ExportEnv(config.Env) + setup
-				}
-				newArgs := make([]string, 0, len(args)+4)
-				newArgs = append(newArgs, defaultShell...)
-				newArgs = append(newArgs, setup, "")
-				newArgs = append(newArgs, args...)
-				args = newArgs
-			}
+		}
+		if !e.execSupportsEnvironment(ctx) {
+			args = shellEnvironment(args, run.Shell, defaultShell, config)
+			config.Env, config.WorkingDir = nil, ""
 		}
 	}
 
-	if e.StrictVolumeOwnership && !e.Volumes.Empty() {
-		return fmt.Errorf("a RUN command was executed after a VOLUME command, which may result in ownership information being lost")
-	}
 	if err := e.Volumes.Save(e.Container.ID, e.TempDir, e.Client); err != nil {
 		return err
 	}
@@ -855,23 +1512,52 @@ func (e *ClientExecutor) Run(run imagebuilder.Run, config docker.Config) error {
 		AttachStdout: true,
 		AttachStderr: true,
 		User:         config.User,
+		Env:          config.Env,
+		WorkingDir:   config.WorkingDir,
+		Context:      ctx,
 	})
 	if err != nil {
 		return err
 	}
-	if err := e.Client.StartExec(exec.ID, docker.StartExecOptions{
-		OutputStream: e.Out,
-		ErrorStream:  e.ErrOut,
-	}); err != nil {
+	stdout, stderr := e.Out, e.ErrOut
+	if e.EventFn != nil {
+		stdout = &outputEventWriter{w: e.Out, stream: "stdout", emit: e.emit}
+		stderr = &outputEventWriter{w: e.ErrOut, stream: "stderr", emit: e.emit}
+	}
+	waiter, err := e.Client.StartExecNonBlocking(exec.ID, docker.StartExecOptions{
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		Context:      ctx,
+	})
+	if err != nil {
 		return err
 	}
+	done := make(chan error, 1)
+	go func() { done <- waiter.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		klog.V(4).Infof("Killing container %s to stop %v: %v", e.Container.ID, args, ctx.Err())
+		if err := e.Client.KillContainer(docker.KillContainerOptions{ID: e.Container.ID}); err != nil {
+			klog.V(4).Infof("Unable to kill container %s: %v", e.Container.ID, err)
+		}
+		e.Container.State.Running = false
+		waiter.Close()
+		if parent.Err() == nil {
+			return fmt.Errorf("RUN exceeded its timeout of %s: %w: %w", e.RunTimeout, errRunKilled, ctx.Err())
+		}
+		return ctx.Err()
+	}
 	status, err := e.Client.InspectExec(exec.ID)
 	if err != nil {
 		return err
 	}
 	if status.ExitCode != 0 {
 		klog.V(4).Infof("Failed command (code %d): %v", status.ExitCode, args)
-		return fmt.Errorf("running '%s' failed with exit code %d", strings.Join(run.Args, " "), status.ExitCode)
+		return &imagebuilder.ExitError{Args: run.Args, ExitCode: status.ExitCode}
 	}
 
 	if err := e.Volumes.Restore(e.Container.ID, e.Client); err != nil {
@@ -883,40 +1569,71 @@ func (e *ClientExecutor) Run(run imagebuilder.Run, config docker.Config) error {
 
 // Copy implements the executor copy function.
 func (e *ClientExecutor) Copy(excludes []string, copies ...imagebuilder.Copy) error {
+	return e.CopyContext(context.Background(), excludes, copies...)
+}
+
+// CopyContext implements imagebuilder.ContextExecutor.
+func (e *ClientExecutor) CopyContext(ctx context.Context, excludes []string, copies ...imagebuilder.Copy) error {
 	// copying content into a volume invalidates the archived state of any given directory
 	for _, copy := range copies {
 		if copy.Checksum != "" {
-			return fmt.Errorf("ADD --checksum not supported")
+			for _, src := range copy.Src {
+				if !e.isGitSource(src) {
+					return fmt.Errorf("ADD --checksum is only supported for git sources")
+				}
+			}
 		}
-		if copy.Link {
-			return fmt.Errorf("ADD or COPY --link not supported")
+		if len(copy.Files) > 0 {
+			return fmt.Errorf("Heredoc syntax is not supported")
 		}
-		if copy.Parents {
-			return fmt.Errorf("COPY --parents not supported")
+		e.Volumes.Invalidate(copy.Dest)
+	}
+
+	// linked copies are handled individually, but keep everything in order
+	for len(copies) > 0 {
+		// stacking the layer relies on loading an archive without the
+		// build container's layers, which containerd's image store
+		// doesn't allow
+		if copies[0].Link && !e.loadsPartialImageArchives() {
+			e.warn("the daemon uses containerd's image store, so %s --link %s is copied without --link", linkedInstruction(copies[0]), strings.Join(copies[0].Src, " "))
+			copies[0].Link = false
 		}
-		if copy.KeepGitDir {
-			return fmt.Errorf("ADD --keep-git-dir not supported")
+		if copies[0].Link {
+			if err := e.copyLinked(ctx, excludes, copies[0]); err != nil {
+				return err
+			}
+			copies = copies[1:]
+			continue
 		}
-		if len(copy.Excludes) > 0 {
-			return fmt.Errorf("ADD or COPY --exclude not supported")
+		i := 1
+		for i < len(copies) && !copies[i].Link {
+			i++
 		}
-		if len(copy.Files) > 0 {
-			return fmt.Errorf("Heredoc syntax is not supported")
+		if err := e.copyContainer(ctx, e.Container, excludes, copies[:i]...); err != nil {
+			return err
 		}
-		e.Volumes.Invalidate(copy.Dest)
+		copies = copies[i:]
 	}
+	return nil
+}
 
-	return e.CopyContainer(e.Container, excludes, copies...)
+// pathCache returns the cache of paths in the build container, creating it
+// if necessary.
+func (e *ClientExecutor) pathCache() *pathCache {
+	if e.paths == nil {
+		e.paths = &pathCache{flush: e.flushUploads}
+	}
+	return e.paths
 }
 
-func (e *ClientExecutor) findMissingParents(container *docker.Container, dest string) (parents []string, err error) {
+func (e *ClientExecutor) findMissingParents(ctx context.Context, container *docker.Container, dest string) (parents []string, err error) {
 	destParent := filepath.Clean(dest)
 	for filepath.Dir(destParent) != destParent {
-		exists, err := isContainerPathDirectory(e.Client, container.ID, destParent)
+		info, err := e.pathCache().stat(ctx, e.Client, container.ID, destParent)
 		if err != nil {
 			return nil, err
 		}
-		if !exists {
+		if !info.dir {
 			parents = append(parents, destParent)
 		}
 		destParent = filepath.Dir(destParent)
@@ -924,14 +1641,44 @@ func (e *ClientExecutor) findMissingParents(container *docker.Container, dest st
 	return parents, nil
 }
 
-func (e *ClientExecutor) getUser(userspec string) (int, int, error) {
-	readFile := func(path string) ([]byte, error) {
+// getUser returns the owner which userspec gives the files that ADD and COPY
+// --chown copy into the build container, and the directories that are created
+// for WORKDIR.
+func (e *ClientExecutor) getUser(ctx context.Context, userspec string) (int, int, error) {
+	return e.userResolver().Owner(ctx, userspec)
+}
+
+// userResolver returns the resolver for user specifications in the build
+// container, which keeps the databases it reads until the container changes.
+func (e *ClientExecutor) userResolver() *usergroup.Resolver {
+	if e.users == nil || e.usersContainer != e.Container.ID {
+		containerID := e.Container.ID
+		e.users = usergroup.NewResolver(func(ctx context.Context, path string) ([]byte, error) {
+			// the files which describe users may have just been copied
+			if err := e.flushUploads(); err != nil {
+				return nil, err
+			}
+			return e.readContainerFile(ctx, containerID, path)
+		})
+		e.usersContainer = containerID
+	}
+	return e.users
+}
+
+// readContainerFile returns the contents of the regular file at path in the
+// container, following symbolic links. It returns an error which wraps
+// os.ErrNotExist if there is no such file.
+func (e *ClientExecutor) readContainerFile(ctx context.Context, containerID, path string) ([]byte, error) {
+	for links := 0; links <= maxContextSymlinks; links++ {
 		var buffer, contents bytes.Buffer
-		if err := e.Client.DownloadFromContainer(e.Container.ID, docker.DownloadFromContainerOptions{
+		if err := e.Client.DownloadFromContainer(containerID, docker.DownloadFromContainerOptions{
 			OutputStream: &buffer,
 			Path:         path,
-			Context:      context.TODO(),
+			Context:      ctx,
 		}); err != nil {
+			if apiErr, ok := err.(*docker.Error); ok && apiErr.Status == 404 {
+				return nil, fmt.Errorf("%s: %w", path, os.ErrNotExist)
+			}
 			return nil, err
 		}
 		tr := tar.NewReader(&buffer)
@@ -939,12 +1686,20 @@ func (e *ClientExecutor) getUser(userspec string) (int, int, error) {
 		if err != nil {
 			return nil, err
 		}
-		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
-			return nil, fmt.Errorf("expected %q to be a regular file, but it was of type %q", path, string(hdr.Typeflag))
-		}
 		if filepath.FromSlash(hdr.Name) != filepath.Base(path) {
 			return nil, fmt.Errorf("error reading contents of %q: got %q instead", path, hdr.Name)
 		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			target := hdr.Linkname
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(path), target)
+			}
+			path = filepath.Clean(target)
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			return nil, fmt.Errorf("expected %q to be a regular file, but it was of type %q", path, string(hdr.Typeflag))
+		}
 		n, err := io.Copy(&contents, tr)
 		if err != nil {
 			return nil, fmt.Errorf("error reading contents of %q: %v", path, err)
@@ -961,99 +1716,31 @@ func (e *ClientExecutor) getUser(userspec string) (int, int, error) {
 		}
 		return contents.Bytes(), nil
 	}
-	parse := func(file []byte, matchField int, key string, numFields, readField int) (string, error) {
-		var value *string
-		scanner := bufio.NewScanner(bytes.NewReader(file))
-		for scanner.Scan() {
-			line := scanner.Text()
-			fields := strings.SplitN(line, ":", numFields)
-			if len(fields) != numFields {
-				return "", fmt.Errorf("error parsing line %q: incorrect number of fields", line)
-			}
-			if fields[matchField] != key {
-				continue
-			}
-			v := fields[readField]
-			value = &v
-		}
-		if err := scanner.Err(); err != nil {
-			return "", fmt.Errorf("error scanning file: %v", err)
-		}
-		if value == nil {
-			return "", os.ErrNotExist
-		}
-		return *value, nil
-	}
+	return nil, fmt.Errorf("%s: too many levels of symbolic links", path)
+}
 
-	spec := strings.SplitN(userspec, ":", 2)
-	if len(spec) == 2 {
-		parsedUid, err := strconv.ParseUint(spec[0], 10, 32)
-		if err != nil {
-			// maybe it's a user name? look up the UID
-			passwdFile, err := readFile("/etc/passwd")
-			if err != nil {
-				return -1, -1, err
-			}
-			uid, err := parse(passwdFile, 0, spec[0], 7, 2)
-			if err != nil {
-				return -1, -1, fmt.Errorf("error reading UID value from passwd file for --chown=%s: %v", spec[0], err)
-			}
-			parsedUid, err = strconv.ParseUint(uid, 10, 32)
-			if err != nil {
-				return -1, -1, fmt.Errorf("error parsing UID value %q from passwd file for --chown=%s", uid, userspec)
-			}
-		}
-		parsedGid, err := strconv.ParseUint(spec[1], 10, 32)
-		if err != nil {
-			// maybe it's a group name? look up the GID
-			groupFile, err := readFile("/etc/group")
-			if err != nil {
-				return -1, -1, err
-			}
-			gid, err := parse(groupFile, 0, spec[1], 4, 2)
-			if err != nil {
-				return -1, -1, err
-			}
-			parsedGid, err = strconv.ParseUint(gid, 10, 32)
-			if err != nil {
-				return -1, -1, fmt.Errorf("error parsing GID value %q from group file for --chown=%s", gid, userspec)
-			}
-		}
-		return int(parsedUid), int(parsedGid), nil
+// checkUser returns an error if user, which is what a USER instruction set,
+// can't be found in the build container, where it is about to run a command.
+// Windows containers don't have user databases to check.
+func (e *ClientExecutor) checkUser(ctx context.Context, user string) error {
+	if e.Container == nil || e.Image != nil && e.Image.OS == "windows" {
+		return nil
 	}
-
-	var parsedUid, parsedGid uint64
-	if id, err := strconv.ParseUint(spec[0], 10, 32); err == nil {
-		// it's an ID. use it as both the UID and the GID
-		parsedUid = id
-		parsedGid = id
-	} else {
-		// it's a user name, we'll need to look up their UID and primary GID
-		passwdFile, err := readFile("/etc/passwd")
-		if err != nil {
-			return -1, -1, err
-		}
-		// read the UID and primary GID
-		uid, err := parse(passwdFile, 0, spec[0], 7, 2)
-		if err != nil {
-			return -1, -1, fmt.Errorf("error reading UID value from /etc/passwd for --chown=%s", userspec)
-		}
-		gid, err := parse(passwdFile, 0, spec[0], 7, 3)
-		if err != nil {
-			return -1, -1, fmt.Errorf("error reading GID value from /etc/passwd for --chown=%s", userspec)
-		}
-		if parsedUid, err = strconv.ParseUint(uid, 10, 32); err != nil {
-			return -1, -1, fmt.Errorf("error parsing UID value %q from /etc/passwd for --chown=%s", uid, userspec)
-		}
-		if parsedGid, err = strconv.ParseUint(gid, 10, 32); err != nil {
-			return -1, -1, fmt.Errorf("error parsing GID value %q from /etc/passwd for --chown=%s", gid, userspec)
+	if _, err := e.userResolver().Resolve(ctx, user); err != nil {
+		if errors.Is(err, usergroup.ErrUnknownUser) || errors.Is(err, usergroup.ErrUnknownGroup) {
+			return err
 		}
+		klog.V(4).Infof("Unable to check the user %q: %v", user, err)
 	}
-	return int(parsedUid), int(parsedGid), nil
+	return nil
 }
 
 // CopyContainer copies the provided content into a destination container.
 func (e *ClientExecutor) CopyContainer(container *docker.Container, excludes []string, copies ...imagebuilder.Copy) error {
+	return e.copyContainer(context.Background(), container, excludes, copies...)
+}
+
+func (e *ClientExecutor) copyContainer(ctx context.Context, container *docker.Container, excludes []string, copies ...imagebuilder.Copy) error {
 	chownUid, chownGid := -1, -1
 	chown := func(h *tar.Header, r io.Reader) (data []byte, update bool, skip bool, err error) {
 		if chownUid != -1 {
@@ -1084,32 +1771,38 @@ func (e *ClientExecutor) CopyContainer(container *docker.Container, excludes []s
 		chownUid, chownGid = -1, -1
 		if c.Chown != "" {
 			var err error
-			chownUid, chownGid, err = e.getUser(c.Chown)
+			chownUid, chownGid, err = e.getUser(ctx, c.Chown)
 			if err != nil {
-				return err
+				return fmt.Errorf("--chown=%s: %w", c.Chown, err)
 			}
 		}
-		// TODO: reuse source
+		opts := copyOptions{Parents: c.Parents, Excludes: c.Excludes, links: newHardlinks(), idMappings: e.IDMappings, KeepGitDir: c.KeepGitDir, Checksum: c.Checksum}
 		for _, src := range c.Src {
 			if src == "" {
 				src = "*"
 			}
-			assumeDstIsDirectory := len(c.Src) > 1
+			assumeDstIsDirectory := len(c.Src) > 1 || c.Parents
 		repeatThisSrc:
 			klog.V(4).Infof("Archiving %s download=%t fromFS=%t from=%s", src, c.Download, c.FromFS, c.From)
 			var r io.Reader
 			var closer io.Closer
 			var err error
-			if len(c.From) > 0 {
+			switch {
+			case c.Download && e.isGitSource(src):
+				klog.V(5).Infof("Archiving %s -> %s from git repository", src, c.Dest)
+				r, closer, err = archiveFromGit(ctx, src, c.Dest, e.TempDir, newDirectoryCheck(ctx, e.Client, e.pathCache(), container.ID), opts)
+			case len(c.From) > 0 && e.NamedContexts[c.From] != nil && e.NamedContexts[c.From].isLocal():
+				r, closer, err = e.archiveFromNamedContext(ctx, e.NamedContexts[c.From], src, c.Dest, container.ID, opts)
+			case len(c.From) > 0:
 				if !assumeDstIsDirectory {
 					var err error
-					if assumeDstIsDirectory, err = e.isContainerGlobMultiple(e.Client, c.From, src); err != nil {
+					if assumeDstIsDirectory, err = e.isContainerGlobMultiple(ctx, e.Client, c.From, src); err != nil {
 						return err
 					}
 				}
-				r, closer, err = e.archiveFromContainer(c.From, src, c.Dest, assumeDstIsDirectory)
-			} else {
-				r, closer, err = e.Archive(c.FromFS, src, c.Dest, c.Download, excludes)
+				r, closer, err = e.archiveFromContainer(ctx, c.From, src, c.Dest, assumeDstIsDirectory, opts)
+			default:
+				r, closer, err = e.archive(ctx, c.FromFS, src, c.Dest, c.Download, excludes, opts)
 			}
 			if err != nil {
 				return err
@@ -1121,7 +1814,7 @@ func (e *ClientExecutor) CopyContainer(container *docker.Container, excludes []s
 				// directories with the wrong ownership, so
 				// check for any that don't exist and create
 				// them ourselves
-				missingParents, err := e.findMissingParents(container, c.Dest)
+				missingParents, err := e.findMissingParents(ctx, container, c.Dest)
 				if err != nil {
 					return err
 				}
@@ -1129,7 +1822,7 @@ func (e *ClientExecutor) CopyContainer(container *docker.Container, excludes []s
 					sort.Strings(missingParents)
 					klog.V(5).Infof("Uploading directories %v to %s%s", missingParents, container.ID, asOwner)
 					for _, missingParent := range missingParents {
-						if err := e.createOrReplaceContainerPathWithOwner(missingParent, chownUid, chownGid, nil); err != nil {
+						if err := e.createOrReplaceContainerPathWithOwner(ctx, missingParent, chownUid, chownGid, nil); err != nil {
 							return err
 						}
 					}
@@ -1151,43 +1844,35 @@ func (e *ClientExecutor) CopyContainer(container *docker.Container, excludes []s
 			if klog.V(6) {
 				logArchiveOutput(r, "Archive file for %s")
 			}
-			// add a workaround allow us to notice if a
-			// dstNeedsToBeDirectoryError was returned while
-			// attempting to read the data we're uploading,
-			// indicating that we thought the content would be just
-			// one item, but it actually isn't
-			reader := &readErrorWrapper{Reader: r}
-			r = reader
-			err = e.Client.UploadToContainer(container.ID, docker.UploadToContainerOptions{
-				InputStream: r,
-				Path:        "/",
-			})
+			// every source is added to the same upload, which is
+			// only finished when something needs to see the content
+			n, err := e.upload(ctx, container, c.Dest, r)
+			if err == nil {
+				e.emit(Event{Type: EventUpload, Destination: c.Dest, Bytes: n})
+			}
 			if err := closer.Close(); err != nil {
 				klog.Errorf("Error while closing stream container copy stream %s: %v", container.ID, err)
 			}
 			if err != nil {
-				if errors.Is(reader.err, dstNeedsToBeDirectoryError) && !assumeDstIsDirectory {
+				// the mapper noticed that the content is more than
+				// one item, so the destination has to be a directory
+				if errors.Is(err, dstNeedsToBeDirectoryError) && !assumeDstIsDirectory {
 					assumeDstIsDirectory = true
+					// this is the only source, and what it
+					// copied will be replaced
+					opts.links = newHardlinks()
 					goto repeatThisSrc
 				}
-				if apiErr, ok := err.(*docker.Error); ok && apiErr.Status == 404 {
-					klog.V(4).Infof("path %s did not exist in container %s: %v", src, container.ID, err)
-				}
 				return err
 			}
 		}
 	}
-	return nil
-}
-
-type readErrorWrapper struct {
-	io.Reader
-	err error
-}
-
-func (r *readErrorWrapper) Read(p []byte) (n int, err error) {
-	n, r.err = r.Reader.Read(p)
-	return n, r.err
+	// later COPY instructions can add to the upload, but anything else
+	// needs the content to be in the container
+	if e.batchUploads && e.Container != nil && container.ID == e.Container.ID {
+		return nil
+	}
+	return e.flushUploads()
 }
 
 type closers []func() error
@@ -1202,9 +1887,17 @@ func (c closers) Close() error {
 	return lastErr
 }
 
-func (e *ClientExecutor) archiveFromContainer(from string, src, dst string, multipleSources bool) (io.Reader, io.Closer, error) {
+func (e *ClientExecutor) archiveFromContainer(ctx context.Context, from string, src, dst string, multipleSources bool, opts copyOptions) (io.Reader, io.Closer, error) {
 	var containerID string
-	if other, ok := e.Named[from]; ok {
+	named, isNamedContext := e.NamedContexts[from]
+	if isNamedContext {
+		image, err := e.namedContextImage(ctx, from, named, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		from = image
+	}
+	if other, ok := e.Named[from]; ok && !isNamedContext {
 		if other.Container == nil {
 			return nil, nil, fmt.Errorf("the stage %q has not been built yet", from)
 		}
@@ -1212,7 +1905,7 @@ func (e *ClientExecutor) archiveFromContainer(from string, src, dst string, mult
 		containerID = other.Container.ID
 	} else {
 		klog.V(5).Infof("Creating a container temporarily for image input from %q in %s", from, src)
-		_, err := e.LoadImage(from)
+		_, err := e.LoadImageWithPlatformContext(ctx, from, "")
 		if err != nil {
 			return nil, nil, err
 		}
@@ -1220,6 +1913,7 @@ func (e *ClientExecutor) archiveFromContainer(from string, src, dst string, mult
 			Config: &docker.Config{
 				Image: from,
 			},
+			Context: ctx,
 		})
 		if err != nil {
 			return nil, nil, err
@@ -1228,7 +1922,7 @@ func (e *ClientExecutor) archiveFromContainer(from string, src, dst string, mult
 		e.Deferred = append([]func() error{func() error { return e.removeContainer(containerID) }}, e.Deferred...)
 	}
 
-	check := newDirectoryCheck(e.Client, e.Container.ID)
+	check := newDirectoryCheck(ctx, e.Client, e.pathCache(), e.Container.ID)
 	pr, pw := io.Pipe()
 	var archiveRoot string
 	fetch := func(pw *io.PipeWriter) {
@@ -1236,10 +1930,11 @@ func (e *ClientExecutor) archiveFromContainer(from string, src, dst string, mult
 		err := e.Client.DownloadFromContainer(containerID, docker.DownloadFromContainerOptions{
 			OutputStream: pw,
 			Path:         archiveRoot,
+			Context:      ctx,
 		})
 		pw.CloseWithError(err)
 	}
-	ar, archiveRoot, err := archiveFromContainer(pr, src, dst, nil, check, fetch, multipleSources)
+	ar, archiveRoot, err := archiveFromContainer(pr, src, dst, nil, check, fetch, multipleSources, opts)
 	if err != nil {
 		pr.Close()
 		pw.Close()
@@ -1257,8 +1952,8 @@ func (e *ClientExecutor) archiveFromContainer(from string, src, dst string, mult
 	return &readCloser{Reader: ar, Closer: closer}, pr, nil
 }
 
-func (e *ClientExecutor) isContainerGlobMultiple(client *docker.Client, from, glob string) (bool, error) {
-	reader, closer, err := e.archiveFromContainer(from, glob, "/ignored", true)
+func (e *ClientExecutor) isContainerGlobMultiple(ctx context.Context, client *docker.Client, from, glob string) (bool, error) {
+	reader, closer, err := e.archiveFromContainer(ctx, from, glob, "/ignored", true, copyOptions{})
 	if err != nil {
 		return false, nil
 	}
@@ -1303,36 +1998,56 @@ func (e *ClientExecutor) isContainerGlobMultiple(client *docker.Client, from, gl
 }
 
 func (e *ClientExecutor) Archive(fromFS bool, src, dst string, allowDownload bool, excludes []string) (io.Reader, io.Closer, error) {
+	return e.archive(context.Background(), fromFS, src, dst, allowDownload, excludes, copyOptions{})
+}
+
+func (e *ClientExecutor) archive(ctx context.Context, fromFS bool, src, dst string, allowDownload bool, excludes []string, opts copyOptions) (io.Reader, io.Closer, error) {
 	var check DirectoryCheck
 	if e.Container != nil {
-		check = newDirectoryCheck(e.Client, e.Container.ID)
+		check = newDirectoryCheck(ctx, e.Client, e.pathCache(), e.Container.ID)
+	}
+	if e.isGitSource(src) {
+		if !allowDownload {
+			return nil, nil, fmt.Errorf("source can't be a git repository")
+		}
+		klog.V(5).Infof("Archiving %s -> %s from git repository", src, dst)
+		return archiveFromGit(ctx, src, dst, e.TempDir, check, opts)
 	}
 	if isURL(src) {
 		if !allowDownload {
 			return nil, nil, fmt.Errorf("source can't be a URL")
 		}
 		klog.V(5).Infof("Archiving %s -> %s from URL", src, dst)
-		return archiveFromURL(src, dst, e.TempDir, check)
+		return archiveFromURL(ctx, src, dst, e.TempDir, check, e.Downloader)
 	}
 	// the input is from the filesystem, use the source as the input
 	if fromFS {
 		klog.V(5).Infof("Archiving %s %s -> %s from a filesystem location", src, ".", dst)
-		return archiveFromDisk(src, ".", dst, allowDownload, excludes, check)
+		return archiveFromDisk(src, ".", dst, allowDownload, excludes, check, opts)
 	}
-	// if the context is in archive form, read from it without decompressing
+	// if the context is in archive form, read from its index, which is only
+	// created once
 	if len(e.ContextArchive) > 0 {
 		klog.V(5).Infof("Archiving %s %s -> %s from context archive", e.ContextArchive, src, dst)
-		return archiveFromFile(e.ContextArchive, src, dst, excludes, check)
+		index, err := e.contextIndex()
+		if err != nil {
+			return nil, nil, err
+		}
+		return archiveFromIndex(index, src, dst, excludes, check, opts)
 	}
 	// if the context is a directory, we only allow relative includes
 	klog.V(5).Infof("Archiving %q %q -> %q from disk", e.Directory, src, dst)
-	return archiveFromDisk(e.Directory, src, dst, allowDownload, excludes, check)
+	return archiveFromDisk(e.Directory, src, dst, allowDownload, excludes, check, opts)
 }
 
 // ContainerVolumeTracker manages tracking archives of specific paths inside a container.
 type ContainerVolumeTracker struct {
 	paths map[string]string
 	errs  []error
+	// idMappings translates the owner of the files which are written to
+	// replace a path before it is restored. Snapshots are restored with
+	// the IDs which the daemon archived them with.
+	idMappings *idtools.IDMappings
 }
 
 func NewContainerVolumeTracker() *ContainerVolumeTracker {
@@ -1445,109 +2160,159 @@ func filterTarPipe(w *tar.Writer, r *tar.Reader, fn func(*tar.Header) bool) erro
 }
 
 // snapshotPath preserves the contents of path in container containerID as a temporary
-// archive, returning either an error or the path of the archived file.
+// archive, returning either an error or the path of the archived file. The
+// archive's entries are named relative to the root of the container, and
+// include path itself, so that its metadata can be restored too.
 func snapshotPath(path, containerID, tempDir string, client *docker.Client) (string, error) {
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	return snapshotContainerPath(path, containerID, tempDir, client)
+}
+
+// snapshotContainerPath archives path in container containerID as snapshotPath
+// does, except that path can be something other than a directory. If path ends
+// with a slash, a symbolic link there is followed.
+func snapshotContainerPath(path, containerID, tempDir string, client *docker.Client) (string, error) {
 	f, err := ioutil.TempFile(tempDir, "archived-path")
 	if err != nil {
 		return "", err
 	}
 	klog.V(4).Infof("Snapshot %s for later use under %s", path, f.Name())
 
+	root := strings.TrimPrefix(filepath.Clean(path), "/")
 	r, w := io.Pipe()
 	tr := tar.NewReader(r)
 	tw := tar.NewWriter(f)
+	done := make(chan error, 1)
 	go func() {
 		err := filterTarPipe(tw, tr, func(h *tar.Header) bool {
+			// the daemon names entries after the base name of path
+			name := ""
 			if i := strings.Index(h.Name, "/"); i != -1 {
-				h.Name = h.Name[i+1:]
+				name = strings.TrimSuffix(h.Name[i+1:], "/")
+			}
+			if len(name) == 0 {
+				h.Name = root
+				if h.Typeflag == tar.TypeDir {
+					h.Name += "/"
+				}
+				return true
 			}
-			return len(h.Name) > 0
+			h.Name = root + "/" + name
+			if h.Typeflag == tar.TypeDir {
+				h.Name += "/"
+			}
+			return true
 		})
 		if err == nil || errors.Is(err, io.EOF) {
-			tw.Flush()
-			w.Close()
-			klog.V(5).Infof("Snapshot rewritten from %s", path)
-			return
+			err = tw.Close()
 		}
-		klog.V(5).Infof("Snapshot of %s failed: %v", path, err)
-		w.CloseWithError(err)
+		if err == nil {
+			// consume anything which follows the end of the archive
+			_, err = io.Copy(ioutil.Discard, r)
+		}
+		// unblock the download if the snapshot can't be written
+		r.CloseWithError(err)
+		done <- err
 	}()
 
-	if !strings.HasSuffix(path, "/") {
-		path += "/"
-	}
 	err = client.DownloadFromContainer(containerID, docker.DownloadFromContainerOptions{
 		Path:         path,
 		OutputStream: w,
 	})
-	f.Close()
+	w.CloseWithError(err)
+	// the snapshot is complete once the archive has been rewritten
+	if rewriteErr := <-done; err == nil && rewriteErr != nil {
+		err = fmt.Errorf("unable to rewrite snapshot of %s: %v", path, rewriteErr)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		klog.V(5).Infof("Snapshot of %s failed: %v", path, err)
 		os.Remove(f.Name())
 		return "", err
 	}
+	klog.V(5).Infof("Snapshot rewritten from %s", path)
 	return f.Name(), nil
 }
 
-// Restore ensures the paths managed by t exactly match the container. This requires running
-// exec as a user that can delete contents from the container. It will return an error if
-// any client operation fails.
+// Restore ensures the paths managed by t exactly match the container. Each
+// path is replaced by uploading an archive which first replaces it with an
+// empty file, which the daemon does by removing it and everything in it, and
+// then recreates it from its snapshot. No programs in the container are used,
+// and the ownership, permissions, timestamps and extended attributes which the
+// daemon recorded in the snapshot are restored. A path which is a mount point
+// can't be removed, so its snapshot is uploaded over what is there, and files
+// which were added beneath it are left in place. It will return an error if any
+// client operation fails.
 func (t *ContainerVolumeTracker) Restore(containerID string, client *docker.Client) error {
 	if t == nil {
 		return nil
 	}
+	var mounts map[string]struct{}
 	for dest, archivePath := range t.paths {
 		if len(archivePath) == 0 {
 			return fmt.Errorf("path %s does not have an archive and cannot be restored", dest)
 		}
-		klog.V(4).Infof("Restoring contents of %s from %s", dest, archivePath)
-		if !strings.HasSuffix(dest, "/") {
-			dest = dest + "/"
-		}
-		exec, err := client.CreateExec(docker.CreateExecOptions{
-			Container: containerID,
-			Cmd:       []string{"/bin/sh", "-c", "rm -rf $@", "", dest + "*"},
-			User:      "0",
-		})
-		if err != nil {
-			return fmt.Errorf("unable to setup clearing preserved path %s: %v", dest, err)
-		}
-		if err := client.StartExec(exec.ID, docker.StartExecOptions{}); err != nil {
-			return fmt.Errorf("unable to clear preserved path %s: %v", dest, err)
-		}
-		var status *docker.ExecInspect
-		for status == nil {
-			status, err = client.InspectExec(exec.ID)
+		if mounts == nil {
+			container, err := client.InspectContainer(containerID)
 			if err != nil {
-				break
+				return fmt.Errorf("unable to find the mounts of the build container: %v", err)
 			}
-			if !status.Running {
-				break
+			mounts = make(map[string]struct{})
+			for _, m := range container.Mounts {
+				mounts[filepath.Clean(m.Destination)] = struct{}{}
 			}
-			status = nil
 		}
-		if err != nil {
-			return fmt.Errorf("clearing preserved path %s did not succeed: %v", dest, err)
+		klog.V(4).Infof("Restoring contents of %s from %s", dest, archivePath)
+		_, mounted := mounts[filepath.Clean(dest)]
+		if mounted {
+			klog.Warningf("Preserved path %s is a mount point, so files added beneath it will not be removed", dest)
 		}
-		if status.ExitCode != 0 {
-			return fmt.Errorf("clearing preserved path %s failed with exit code %d", dest, status.ExitCode)
+		if err := restorePath(dest, archivePath, !mounted, t.idMappings, containerID, client); err != nil {
+			return err
 		}
-		err = func() error {
-			f, err := os.Open(archivePath)
-			if err != nil {
-				return fmt.Errorf("unable to open archive %s for preserved path %s: %v", archivePath, dest, err)
-			}
-			defer f.Close()
-			if err := client.UploadToContainer(containerID, docker.UploadToContainerOptions{
-				InputStream: f,
-				Path:        dest,
-			}); err != nil {
-				return fmt.Errorf("unable to upload preserved contents from %s to %s: %v", archivePath, dest, err)
-			}
-			return nil
-		}()
-		if err != nil {
+	}
+	return nil
+}
+
+// restorePath uploads the snapshot of dest in archivePath to the container.
+// If replace is true, dest is replaced by an empty file first, so that
+// anything which isn't in the snapshot is removed.
+func restorePath(dest, archivePath string, replace bool, idMappings *idtools.IDMappings, containerID string, client *docker.Client) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("unable to open archive %s for preserved path %s: %v", archivePath, dest, err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if replace {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		h := &tar.Header{
+			Name:     strings.TrimPrefix(filepath.Clean(dest), "/"),
+			Typeflag: tar.TypeReg,
+			Mode:     0o600,
+		}
+		if err := mapToHost(idMappings, h); err != nil {
 			return err
 		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		// don't write the end of the archive, since the snapshot follows
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		r = io.MultiReader(buf, f)
+	}
+	if err := client.UploadToContainer(containerID, docker.UploadToContainerOptions{
+		InputStream: r,
+		Path:        "/",
+	}); err != nil {
+		return fmt.Errorf("unable to upload preserved contents from %s to %s: %v", archivePath, dest, err)
 	}
 	return nil
 }
@@ -0,0 +1,1023 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+
+	"github.com/openshift/imagebuilder"
+)
+
+func TestStagesAfter(t *testing.T) {
+	testCases := []struct {
+		dockerfile string
+		after      []string
+		err        string
+	}{
+		{
+			dockerfile: "FROM busybox AS first\nFROM --after=first busybox\n",
+			after:      []string{"", "first"},
+		},
+		{
+			dockerfile: "FROM busybox\nFROM busybox\nFROM --after=0 busybox AS last\n",
+			after:      []string{"", "", "0"},
+		},
+		{
+			dockerfile: "ARG STAGE=first\nFROM busybox AS first\nFROM --after=$STAGE busybox\n",
+			after:      []string{"", "first"},
+		},
+		{
+			dockerfile: "FROM busybox AS first\nFROM --after=missing busybox\n",
+			err:        "Unable to find stage missing",
+		},
+		{
+			dockerfile: "FROM --after=second busybox AS first\nFROM busybox AS second\n",
+			err:        "not an earlier stage",
+		},
+		{
+			dockerfile: "FROM busybox AS first\nFROM --after=second busybox AS second\n",
+			err:        "not an earlier stage",
+		},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			node, err := imagebuilder.ParseDockerfile(strings.NewReader(testCase.dockerfile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := imagebuilder.NewBuilder(nil)
+			stages, err := imagebuilder.NewStages(node, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if testCase.err != "" {
+				// the error has to be caught before anything is built, which
+				// would require a client
+				_, err := NewClientExecutor(nil).Stages(b, stages, "")
+				if err == nil || !strings.Contains(err.Error(), testCase.err) {
+					t.Fatalf("expected error containing %q, got %v", testCase.err, err)
+				}
+				return
+			}
+			for j, stage := range stages {
+				after, err := stageAfter(b, stage)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if after != testCase.after[j] {
+					t.Errorf("stage %d: expected --after=%q, got %q", j, testCase.after[j], after)
+				}
+				// the FROM instruction should still be there to be processed
+				if len(stage.Node.Children) == 0 || stage.Node.Children[0].Value != "from" {
+					t.Errorf("stage %d: FROM instruction was consumed", j)
+				}
+			}
+		})
+	}
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	node, err := imagebuilder.ParseDockerfile(strings.NewReader("FROM busybox\nRUN sleep 100\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := imagebuilder.NewBuilder(nil)
+	if _, err := b.From(node); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	err = NewClientExecutor(nil).ExecuteContext(ctx, b, node)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "RUN sleep 100 (line 2): timed out after") {
+		t.Errorf("expected the error to name the instruction and its line, got %v", err)
+	}
+	var stepErr *imagebuilder.StepError
+	if !errors.As(err, &stepErr) {
+		t.Fatalf("expected a step error, got %T", err)
+	}
+	if stepErr.StartLine != 2 || stepErr.EndLine != 2 || stepErr.Original != "RUN sleep 100" {
+		t.Errorf("unexpected step error location: %#v", stepErr)
+	}
+}
+
+func TestExecuteBreakpoint(t *testing.T) {
+	node, err := imagebuilder.ParseDockerfile(strings.NewReader("FROM busybox\nENV A=B\nUSER nobody\nLABEL a=b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := imagebuilder.NewBuilder(nil)
+	if _, err := b.From(node); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	in := strings.NewReader("\nremaining")
+	e := NewClientExecutor(nil)
+	e.Container = &docker.Container{ID: "abc123"}
+	e.Breakpoints = []int{4}
+	e.DebugIn = in
+	e.Out, e.ErrOut = &out, &out
+	if err := e.Execute(b, node); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"Paused before LABEL a=b (line 4)", "Container:  abc123", "User:       nobody", "Env:        A=B"} {
+		if !strings.Contains(out.String(), expect) {
+			t.Errorf("expected output to contain %q, got:\n%s", expect, out.String())
+		}
+	}
+	if in.Len() != len("remaining") {
+		t.Errorf("expected only one line of input to be read, %d bytes remain", in.Len())
+	}
+}
+
+func TestExecuteKeepOnFailure(t *testing.T) {
+	node, err := imagebuilder.ParseDockerfile(strings.NewReader("FROM busybox\nENV A=B\nUSER\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := imagebuilder.NewBuilder(nil)
+	if _, err := b.From(node); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	e := NewClientExecutor(nil)
+	e.Container = &docker.Container{ID: "abc123"}
+	e.KeepOnFailure = true
+	e.Out, e.ErrOut = &out, &out
+	if err := e.Execute(b, node); err == nil {
+		t.Fatal("expected the build to fail")
+	}
+	for _, expect := range []string{"USER (line 3) failed, the build container has been kept", "Container:  abc123", "Env:        A=B", "docker rm -f abc123"} {
+		if !strings.Contains(out.String(), expect) {
+			t.Errorf("expected output to contain %q, got:\n%s", expect, out.String())
+		}
+	}
+	// the client is nil, so this would panic if it tried to remove the container
+	if err := e.removeContainer("abc123"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecuteDebugShellOnFailure(t *testing.T) {
+	node, err := imagebuilder.ParseDockerfile(strings.NewReader("FROM busybox\nENV A=B\nUSER\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := imagebuilder.NewBuilder(nil)
+	if _, err := b.From(node); err != nil {
+		t.Fatal(err)
+	}
+	var exec docker.CreateExecOptions
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version"):
+			fmt.Fprint(w, `{"Version":"28.0.0","ApiVersion":"1.44"}`)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/containers/abc123/exec"):
+			json.NewDecoder(r.Body).Decode(&exec)
+			http.Error(w, "no shell today", http.StatusInternalServerError)
+		default:
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+
+	var out bytes.Buffer
+	e := NewClientExecutor(client)
+	e.Container = &docker.Container{ID: "abc123", State: docker.State{Running: true}}
+	e.DebugShell = []string{"/bin/sh"}
+	e.Out, e.ErrOut = &out, &out
+	if err := e.Execute(b, node); err == nil {
+		t.Fatal("expected the build to fail")
+	}
+	for _, expect := range []string{"USER (line 3) failed\n", "Container:  abc123", "Env:        A=B", "Unable to start a shell in the build container"} {
+		if !strings.Contains(out.String(), expect) {
+			t.Errorf("expected output to contain %q, got:\n%s", expect, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "docker rm -f") {
+		t.Errorf("expected the build container not to be kept, got:\n%s", out.String())
+	}
+	if !reflect.DeepEqual(exec.Cmd, []string{"/bin/sh"}) || !reflect.DeepEqual(exec.Env, []string{"A=B"}) {
+		t.Errorf("unexpected debug shell: %#v", exec)
+	}
+	if e.keptContainer != "" {
+		t.Errorf("expected the build container to be removed, but %s was kept", e.keptContainer)
+	}
+}
+
+func TestExecuteRunTimeoutNotDebugged(t *testing.T) {
+	node, err := imagebuilder.ParseDockerfile(strings.NewReader("FROM busybox\nRUN sleep 60\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := imagebuilder.NewBuilder(nil)
+	if _, err := b.From(node); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	execs, kills := 0, 0
+	release := make(chan struct{})
+	defer close(release)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/version"):
+			fmt.Fprint(w, `{"Version":"28.0.0","ApiVersion":"1.44"}`)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/containers/abc123/exec"):
+			execs++
+			fmt.Fprint(w, `{"Id":"sleep"}`)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/exec/sleep/start"):
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
+			// the command never finishes
+			go func() {
+				<-release
+				conn.Close()
+			}()
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/containers/abc123/kill"):
+			kills++
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+
+	var out bytes.Buffer
+	e := NewClientExecutor(client)
+	e.Container = &docker.Container{ID: "abc123", State: docker.State{Running: true}}
+	e.Volumes = NewContainerVolumeTracker()
+	e.RunTimeout = 100 * time.Millisecond
+	e.KeepOnFailure = true
+	e.DebugShell = []string{"/bin/sh"}
+	e.Out, e.ErrOut = &out, &out
+	err = e.Execute(b, node)
+	if !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, errRunKilled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if kills != 1 {
+		t.Errorf("expected the build container to be killed once, got %d", kills)
+	}
+	if execs != 1 {
+		t.Errorf("expected no debug shell to be started, got %d execs", execs)
+	}
+	if !strings.Contains(out.String(), "RUN sleep 60 (line 2) timed out and the build container was killed, so it can't be debugged") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+	if e.keptContainer != "" || strings.Contains(out.String(), "docker rm -f") {
+		t.Errorf("expected the killed build container not to be kept, got:\n%s", out.String())
+	}
+}
+
+func TestExecSupportsEnvironment(t *testing.T) {
+	testCases := []struct {
+		version   string
+		requested string
+		expect    bool
+	}{
+		{version: "1.24", expect: false},
+		{version: "1.34", expect: false},
+		{version: "1.35", expect: true},
+		{version: "1.44", expect: true},
+		{version: "", expect: false},
+		{version: "1.44", requested: "1.30", expect: false},
+		{version: "1.44", requested: "1.35", expect: true},
+		{version: "1.34", requested: "1.40", expect: false},
+		{version: "1.35", requested: "1.44", expect: true},
+	}
+	for i, test := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if test.version == "" {
+					http.Error(w, "unavailable", http.StatusInternalServerError)
+					return
+				}
+				fmt.Fprintf(w, `{"Version":"28.0.0","ApiVersion":%q}`, test.version)
+			}))
+			defer server.Close()
+			client, err := docker.NewVersionedClient(server.URL, test.requested)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.SkipServerVersionCheck = true
+			e := NewClientExecutor(client)
+			if test.requested != "" {
+				if e.APIVersion, err = docker.NewAPIVersion(test.requested); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for j := 0; j < 2; j++ {
+				if supported := e.execSupportsEnvironment(context.Background()); supported != test.expect {
+					t.Errorf("expected %t for version %q requested as %q, got %t", test.expect, test.version, test.requested, supported)
+				}
+			}
+			if test.version != "" && requests != 1 {
+				t.Errorf("expected the version to be requested once, got %d requests", requests)
+			}
+		})
+	}
+}
+
+func TestShellEnvironment(t *testing.T) {
+	shell := []string{"/bin/sh", "-c"}
+	testCases := []struct {
+		args   []string
+		shell  bool
+		config docker.Config
+		expect []string
+	}{
+		{
+			args:   []string{"/bin/true"},
+			expect: []string{"/bin/true"},
+		},
+		{
+			args:   []string{"/bin/sh", "-c", "make"},
+			shell:  true,
+			config: docker.Config{Env: []string{"A=$b"}, WorkingDir: "/src"},
+			expect: []string{"/bin/sh", "-c", `export "A=\$b"; cd "/src" && make`},
+		},
+		{
+			args:   []string{"/bin/echo", "hello"},
+			config: docker.Config{Env: []string{"A=1"}},
+			expect: []string{"/bin/sh", "-c", `export "A=1"; exec "$@"`, "", "/bin/echo", "hello"},
+		},
+		{
+			args:   []string{"/bin/echo", "hello"},
+			config: docker.Config{WorkingDir: "/work dir"},
+			expect: []string{"/bin/sh", "-c", `cd "/work dir" && exec "$@"`, "", "/bin/echo", "hello"},
+		},
+	}
+	for i, test := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			args := shellEnvironment(test.args, test.shell, shell, test.config)
+			if !reflect.DeepEqual(test.expect, args) {
+				t.Errorf("expected %q, got %q", test.expect, args)
+			}
+		})
+	}
+}
+
+func TestDescribeTimeout(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-expired.Done()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	e := &ClientExecutor{StageTimeout: time.Minute, BuildTimeout: time.Hour}
+	testCases := []struct {
+		build, stage context.Context
+		expect       string
+	}{
+		{build: context.Background(), stage: context.Background(), expect: "failed"},
+		{build: context.Background(), stage: cancelled, expect: "failed"},
+		{build: context.Background(), stage: expired, expect: "stage first exceeded its timeout of 1m0s: failed"},
+		{build: expired, stage: expired, expect: "build exceeded its timeout of 1h0m0s: failed"},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			err := e.describeTimeout(testCase.build, testCase.stage, "first", errors.New("failed"))
+			if err.Error() != testCase.expect {
+				t.Errorf("expected %q, got %q", testCase.expect, err.Error())
+			}
+		})
+	}
+}
+
+func TestContainerVolumeTrackerRestore(t *testing.T) {
+	testCases := []struct {
+		path    string
+		mounts  []docker.Mount
+		corrupt bool
+		expect  []string
+		err     bool
+	}{
+		{
+			// the path is replaced by a file, and then recreated
+			path:   "/var/lib/data",
+			expect: []string{"0 var/lib/data", "1000 var/lib/data/", "1000 var/lib/data/file", "0 var/lib/data/sub/", "2000 var/lib/data/sub/.hidden"},
+		},
+		{
+			// a mount point can't be replaced, so the snapshot is uploaded
+			// over it, and no program is run in the container
+			path:   "/var/lib/data",
+			mounts: []docker.Mount{{Destination: "/var/lib/data/"}},
+			expect: []string{"1000 var/lib/data/", "1000 var/lib/data/file", "0 var/lib/data/sub/", "2000 var/lib/data/sub/.hidden"},
+		},
+		{
+			path:   "/var/lib/my data",
+			expect: []string{"0 var/lib/my data", "1000 var/lib/my data/", "1000 var/lib/my data/file", "0 var/lib/my data/sub/", "2000 var/lib/my data/sub/.hidden"},
+		},
+		{
+			// a snapshot which can't be read isn't kept
+			path:    "/var/lib/data",
+			corrupt: true,
+			err:     true,
+		},
+	}
+	for i, test := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			var uploadPath string
+			var uploaded []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/containers/build/archive"):
+					if r.URL.Query().Get("path") != test.path+"/" {
+						http.Error(w, "unexpected path", http.StatusBadRequest)
+						return
+					}
+					if test.corrupt {
+						w.Write(bytes.Repeat([]byte("not an archive"), 100))
+						return
+					}
+					base := path.Base(test.path)
+					tw := tar.NewWriter(w)
+					for _, h := range []tar.Header{
+						{Name: base + "/", Typeflag: tar.TypeDir, Uid: 1000, Mode: 0o700},
+						{Name: base + "/file", Typeflag: tar.TypeReg, Uid: 1000, Mode: 0o640, Size: 5},
+						{Name: base + "/sub/", Typeflag: tar.TypeDir, Mode: 0o755},
+						{Name: base + "/sub/.hidden", Typeflag: tar.TypeReg, Uid: 2000, Mode: 0o600},
+					} {
+						h := h
+						tw.WriteHeader(&h)
+						tw.Write(make([]byte, h.Size))
+					}
+					tw.Close()
+				case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/containers/build/archive"):
+					uploadPath = r.URL.Query().Get("path")
+					tr := tar.NewReader(r.Body)
+					for {
+						h, err := tr.Next()
+						if err == io.EOF {
+							break
+						}
+						if err != nil {
+							http.Error(w, err.Error(), http.StatusBadRequest)
+							return
+						}
+						uploaded = append(uploaded, fmt.Sprintf("%d %s", h.Uid, h.Name))
+					}
+				case strings.HasSuffix(r.URL.Path, "/containers/build/json"):
+					fmt.Fprint(w, `{"Id":"build","Mounts":`)
+					json.NewEncoder(w).Encode(test.mounts)
+					fmt.Fprint(w, `}`)
+				default:
+					http.Error(w, "unexpected request "+r.URL.Path, http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+			client, err := docker.NewClient(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.SkipServerVersionCheck = true
+
+			tempDir := t.TempDir()
+			tracker := NewContainerVolumeTracker()
+			tracker.Add(test.path)
+			defer tracker.Release()
+			err = tracker.Save("build", tempDir, client)
+			if test.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+					t.Errorf("expected the failed snapshot to be removed, found %v", entries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tracker.Restore("build", client); err != nil {
+				t.Fatal(err)
+			}
+			if uploadPath != "/" {
+				t.Errorf("expected the archive to be uploaded to /, got %q", uploadPath)
+			}
+			if !reflect.DeepEqual(test.expect, uploaded) {
+				t.Errorf("unexpected archive:\n%q\n%q", test.expect, uploaded)
+			}
+		})
+	}
+}
+
+func TestPathCache(t *testing.T) {
+	testCases := []struct {
+		stat     bool
+		path     string
+		expect   pathInfo
+		requests []string
+	}{
+		{
+			stat:     true,
+			path:     "/usr/bin",
+			expect:   pathInfo{exists: true, dir: true},
+			requests: []string{"HEAD /usr/bin"},
+		},
+		{
+			stat:     true,
+			path:     "/usr/bin/env",
+			expect:   pathInfo{exists: true},
+			requests: []string{"HEAD /usr/bin/env"},
+		},
+		{
+			stat:     true,
+			path:     "/missing",
+			requests: []string{"HEAD /missing"},
+		},
+		{
+			// daemons which can't stat paths have them downloaded instead
+			path:     "/usr/bin",
+			expect:   pathInfo{exists: true, dir: true},
+			requests: []string{"HEAD /usr/bin", "GET /usr/bin"},
+		},
+		{
+			path:     "/missing",
+			requests: []string{"HEAD /missing", "GET /missing"},
+		},
+	}
+	for i, test := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			paths := map[string]*tar.Header{
+				"/usr/bin":     {Name: "bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+				"/usr/bin/env": {Name: "env", Typeflag: tar.TypeReg, Mode: 0o755},
+			}
+			var requests []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path := r.URL.Query().Get("path")
+				requests = append(requests, r.Method+" "+path)
+				if !strings.HasSuffix(r.URL.Path, "/containers/build/archive") {
+					http.Error(w, "unexpected request "+r.URL.Path, http.StatusBadRequest)
+					return
+				}
+				h, ok := paths[path]
+				switch {
+				case r.Method == http.MethodHead && !test.stat:
+					w.WriteHeader(http.StatusMethodNotAllowed)
+				case !ok:
+					w.WriteHeader(http.StatusNotFound)
+				case r.Method == http.MethodHead:
+					data, _ := json.Marshal(containerPathStat{Name: h.Name, Mode: h.FileInfo().Mode()})
+					w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(data))
+				default:
+					tw := tar.NewWriter(w)
+					tw.WriteHeader(h)
+					tw.Close()
+				}
+			}))
+			defer server.Close()
+			client, err := docker.NewClient(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.SkipServerVersionCheck = true
+
+			cache := &pathCache{}
+			for j := 0; j < 2; j++ {
+				info, err := cache.stat(context.Background(), client, "build", test.path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info != test.expect {
+					t.Errorf("expected %#v, got %#v", test.expect, info)
+				}
+			}
+			if !reflect.DeepEqual(requests, test.requests) {
+				t.Errorf("expected requests %v, got %v", test.requests, requests)
+			}
+
+			// once the cache is invalidated, the daemon has to be asked again
+			requests = nil
+			cache.invalidate()
+			if _, err := cache.stat(context.Background(), client, "build", test.path); err != nil {
+				t.Fatal(err)
+			}
+			if len(requests) != 1 {
+				t.Errorf("expected one request after invalidating the cache, got %v", requests)
+			}
+
+			// paths in other containers aren't cached
+			requests = nil
+			if _, err := cache.stat(context.Background(), client, "other", test.path); err == nil || len(requests) == 0 {
+				t.Errorf("expected a failed request for another container, got %v: %v", requests, err)
+			}
+		})
+	}
+}
+
+func TestPathCacheCreated(t *testing.T) {
+	cache := &pathCache{}
+	cache.created("build", "/var/lib/data/")
+	for _, path := range []string{"/", "/var", "/var/lib", "/var/lib/data"} {
+		if info, ok := cache.paths[path]; !ok || info != (pathInfo{exists: true, dir: true}) {
+			t.Errorf("expected %s to be a directory, got %#v", path, info)
+		}
+	}
+	cache.created("other", "/tmp")
+	if _, ok := cache.paths["/var"]; ok {
+		t.Errorf("expected paths in another container to replace the cache")
+	}
+}
+
+func TestUploadsContinue(t *testing.T) {
+	testCases := []struct {
+		dockerfile string
+		expect     bool
+	}{
+		{dockerfile: "COPY a /a\n", expect: true},
+		{dockerfile: "ADD a /a\n", expect: true},
+		{dockerfile: "ENV A=b\nLABEL a=b\nCOPY a /a\n", expect: true},
+		{dockerfile: "RUN true\nCOPY a /a\n", expect: false},
+		{dockerfile: "WORKDIR /a\nCOPY a /a\n", expect: false},
+		{dockerfile: "ENV A=b\n", expect: false},
+		{dockerfile: "", expect: false},
+	}
+	for i, test := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			node, err := imagebuilder.ParseDockerfile(strings.NewReader(test.dockerfile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if continues := uploadsContinue(node.Children); continues != test.expect {
+				t.Errorf("expected %t, got %t", test.expect, continues)
+			}
+		})
+	}
+}
+
+func TestBatchedUploads(t *testing.T) {
+	var lock sync.Mutex
+	var uploads [][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || !strings.HasSuffix(r.URL.Path, "/containers/build/archive") {
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+			return
+		}
+		var names []string
+		tr := tar.NewReader(r.Body)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			names = append(names, h.Name)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		uploads = append(uploads, names)
+	}))
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+
+	e := NewClientExecutor(client)
+	e.Directory = "testdata/dir"
+	e.Container = &docker.Container{ID: "build"}
+	e.batchUploads = true
+	ctx := context.Background()
+	if err := e.CopyContext(ctx, nil, imagebuilder.Copy{Src: []string{"file", "Dockerfile"}, Dest: "/a/"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.CopyContext(ctx, nil, imagebuilder.Copy{Src: []string{"subdir/"}, Dest: "/b/"}); err != nil {
+		t.Fatal(err)
+	}
+	// what was written is known without asking the daemon
+	if info, err := e.pathCache().stat(ctx, client, "build", "/b/file2"); err != nil || info != (pathInfo{exists: true}) {
+		t.Errorf("expected /b/file2 to be a file, got %#v: %v", info, err)
+	}
+	lock.Lock()
+	if len(uploads) != 0 {
+		t.Errorf("expected the upload to be in progress, got %v", uploads)
+	}
+	lock.Unlock()
+
+	e.batchUploads = false
+	if err := e.flushUploads(); err != nil {
+		t.Fatal(err)
+	}
+	expect := [][]string{{"a/file", "a/Dockerfile", "b/", "b/file2"}}
+	if !reflect.DeepEqual(uploads, expect) {
+		t.Errorf("expected uploads %v, got %v", expect, uploads)
+	}
+}
+
+func TestDefaultExcludesFromContextArchive(t *testing.T) {
+	testCases := []struct {
+		files            map[string]string
+		dockerfileIgnore string
+		expect           []string
+	}{
+		{
+			files:  map[string]string{".dockerignore": "subdir\n# comment\n*.txt\n"},
+			expect: []string{"subdir", "*.txt"},
+		},
+		{
+			files:  map[string]string{".dockerignore": "subdir\n", ".containerignore": "other\n"},
+			expect: []string{"other"},
+		},
+		{
+			files: map[string]string{"file": "content"},
+		},
+		{
+			// the Dockerfile's own ignore file is next to it, not in
+			// the archive
+			files:            map[string]string{".dockerignore": "subdir\n"},
+			dockerfileIgnore: "!keep\n",
+			expect:           []string{"!keep"},
+		},
+	}
+	for i, test := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			gz := gzip.NewWriter(buf)
+			tw := tar.NewWriter(gz)
+			for name, content := range test.files {
+				if err := tw.WriteHeader(&tar.Header{Name: "./" + name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(content))}); err != nil {
+					t.Fatal(err)
+				}
+				tw.Write([]byte(content))
+			}
+			tw.Close()
+			gz.Close()
+			dir := t.TempDir()
+			file := filepath.Join(dir, "context.tar.gz")
+			if err := os.WriteFile(file, buf.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			dockerfile := filepath.Join(dir, "Dockerfile")
+			if test.dockerfileIgnore != "" {
+				if err := os.WriteFile(dockerfile+".dockerignore", []byte(test.dockerfileIgnore), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			e := &ClientExecutor{ContextArchive: file, TempDir: dir, Directory: "testdata/ignore"}
+			defer e.Release()
+			if err := e.DefaultExcludesFor(dockerfile); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(e.Excludes, test.expect) {
+				t.Errorf("expected excludes %v, got %v", test.expect, e.Excludes)
+			}
+		})
+	}
+}
+
+func TestUserResolution(t *testing.T) {
+	files := map[string]*tar.Header{
+		"/etc/passwd":      {Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: "passwd.real"},
+		"/etc/passwd.real": {Name: "passwd.real", Typeflag: tar.TypeReg, Mode: 0o644},
+	}
+	const passwd = "root:x:0:0:root:/root:/bin/sh\napp:x:1000:1001::/home/app:/bin/sh\n"
+	var lock sync.Mutex
+	downloads := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !strings.HasSuffix(r.URL.Path, "/containers/build/archive") {
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+			return
+		}
+		name := r.URL.Query().Get("path")
+		lock.Lock()
+		downloads[name]++
+		lock.Unlock()
+		h, ok := files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		h = &tar.Header{Name: h.Name, Typeflag: h.Typeflag, Linkname: h.Linkname, Mode: h.Mode}
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(passwd))
+		}
+		tw := tar.NewWriter(w)
+		tw.WriteHeader(h)
+		if h.Size > 0 {
+			io.WriteString(tw, passwd)
+		}
+		tw.Close()
+	}))
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+	e := NewClientExecutor(client)
+	e.Container = &docker.Container{ID: "build"}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		uid, gid, err := e.getUser(ctx, "app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid != 1000 || gid != 1001 {
+			t.Errorf("unexpected owner %d:%d", uid, gid)
+		}
+		if err := e.checkUser(ctx, "app"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the databases are read once, and a missing one is treated as empty
+	if expect := map[string]int{"/etc/passwd": 1, "/etc/passwd.real": 1, "/etc/group": 1}; !reflect.DeepEqual(expect, downloads) {
+		t.Errorf("unexpected downloads: %v", downloads)
+	}
+	// until something can change them
+	e.users.Invalidate()
+	if _, _, err := e.getUser(ctx, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if downloads["/etc/passwd"] != 2 {
+		t.Errorf("expected the databases to be read again, got %v", downloads)
+	}
+
+	// a USER which a RUN instruction would fail to find fails when it's set
+	node, err := imagebuilder.ParseDockerfile(strings.NewReader("FROM busybox\nUSER missing\nRUN true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := imagebuilder.NewBuilder(nil)
+	if _, err := b.From(node); err != nil {
+		t.Fatal(err)
+	}
+	err = e.ExecuteContext(ctx, b, node)
+	if err == nil || !strings.Contains(err.Error(), "USER missing: unable to find user missing") {
+		t.Fatalf("expected the USER instruction to fail, got %v", err)
+	}
+	var stepErr *imagebuilder.StepError
+	if !errors.As(err, &stepErr) || stepErr.StartLine != 2 {
+		t.Errorf("expected the error to point at the USER instruction, got %#v", err)
+	}
+	if err := e.checkUser(ctx, "4242"); err != nil {
+		t.Errorf("expected a user ID to be accepted, got %v", err)
+	}
+}
+
+func TestPrepareVolumeSemantics(t *testing.T) {
+	buildKit, classic := imagebuilder.VolumeSemanticsBuildKit, imagebuilder.VolumeSemanticsDocker
+	testCases := []struct {
+		builder    imagebuilder.VolumeSemantics
+		executor   *imagebuilder.VolumeSemantics
+		volumes    map[string]struct{}
+		containerd bool
+		expect     string
+		preserved  bool
+	}{
+		// the image's volumes would be mounted in the build container
+		{executor: &buildKit, volumes: map[string]struct{}{"/data": {}}, expect: "sha256:novolumes"},
+		// containerd's image store can't load the copy
+		{executor: &buildKit, volumes: map[string]struct{}{"/data": {}}, containerd: true, expect: "base"},
+		{volumes: map[string]struct{}{"/data": {}}, containerd: true, expect: "base"},
+		// with docker's semantics the volumes are preserved instead
+		{builder: buildKit, executor: &classic, volumes: map[string]struct{}{"/data": {}}, expect: "sha256:novolumes", preserved: true},
+		{volumes: map[string]struct{}{"/data": {}}, expect: "sha256:novolumes", preserved: true},
+		// the Builder's setting is kept unless the executor has one
+		{builder: buildKit, volumes: map[string]struct{}{"/data": {}}, expect: "sha256:novolumes"},
+		// there's nothing to remove
+		{executor: &buildKit, expect: "base"},
+		{expect: "base"},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			var lock sync.Mutex
+			var created string
+			var loaded map[string]json.RawMessage
+			var layers []string
+			var files map[string][]byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				defer lock.Unlock()
+				switch {
+				case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/info"):
+					if testCase.containerd {
+						fmt.Fprint(w, `{"Driver":"overlayfs","DriverStatus":[["driver-type","io.containerd.snapshotter.v1"]]}`)
+					} else {
+						fmt.Fprint(w, `{"Driver":"overlay2","DriverStatus":[["Backing Filesystem","extfs"]]}`)
+					}
+				case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/images/sha256:base/json"):
+					fmt.Fprint(w, `{"Id":"sha256:base","Architecture":"amd64","Os":"linux","Config":{"Env":["A=B"],"Volumes":{"/data":{}}},"RootFS":{"Type":"layers","Layers":["sha256:aaaa"]}}`)
+				case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/images/sha256:base/history"):
+					fmt.Fprint(w, `[{"Id":"sha256:base","Created":1,"CreatedBy":"ADD /","Size":5}]`)
+				case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/images/load"):
+					files = make(map[string][]byte)
+					tr := tar.NewReader(r.Body)
+					for {
+						h, err := tr.Next()
+						if err != nil {
+							break
+						}
+						data, _ := io.ReadAll(tr)
+						files[h.Name] = data
+					}
+					var manifest []imageArchiveManifest
+					json.Unmarshal(files["manifest.json"], &manifest)
+					if len(manifest) == 1 {
+						layers = manifest[0].Layers
+						json.Unmarshal(files[manifest[0].Config], &loaded)
+					}
+				case r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/images/imagebuilder-novolumes-"):
+					fmt.Fprint(w, `{"Id":"sha256:novolumes"}`)
+				case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/containers/create"):
+					var config docker.Config
+					json.NewDecoder(r.Body).Decode(&config)
+					created = config.Image
+					fmt.Fprint(w, `{"Id":"build"}`)
+				case r.Method == http.MethodDelete:
+				default:
+					http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+				}
+			}))
+			defer server.Close()
+			client, err := docker.NewClient(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.SkipServerVersionCheck = true
+
+			e := NewClientExecutor(client)
+			e.TempDir = t.TempDir()
+			e.VolumeSemantics = testCase.executor
+			e.Image = &docker.Image{ID: "sha256:base", Config: &docker.Config{Env: []string{"A=B"}, Volumes: testCase.volumes}}
+			defer e.Release()
+			node, err := imagebuilder.ParseDockerfile(strings.NewReader("FROM base\nLABEL a=b\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := imagebuilder.NewBuilder(nil)
+			b.VolumeSemantics = testCase.builder
+			if err := e.Prepare(b, node, ""); err != nil {
+				t.Fatal(err)
+			}
+			if created != testCase.expect {
+				t.Errorf("expected the build container to be created from %s, got %s", testCase.expect, created)
+			}
+			if _, ok := b.RunConfig.Volumes["/data"]; !ok && len(testCase.volumes) > 0 {
+				t.Errorf("expected the image's volumes to be kept in the builder's configuration, got %v", b.RunConfig.Volumes)
+			}
+			if _, ok := e.volumeTracker().paths["/data"]; ok != testCase.preserved || (!ok && !e.Volumes.Empty()) {
+				t.Errorf("unexpected preserved paths: %v", e.Volumes)
+			}
+			if testCase.expect != "sha256:novolumes" {
+				return
+			}
+			if !reflect.DeepEqual([]string{"aaaa/layer.tar"}, layers) || len(files) != 2 {
+				t.Errorf("expected the copy of the image to have the same layers, got %v", layers)
+			}
+			var config map[string]interface{}
+			json.Unmarshal(loaded["config"], &config)
+			if _, ok := config["Volumes"]; ok || !reflect.DeepEqual([]interface{}{"A=B"}, config["Env"]) {
+				t.Errorf("unexpected configuration of the copy of the image: %s", loaded["config"])
+			}
+			if string(loaded["history"]) != `[{"created":"1970-01-01T00:00:01Z","created_by":"ADD /"}]` {
+				t.Errorf("expected the image's history to be kept, got %s", loaded["history"])
+			}
+		})
+	}
+}
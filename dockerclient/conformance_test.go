@@ -252,6 +252,177 @@ func TestMultiStageBase(t *testing.T) {
 	}
 }
 
+func TestMultiStageAfter(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewClientExecutor(c)
+	defer func() {
+		for _, err := range e.Release() {
+			t.Errorf("%v", err)
+		}
+	}()
+
+	out := &bytes.Buffer{}
+	e.Out, e.ErrOut = out, out
+	node, err := imagebuilder.ParseDockerfile(strings.NewReader(`
+		FROM mirror.gcr.io/busybox AS first
+		RUN echo first
+		FROM --after=first mirror.gcr.io/busybox
+		RUN echo second
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := imagebuilder.NewBuilder(nil)
+	stages, err := imagebuilder.NewStages(node, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Stages(b, stages, ""); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "first\nsecond\n" {
+		t.Errorf("Unexpected build output:\n%s", out.String())
+	}
+	if e.Named["first"].Committed == nil {
+		t.Errorf("expected stage first to have been committed")
+	}
+}
+
+func TestVolumeSemantics(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		semantics  imagebuilder.VolumeSemantics
+		dockerfile string
+		output     string
+	}{
+		{
+			semantics: imagebuilder.VolumeSemanticsDocker,
+			dockerfile: `
+				FROM mirror.gcr.io/busybox
+				VOLUME /data
+				RUN touch /data/kept
+				RUN echo ls && ls /data
+			`,
+			output: "ls\n",
+		},
+		{
+			semantics: imagebuilder.VolumeSemanticsBuildKit,
+			dockerfile: `
+				FROM mirror.gcr.io/busybox
+				VOLUME /data
+				RUN touch /data/kept
+				RUN echo ls && ls /data
+			`,
+			output: "ls\nkept\n",
+		},
+		{
+			// the volume is declared by the base image, so the daemon
+			// would mount it in the build container
+			semantics: imagebuilder.VolumeSemanticsBuildKit,
+			dockerfile: `
+				FROM mirror.gcr.io/busybox AS base
+				VOLUME /data
+				FROM base
+				RUN touch /data/kept
+				RUN echo ls && ls /data
+			`,
+			output: "ls\nkept\n",
+		},
+	}
+	for i, test := range testCases {
+		t.Run(fmt.Sprintf("%d-%s", i, test.semantics), func(t *testing.T) {
+			e := NewClientExecutor(c)
+			defer func() {
+				for _, err := range e.Release() {
+					t.Errorf("%v", err)
+				}
+			}()
+
+			out := &bytes.Buffer{}
+			e.Out, e.ErrOut = out, out
+			e.VolumeSemantics = &test.semantics
+			e.Tag = fmt.Sprintf("conformance%d", rand.Int63())
+			defer e.removeImage(e.Tag)
+			node, err := imagebuilder.ParseDockerfile(strings.NewReader(test.dockerfile))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b := imagebuilder.NewBuilder(nil)
+			stages, err := imagebuilder.NewStages(node, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stageExecutor, err := e.Stages(b, stages, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := stageExecutor.Commit(stages[len(stages)-1].Builder); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != test.output {
+				t.Errorf("Unexpected build output:\n%s", out.String())
+			}
+			// the committed image still declares the volume
+			image, err := c.InspectImage(e.Tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := image.Config.Volumes["/data"]; !ok {
+				t.Errorf("expected the image to declare /data as a volume, got %v", image.Config.Volumes)
+			}
+		})
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewClientExecutor(c)
+	defer func() {
+		for _, err := range e.Release() {
+			t.Errorf("%v", err)
+		}
+	}()
+
+	out := &bytes.Buffer{}
+	e.Out, e.ErrOut = out, out
+	e.RunTimeout = time.Second
+	node, err := imagebuilder.ParseDockerfile(strings.NewReader(`
+		FROM mirror.gcr.io/busybox
+		RUN sleep 60
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := imagebuilder.NewBuilder(nil)
+	stages, err := imagebuilder.NewStages(node, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = e.Stages(b, stages, "")
+	if err == nil || !strings.Contains(err.Error(), "RUN exceeded its timeout of 1s") || !strings.Contains(err.Error(), "(line 3)") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("build took %s to time out", elapsed)
+	}
+}
+
 // TestConformance* compares the result of running the direct build against a
 // sequential docker build. A dockerfile and git repo is loaded, then each step
 // in the file is run sequentially, committing after each step. The generated
@@ -392,6 +563,13 @@ func TestConformanceInternal(t *testing.T) {
 				regexp.MustCompile(`(?m)(\[0m|^)fifth sixth$`),
 			},
 		},
+		{
+			Name:       "run with JSON and environment",
+			Dockerfile: "testdata/Dockerfile.run.env",
+			Output: []*regexp.Regexp{
+				regexp.MustCompile(`(?m)(\[0m|^)it's "quoted"\|` + "`id -u`" + ` and \$HOME\|/tmp/work dir$`),
+			},
+		},
 		{
 			Name:       "shell",
 			Dockerfile: "testdata/Dockerfile.shell",
@@ -441,6 +619,10 @@ func TestConformanceInternal(t *testing.T) {
 			Name:       "volumeexists",
 			Dockerfile: "testdata/Dockerfile.volumeexists",
 		},
+		{
+			Name:       "volume ownership",
+			Dockerfile: "testdata/Dockerfile.volumeownership",
+		},
 		{
 			Name:       "multistage 1",
 			ContextDir: "testdata",
@@ -619,7 +801,7 @@ func TestTransientMount(t *testing.T) {
 	out := &bytes.Buffer{}
 	e.Out = out
 	b := imagebuilder.NewBuilder(nil)
-	node, err := imagebuilder.ParseDockerfile(bytes.NewBufferString("FROM mirror.gcr.io/busybox\nRUN ls /mountdir/subdir\nRUN cat /mountfile\n"))
+	node, err := imagebuilder.ParseDockerfile(bytes.NewBufferString("FROM mirror.gcr.io/busybox\nRUN ls /mountdir/subdir\nRUN cat /mountfile\nRUN echo keepalive: $(ls -A /dev/.imagebuilder)\n"))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -632,6 +814,10 @@ func TestTransientMount(t *testing.T) {
 	if !strings.Contains(out.String(), "file2\n") {
 		t.Errorf("did not find expected output:\n%s", out.String())
 	}
+	// the transient mounts aren't visible next to the keepalive process
+	if !strings.Contains(out.String(), "keepalive: keepalive\n") {
+		t.Errorf("did not find expected output:\n%s", out.String())
+	}
 
 	result, err := testContainerOutput(c, e.Tag, []string{"/bin/sh", "-c", "ls -al /mountdir"})
 	if err != nil {
@@ -649,6 +835,142 @@ func TestTransientMount(t *testing.T) {
 	}
 }
 
+func TestRunMount(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewClientExecutor(c)
+	defer func() {
+		for _, err := range e.Release() {
+			t.Errorf("%v", err)
+		}
+	}()
+
+	out := &bytes.Buffer{}
+	e.Out, e.ErrOut = out, out
+	e.AllowPull = true
+	e.Directory = "testdata"
+	e.NamedContexts = map[string]*NamedContext{"files": {Directory: "testdata/dir"}}
+	e.Tag = fmt.Sprintf("conformance%d", rand.Int63())
+	defer e.removeImage(e.Tag)
+	node, err := imagebuilder.ParseDockerfile(strings.NewReader(`
+		FROM mirror.gcr.io/busybox AS stage
+		RUN mkdir /out && echo staged > /out/file
+		FROM mirror.gcr.io/busybox
+		RUN --mount=from=files,target=/files ls /files/subdir
+		RUN --mount=from=stage,source=/out/file,target=/staged cat /staged
+		RUN --mount=from=files,target=/files touch /files/new 2>/dev/null || echo read-only
+		RUN --mount=target=/context,source=dir cat /context/file
+		RUN --mount=from=files,target=/opt/files ls /opt/files/subdir
+		RUN --mount=from=files,target=/home,rw touch /home/new && ls /home/subdir
+		RUN echo after > /after
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := imagebuilder.NewBuilder(nil)
+	stages, err := imagebuilder.NewStages(node, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stageExecutor, err := e.Stages(b, stages, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stageExecutor.Commit(stages[len(stages)-1].Builder); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"file2\n", "staged\n", "read-only\n"} {
+		if !strings.Contains(out.String(), expect) {
+			t.Errorf("did not find %q in output:\n%s", expect, out.String())
+		}
+	}
+
+	// nothing which was mounted is kept in the image, and what was at a
+	// target beforehand is restored
+	result, err := testContainerOutput(c, e.Tag, []string{"/bin/sh", "-c", "test ! -e /files && test ! -e /staged && test ! -e /context && test ! -e /opt && test -d /home && test ! -L /home && test ! -e /home/new && cat /after"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "after\n" {
+		t.Errorf("unexpected content in the image:\n%s", result)
+	}
+}
+
+func TestCopyLink(t *testing.T) {
+	c, err := docker.NewClientFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewClientExecutor(c)
+	defer func() {
+		for _, err := range e.Release() {
+			t.Errorf("%v", err)
+		}
+	}()
+
+	out := &bytes.Buffer{}
+	e.Out, e.ErrOut = out, out
+	e.AllowPull = true
+	e.Directory = "testdata"
+	e.Tag = fmt.Sprintf("conformance%d", rand.Int63())
+	defer e.removeImage(e.Tag)
+	node, err := imagebuilder.ParseDockerfile(strings.NewReader(`
+		FROM mirror.gcr.io/busybox
+		RUN echo base > /base
+		COPY --link dir /linked/
+		RUN cat /linked/file
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the layer is stacked by loading an archive into the daemon, which
+	// leaves out the layers the daemon already has, unless it can't load
+	// one of those
+	partial := e.loadsPartialImageArchives()
+	b := imagebuilder.NewBuilder(nil)
+	stages, err := imagebuilder.NewStages(node, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stageExecutor, err := e.Stages(b, stages, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stageExecutor.Commit(stages[len(stages)-1].Builder); err != nil {
+		t.Fatal(err)
+	}
+	if warned := strings.Contains(out.String(), "copied without --link"); warned == partial {
+		t.Errorf("expected a warning only if the daemon can't load partial archives (%t):\n%s", partial, out.String())
+	}
+
+	result, err := testContainerOutput(c, e.Tag, []string{"/bin/sh", "-c", "cat /base && ls /linked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "base\nDockerfile\nfile\nsubdir\n" {
+		t.Errorf("unexpected content in the image:\n%s", result)
+	}
+	history, err := c.ImageHistory(e.Tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linked := false
+	for _, h := range history {
+		if strings.Contains(h.CreatedBy, "COPY --link dir /linked/") {
+			linked = true
+		}
+	}
+	if linked != partial {
+		t.Errorf("expected a history entry for the linked layer only if it was stacked (%t): %#v", partial, history)
+	}
+}
+
 func testContainerOutput(c *docker.Client, tag string, command []string) (string, error) {
 	container, err := c.CreateContainer(docker.CreateContainerOptions{
 		Name: tag + "-test",
@@ -0,0 +1,285 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go.podman.io/storage/pkg/archive"
+	"k8s.io/klog"
+)
+
+// buildContext gives every stage of a build access to the same copy of the
+// build context, and of any named contexts. A directory is read in place,
+// since the filesystem already lets any source be found without reading the
+// others, while an archive is indexed once, the first time a source is copied
+// from it.
+type buildContext struct {
+	lock    sync.Mutex
+	indexes map[string]*archiveIndex
+}
+
+// archiveIndex returns the index of the archive file, creating it in tempDir
+// the first time it is needed.
+func (c *buildContext) archiveIndex(file, tempDir string) (*archiveIndex, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if index, ok := c.indexes[file]; ok {
+		return index, nil
+	}
+	index, err := newArchiveIndex(file, tempDir)
+	if err != nil {
+		return nil, err
+	}
+	if c.indexes == nil {
+		c.indexes = make(map[string]*archiveIndex)
+	}
+	c.indexes[file] = index
+	return index, nil
+}
+
+// Close releases the indexes of the archives, if any were created.
+func (c *buildContext) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var lastErr error
+	for file, index := range c.indexes {
+		if err := index.Close(); err != nil {
+			klog.V(4).Infof("Unable to close the index of %s: %v", file, err)
+			lastErr = err
+		}
+	}
+	c.indexes = nil
+	return lastErr
+}
+
+// indexEntry is the header of an entry in an archive, and the offset of its
+// content in the uncompressed archive.
+type indexEntry struct {
+	header *tar.Header
+	offset int64
+}
+
+// archiveIndex is an uncompressed copy of an archive and the location of each
+// of its entries, so that any of them can be read without decompressing or
+// reading through the entries before it.
+type archiveIndex struct {
+	source  string
+	file    *os.File
+	size    int64
+	temp    bool
+	entries []indexEntry
+	// names maps the cleaned name of each entry to its position in
+	// entries. When a name appears more than once, the last entry wins,
+	// as it would when the archive is extracted.
+	names map[string]int
+	// sequential is set if the content of an entry isn't stored in one
+	// piece, so that entries have to be read in order.
+	sequential bool
+}
+
+// newArchiveIndex indexes the archive in file, which may be uncompressed or
+// compressed with any of the formats the daemon accepts for layers. A
+// compressed archive is decompressed into a private spool file in tempDir,
+// which is removed when the index is closed.
+func newArchiveIndex(file, tempDir string) (*archiveIndex, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(10)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("unable to read context archive %s: %v", file, err)
+	}
+
+	index := &archiveIndex{source: file}
+	if compression := archive.DetectCompression(magic); compression == archive.Uncompressed {
+		if index.file, err = os.Open(file); err != nil {
+			return nil, err
+		}
+	} else {
+		klog.V(4).Infof("Decompressing %s context archive %s", compression.Extension(), file)
+		if index.file, err = spoolArchive(f, tempDir); err != nil {
+			return nil, fmt.Errorf("unable to decompress context archive %s: %v", file, err)
+		}
+		index.temp = true
+	}
+
+	// the tar reader reads whole blocks and no further, so once it has read a
+	// header the count is the offset of the entry's content
+	index.names = make(map[string]int)
+	counter := &countingReader{Reader: io.NewSectionReader(index.file, 0, math.MaxInt64)}
+	tr := tar.NewReader(counter)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			index.Close()
+			return nil, fmt.Errorf("unable to index context archive %s: %v", file, err)
+		}
+		if err := checkArchiveEntry(file, h, false); err != nil {
+			index.Close()
+			return nil, err
+		}
+		index.names[path.Clean("/"+h.Name)] = len(index.entries)
+		index.entries = append(index.entries, indexEntry{header: h, offset: counter.n})
+		if isSparse(h) {
+			index.sequential = true
+		}
+	}
+	index.size = counter.n
+	klog.V(4).Infof("Indexed %d entries in context archive %s", len(index.entries), file)
+	return index, nil
+}
+
+// spoolArchive decompresses the archive in f into a file in a directory of
+// its own, created in tempDir, which only the current user can read or write.
+// Nothing which is already in tempDir is trusted, since another user of a
+// shared directory could have put it there.
+func spoolArchive(f *os.File, tempDir string) (*os.File, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	dc, err := archive.DecompressStream(f)
+	if err != nil {
+		return nil, err
+	}
+	defer dc.Close()
+	dir, err := ioutil.TempDir(tempDir, "imagebuilder-context-")
+	if err != nil {
+		return nil, err
+	}
+	spool, err := os.OpenFile(filepath.Join(dir, "context.tar"), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if _, err := io.Copy(spool, dc); err != nil {
+		spool.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		spool.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return spool, nil
+}
+
+// Stat returns the header of the entry in the archive named name, or nil if
+// there isn't one.
+func (i *archiveIndex) Stat(name string) *tar.Header {
+	n, ok := i.names[path.Clean("/"+filepath.ToSlash(name))]
+	if !ok {
+		return nil
+	}
+	h := *i.entries[n].header
+	return &h
+}
+
+// Open returns the content of the entry in the archive named name.
+func (i *archiveIndex) Open(name string) (io.Reader, error) {
+	n, ok := i.names[path.Clean("/"+filepath.ToSlash(name))]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	entry := i.entries[n]
+	if i.sequential {
+		tr := tar.NewReader(i.Reader())
+		for j := 0; j <= n; j++ {
+			if _, err := tr.Next(); err != nil {
+				return nil, err
+			}
+		}
+		return tr, nil
+	}
+	return io.NewSectionReader(i.file, entry.offset, entry.header.Size), nil
+}
+
+// Reader returns the whole uncompressed archive.
+func (i *archiveIndex) Reader() io.Reader {
+	return io.NewSectionReader(i.file, 0, i.size)
+}
+
+// Filter returns an archive of the entries which fn doesn't skip, as
+// transformed by fn. The content of skipped entries is never read.
+func (i *archiveIndex) Filter(fn TransformFileFunc) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		if i.sequential {
+			pw.CloseWithError(FilterArchive(i.Reader(), pw, fn))
+			return
+		}
+		tw := tar.NewWriter(pw)
+		for _, entry := range i.entries {
+			h := *entry.header
+			var body io.Reader = io.NewSectionReader(i.file, entry.offset, h.Size)
+			data, ok, skip, err := fn(&h, body)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if skip {
+				continue
+			}
+			if ok {
+				h.Size = int64(len(data))
+				body = bytes.NewReader(data)
+			}
+			if err := tw.WriteHeader(&h); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(tw, body); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(tw.Close())
+	}()
+	return pr
+}
+
+// isSparse returns true if the content of the entry is stored as a sparse
+// file, which the tar reader expands.
+func isSparse(h *tar.Header) bool {
+	if h.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range h.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes the archive, and removes it if it was decompressed.
+func (i *archiveIndex) Close() error {
+	if i.file == nil {
+		return nil
+	}
+	err := i.file.Close()
+	if i.temp {
+		// the spool is alone in a directory of its own
+		if rmErr := os.RemoveAll(filepath.Dir(i.file.Name())); rmErr != nil && err == nil {
+			err = rmErr
+		}
+	}
+	i.file = nil
+	return err
+}
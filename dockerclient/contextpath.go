@@ -0,0 +1,184 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// maxContextSymlinks is the number of symbolic links which may be followed
+// while resolving one path in the build context, as with MAXSYMLINKS.
+const maxContextSymlinks = 40
+
+// ContextEscapeError is returned when the source of an ADD or COPY instruction
+// would have to be read from outside of the build context.
+type ContextEscapeError struct {
+	// Path is the source, relative to the build context.
+	Path string
+	// Reason describes how the source leads out of the build context.
+	Reason string
+}
+
+func (e *ContextEscapeError) Error() string {
+	return fmt.Sprintf("forbidden path outside the build context: %s (%s)", e.Path, e.Reason)
+}
+
+// UnsafeArchiveEntryError is returned when an archive in the build context,
+// or the build context itself when it is an archive, contains an entry which
+// can't be copied safely.
+type UnsafeArchiveEntryError struct {
+	// Archive is the archive which contains the entry.
+	Archive string
+	// Name is the name of the entry in the archive.
+	Name string
+	// Reason describes what is wrong with the entry.
+	Reason string
+}
+
+func (e *UnsafeArchiveEntryError) Error() string {
+	return fmt.Sprintf("unsafe entry %q in archive %s: %s", e.Name, e.Archive, e.Reason)
+}
+
+// checkContextPath returns a *ContextEscapeError if reading name, a path
+// relative to the build context in root, would leave the build context, either
+// because of its own .. components or by following a symbolic link. Links are
+// followed the way the kernel would, except that a link to an absolute path is
+// never followed, since its target is only meaningful inside an image. The
+// last component of name is only followed if followLast is set, since a link
+// is otherwise copied as a link. A path which doesn't exist is not an error.
+func checkContextPath(root, name string, followLast bool) error {
+	var resolved []string
+	pending := splitContextPath(name)
+	links := 0
+	escape := func() error {
+		if links > 0 {
+			return &ContextEscapeError{Path: name, Reason: "a symbolic link in it leads to a location outside of the context"}
+		}
+		return &ContextEscapeError{Path: name, Reason: "it has more .. components than parent directories"}
+	}
+	for len(pending) > 0 {
+		component := pending[0]
+		pending = pending[1:]
+		if component == ".." {
+			if len(resolved) == 0 {
+				return escape()
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		resolved = append(resolved, component)
+		if len(pending) == 0 && !followLast {
+			break
+		}
+
+		current := path.Join(resolved...)
+		fi, err := os.Lstat(filepath.Join(root, filepath.FromSlash(current)))
+		if err != nil {
+			if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+				// nothing more will be read, but the rest of the
+				// path still has to stay in the context
+				if leavesArchiveRoot(path.Join(append(resolved, pending...)...)) {
+					return escape()
+				}
+				return nil
+			}
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if links++; links > maxContextSymlinks {
+			return &ContextEscapeError{Path: name, Reason: "too many levels of symbolic links"}
+		}
+		target, err := os.Readlink(filepath.Join(root, filepath.FromSlash(current)))
+		if err != nil {
+			return err
+		}
+		if filepath.IsAbs(target) || path.IsAbs(filepath.ToSlash(target)) {
+			return &ContextEscapeError{Path: name, Reason: fmt.Sprintf("%s is a symbolic link to the absolute path %s", current, target)}
+		}
+		resolved = resolved[:len(resolved)-1]
+		pending = append(splitContextPath(target), pending...)
+	}
+	return nil
+}
+
+// splitContextPath splits a path into its components, leaving out empty and
+// "." components.
+func splitContextPath(name string) []string {
+	var components []string
+	for _, component := range strings.Split(filepath.ToSlash(name), "/") {
+		if component == "" || component == "." {
+			continue
+		}
+		components = append(components, component)
+	}
+	return components
+}
+
+// isContextArchive returns true if name, a path relative to the build context
+// in directory, is a regular file that ADD would extract. Links which lead
+// outside of the build context are not followed, so that what they point to
+// is never read.
+func isContextArchive(directory, name string) bool {
+	if checkContextPath(directory, name, true) != nil {
+		return false
+	}
+	fi, err := os.Stat(filepath.Join(directory, name))
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	return isArchivePath(filepath.Join(directory, name))
+}
+
+// checkArchiveEntry returns an *UnsafeArchiveEntryError if h, an entry in the
+// archive named archiveName, would be written anywhere other than under the
+// directory the archive is copied into, or is a device node and devices is
+// not set.
+func checkArchiveEntry(archiveName string, h *tar.Header, devices bool) error {
+	unsafe := func(reason string) error {
+		return &UnsafeArchiveEntryError{Archive: archiveName, Name: h.Name, Reason: reason}
+	}
+	name := filepath.ToSlash(h.Name)
+	switch {
+	case path.IsAbs(name):
+		return unsafe("it has an absolute name")
+	case leavesArchiveRoot(name):
+		return unsafe("its name leads outside of the archive")
+	}
+	switch h.Typeflag {
+	case tar.TypeLink:
+		linkname := filepath.ToSlash(h.Linkname)
+		if path.IsAbs(linkname) || leavesArchiveRoot(linkname) {
+			return unsafe(fmt.Sprintf("it is a hard link to %s, which is outside of the archive", h.Linkname))
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		if !devices {
+			return unsafe("it is a device node")
+		}
+	}
+	return nil
+}
+
+// leavesArchiveRoot returns true if the relative, slash-separated path name
+// has more .. components than parent directories.
+func leavesArchiveRoot(name string) bool {
+	depth := 0
+	for _, component := range strings.Split(name, "/") {
+		switch component {
+		case "", ".":
+		case "..":
+			if depth--; depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+	return false
+}
@@ -0,0 +1,314 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// maliciousContext builds a context directory, with a directory named
+// "outside" next to it holding a file named "secret" and an archive named
+// "secret.tar", neither of which may ever be copied.
+type maliciousContext struct {
+	files    []string
+	links    map[string]string
+	archives map[string]*archiveGenerator
+}
+
+func (c maliciousContext) create(t *testing.T) (string, string) {
+	top := t.TempDir()
+	outside := filepath.Join(top, "outside")
+	secretArchive := newArchiveGenerator().File("secret")
+	for name, content := range map[string]io.Reader{"secret": nil, "secret.tar": secretArchive.Reader()} {
+		f, err := os.Create(filepath.Join(mkdirAll(t, outside), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content != nil {
+			_, err = io.Copy(f, content)
+		} else {
+			_, err = f.WriteString("secret")
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := mkdirAll(t, filepath.Join(top, "context"))
+	for _, name := range c.files {
+		mkdirAll(t, filepath.Dir(filepath.Join(dir, name)))
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range c.links {
+		target = os.Expand(target, func(key string) string { return map[string]string{"outside": outside}[key] })
+		mkdirAll(t, filepath.Dir(filepath.Join(dir, name)))
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, gen := range c.archives {
+		writeArchive(t, filepath.Join(mkdirAll(t, filepath.Dir(filepath.Join(dir, name))), filepath.Base(name)), gen)
+	}
+	return dir, outside
+}
+
+func mkdirAll(t *testing.T, dir string) string {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeArchive(t *testing.T, name string, gen *archiveGenerator) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(f, gen.Reader())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hostileArchives are archives with entries which would be written outside of
+// the directory they're extracted into, or which create device nodes.
+var hostileArchives = []*archiveGenerator{
+	newArchiveGenerator().File("../escaped"),
+	newArchiveGenerator().Dir("a").File("a/../../escaped"),
+	newArchiveGenerator().File("/etc/escaped"),
+	{Headers: []*tar.Header{{Name: "null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}}},
+	{Headers: []*tar.Header{{Name: "sda", Typeflag: tar.TypeBlock, Devmajor: 8}}},
+	{Headers: []*tar.Header{{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}}},
+	{Headers: []*tar.Header{{Name: "shadow", Typeflag: tar.TypeLink, Linkname: "/etc/shadow"}}},
+}
+
+func TestMaliciousContexts(t *testing.T) {
+	testCases := []struct {
+		context       maliciousContext
+		src           string
+		allowDownload bool
+		// escape is set if the source must be rejected with a
+		// *ContextEscapeError, and unsafe if it must be rejected with an
+		// *UnsafeArchiveEntryError
+		escape bool
+		unsafe bool
+		expect []string
+	}{
+		{src: "../outside/secret", escape: true},
+		{src: "a/../../outside/secret", context: maliciousContext{files: []string{"a/file"}}, escape: true},
+		{src: "/../outside/secret", escape: true},
+		{src: "../outside/*", escape: true},
+		{src: "../outside/secret.tar", allowDownload: true, escape: true},
+		{
+			// a directory which links outside of the context
+			context: maliciousContext{links: map[string]string{"escape": "../outside"}},
+			src:     "escape/secret",
+			escape:  true,
+		},
+		{
+			context: maliciousContext{links: map[string]string{"escape": "../outside"}},
+			src:     "escape/*",
+			escape:  true,
+		},
+		{
+			context: maliciousContext{links: map[string]string{"escape": "../outside"}},
+			src:     "escape/secret.tar",
+			escape:  true,
+		},
+		{
+			// links to absolute paths are never followed, even into the
+			// context
+			context: maliciousContext{links: map[string]string{"abs": "${outside}"}},
+			src:     "abs/secret",
+			escape:  true,
+		},
+		{
+			// a chain of links, each of which stays in the context
+			// until the last one is followed
+			context: maliciousContext{files: []string{"sub/file"}, links: map[string]string{"first": "sub/second", "sub/second": "../.."}},
+			src:     "first/outside/secret",
+			escape:  true,
+		},
+		{
+			context: maliciousContext{links: map[string]string{"loop": "loop"}},
+			src:     "loop/file",
+			escape:  true,
+		},
+		{
+			// links are copied as links, so what they point to isn't read
+			context: maliciousContext{links: map[string]string{"secret": "../outside/secret"}},
+			src:     "secret",
+			expect:  []string{"dst"},
+		},
+		{
+			context:       maliciousContext{links: map[string]string{"secret.tar": "../outside/secret.tar"}},
+			src:           "secret.tar",
+			allowDownload: true,
+			expect:        []string{"dst"},
+		},
+		{
+			context:       maliciousContext{links: map[string]string{"secret.tar": "${outside}/secret.tar"}},
+			src:           "secret.tar",
+			allowDownload: true,
+			expect:        []string{"dst"},
+		},
+		{
+			// links which stay in the context can be followed
+			context: maliciousContext{files: []string{"sub/file"}, links: map[string]string{"inside": "sub", "sub/up": ".."}},
+			src:     "inside/up/sub/file",
+			expect:  []string{"dst"},
+		},
+		{
+			context: maliciousContext{files: []string{"sub/file"}, links: map[string]string{"inside": "./sub/../sub"}},
+			src:     "inside/file",
+			expect:  []string{"dst"},
+		},
+	}
+	for i, archive := range hostileArchives {
+		testCases = append(testCases, struct {
+			context       maliciousContext
+			src           string
+			allowDownload bool
+			escape        bool
+			unsafe        bool
+			expect        []string
+		}{
+			context:       maliciousContext{archives: map[string]*archiveGenerator{fmt.Sprintf("hostile%d.tar", i): archive}},
+			src:           fmt.Sprintf("hostile%d.tar", i),
+			allowDownload: true,
+			unsafe:        true,
+		})
+	}
+
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			dir, _ := testCase.context.create(t)
+			var found []string
+			err := func() error {
+				r, c, err := archiveFromDisk(dir, testCase.src, "dst", testCase.allowDownload, nil, testDirectoryCheck(map[string]bool{"dst": false}), copyOptions{})
+				if err != nil {
+					return err
+				}
+				defer c.Close()
+				tr := tar.NewReader(r)
+				for {
+					h, err := tr.Next()
+					if err == io.EOF {
+						return c.Close()
+					}
+					if err != nil {
+						return err
+					}
+					if h.Typeflag == tar.TypeReg {
+						content, err := io.ReadAll(tr)
+						if err != nil {
+							return err
+						}
+						if string(content) == "secret" {
+							t.Errorf("content from outside of the context was copied to %s", h.Name)
+						}
+					}
+					found = append(found, h.Name)
+				}
+			}()
+			var escapeErr *ContextEscapeError
+			var unsafeErr *UnsafeArchiveEntryError
+			switch {
+			case testCase.escape:
+				if !errors.As(err, &escapeErr) {
+					t.Fatalf("expected the source to be rejected as being outside of the context, got %v", err)
+				}
+			case testCase.unsafe:
+				if !errors.As(err, &unsafeErr) {
+					t.Fatalf("expected the archive to be rejected as unsafe, got %v", err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			}
+			sort.Strings(found)
+			if err == nil && fmt.Sprint(found) != fmt.Sprint(testCase.expect) {
+				t.Errorf("unexpected files:\nexpected: %v\nfound:    %v", testCase.expect, found)
+			}
+		})
+	}
+}
+
+func TestMaliciousContextArchives(t *testing.T) {
+	for i, gen := range hostileArchives {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "context.tar")
+			writeArchive(t, file, gen)
+			_, _, err := archiveFromFile(file, ".", "dst", nil, nil, copyOptions{})
+			var unsafeErr *UnsafeArchiveEntryError
+			if !errors.As(err, &unsafeErr) {
+				t.Fatalf("expected the context archive to be rejected as unsafe, got %v", err)
+			}
+			if unsafeErr.Archive != file {
+				t.Errorf("expected the error to name %s, got %v", file, err)
+			}
+		})
+	}
+
+	file := filepath.Join(t.TempDir(), "context.tar")
+	writeArchive(t, file, newArchiveGenerator().File("file"))
+	for _, src := range []string{"../file", "a/../../file"} {
+		_, _, err := archiveFromFile(file, src, "dst", nil, nil, copyOptions{})
+		var escapeErr *ContextEscapeError
+		if !errors.As(err, &escapeErr) {
+			t.Errorf("expected %s to be rejected as being outside of the context, got %v", src, err)
+		}
+	}
+}
+
+func TestCheckContextPath(t *testing.T) {
+	context := maliciousContext{
+		files: []string{"a/b/file"},
+		links: map[string]string{
+			"a/up":       "..",
+			"a/out":      "../..",
+			"a/abs":      "/etc",
+			"a/b/dangle": "missing",
+		},
+	}
+	dir, _ := context.create(t)
+	testCases := []struct {
+		name       string
+		followLast bool
+		escape     bool
+	}{
+		{name: "a/b/file"},
+		{name: "a/up/a/b/file"},
+		{name: "a/up", followLast: true},
+		{name: "a/out"},
+		{name: "a/out", followLast: true, escape: true},
+		{name: "a/out/anything", escape: true},
+		{name: "a/abs"},
+		{name: "a/abs", followLast: true, escape: true},
+		{name: "a/b/dangle/file"},
+		{name: "missing/../../file", escape: true},
+		{name: "./a/./b/../../a/b/file"},
+		{name: "a/b/file/not-a-directory"},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			err := checkContextPath(dir, testCase.name, testCase.followLast)
+			var escapeErr *ContextEscapeError
+			if testCase.escape != errors.As(err, &escapeErr) || (!testCase.escape && err != nil) {
+				t.Errorf("unexpected result checking %s: %v", testCase.name, err)
+			}
+		})
+	}
+}
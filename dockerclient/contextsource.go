@@ -0,0 +1,152 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"k8s.io/klog"
+
+	"github.com/openshift/imagebuilder"
+)
+
+// StdinContext is the build context source which names an archive which is
+// read from standard input.
+const StdinContext = "-"
+
+// IsRemoteContext returns true if source names a build context which has to
+// be fetched by FetchContext before it can be built from: a git repository,
+// an HTTP(S) URL of an archive, or StdinContext.
+func IsRemoteContext(source string) bool {
+	return source == StdinContext || isGitURL(source) || isURL(source)
+}
+
+// FetchContext sets the build context to the one named by source. A git
+// repository is cloned into TempDir and used as Directory, or the
+// subdirectory of it which is named in the URL's fragment, along with the
+// ref to check out (e.g. https://host/repo.git#ref:subdir). An archive which
+// is read from in, if source is StdinContext, or downloaded from an HTTP(S)
+// URL, is written to TempDir and used as ContextArchive. Any other source is
+// used as Directory. Whatever is fetched is removed by Release.
+func (e *ClientExecutor) FetchContext(ctx context.Context, source string, in io.Reader) error {
+	switch {
+	case source == StdinContext:
+		f, err := ioutil.TempFile(e.TempDir, "context-")
+		if err != nil {
+			return fmt.Errorf("unable to create temporary file for the build context: %v", err)
+		}
+		if _, err := io.Copy(f, in); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return fmt.Errorf("unable to read the build context: %v", err)
+		}
+		if err := f.Close(); err != nil {
+			os.Remove(f.Name())
+			return fmt.Errorf("unable to write the build context: %v", err)
+		}
+		return e.useContextArchive(f.Name(), func() error { return os.Remove(f.Name()) })
+
+	case e.isGitSource(source):
+		gitSource, err := parseGitSource(source)
+		if err != nil {
+			return err
+		}
+		dir, commit, err := cloneGitSource(ctx, gitSource, e.TempDir, false)
+		if err != nil {
+			return err
+		}
+		e.Deferred = append(e.Deferred, func() error { return os.RemoveAll(dir) })
+		root := dir
+		if gitSource.Subdir != "" {
+			if err := checkContextPath(dir, gitSource.Subdir, true); err != nil {
+				return err
+			}
+			root = filepath.Join(dir, filepath.FromSlash(gitSource.Subdir))
+			if fi, err := os.Stat(root); err != nil || !fi.IsDir() {
+				return fmt.Errorf("%s is not a directory in %s", gitSource.Subdir, gitSource.Remote)
+			}
+		}
+		klog.V(4).Infof("Using commit %s of %s as the build context", commit, gitSource.Remote)
+		e.Directory, e.ContextArchive = root, ""
+		return nil
+
+	case isURL(source):
+		f, err := e.Downloader.Fetch(ctx, source, e.TempDir)
+		if err != nil {
+			return fmt.Errorf("unable to download the build context: %v", err)
+		}
+		return e.useContextArchive(f.Name(), f.Close)
+
+	default:
+		e.Directory, e.ContextArchive = source, ""
+		return nil
+	}
+}
+
+// useContextArchive sets the build context to the archive in file, which is
+// indexed right away, so that it is read as it was when it was fetched, and
+// which release removes once the build is released.
+func (e *ClientExecutor) useContextArchive(file string, release func() error) error {
+	e.Directory, e.ContextArchive = "", file
+	if _, err := e.contextIndex(); err != nil {
+		release()
+		return err
+	}
+	e.Deferred = append(e.Deferred, release)
+	return nil
+}
+
+// ContextDockerfile returns the location on disk of the Dockerfile named by
+// name, a slash-separated path relative to the top of the build context, or
+// "Dockerfile" if it is empty. If ContextArchive is set, the Dockerfile is
+// written to TempDir, along with the ignore files which are named after it,
+// so that DefaultExcludesFor finds them, and removed by Release.
+func (e *ClientExecutor) ContextDockerfile(name string) (string, error) {
+	if name == "" {
+		name = "Dockerfile"
+	}
+	if len(e.ContextArchive) == 0 {
+		if err := checkContextPath(e.Directory, name, true); err != nil {
+			return "", err
+		}
+		return filepath.Join(e.Directory, filepath.FromSlash(name)), nil
+	}
+	index, err := e.contextIndex()
+	if err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir(e.TempDir, "dockerfile-")
+	if err != nil {
+		return "", fmt.Errorf("unable to create temporary directory for the Dockerfile: %v", err)
+	}
+	e.Deferred = append(e.Deferred, func() error { return os.RemoveAll(dir) })
+	for i, file := range append([]string{name}, imagebuilder.DockerfileIgnoreFiles(name)...) {
+		h := index.Stat(file)
+		if h == nil && i > 0 {
+			continue
+		}
+		if h == nil {
+			return "", fmt.Errorf("unable to find %s in the build context: %w", file, os.ErrNotExist)
+		}
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeRegA {
+			return "", fmt.Errorf("%s in the build context is not a regular file", file)
+		}
+		r, err := index.Open(file)
+		if err != nil {
+			return "", err
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", fmt.Errorf("unable to read %s from the build context: %v", file, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, path.Base(file)), data, 0o600); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, path.Base(name)), nil
+}
@@ -0,0 +1,209 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// contextTestArchive returns a gzipped archive of a build context with a
+// Dockerfile at its top and another, with its own ignore file, in build/.
+func contextTestArchive(t *testing.T) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, entry := range []struct{ name, content string }{
+		{name: "Dockerfile", content: "FROM busybox\n"},
+		{name: ".dockerignore", content: "*.log\n"},
+		{name: "build/Dockerfile.custom", content: "FROM scratch\n"},
+		{name: "build/Dockerfile.custom.dockerignore", content: "secret\n"},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: entry.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(entry.content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "Dockerfile"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetchContextArchive(t *testing.T) {
+	archive := contextTestArchive(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/context.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		source     string
+		dockerfile string
+		content    string
+		excludes   []string
+		err        bool
+	}{
+		{source: StdinContext, content: "FROM busybox\n", excludes: []string{"*.log"}},
+		{source: server.URL + "/context.tar.gz", content: "FROM busybox\n", excludes: []string{"*.log"}},
+		{source: server.URL + "/context.tar.gz", dockerfile: "build/Dockerfile.custom", content: "FROM scratch\n", excludes: []string{"secret"}},
+		{source: StdinContext, dockerfile: "/build/../build/Dockerfile.custom", content: "FROM scratch\n", excludes: []string{"secret"}},
+		{source: StdinContext, dockerfile: "missing", err: true},
+		{source: StdinContext, dockerfile: "link", err: true},
+		{source: server.URL + "/missing.tar.gz", err: true},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			e := NewClientExecutor(nil)
+			e.TempDir = t.TempDir()
+			defer func() {
+				if errs := e.Release(); len(errs) > 0 {
+					t.Errorf("unexpected errors releasing the build: %v", errs)
+				}
+				if entries, err := os.ReadDir(e.TempDir); err != nil || len(entries) != 0 {
+					t.Errorf("expected the build context to be removed, got %v %v", entries, err)
+				}
+			}()
+			err := e.FetchContext(context.Background(), testCase.source, bytes.NewReader(archive))
+			var dockerfile string
+			if err == nil {
+				dockerfile, err = e.ContextDockerfile(testCase.dockerfile)
+			}
+			if err == nil {
+				err = e.DefaultExcludesFor(dockerfile)
+			}
+			if testCase.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(e.ContextArchive) == 0 || len(e.Directory) > 0 {
+				t.Errorf("expected an archive context, got %q %q", e.ContextArchive, e.Directory)
+			}
+			if data, err := os.ReadFile(dockerfile); err != nil || string(data) != testCase.content {
+				t.Errorf("unexpected Dockerfile %s: %q %v", dockerfile, data, err)
+			}
+			if !reflect.DeepEqual(testCase.excludes, e.Excludes) {
+				t.Errorf("expected excludes %v, got %v", testCase.excludes, e.Excludes)
+			}
+		})
+	}
+}
+
+func TestFetchContextGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	repo, _, _ := gitTestRepository(t, t.TempDir())
+
+	testCases := []struct {
+		source     string
+		dockerfile string
+		content    string
+		err        bool
+	}{
+		{source: repo, dockerfile: "README", content: "second"},
+		{source: repo + "#v1", dockerfile: "README", content: "first"},
+		{source: repo + "#main:docs", dockerfile: "index.md", content: "docs"},
+		{source: repo + "#main:docs", dockerfile: "../README", err: true},
+		{source: repo + "#main:README", err: true},
+		{source: repo + "#missing", err: true},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			e := NewClientExecutor(nil)
+			e.TempDir = t.TempDir()
+			e.AllowLocalGitRepositories = true
+			defer func() {
+				e.Release()
+				if entries, err := os.ReadDir(e.TempDir); err != nil || len(entries) != 0 {
+					t.Errorf("expected the build context to be removed, got %v %v", entries, err)
+				}
+			}()
+			err := e.FetchContext(context.Background(), testCase.source, nil)
+			var dockerfile string
+			if err == nil {
+				dockerfile, err = e.ContextDockerfile(testCase.dockerfile)
+			}
+			if testCase.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(e.Directory, e.TempDir) || len(e.ContextArchive) > 0 {
+				t.Errorf("expected a directory context in %s, got %q %q", e.TempDir, e.Directory, e.ContextArchive)
+			}
+			if data, err := os.ReadFile(dockerfile); err != nil || string(data) != testCase.content {
+				t.Errorf("unexpected Dockerfile %s: %q %v", dockerfile, data, err)
+			}
+		})
+	}
+}
+
+func TestFetchContextDirectory(t *testing.T) {
+	dir := t.TempDir()
+	e := NewClientExecutor(nil)
+	if err := e.FetchContext(context.Background(), dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if e.Directory != dir || len(e.Deferred) != 0 {
+		t.Errorf("expected the directory to be used in place, got %q", e.Directory)
+	}
+	if dockerfile, err := e.ContextDockerfile(""); err != nil || dockerfile != filepath.Join(dir, "Dockerfile") {
+		t.Errorf("unexpected Dockerfile %q: %v", dockerfile, err)
+	}
+	var escape *ContextEscapeError
+	if _, err := e.ContextDockerfile("../Dockerfile"); !errors.As(err, &escape) {
+		t.Errorf("expected a Dockerfile outside of the context to be rejected, got %v", err)
+	}
+}
+
+func TestIsRemoteContext(t *testing.T) {
+	testCases := []struct {
+		source string
+		remote bool
+	}{
+		{source: "-", remote: true},
+		{source: "https://example.com/context.tar.gz", remote: true},
+		{source: "https://example.com/repo.git#main:dir", remote: true},
+		{source: "git@example.com:repo.git", remote: true},
+		{source: ".", remote: false},
+		{source: "path/to/context", remote: false},
+		{source: "context.tar", remote: false},
+	}
+	for _, testCase := range testCases {
+		if remote := IsRemoteContext(testCase.source); remote != testCase.remote {
+			t.Errorf("IsRemoteContext(%q): expected %t, got %t", testCase.source, testCase.remote, remote)
+		}
+	}
+}
@@ -1,10 +1,10 @@
 package dockerclient
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"net/url"
 	"os"
 	"path"
@@ -37,34 +37,37 @@ func calcCopyInfo(origPath, rootPath string, allowWildcards, explicitDir bool) (
 	}
 	// Deal with wildcards
 	if allowWildcards && containsWildcards(origPath) {
-		matchPath := filepath.Join(rootPath, origPath)
+		if leavesArchiveRoot(filepath.ToSlash(origPath)) {
+			return nil, &ContextEscapeError{Path: origPath, Reason: "it has more .. components than parent directories"}
+		}
+		glob, err := newCopyGlob(origPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkContextPath(rootPath, glob.root(), true); err != nil {
+			return nil, err
+		}
+		matches, err := glob.Walk(rootPath)
+		if err != nil {
+			return nil, err
+		}
 		var copyInfos []CopyInfo
-		if err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.Name() == "" {
-				// Why are we doing this check?
-				return nil
-			}
-			if match, _ := filepath.Match(matchPath, path); !match {
-				return nil
-			}
-
+		for _, match := range matches {
 			// Note we set allowWildcards to false in case the name has
 			// a * in it
-			subInfos, err := calcCopyInfo(trimLeadingPath(strings.TrimPrefix(path, rootPath)), rootPath, false, explicitDir)
+			subInfos, err := calcCopyInfo(filepath.FromSlash(match), rootPath, false, explicitDir)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			copyInfos = append(copyInfos, subInfos...)
-			return nil
-		}); err != nil {
-			return nil, err
 		}
 		return copyInfos, nil
 	}
 
+	if err := checkContextPath(rootPath, origPath, false); err != nil {
+		return nil, err
+	}
+
 	// Must be a dir or a file
 	fi, err := os.Stat(filepath.Join(rootPath, origPath))
 	if err != nil {
@@ -92,7 +95,17 @@ func calcCopyInfo(origPath, rootPath string, allowWildcards, explicitDir bool) (
 	return []CopyInfo{{FileInfo: fi, Path: origPath, FromDir: explicitDir}}, nil
 }
 
+// DownloadURL downloads src into a new directory in tempDir, which the caller
+// must remove, with the default Downloader.
 func DownloadURL(src, dst, tempDir string) ([]CopyInfo, string, error) {
+	var d *Downloader
+	return d.DownloadURL(context.Background(), src, tempDir)
+}
+
+// DownloadURL downloads src into a new directory in tempDir, which the caller
+// must remove, naming the file after the last element of the URL's path. Its
+// modification time is set from the Last-Modified header of the response.
+func (d *Downloader) DownloadURL(ctx context.Context, src, tempDir string) ([]CopyInfo, string, error) {
 	// get filename from URL
 	u, err := url.Parse(src)
 	if err != nil {
@@ -103,14 +116,11 @@ func DownloadURL(src, dst, tempDir string) ([]CopyInfo, string, error) {
 		return nil, "", fmt.Errorf("cannot determine filename from url: %s", u)
 	}
 
-	resp, err := http.Get(src)
+	downloaded, err := d.Fetch(ctx, src, tempDir)
 	if err != nil {
 		return nil, "", err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		return nil, "", fmt.Errorf("server returned a status code >= 400: %s", resp.Status)
-	}
+	defer downloaded.Close()
 
 	tmpDir, err := ioutil.TempDir(tempDir, "dockerbuildurl-")
 	if err != nil {
@@ -122,7 +132,8 @@ func DownloadURL(src, dst, tempDir string) ([]CopyInfo, string, error) {
 		os.RemoveAll(tmpDir)
 		return nil, "", err
 	}
-	if _, err := io.Copy(tmpFile, resp.Body); err != nil {
+	if _, err := io.Copy(tmpFile, downloaded); err != nil {
+		tmpFile.Close()
 		os.RemoveAll(tmpDir)
 		return nil, "", err
 	}
@@ -130,6 +141,12 @@ func DownloadURL(src, dst, tempDir string) ([]CopyInfo, string, error) {
 		os.RemoveAll(tmpDir)
 		return nil, "", err
 	}
+	if !downloaded.ModTime.IsZero() {
+		if err := os.Chtimes(tmpFileName, downloaded.ModTime, downloaded.ModTime); err != nil {
+			os.RemoveAll(tmpDir)
+			return nil, "", err
+		}
+	}
 	info, err := os.Stat(tmpFileName)
 	if err != nil {
 		os.RemoveAll(tmpDir)
@@ -0,0 +1,184 @@
+package dockerclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/moby/term"
+	"k8s.io/klog"
+
+	"github.com/openshift/imagebuilder"
+)
+
+// isBreakpoint returns true if the build should pause before the instruction
+// which starts on line.
+func (e *ClientExecutor) isBreakpoint(line int) bool {
+	for _, breakpoint := range e.Breakpoints {
+		if breakpoint == line {
+			return true
+		}
+	}
+	return false
+}
+
+// debugBreakpoint pauses the build before an instruction, until DebugShell
+// exits or, if it isn't set, until a line is read from DebugIn.
+func (e *ClientExecutor) debugBreakpoint(ctx context.Context, step *imagebuilder.Step, line int, config docker.Config) error {
+	// whatever earlier instructions copied should be there to look at
+	if err := e.flushUploads(); err != nil {
+		return err
+	}
+	e.describeDebug(fmt.Sprintf("Paused before %s (line %d)", step.Original, line), config)
+	if len(e.DebugShell) > 0 {
+		return e.debugShell(ctx, config)
+	}
+	if e.DebugIn == nil {
+		return nil
+	}
+	fmt.Fprintf(e.ErrOut, "    Press Enter to continue the build.\n")
+	read := make(chan error, 1)
+	go func() {
+		// read a byte at a time, so that nothing after the line is consumed
+		b := make([]byte, 1)
+		for {
+			if _, err := e.DebugIn.Read(b); err != nil || b[0] == '\n' {
+				read <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-read:
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("unable to read from the debug input: %v", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// debugFailure describes the build container after step failed with err, and
+// starts DebugShell in it if one is set. The container is kept if
+// KeepOnFailure is set, and otherwise it is only removed once the shell exits.
+// Nothing is done if the build was cancelled, or if the container was killed
+// to stop a command which timed out, since then there is nothing to debug.
+func (e *ClientExecutor) debugFailure(ctx context.Context, step *imagebuilder.Step, line int, config docker.Config, err error) {
+	if e.Container == nil || ctx.Err() != nil {
+		return
+	}
+	if errors.Is(err, errRunKilled) {
+		fmt.Fprintf(e.ErrOut, "--> %s (line %d) timed out and the build container was killed, so it can't be debugged\n", step.Original, line)
+		return
+	}
+	if err := e.flushUploads(); err != nil {
+		klog.V(4).Infof("Unable to finish copying content into the build container: %v", err)
+	}
+	reason := fmt.Sprintf("%s (line %d) failed", step.Original, line)
+	if e.KeepOnFailure {
+		e.keptContainer = e.Container.ID
+		reason += ", the build container has been kept"
+	}
+	e.describeDebug(reason, config)
+	if e.KeepOnFailure {
+		fmt.Fprintf(e.ErrOut, "    Remove it with \"docker rm -f %s\" when you are done.\n", e.Container.ID)
+	}
+	if len(e.DebugShell) == 0 {
+		return
+	}
+	if err := e.debugShell(ctx, config); err != nil {
+		fmt.Fprintf(e.ErrOut, "    Unable to start a shell in the build container: %v\n", err)
+	}
+}
+
+// describeDebug writes the ID of the build container and the environment an
+// instruction runs in to ErrOut.
+func (e *ClientExecutor) describeDebug(reason string, config docker.Config) {
+	fmt.Fprintf(e.ErrOut, "--> %s\n", reason)
+	fmt.Fprintf(e.ErrOut, "    Container:  %s\n", e.Container.ID)
+	fmt.Fprintf(e.ErrOut, "    User:       %s\n", config.User)
+	fmt.Fprintf(e.ErrOut, "    WorkingDir: %s\n", config.WorkingDir)
+	for i, env := range config.Env {
+		if i == 0 {
+			fmt.Fprintf(e.ErrOut, "    Env:        %s\n", env)
+			continue
+		}
+		fmt.Fprintf(e.ErrOut, "                %s\n", env)
+	}
+}
+
+// debugShell runs DebugShell interactively in the build container, as the
+// user and in the working directory and environment described by config.
+func (e *ClientExecutor) debugShell(ctx context.Context, config docker.Config) error {
+	if !e.Container.State.Running {
+		return fmt.Errorf("the build container %s is not running", e.Container.ID)
+	}
+	// whoever is using the shell can change anything in the container
+	defer e.pathCache().invalidate()
+	defer e.users.Invalidate()
+	cmd := append([]string{}, e.DebugShell...)
+	if !e.execSupportsEnvironment(ctx) {
+		cmd = shellEnvironment(cmd, false, []string{"/bin/sh", "-c"}, config)
+		config.Env, config.WorkingDir = nil, ""
+	}
+	klog.V(4).Infof("Starting debug shell %#v inside of %s as user %s", cmd, e.Container.ID, config.User)
+	exec, err := e.Client.CreateExec(docker.CreateExecOptions{
+		Cmd:          cmd,
+		Container:    e.Container.ID,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Tty:          true,
+		User:         config.User,
+		Env:          config.Env,
+		WorkingDir:   config.WorkingDir,
+		Context:      ctx,
+	})
+	if err != nil {
+		return err
+	}
+
+	// pass keystrokes through unchanged when the shell is attached to a
+	// terminal, and size its terminal to match
+	var size *term.Winsize
+	if in, ok := e.DebugIn.(*os.File); ok && term.IsTerminal(in.Fd()) {
+		state, err := term.SetRawTerminal(in.Fd())
+		if err != nil {
+			return fmt.Errorf("unable to configure the terminal: %v", err)
+		}
+		defer term.RestoreTerminal(in.Fd(), state)
+		if size, err = term.GetWinsize(in.Fd()); err != nil {
+			klog.V(4).Infof("Unable to read the size of the terminal: %v", err)
+		}
+	}
+
+	waiter, err := e.Client.StartExecNonBlocking(exec.ID, docker.StartExecOptions{
+		InputStream:  e.DebugIn,
+		OutputStream: e.Out,
+		ErrorStream:  e.ErrOut,
+		Tty:          true,
+		RawTerminal:  true,
+		Context:      ctx,
+	})
+	if err != nil {
+		return err
+	}
+	if size != nil {
+		if err := e.Client.ResizeExecTTY(exec.ID, int(size.Height), int(size.Width)); err != nil {
+			klog.V(4).Infof("Unable to resize the debug shell's terminal: %v", err)
+		}
+	}
+	defer waiter.Close()
+	return waiter.Wait()
+}
+
+// debugConfig returns the configuration which step runs with.
+func debugConfig(b *imagebuilder.Builder, step *imagebuilder.Step) docker.Config {
+	config := *b.Config()
+	config.Env = append([]string{}, step.Env...)
+	return config
+}
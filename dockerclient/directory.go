@@ -3,8 +3,16 @@ package dockerclient
 import (
 	"archive/tar"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 
 	docker "github.com/fsouza/go-dockerclient"
 	"k8s.io/klog"
@@ -15,14 +23,18 @@ type DirectoryCheck interface {
 }
 
 type directoryCheck struct {
+	ctx         context.Context
 	containerID string
 	client      *docker.Client
+	paths       *pathCache
 }
 
-func newDirectoryCheck(client *docker.Client, containerID string) *directoryCheck {
+func newDirectoryCheck(ctx context.Context, client *docker.Client, paths *pathCache, containerID string) *directoryCheck {
 	return &directoryCheck{
+		ctx:         ctx,
 		containerID: containerID,
 		client:      client,
+		paths:       paths,
 	}
 }
 
@@ -31,18 +43,219 @@ func (c *directoryCheck) IsDirectory(path string) (bool, error) {
 		return true, nil
 	}
 
-	dir, err := isContainerPathDirectory(c.client, c.containerID, path)
+	info, err := c.paths.stat(c.ctx, c.client, c.containerID, path)
 	if err != nil {
 		return false, err
 	}
 
-	return dir, nil
+	return info.dir, nil
 }
 
-func isContainerPathDirectory(client *docker.Client, containerID, path string) (bool, error) {
+// pathInfo is what is known about a path in a container.
+type pathInfo struct {
+	exists bool
+	dir    bool
+}
+
+// pathCache remembers what is known about paths in a container, so that the
+// daemon isn't asked about the same path over and over again. It must be
+// invalidated whenever the container's filesystem is changed by anything
+// other than the creation of a directory which is recorded with created, or
+// content which is recorded with wrote. A nil *pathCache caches nothing.
+type pathCache struct {
+	containerID string
+	paths       map[string]pathInfo
+	// noStat is set once the daemon has failed to stat a path, after which
+	// archives are downloaded instead.
+	noStat bool
+	// flush, if set, is called before the daemon is asked about a path, so
+	// that content recorded with wrote which hasn't reached the container
+	// yet is there.
+	flush func() error
+}
+
+// invalidate forgets everything which is known about the container.
+func (c *pathCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.paths = nil
+}
+
+// created records that path, and each of its parents, is a directory.
+func (c *pathCache) created(containerID, path string) {
+	if c == nil {
+		return
+	}
+	for path = filepath.Clean(path); ; path = filepath.Dir(path) {
+		c.set(containerID, path, pathInfo{exists: true, dir: true})
+		if filepath.Dir(path) == path {
+			break
+		}
+	}
+}
+
+// wrote records that an archive entry of type typeflag was extracted to path,
+// replacing whatever was there.
+func (c *pathCache) wrote(containerID, path string, typeflag byte) {
+	if c == nil {
+		return
+	}
+	if typeflag == tar.TypeSymlink {
+		// paths which pass through the link now lead somewhere else
+		c.invalidate()
+		return
+	}
+	path = filepath.Clean(path)
+	if c.containerID == containerID {
+		for known, info := range c.paths {
+			if known == path || strings.HasPrefix(known, path+string(filepath.Separator)) {
+				delete(c.paths, known)
+				continue
+			}
+			// a parent which wasn't a directory had to become one
+			if !info.dir && strings.HasPrefix(path, known+string(filepath.Separator)) {
+				delete(c.paths, known)
+			}
+		}
+	}
+	c.set(containerID, path, pathInfo{exists: true, dir: typeflag == tar.TypeDir})
+}
+
+func (c *pathCache) set(containerID, path string, info pathInfo) {
+	if c.containerID != containerID || c.paths == nil {
+		c.containerID = containerID
+		c.paths = make(map[string]pathInfo)
+	}
+	c.paths[filepath.Clean(path)] = info
+}
+
+// stat returns what is known about path in the container, asking the daemon
+// if it isn't cached.
+func (c *pathCache) stat(ctx context.Context, client *docker.Client, containerID, path string) (pathInfo, error) {
+	if c != nil && c.containerID == containerID {
+		if info, ok := c.paths[filepath.Clean(path)]; ok {
+			klog.V(6).Infof("Found path %s in container %s in the cache: %#v", path, containerID, info)
+			return info, nil
+		}
+	}
+	if c != nil && c.flush != nil {
+		if err := c.flush(); err != nil {
+			return pathInfo{}, err
+		}
+	}
+	var info pathInfo
+	var err error
+	if c == nil || !c.noStat {
+		var stat *containerPathStat
+		if stat, err = statContainerPath(ctx, client, containerID, path); err == nil {
+			if stat != nil {
+				info = pathInfo{exists: true, dir: stat.Mode.IsDir()}
+			}
+		} else if ctx.Err() != nil {
+			return info, ctx.Err()
+		} else if c != nil {
+			klog.V(4).Infof("Unable to stat paths in container %s, falling back to downloading them: %v", containerID, err)
+			c.noStat = true
+		}
+	}
+	if c != nil && c.noStat || c == nil && err != nil {
+		if info, err = downloadContainerPathInfo(ctx, client, containerID, path); err != nil {
+			return info, err
+		}
+	}
+	if c != nil {
+		c.set(containerID, path, info)
+	}
+	return info, nil
+}
+
+// containerPathStat is the description of a path which the daemon returns
+// from the HEAD method of its archive endpoint.
+type containerPathStat struct {
+	Name       string      `json:"name"`
+	Size       int64       `json:"size"`
+	Mode       os.FileMode `json:"mode"`
+	LinkTarget string      `json:"linkTarget"`
+}
+
+// statContainerPath asks the daemon to describe path using the HEAD method of
+// the archive endpoint, which unlike a download doesn't transfer the contents
+// of path. It returns nil if the path doesn't exist.
+func statContainerPath(ctx context.Context, client *docker.Client, containerID, path string) (*containerPathStat, error) {
+	if client.HTTPClient == nil {
+		return nil, fmt.Errorf("the client has no HTTP client")
+	}
+	u, err := apiURL(client, fmt.Sprintf("/containers/%s/archive?%s", url.PathEscape(containerID), url.Values{"path": {path}}.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		klog.V(4).Infof("path %s did not exist in container %s", path, containerID)
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %q from the daemon", resp.Status)
+	}
+	header := resp.Header.Get("X-Docker-Container-Path-Stat")
+	if header == "" {
+		return nil, fmt.Errorf("the daemon did not describe the path")
+	}
+	data, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode the description of the path: %v", err)
+	}
+	var stat containerPathStat
+	if err := json.Unmarshal(data, &stat); err != nil {
+		return nil, fmt.Errorf("unable to decode the description of the path: %v", err)
+	}
+	klog.V(4).Infof("Retrieved description of path %s from container %s: %#v", path, containerID, stat)
+	return &stat, nil
+}
+
+// apiURL returns the URL which client would use to call the API at path.
+func apiURL(client *docker.Client, path string) (string, error) {
+	endpoint, err := url.Parse(client.Endpoint())
+	if err != nil {
+		return "", err
+	}
+	switch endpoint.Scheme {
+	case "unix", "npipe":
+		// the client's dialer ignores the host
+		return "http://unix.sock" + path, nil
+	case "tcp":
+		endpoint.Scheme = "http"
+		if client.TLSConfig != nil {
+			endpoint.Scheme = "https"
+		}
+	case "http", "https":
+	default:
+		return "", fmt.Errorf("unsupported endpoint %q", client.Endpoint())
+	}
+	return strings.TrimRight(endpoint.String(), "/") + path, nil
+}
+
+// downloadContainerPathInfo describes path using the first header of an
+// archive of it, for daemons which can't be asked to stat it.
+func downloadContainerPathInfo(ctx context.Context, client *docker.Client, containerID, path string) (pathInfo, error) {
+	dir, exists, err := isContainerPathDirectory(ctx, client, containerID, path)
+	return pathInfo{exists: exists, dir: dir}, err
+}
+
+func isContainerPathDirectory(ctx context.Context, client *docker.Client, containerID, path string) (dir, exists bool, err error) {
 	pr, pw := io.Pipe()
 	defer pw.Close()
-	ctx, cancel := context.WithCancel(context.TODO())
+	ctx, cancel := context.WithCancel(ctx)
 	go func() {
 		err := client.DownloadFromContainer(containerID, docker.DownloadFromContainerOptions{
 			OutputStream: pw,
@@ -69,7 +282,7 @@ func isContainerPathDirectory(client *docker.Client, containerID, path string) (
 			err = nil
 		}
 		cancel()
-		return false, err
+		return false, false, err
 	}
 
 	klog.V(4).Infof("Retrieved first header from container %s at path %s: %#v", containerID, path, h)
@@ -83,5 +296,5 @@ func isContainerPathDirectory(client *docker.Client, containerID, path string) (
 		}
 	}()
 
-	return h.FileInfo().IsDir(), nil
+	return h.FileInfo().IsDir(), true, nil
 }
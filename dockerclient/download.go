@@ -0,0 +1,439 @@
+package dockerclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// defaultDownloader is used in place of a nil Downloader.
+var defaultDownloader = &Downloader{}
+
+// defaultMaxBackoff is the longest wait between attempts to download a URL if
+// Downloader.MaxBackoff isn't set.
+const defaultMaxBackoff = time.Minute
+
+// Downloader fetches the URLs which are named as the sources of ADD
+// instructions. A nil Downloader, or one which is not configured, downloads
+// each URL once, using the proxies named by the environment, and keeps
+// nothing once the build is done.
+type Downloader struct {
+	// Timeout, if set, limits how long each attempt to download a URL may
+	// take, including reading all of its content.
+	Timeout time.Duration
+	// Retries is the number of times a download is tried again after it
+	// fails because of a network error, or because the server responded
+	// with a 5xx or 429 status.
+	Retries int
+	// Backoff is how long to wait before trying a download again for the
+	// first time. The wait doubles for each retry after that, unless the
+	// server asks for a longer one with Retry-After. Defaults to one second.
+	Backoff time.Duration
+	// MaxBackoff limits how long to wait before trying a download again,
+	// including when the server asks for a longer wait. Defaults to one
+	// minute.
+	MaxBackoff time.Duration
+	// Proxy, if set, is the URL of a proxy which every request is sent
+	// through. Otherwise, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// environment variables are honored.
+	Proxy string
+	// CAFiles are files of PEM encoded certificates of authorities which are
+	// trusted to identify servers, in addition to the system's.
+	CAFiles []string
+	// Auth maps the host name, or host:port, of a server to the value of the
+	// Authorization header which is sent to it. It is only sent to that
+	// server, even if a request to another one is redirected there, and
+	// only over https, unless AllowInsecureAuth is set.
+	Auth map[string]string
+	// AllowInsecureAuth allows the values in Auth to be sent over plain http.
+	AllowInsecureAuth bool
+	// CacheDir, if set, is a directory in which downloaded content is kept
+	// along with the ETag and Last-Modified headers which the server sent
+	// with it. Later downloads of the same URL are sent as conditional
+	// requests, and reuse the content which was kept if it hasn't changed.
+	CacheDir string
+	// Transport, if set, is used to send requests instead of a transport
+	// configured by Proxy, CAFiles and Auth.
+	Transport http.RoundTripper
+
+	once      sync.Once
+	client    *http.Client
+	clientErr error
+}
+
+// BasicAuth returns the value of an Authorization header which sends user
+// and password with the basic scheme, for use in Downloader.Auth.
+func BasicAuth(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+// DownloadedFile is the content of a URL which a Downloader fetched.
+type DownloadedFile struct {
+	// File is open for reading the content.
+	*os.File
+	// Size is the length of the content.
+	Size int64
+	// ModTime is the time given by the Last-Modified header of the response,
+	// or the zero time if it had none.
+	ModTime time.Time
+
+	// temporary is set if the file isn't part of the cache, and should be
+	// removed once it has been read.
+	temporary bool
+}
+
+// Close closes the file, and removes it unless it is kept in the cache.
+func (f *DownloadedFile) Close() error {
+	err := f.File.Close()
+	if f.temporary {
+		if removeErr := os.Remove(f.Name()); removeErr != nil && err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
+
+// downloadCacheEntry describes the content of a URL which is kept in the
+// cache.
+type downloadCacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	// File is the name of the file in the cache directory which holds the
+	// content.
+	File string `json:"file"`
+}
+
+// retryableError is a failure which is worth trying again.
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableError) Error() string { return e.err.Error() }
+func (e *retryableError) Unwrap() error { return e.err }
+
+// Fetch downloads src, writing its content to a file in tempDir unless it is
+// kept in the cache. The caller must close the returned file.
+func (d *Downloader) Fetch(ctx context.Context, src, tempDir string) (*DownloadedFile, error) {
+	if d == nil {
+		d = defaultDownloader
+	}
+	client, err := d.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	cached := d.cached(src)
+	backoff := d.Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := d.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		f, err := d.fetch(ctx, client, src, tempDir, cached)
+		if err == nil {
+			return f, nil
+		}
+		var retryable *retryableError
+		if attempt >= d.Retries || !errors.As(err, &retryable) || ctx.Err() != nil {
+			return nil, err
+		}
+		wait := maxBackoff
+		if attempt < 32 && backoff<<attempt < wait {
+			wait = backoff << attempt
+		}
+		if retryable.retryAfter > wait {
+			// the server can ask for a longer wait, but not an
+			// unlimited one
+			wait = retryable.retryAfter
+			if wait > maxBackoff {
+				wait = maxBackoff
+			}
+		}
+		klog.V(4).Infof("Retrying download of %s in %s: %v", src, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// fetch makes one attempt to download src, as a conditional request if there
+// is a cached copy of its content.
+func (d *Downloader) fetch(ctx context.Context, client *http.Client, src, tempDir string, cached *downloadCacheEntry) (*DownloadedFile, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, err
+		}
+		return nil, &retryableError{err: err}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		f, err := d.openCached(cached)
+		if errors.Is(err, os.ErrNotExist) {
+			// the content was removed from the cache since its entry was
+			// read, so ask for all of it
+			return d.fetch(ctx, client, src, tempDir, nil)
+		}
+		klog.V(4).Infof("Using the cached content of %s", src)
+		return f, err
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, &retryableError{
+			err:        fmt.Errorf("server returned a status code >= 400: %s", resp.Status),
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	case resp.StatusCode >= 400:
+		return nil, fmt.Errorf("server returned a status code >= 400: %s", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("server returned an unexpected status: %s", resp.Status)
+	}
+
+	entry := &downloadCacheEntry{URL: src, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	cacheable := len(d.CacheDir) > 0 && (entry.ETag != "" || entry.LastModified != "") &&
+		!strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-store")
+	dir := tempDir
+	if cacheable {
+		if err := os.MkdirAll(d.CacheDir, 0o700); err != nil {
+			return nil, fmt.Errorf("unable to create download cache: %v", err)
+		}
+		dir = d.CacheDir
+	}
+	f, err := ioutil.TempFile(dir, ".download-")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary file for source URL: %v", err)
+	}
+	n, err := io.Copy(f, resp.Body)
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, &retryableError{err: fmt.Errorf("unable to download source URL: %v", err)}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	downloaded := &DownloadedFile{File: f, Size: n, ModTime: parseLastModified(entry.LastModified), temporary: true}
+	if cacheable {
+		if err := d.store(entry, f.Name(), cached); err != nil {
+			klog.V(2).Infof("Unable to cache the content of %s: %v", src, err)
+		} else {
+			downloaded.temporary = false
+		}
+	}
+	return downloaded, nil
+}
+
+// httpClient returns the client which requests are sent with.
+func (d *Downloader) httpClient() (*http.Client, error) {
+	d.once.Do(func() {
+		if d.Transport != nil {
+			d.client = &http.Client{Transport: d.Transport}
+			return
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if len(d.Proxy) > 0 {
+			proxy, err := url.Parse(d.Proxy)
+			if err != nil {
+				d.clientErr = fmt.Errorf("invalid download proxy %q: %v", d.Proxy, err)
+				return
+			}
+			transport.Proxy = http.ProxyURL(proxy)
+		}
+		if len(d.CAFiles) > 0 {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			for _, file := range d.CAFiles {
+				data, err := os.ReadFile(file)
+				if err != nil {
+					d.clientErr = fmt.Errorf("unable to read certificate authorities: %v", err)
+					return
+				}
+				if !pool.AppendCertsFromPEM(data) {
+					d.clientErr = fmt.Errorf("no certificates were found in %s", file)
+					return
+				}
+			}
+			transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		}
+		var rt http.RoundTripper = transport
+		if len(d.Auth) > 0 {
+			rt = &authTransport{auth: d.Auth, insecure: d.AllowInsecureAuth, base: transport}
+		}
+		d.client = &http.Client{Transport: rt}
+	})
+	return d.client, d.clientErr
+}
+
+// authTransport adds the Authorization header for the server each request is
+// sent to. Since it applies to every request, including those which follow
+// redirects, credentials are never sent to a server they weren't given for,
+// nor over plain http, unless insecure is set.
+type authTransport struct {
+	auth     map[string]string
+	insecure bool
+	base     http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Authorization") != "" || (req.URL.Scheme != "https" && !t.insecure) {
+		return t.base.RoundTrip(req)
+	}
+	value, ok := t.auth[req.URL.Host]
+	if !ok {
+		value, ok = t.auth[req.URL.Hostname()]
+	}
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", value)
+	return t.base.RoundTrip(req)
+}
+
+// cacheKey returns the name of a file in the cache for parts.
+func cacheKey(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// cached returns the entry in the cache for src, or nil if there isn't one.
+func (d *Downloader) cached(src string) *downloadCacheEntry {
+	if len(d.CacheDir) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(d.CacheDir, cacheKey(src)+".json"))
+	if err != nil {
+		return nil
+	}
+	var entry downloadCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.URL != src || entry.File != filepath.Base(entry.File) {
+		return nil
+	}
+	return &entry
+}
+
+// openCached opens the content which entry describes.
+func (d *Downloader) openCached(entry *downloadCacheEntry) (*DownloadedFile, error) {
+	f, err := os.Open(filepath.Join(d.CacheDir, entry.File))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &DownloadedFile{File: f, Size: fi.Size(), ModTime: parseLastModified(entry.LastModified)}, nil
+}
+
+// store moves the downloaded file at name into the cache, and records entry
+// for it, replacing any content which previous described.
+func (d *Downloader) store(entry *downloadCacheEntry, name string, previous *downloadCacheEntry) error {
+	// content is named for the URL and the headers which identify it, so
+	// that the entry for a URL never names content which it doesn't describe
+	entry.File = cacheKey(entry.URL, entry.ETag, entry.LastModified)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(name, filepath.Join(d.CacheDir, entry.File)); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(d.CacheDir, ".entry-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(d.CacheDir, cacheKey(entry.URL)+".json")); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if previous != nil && previous.File != entry.File {
+		os.Remove(filepath.Join(d.CacheDir, previous.File))
+	}
+	return nil
+}
+
+// parseLastModified parses the value of a Last-Modified header, returning the
+// zero time if it isn't valid.
+func parseLastModified(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or a date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -0,0 +1,330 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloaderRetries(t *testing.T) {
+	testCases := []struct {
+		status   int
+		failures int
+		retries  int
+		requests int
+		err      bool
+	}{
+		{status: http.StatusServiceUnavailable, failures: 2, retries: 2, requests: 3},
+		{status: http.StatusServiceUnavailable, failures: 2, retries: 1, requests: 2, err: true},
+		{status: http.StatusTooManyRequests, failures: 1, retries: 1, requests: 2},
+		// client errors aren't retried
+		{status: http.StatusNotFound, failures: 1, retries: 3, requests: 1, err: true},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if requests <= testCase.failures {
+					http.Error(w, "failed", testCase.status)
+					return
+				}
+				fmt.Fprint(w, "content")
+			}))
+			defer server.Close()
+			d := &Downloader{Retries: testCase.retries, Backoff: time.Millisecond}
+			f, err := d.Fetch(context.Background(), server.URL+"/file", t.TempDir())
+			if requests != testCase.requests {
+				t.Errorf("expected %d requests, got %d", testCase.requests, requests)
+			}
+			if testCase.err {
+				if err == nil {
+					f.Close()
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if data, err := io.ReadAll(f); err != nil || string(data) != "content" {
+				t.Errorf("unexpected content %q: %v", data, err)
+			}
+		})
+	}
+}
+
+func TestDownloaderRetryAfter(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			// a day is longer than the build should be held up for
+			w.Header().Set("Retry-After", "86400")
+			http.Error(w, "failed", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "content")
+	}))
+	defer server.Close()
+	d := &Downloader{Retries: 1, Backoff: time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	f, err := d.Fetch(ctx, server.URL+"/file", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if requests != 2 {
+		t.Errorf("expected 2 requests, got %d", requests)
+	}
+}
+
+func TestDownloaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	d := &Downloader{Timeout: 50 * time.Millisecond}
+	start := time.Now()
+	if f, err := d.Fetch(context.Background(), server.URL+"/file", t.TempDir()); err == nil {
+		f.Close()
+		t.Fatal("expected the download to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("download took %s", elapsed)
+	}
+}
+
+func TestDownloaderCache(t *testing.T) {
+	lastModified := time.Date(2020, time.March, 1, 12, 30, 0, 0, time.UTC)
+	var lock sync.Mutex
+	content, etag := "first", `"1"`
+	var conditional []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		conditional = append(conditional, r.Header.Get("If-None-Match"))
+		if r.URL.Path == "/uncached" {
+			fmt.Fprint(w, content)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, content)
+	}))
+	defer server.Close()
+
+	d := &Downloader{CacheDir: filepath.Join(t.TempDir(), "cache")}
+	tempDir := t.TempDir()
+	fetch := func(path, expect string) {
+		t.Helper()
+		f, err := d.Fetch(context.Background(), server.URL+path, tempDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expect || f.Size != int64(len(expect)) {
+			t.Errorf("expected %q, got %q (%d bytes)", expect, data, f.Size)
+		}
+		if path != "/uncached" && !f.ModTime.Equal(lastModified) {
+			t.Errorf("expected modification time %s, got %s", lastModified, f.ModTime)
+		}
+	}
+
+	fetch("/file", "first")
+	fetch("/file", "first")
+	lock.Lock()
+	content, etag = "second", `"2"`
+	lock.Unlock()
+	fetch("/file", "second")
+	fetch("/file", "second")
+	fetch("/uncached", "second")
+	fetch("/uncached", "second")
+
+	lock.Lock()
+	defer lock.Unlock()
+	if expect := []string{"", `"1"`, `"1"`, `"2"`, "", ""}; strings.Join(expect, ",") != strings.Join(conditional, ",") {
+		t.Errorf("unexpected conditional requests:\nexpected: %q\nfound:    %q", expect, conditional)
+	}
+	// only the current content of the cached URL is kept, and nothing is
+	// left in the temporary directory
+	if entries, err := os.ReadDir(d.CacheDir); err != nil || len(entries) != 2 {
+		t.Errorf("expected one entry and its content in the cache, got %v %v", entries, err)
+	}
+	if entries, err := os.ReadDir(tempDir); err != nil || len(entries) != 0 {
+		t.Errorf("expected temporary files to be removed, got %v %v", entries, err)
+	}
+
+	// content which has gone missing from the cache is downloaded again
+	entry := d.cached(server.URL + "/file")
+	if entry == nil {
+		t.Fatal("expected an entry in the cache")
+	}
+	if err := os.Remove(filepath.Join(d.CacheDir, entry.File)); err != nil {
+		t.Fatal(err)
+	}
+	lock.Unlock()
+	fetch("/file", "second")
+	lock.Lock()
+	if expect := `"2",`; !strings.HasSuffix(strings.Join(conditional, ","), expect) {
+		t.Errorf("expected an unconditional request to follow, got %q", conditional)
+	}
+}
+
+func TestDownloaderAuthAndCAFiles(t *testing.T) {
+	var lock sync.Mutex
+	authorization := map[string]string{}
+	var other *httptest.Server
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		authorization[r.URL.Path] = r.Header.Get("Authorization")
+		lock.Unlock()
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, other.URL+"/elsewhere", http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, "content")
+	}))
+	defer server.Close()
+	other = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		authorization[r.URL.Path] = r.Header.Get("Authorization")
+		lock.Unlock()
+		fmt.Fprint(w, "content")
+	}))
+	defer other.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server's certificate isn't trusted unless its authority is given
+	if f, err := (&Downloader{}).Fetch(context.Background(), server.URL+"/file", t.TempDir()); err == nil {
+		f.Close()
+		t.Fatal("expected the server's certificate not to be trusted")
+	}
+
+	d := &Downloader{CAFiles: []string{caFile}, Auth: map[string]string{u.Host: BasicAuth("user", "secret")}}
+	for _, path := range []string{"/file", "/redirect"} {
+		f, err := d.Fetch(context.Background(), server.URL+path, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	expect := map[string]string{"/file": BasicAuth("user", "secret"), "/redirect": BasicAuth("user", "secret"), "/elsewhere": ""}
+	for path, value := range expect {
+		if authorization[path] != value {
+			t.Errorf("expected the authorization %q for %s, got %q", value, path, authorization[path])
+		}
+	}
+
+	// credentials aren't sent over plain http unless that's allowed
+	o, err := url.Parse(other.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, insecure := range []bool{false, true} {
+		d := &Downloader{Auth: map[string]string{o.Host: BasicAuth("user", "secret")}, AllowInsecureAuth: insecure}
+		lock.Unlock()
+		f, err := d.Fetch(context.Background(), other.URL+"/plain", t.TempDir())
+		lock.Lock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if sent := authorization["/plain"] != ""; sent != insecure {
+			t.Errorf("expected credentials to be sent over http to be %t, got %t", insecure, sent)
+		}
+	}
+
+	if _, err := (&Downloader{CAFiles: []string{filepath.Join(t.TempDir(), "missing.pem")}}).Fetch(context.Background(), server.URL, t.TempDir()); err == nil {
+		t.Error("expected a missing CA file to be reported")
+	}
+}
+
+func TestArchiveFromURL(t *testing.T) {
+	lastModified := time.Date(2021, time.June, 2, 3, 4, 5, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked.txt" {
+			// a response without a length is still read completely
+			w.(http.Flusher).Flush()
+		} else {
+			w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		}
+		fmt.Fprint(w, "content")
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		src     string
+		name    string
+		modTime time.Time
+	}{
+		{src: "/dir/file.txt", name: "/dst/file.txt", modTime: lastModified},
+		{src: "/chunked.txt", name: "/dst/chunked.txt"},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			tempDir := t.TempDir()
+			r, closer, err := archiveFromURL(context.Background(), server.URL+testCase.src, "/dst/", tempDir, testDirectoryCheck(nil), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr := tar.NewReader(r)
+			h, err := tr.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Name != testCase.name || string(data) != "content" || h.Size != int64(len(data)) {
+				t.Errorf("unexpected entry %s (%d bytes): %q", h.Name, h.Size, data)
+			}
+			if !testCase.modTime.IsZero() && !h.ModTime.Equal(testCase.modTime) {
+				t.Errorf("expected modification time %s, got %s", testCase.modTime, h.ModTime)
+			}
+			if err := closer.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if entries, err := os.ReadDir(tempDir); err != nil || len(entries) != 0 {
+				t.Errorf("expected the download to be removed, got %v %v", entries, err)
+			}
+		})
+	}
+}
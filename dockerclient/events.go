@@ -0,0 +1,192 @@
+package dockerclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// EventType identifies the kind of an Event.
+type EventType string
+
+const (
+	// EventBuildStart and EventBuildFinish bracket a call to Build or Stages.
+	EventBuildStart  EventType = "build-start"
+	EventBuildFinish EventType = "build-finish"
+	// EventStageStart and EventStageFinish bracket the building of a stage.
+	EventStageStart  EventType = "stage-start"
+	EventStageFinish EventType = "stage-finish"
+	// EventStepStart and EventStepFinish bracket each instruction.
+	EventStepStart  EventType = "step-start"
+	EventStepFinish EventType = "step-finish"
+	// EventPullProgress reports the progress of one layer of an image which
+	// is being pulled.
+	EventPullProgress EventType = "pull-progress"
+	// EventUpload reports content which was copied into a container.
+	EventUpload EventType = "upload"
+	// EventOutput carries output from a RUN instruction.
+	EventOutput EventType = "output"
+	// EventWarning carries a warning about the build.
+	EventWarning EventType = "warning"
+	// EventCommit reports the image which was committed at the end of a build.
+	EventCommit EventType = "commit"
+)
+
+// Event describes something which happened during a build. Fields which
+// don't apply to an event's type are left empty.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Stage is the name of the stage being built.
+	Stage string `json:"stage,omitempty"`
+	// Step is the position of the instruction within its stage, starting
+	// at 1, and Instruction and Line describe it.
+	Step        int    `json:"step,omitempty"`
+	Instruction string `json:"instruction,omitempty"`
+	Line        int    `json:"line,omitempty"`
+	// Duration is set for events which mark the end of something.
+	Duration time.Duration `json:"duration,omitempty"`
+	// Error is set for events which mark the end of something which failed.
+	Error string `json:"error,omitempty"`
+	// Image is the image being pulled, or the ID of the committed image.
+	Image string `json:"image,omitempty"`
+	// Tags are the names given to a committed image.
+	Tags []string `json:"tags,omitempty"`
+	// Layer, Status, Current and Total describe the progress of a pull.
+	Layer   string `json:"layer,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Current int64  `json:"current,omitempty"`
+	Total   int64  `json:"total,omitempty"`
+	// Destination and Bytes describe an upload.
+	Destination string `json:"destination,omitempty"`
+	Bytes       int64  `json:"bytes,omitempty"`
+	// Stream is "stdout" or "stderr", and Data is a chunk of what was
+	// written to it, exactly as it was written. Since output need not be
+	// valid UTF-8, or may be split in the middle of a character, Data is
+	// base64-encoded in JSON.
+	Stream string `json:"stream,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+	// Message is the text of a warning.
+	Message string `json:"message,omitempty"`
+}
+
+// stepInfo describes the instruction which is currently being executed, so
+// that events can be tagged with it.
+type stepInfo struct {
+	step        int
+	instruction string
+	line        int
+}
+
+// emit fills in the time and location of an event and passes it to EventFn,
+// if one is set.
+func (e *ClientExecutor) emit(event Event) {
+	if e.EventFn == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if event.Stage == "" {
+		event.Stage = e.Name
+	}
+	if event.Step == 0 && e.step.step != 0 {
+		event.Step, event.Instruction, event.Line = e.step.step, e.step.instruction, e.step.line
+	}
+	e.EventFn(event)
+}
+
+// warn logs a warning and emits it as an event.
+func (e *ClientExecutor) warn(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	e.LogFn("warning: %s", message)
+	e.emit(Event{Type: EventWarning, Message: message})
+}
+
+// errorString returns the text of err, or "" if err is nil.
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// outputEventWriter passes through everything written to it, and emits an
+// output event for each chunk.
+type outputEventWriter struct {
+	w      io.Writer
+	stream string
+	emit   func(Event)
+}
+
+func (w *outputEventWriter) Write(p []byte) (int, error) {
+	// the caller may reuse p once we return
+	w.emit(Event{Type: EventOutput, Stream: w.stream, Data: append([]byte(nil), p...)})
+	if w.w == nil {
+		return len(p), nil
+	}
+	return w.w.Write(p)
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// newPullEventWriter returns a writer which decodes the JSON progress messages
+// the daemon sends while pulling an image, and emits an event for each one
+// which describes a layer.
+func newPullEventWriter(image string, emit func(Event)) io.WriteCloser {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		decoder := json.NewDecoder(pr)
+		for {
+			var message struct {
+				ID             string `json:"id"`
+				Status         string `json:"status"`
+				ProgressDetail struct {
+					Current int64 `json:"current"`
+					Total   int64 `json:"total"`
+				} `json:"progressDetail"`
+			}
+			if err := decoder.Decode(&message); err != nil {
+				// keep draining so that the pull isn't blocked
+				io.Copy(io.Discard, pr)
+				return
+			}
+			if message.ID == "" {
+				continue
+			}
+			emit(Event{
+				Type:    EventPullProgress,
+				Image:   image,
+				Layer:   message.ID,
+				Status:  message.Status,
+				Current: message.ProgressDetail.Current,
+				Total:   message.ProgressDetail.Total,
+			})
+		}
+	}()
+	return &pullEventWriter{PipeWriter: pw, done: done}
+}
+
+type pullEventWriter struct {
+	*io.PipeWriter
+	done chan struct{}
+}
+
+func (w *pullEventWriter) Close() error {
+	err := w.PipeWriter.Close()
+	<-w.done
+	return err
+}
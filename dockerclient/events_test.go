@@ -0,0 +1,129 @@
+package dockerclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/openshift/imagebuilder"
+)
+
+func TestExecuteEvents(t *testing.T) {
+	node, err := imagebuilder.ParseDockerfile(strings.NewReader("FROM busybox\nENV A=B\nBOGUS instruction\nLABEL a=b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := imagebuilder.NewBuilder(nil)
+	if _, err := b.From(node); err != nil {
+		t.Fatal(err)
+	}
+	var events []Event
+	e := NewClientExecutor(nil)
+	e.Name = "builder"
+	e.IgnoreUnrecognizedInstructions = true
+	e.EventFn = func(event Event) {
+		if event.Time.IsZero() {
+			t.Errorf("event %#v has no time", event)
+		}
+		if event.Stage != "builder" {
+			t.Errorf("event %#v has the wrong stage", event)
+		}
+		events = append(events, event)
+	}
+	if err := e.Execute(b, node); err != nil {
+		t.Fatal(err)
+	}
+
+	type summary struct {
+		Type    EventType
+		Step    int
+		Line    int
+		Message string
+	}
+	var found []summary
+	for _, event := range events {
+		found = append(found, summary{Type: event.Type, Step: event.Step, Line: event.Line, Message: event.Message})
+	}
+	expect := []summary{
+		{Type: EventStepStart, Step: 1, Line: 2},
+		{Type: EventStepFinish, Step: 1, Line: 2},
+		{Type: EventStepStart, Step: 2, Line: 3},
+		{Type: EventWarning, Step: 2, Line: 3, Message: "Unknown instruction: BOGUS"},
+		{Type: EventStepFinish, Step: 2, Line: 3},
+		{Type: EventStepStart, Step: 3, Line: 4},
+		{Type: EventStepFinish, Step: 3, Line: 4},
+	}
+	if !reflect.DeepEqual(expect, found) {
+		t.Errorf("unexpected events:\n%#v\n%#v", expect, found)
+	}
+	if events[0].Instruction != "ENV A=B" {
+		t.Errorf("unexpected instruction %q", events[0].Instruction)
+	}
+	if e.step != (stepInfo{}) {
+		t.Errorf("step was not reset after execution: %#v", e.step)
+	}
+}
+
+func TestOutputEventWriter(t *testing.T) {
+	var buf bytes.Buffer
+	var events []Event
+	w := &outputEventWriter{w: &buf, stream: "stderr", emit: func(event Event) { events = append(events, event) }}
+	// "é" split between writes, followed by bytes which aren't UTF-8
+	chunk := []byte("one \xc3")
+	for _, p := range [][]byte{chunk, []byte("\xa9\n"), []byte("\xff\xfe\n")} {
+		if _, err := w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copy(chunk, "xxx")
+	if buf.String() != "one \u00e9\n\xff\xfe\n" {
+		t.Errorf("output was not passed through: %q", buf.String())
+	}
+	if len(events) != 3 || events[0].Type != EventOutput || events[0].Stream != "stderr" || string(events[0].Data) != "one \xc3" {
+		t.Fatalf("unexpected events: %#v", events)
+	}
+	var data []byte
+	for _, event := range events {
+		encoded, err := json.Marshal(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Event
+		if err := json.Unmarshal(encoded, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, decoded.Data...)
+	}
+	if string(data) != buf.String() {
+		t.Errorf("output was not preserved through JSON: %q", data)
+	}
+}
+
+func TestPullEventWriter(t *testing.T) {
+	var events []Event
+	w := newPullEventWriter("busybox", func(event Event) { events = append(events, event) })
+	input := `{"status":"Pulling from library/busybox","id":"latest"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"aaaa"}
+{"status":"Downloading","progressDetail":{"current":10,"total":100},"id":"aaaa"}
+{"status":"Digest: sha256:1234"}
+{"status":"Download complete","progressDetail":{},"id":"aaaa"}
+`
+	// split the input to make sure messages can span writes
+	for _, chunk := range []string{input[:50], input[50:]} {
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %#v", events)
+	}
+	progress := events[2]
+	if progress.Type != EventPullProgress || progress.Image != "busybox" || progress.Layer != "aaaa" || progress.Status != "Downloading" || progress.Current != 10 || progress.Total != 100 {
+		t.Errorf("unexpected event %#v", progress)
+	}
+}
@@ -0,0 +1,258 @@
+package dockerclient
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// gitSource describes a remote git repository named as the source of an ADD
+// instruction, along with the optional ref and subdirectory given in the
+// URL's fragment (e.g. https://host/repo.git#ref:subdir).
+type gitSource struct {
+	Remote string
+	Ref    string
+	Subdir string
+}
+
+// isGitURL returns true if the string appears to name a remote git
+// repository. Repositories on the local system are not included, since a
+// Dockerfile could then read any of them.
+func isGitURL(s string) bool {
+	switch {
+	case strings.HasPrefix(s, "git://"), strings.HasPrefix(s, "git@"),
+		strings.HasPrefix(s, "ssh://"), strings.HasPrefix(s, "git+ssh://"):
+		return true
+	case strings.HasPrefix(s, "http://"), strings.HasPrefix(s, "https://"):
+		return hasGitPath(s)
+	}
+	return false
+}
+
+// isLocalGitURL returns true if the string is a file:// URL which appears to
+// name a git repository.
+func isLocalGitURL(s string) bool {
+	return strings.HasPrefix(s, "file://") && hasGitPath(s)
+}
+
+// hasGitPath returns true if the path of the URL, ignoring its fragment,
+// ends in .git.
+func hasGitPath(s string) bool {
+	remote, _, _ := strings.Cut(s, "#")
+	u, err := url.Parse(remote)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(strings.TrimSuffix(u.Path, "/"), ".git")
+}
+
+// isGitSource returns true if src names a git repository which may be
+// copied from or built from: a remote one, or one on the local system if
+// AllowLocalGitRepositories is set.
+func (e *ClientExecutor) isGitSource(src string) bool {
+	return isGitURL(src) || (e.AllowLocalGitRepositories && isLocalGitURL(src))
+}
+
+// isGitCommitID returns true if ref looks like a full SHA-1 or SHA-256 commit ID.
+func isGitCommitID(ref string) bool {
+	if len(ref) != 40 && len(ref) != 64 {
+		return false
+	}
+	for _, c := range ref {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseGitSource splits a git URL into the repository location and the ref
+// and subdirectory which were requested in its fragment.
+func parseGitSource(src string) (*gitSource, error) {
+	remote, fragment, _ := strings.Cut(src, "#")
+	if remote == "" {
+		return nil, fmt.Errorf("invalid git source %q: no repository specified", src)
+	}
+	source := &gitSource{Remote: strings.TrimPrefix(remote, "git+")}
+	source.Ref, source.Subdir, _ = strings.Cut(fragment, ":")
+	if source.Subdir != "" {
+		subdir := path.Clean(strings.TrimPrefix(source.Subdir, "/"))
+		if subdir == ".." || strings.HasPrefix(subdir, "../") {
+			return nil, fmt.Errorf("invalid git source %q: subdirectory %q is outside of the repository", src, source.Subdir)
+		}
+		if subdir == "." {
+			subdir = ""
+		}
+		source.Subdir = subdir
+	}
+	if strings.HasPrefix(source.Ref, "-") {
+		return nil, fmt.Errorf("invalid git source %q: invalid ref %q", src, source.Ref)
+	}
+	return source, nil
+}
+
+// cloneGitSource checks out the requested ref of the repository, along with
+// any submodules, into a new directory under tempDir and returns the location
+// of the new directory and the ID of the commit which was checked out. Unless
+// keepGitDir is set, the repository metadata is removed from the checkout.
+func cloneGitSource(ctx context.Context, source *gitSource, tempDir string, keepGitDir bool) (string, string, error) {
+	dir, err := ioutil.TempDir(tempDir, "git-")
+	if err != nil {
+		return "", "", fmt.Errorf("unable to create temporary directory for git source: %v", err)
+	}
+	git := func(args ...string) (string, error) {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		klog.V(5).Infof("Running git %v in %s", args, dir)
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("git %s failed: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimSpace(stdout.String()), nil
+	}
+	commit, err := func() (string, error) {
+		if _, err := git("init", "--quiet"); err != nil {
+			return "", err
+		}
+		if _, err := git("remote", "add", "origin", source.Remote); err != nil {
+			return "", err
+		}
+		ref := source.Ref
+		if ref == "" {
+			ref = "HEAD"
+		}
+		target := "FETCH_HEAD"
+		if _, err := git("fetch", "--quiet", "--depth=1", "--no-tags", "origin", ref); err != nil {
+			if !isGitCommitID(ref) {
+				return "", fmt.Errorf("unable to fetch %q from %s: %v", ref, source.Remote, err)
+			}
+			// not every server will hand out an arbitrary commit, so fetch
+			// everything and look for it locally
+			klog.V(4).Infof("Unable to fetch commit %s directly, fetching all of %s: %v", ref, source.Remote, err)
+			if _, err := git("fetch", "--quiet", "--tags", "origin"); err != nil {
+				return "", fmt.Errorf("unable to fetch %s: %v", source.Remote, err)
+			}
+			target = ref
+		}
+		if _, err := git("checkout", "--quiet", "--detach", target); err != nil {
+			return "", fmt.Errorf("unable to check out %q from %s: %v", ref, source.Remote, err)
+		}
+		if _, err := git("submodule", "update", "--quiet", "--init", "--recursive"); err != nil {
+			return "", fmt.Errorf("unable to update submodules of %s: %v", source.Remote, err)
+		}
+		commit, err := git("rev-parse", "HEAD")
+		if err != nil {
+			return "", err
+		}
+		if isGitCommitID(ref) && commit != ref {
+			return "", fmt.Errorf("checked out commit %s from %s, but commit %s was requested", commit, source.Remote, ref)
+		}
+		return commit, nil
+	}()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", "", err
+	}
+	klog.V(4).Infof("Checked out %s at %s into %s", source.Remote, commit, dir)
+	if !keepGitDir {
+		if err := removeGitMetadata(dir); err != nil {
+			os.RemoveAll(dir)
+			return "", "", err
+		}
+	}
+	// match the permissions the directory would have if it had been cloned
+	// normally instead of created as a temporary directory
+	if err := os.Chmod(dir, 0o755); err != nil {
+		os.RemoveAll(dir)
+		return "", "", err
+	}
+	return dir, commit, nil
+}
+
+// removeGitMetadata removes the .git directory from the top of a checkout,
+// along with the .git files that point submodules at it.
+func removeGitMetadata(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Name() != ".git" {
+			return nil
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// archiveFromGit clones the repository named by src and returns an archive of
+// its contents, or of the requested subdirectory's contents, placed under dst.
+// If opts.Checksum is set, it must be the full ID of the checked out commit.
+func archiveFromGit(ctx context.Context, src, dst, tempDir string, check DirectoryCheck, opts copyOptions) (io.Reader, io.Closer, error) {
+	checksum := strings.ToLower(opts.Checksum)
+	if checksum != "" && !isGitCommitID(checksum) {
+		return nil, nil, fmt.Errorf("invalid checksum %q for %s: expected a full commit ID", opts.Checksum, src)
+	}
+	source, err := parseGitSource(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir, commit, err := cloneGitSource(ctx, source, tempDir, opts.KeepGitDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() error { return os.RemoveAll(dir) }
+	if checksum != "" && commit != checksum {
+		cleanup()
+		return nil, nil, fmt.Errorf("expected checksum %s for %s, but checked out commit %s", opts.Checksum, src, commit)
+	}
+	root := dir
+	if source.Subdir != "" {
+		root, err = filepath.EvalSymlinks(filepath.Join(dir, filepath.FromSlash(source.Subdir)))
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("unable to find subdirectory %q in %s: %v", source.Subdir, source.Remote, err)
+		}
+		realDir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		if rel, err := filepath.Rel(realDir, root); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			cleanup()
+			return nil, nil, fmt.Errorf("subdirectory %q in %s is outside of the repository", source.Subdir, source.Remote)
+		}
+		info, err := os.Stat(root)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		if !info.IsDir() {
+			cleanup()
+			return nil, nil, fmt.Errorf("subdirectory %q in %s is not a directory", source.Subdir, source.Remote)
+		}
+	}
+	// the contents of the repository always end up inside of dst
+	r, closer, err := archiveFromDisk(filepath.Dir(root), filepath.Base(root)+"/", dst, false, nil, check, copyOptions{Excludes: opts.Excludes})
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return r, closers{closer.Close, cleanup}, nil
+}
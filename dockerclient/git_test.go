@@ -0,0 +1,364 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func Test_isGitURL(t *testing.T) {
+	testCases := []struct {
+		src   string
+		isGit bool
+	}{
+		{src: "https://github.com/openshift/imagebuilder.git", isGit: true},
+		{src: "https://github.com/openshift/imagebuilder.git#main:dockerclient", isGit: true},
+		{src: "http://example.com/repo.git/", isGit: true},
+		{src: "git@github.com:openshift/imagebuilder.git", isGit: true},
+		{src: "git://example.com/repo", isGit: true},
+		{src: "ssh://git@example.com/repo", isGit: true},
+		{src: "file:///srv/repo.git#v1.0", isGit: false},
+		{src: "https://example.com/archive.tar.gz", isGit: false},
+		{src: "https://example.com/file#frag.git", isGit: false},
+		{src: "file:///srv/file.txt", isGit: false},
+		{src: "repo.git", isGit: false},
+	}
+	for _, testCase := range testCases {
+		if isGit := isGitURL(testCase.src); isGit != testCase.isGit {
+			t.Errorf("isGitURL(%q): expected %t, got %t", testCase.src, testCase.isGit, isGit)
+		}
+	}
+}
+
+func Test_isGitSource(t *testing.T) {
+	testCases := []struct {
+		src        string
+		allowLocal bool
+		isGit      bool
+	}{
+		{src: "https://example.com/repo.git", isGit: true},
+		{src: "file:///home/user/secret.git", isGit: false},
+		{src: "file:///home/user/secret.git", allowLocal: true, isGit: true},
+		{src: "file:///home/user/file.txt", allowLocal: true, isGit: false},
+	}
+	for _, testCase := range testCases {
+		e := NewClientExecutor(nil)
+		e.AllowLocalGitRepositories = testCase.allowLocal
+		if isGit := e.isGitSource(testCase.src); isGit != testCase.isGit {
+			t.Errorf("isGitSource(%q) with local repositories allowed=%t: expected %t, got %t", testCase.src, testCase.allowLocal, testCase.isGit, isGit)
+		}
+	}
+}
+
+func Test_parseGitSource(t *testing.T) {
+	testCases := []struct {
+		src    string
+		expect *gitSource
+		err    bool
+	}{
+		{
+			src:    "https://example.com/repo.git",
+			expect: &gitSource{Remote: "https://example.com/repo.git"},
+		},
+		{
+			src:    "https://example.com/repo.git#v1.0",
+			expect: &gitSource{Remote: "https://example.com/repo.git", Ref: "v1.0"},
+		},
+		{
+			src:    "https://example.com/repo.git#v1.0:docs/",
+			expect: &gitSource{Remote: "https://example.com/repo.git", Ref: "v1.0", Subdir: "docs"},
+		},
+		{
+			src:    "git@example.com:repo.git#:/docs",
+			expect: &gitSource{Remote: "git@example.com:repo.git", Subdir: "docs"},
+		},
+		{
+			src:    "git+ssh://example.com/repo.git#main:.",
+			expect: &gitSource{Remote: "ssh://example.com/repo.git", Ref: "main"},
+		},
+		{
+			src: "https://example.com/repo.git#main:../escape",
+			err: true,
+		},
+		{
+			src: "https://example.com/repo.git#--upload-pack=evil",
+			err: true,
+		},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			source, err := parseGitSource(testCase.src)
+			if testCase.err {
+				if err == nil {
+					t.Fatalf("expected an error parsing %q, got %#v", testCase.src, source)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(testCase.expect, source) {
+				t.Errorf("unexpected result:\n%#v\n%#v", testCase.expect, source)
+			}
+		})
+	}
+}
+
+// gitTestRepository creates a bare repository named repo.git under dir, with a
+// "v1" tag pointing at its first commit, and returns its file:// URL along
+// with the IDs of the first and second commits.
+func gitTestRepository(t *testing.T, dir string) (string, string, string) {
+	work := filepath.Join(dir, "work")
+	bare := filepath.Join(dir, "repo.git")
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v: %s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	write := func(name, content string) {
+		name = filepath.Join(work, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(work, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	git(work, "init", "--quiet", "--initial-branch=main")
+	write("README", "first")
+	write("docs/index.md", "docs")
+	git(work, "add", ".")
+	git(work, "commit", "--quiet", "-m", "first")
+	git(work, "tag", "v1")
+	first := git(work, "rev-parse", "HEAD")
+	write("README", "second")
+	write("CHANGES", "second")
+	git(work, "add", ".")
+	git(work, "commit", "--quiet", "-m", "second")
+	second := git(work, "rev-parse", "HEAD")
+	git(dir, "clone", "--quiet", "--bare", work, bare)
+	return "file://" + filepath.ToSlash(bare), first, second
+}
+
+func Test_archiveFromGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	dir := t.TempDir()
+	repo, first, second := gitTestRepository(t, dir)
+	tempDir := t.TempDir()
+
+	testCases := []struct {
+		src        string
+		dst        string
+		keepGitDir bool
+		checksum   string
+		expect     []string
+		content    map[string]string
+		err        bool
+	}{
+		{
+			src:     repo,
+			dst:     "/app",
+			expect:  []string{"app/", "app/CHANGES", "app/README", "app/docs/", "app/docs/index.md"},
+			content: map[string]string{"app/README": "second"},
+		},
+		{
+			src:     repo + "#v1",
+			dst:     "/app/",
+			expect:  []string{"app/", "app/README", "app/docs/", "app/docs/index.md"},
+			content: map[string]string{"app/README": "first"},
+		},
+		{
+			src:     repo + "#" + first,
+			dst:     "/app",
+			expect:  []string{"app/", "app/README", "app/docs/", "app/docs/index.md"},
+			content: map[string]string{"app/README": "first"},
+		},
+		{
+			src:    repo + "#main:docs",
+			dst:    "/srv",
+			expect: []string{"srv/", "srv/index.md"},
+		},
+		{
+			src:      repo + "#main",
+			dst:      "/app",
+			checksum: second,
+			expect:   []string{"app/", "app/CHANGES", "app/README", "app/docs/", "app/docs/index.md"},
+		},
+		{
+			src:      repo + "#main",
+			dst:      "/app",
+			checksum: strings.ToUpper(second),
+			expect:   []string{"app/", "app/CHANGES", "app/README", "app/docs/", "app/docs/index.md"},
+		},
+		{
+			src:      repo + "#main",
+			dst:      "/app",
+			checksum: first,
+			err:      true,
+		},
+		{
+			// an abbreviated commit ID is not enough
+			src:      repo + "#main",
+			dst:      "/app",
+			checksum: second[:7],
+			err:      true,
+		},
+		{
+			src: repo + "#no-such-branch",
+			dst: "/app",
+			err: true,
+		},
+		{
+			src: repo + "#main:no-such-dir",
+			dst: "/app",
+			err: true,
+		},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			r, c, err := archiveFromGit(context.Background(), testCase.src, testCase.dst, tempDir, testDirectoryCheck(nil), copyOptions{KeepGitDir: testCase.keepGitDir, Checksum: testCase.checksum})
+			if testCase.err {
+				if err == nil {
+					c.Close()
+					t.Fatalf("expected an error archiving %q", testCase.src)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			found, content := readTestArchive(t, r)
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(testCase.expect, found) {
+				t.Errorf("unexpected files:\n%v\n%v", testCase.expect, found)
+			}
+			for name, expected := range testCase.content {
+				if content[name] != expected {
+					t.Errorf("unexpected content for %s: expected %q, got %q", name, expected, content[name])
+				}
+			}
+		})
+	}
+
+	t.Run("keep-git-dir", func(t *testing.T) {
+		// ADD without a container to copy into reads the repository
+		// through the executor's archive
+		e := NewClientExecutor(nil)
+		e.TempDir = tempDir
+		e.AllowLocalGitRepositories = true
+		r, c, err := e.archive(context.Background(), false, repo+"#v1", "/app", true, nil, copyOptions{KeepGitDir: true, Checksum: first})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, _ := readTestArchive(t, r)
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+		var sawGitDir bool
+		for _, name := range found {
+			if name == "app/.git/HEAD" {
+				sawGitDir = true
+			}
+		}
+		if !sawGitDir {
+			t.Errorf("expected app/.git/HEAD in %v", found)
+		}
+	})
+
+	t.Run("submodules", func(t *testing.T) {
+		// newer versions of git refuse to clone submodules from local paths by default
+		t.Setenv("GIT_CONFIG_COUNT", "1")
+		t.Setenv("GIT_CONFIG_KEY_0", "protocol.file.allow")
+		t.Setenv("GIT_CONFIG_VALUE_0", "always")
+		superDir := t.TempDir()
+		super, _, _ := gitTestRepository(t, superDir)
+		work := filepath.Join(superDir, "work")
+		for _, args := range [][]string{
+			{"submodule", "--quiet", "add", repo, "vendor/repo"},
+			{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "submodule"},
+			{"push", "--quiet", filepath.Join(superDir, "repo.git"), "main"},
+		} {
+			if out, err := exec.Command("git", append([]string{"-C", work}, args...)...).CombinedOutput(); err != nil {
+				t.Fatalf("git %v: %v: %s", args, err, out)
+			}
+		}
+		r, c, err := archiveFromGit(context.Background(), super+"#main", "/app", tempDir, testDirectoryCheck(nil), copyOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, content := readTestArchive(t, r)
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if content["app/vendor/repo/README"] != "second" {
+			t.Errorf("expected submodule contents in archive, got %v", content)
+		}
+		for name := range content {
+			if strings.HasSuffix(name, "/.git") || strings.Contains(name, "/.git/") {
+				t.Errorf("unexpected git metadata %s in archive", name)
+			}
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, _, err := archiveFromGit(ctx, repo, "/app", tempDir, testDirectoryCheck(nil), copyOptions{}); err == nil {
+			t.Fatalf("expected an error cloning with a cancelled context")
+		}
+	})
+
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected clones to be cleaned up, found %v", entries)
+	}
+}
+
+func readTestArchive(t *testing.T, r io.Reader) ([]string, map[string]string) {
+	var found []string
+	content := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		found = append(found, h.Name)
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content[h.Name] = string(data)
+	}
+	sort.Strings(found)
+	return found, content
+}
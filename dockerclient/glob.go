@@ -0,0 +1,202 @@
+package dockerclient
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// copyGlob matches the source of an ADD or COPY instruction which contains
+// wildcards, in the same way whether the source is read from the build
+// context, a context archive, or another image or stage. The pattern is split
+// into slash-separated segments, each of which is matched against one
+// component of a path using the rules of path.Match, so that a wildcard never
+// matches a "/" and a "\" escapes the character after it, except that a
+// segment which is exactly "**" matches any number of components, including
+// none unless it is the last segment.
+type copyGlob struct {
+	pattern  string
+	segments []string
+}
+
+// newCopyGlob parses pattern, which is relative to the top of the source.
+func newCopyGlob(pattern string) (*copyGlob, error) {
+	pattern = strings.Trim(path.Clean("/"+filepath.ToSlash(pattern)), "/")
+	g := &copyGlob{pattern: pattern}
+	if pattern == "" {
+		return g, nil
+	}
+	g.segments = strings.Split(pattern, "/")
+	for _, segment := range g.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return g, nil
+}
+
+// root returns the leading directories of the pattern which contain no
+// wildcards, with any escapes removed, which is the deepest directory that
+// every match is found under. It is empty if the first segment contains a
+// wildcard.
+func (g *copyGlob) root() string {
+	var root []string
+	for _, segment := range g.segments[:g.rootLength()] {
+		root = append(root, unescapeGlob(segment))
+	}
+	return path.Join(root...)
+}
+
+// relative returns the part of the pattern which follows its root.
+func (g *copyGlob) relative() string {
+	return path.Join(g.segments[g.rootLength():]...)
+}
+
+// rootLength returns the number of segments in the root of the pattern.
+func (g *copyGlob) rootLength() int {
+	for i, segment := range g.segments {
+		if i == len(g.segments)-1 || containsWildcards(segment) {
+			return i
+		}
+	}
+	return 0
+}
+
+// Match returns true if name, a slash-separated path relative to the top of
+// the source, matches the entire pattern.
+func (g *copyGlob) Match(name string) bool {
+	return matchSegments(g.segments, splitGlobName(name))
+}
+
+// Matched returns the shortest leading part of name which matches the entire
+// pattern, or false if name is neither a match nor found under one.
+func (g *copyGlob) Matched(name string) (string, bool) {
+	components := splitGlobName(name)
+	for i := 1; i <= len(components); i++ {
+		if matchSegments(g.segments, components[:i]) {
+			return path.Join(components[:i]...), true
+		}
+	}
+	return "", false
+}
+
+// mayContain returns false if nothing under the directory named dir, a
+// slash-separated path relative to the top of the source, can match the
+// pattern, so that a walk doesn't need to look inside it.
+func (g *copyGlob) mayContain(dir string) bool {
+	segments, components := g.segments, splitGlobName(dir)
+	for len(components) > 0 {
+		if len(segments) == 0 {
+			return false
+		}
+		if segments[0] == "**" {
+			return true
+		}
+		if ok, _ := path.Match(segments[0], components[0]); !ok {
+			return false
+		}
+		segments, components = segments[1:], components[1:]
+	}
+	return len(segments) > 0
+}
+
+// Walk returns the paths under directory, relative to it, which match the
+// pattern, in sorted order. Only the directories which can contain a match
+// are read, and the content of a directory which matches is not searched for
+// more matches, since copying the directory will copy all of it.
+func (g *copyGlob) Walk(directory string) ([]string, error) {
+	start := filepath.Join(directory, filepath.FromSlash(g.root()))
+	if _, err := os.Lstat(start); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var matches []string
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(directory, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if g.Match(rel) {
+			matches = append(matches, rel)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() && !g.mayContain(rel) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// matchSegments returns true if the path components in components match
+// every one of the pattern segments in segments.
+func matchSegments(segments, components []string) bool {
+	for len(segments) > 0 {
+		if segments[0] == "**" {
+			if len(segments) == 1 {
+				// a trailing "**" matches what is inside a directory,
+				// but not the directory itself
+				return len(components) > 0
+			}
+			for i := 0; i <= len(components); i++ {
+				if matchSegments(segments[1:], components[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(components) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(segments[0], components[0]); !ok {
+			return false
+		}
+		segments, components = segments[1:], components[1:]
+	}
+	return len(components) == 0
+}
+
+// splitGlobName splits a slash-separated path into its components.
+func splitGlobName(name string) []string {
+	name = strings.Trim(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// unescapeGlob removes the escapes from a pattern which contains no
+// wildcards, leaving the name it matches.
+func unescapeGlob(pattern string) string {
+	if !strings.Contains(pattern, `\`) {
+		return pattern
+	}
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+		}
+		b.WriteByte(pattern[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,300 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.podman.io/storage/pkg/archive"
+)
+
+func TestCopyGlob(t *testing.T) {
+	testCases := []struct {
+		pattern    string
+		root       string
+		relative   string
+		match      []string
+		noMatch    []string
+		matched    map[string]string
+		mayContain []string
+		pruned     []string
+	}{
+		{
+			pattern:    "a/*.go",
+			root:       "a",
+			relative:   "*.go",
+			match:      []string{"a/x.go", "/a/x.go", "a/.go"},
+			noMatch:    []string{"x.go", "a/b/x.go", "a/x.go/y", "b/x.go"},
+			matched:    map[string]string{"a/x.go/y": "a/x.go", "a/x.go": "a/x.go", "a": ""},
+			mayContain: []string{"", "a"},
+			pruned:     []string{"b", "a/b"},
+		},
+		{
+			pattern:    "**/*.go",
+			relative:   "**/*.go",
+			match:      []string{"x.go", "a/x.go", "a/b/c/x.go"},
+			noMatch:    []string{"x.txt", "a/x.go.txt"},
+			matched:    map[string]string{"a/b.go/c": "a/b.go", "a/b/c": ""},
+			mayContain: []string{"", "a", "a/b/c"},
+		},
+		{
+			pattern:    "src/**/test/*",
+			root:       "src",
+			relative:   "**/test/*",
+			match:      []string{"src/test/a", "src/a/b/test/a"},
+			noMatch:    []string{"src/test", "test/a", "src/a/test"},
+			mayContain: []string{"src", "src/a", "src/a/test"},
+			pruned:     []string{"test", "other/src"},
+		},
+		{
+			pattern:  "*/b",
+			relative: "*/b",
+			match:    []string{"a/b", "c/b"},
+			noMatch:  []string{"b", "a/c", "a/b/c"},
+			matched:  map[string]string{"a/b/c": "a/b"},
+			pruned:   []string{"a/b", "a/c"},
+		},
+		{
+			// escaped brackets and wildcards match themselves
+			pattern:  `e\[1\]/\*.go`,
+			root:     "e[1]",
+			relative: `\*.go`,
+			match:    []string{"e[1]/*.go"},
+			noMatch:  []string{"e1/*.go", "e[1]/x.go", `e\[1\]/*.go`},
+		},
+		{
+			pattern:  "e[[]1]/f?.go",
+			relative: "e[[]1]/f?.go",
+			match:    []string{"e[1]/fa.go"},
+			noMatch:  []string{"e1/fa.go", "e[1]/f.go"},
+		},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			g, err := newCopyGlob(testCase.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g.root() != testCase.root || g.relative() != testCase.relative {
+				t.Errorf("expected root %q and relative pattern %q, got %q and %q", testCase.root, testCase.relative, g.root(), g.relative())
+			}
+			for _, name := range testCase.match {
+				if !g.Match(name) {
+					t.Errorf("expected %q to match %q", name, testCase.pattern)
+				}
+			}
+			for _, name := range testCase.noMatch {
+				if g.Match(name) {
+					t.Errorf("expected %q not to match %q", name, testCase.pattern)
+				}
+			}
+			for name, expected := range testCase.matched {
+				match, ok := g.Matched(name)
+				if match != expected || ok != (expected != "") {
+					t.Errorf("expected %q to be under match %q, got %q %t", name, expected, match, ok)
+				}
+			}
+			for _, dir := range testCase.mayContain {
+				if !g.mayContain(dir) {
+					t.Errorf("expected %q to be searched for matches of %q", dir, testCase.pattern)
+				}
+			}
+			for _, dir := range testCase.pruned {
+				if g.mayContain(dir) {
+					t.Errorf("expected %q not to be searched for matches of %q", dir, testCase.pattern)
+				}
+			}
+		})
+	}
+
+	if _, err := newCopyGlob("a/[b"); err == nil {
+		t.Error("expected an unterminated [ to be rejected")
+	}
+}
+
+// writeGlobTree creates files at each of names under a new directory.
+func writeGlobTree(t *testing.T, names []string) string {
+	dir := t.TempDir()
+	for _, name := range names {
+		name = filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestCopyGlobWalk(t *testing.T) {
+	dir := writeGlobTree(t, []string{
+		"top.go",
+		"a/x.go",
+		"a/b/y.go",
+		"a/b/c/z.go",
+		"a/b/c/z.txt",
+		"b.go/inner.go",
+		"d/x.go",
+		"e[1]/f.go",
+	})
+	testCases := []struct {
+		pattern string
+		expect  []string
+	}{
+		{pattern: "*.go", expect: []string{"b.go", "top.go"}},
+		{pattern: "**/*.go", expect: []string{"a/b/c/z.go", "a/b/y.go", "a/x.go", "b.go", "d/x.go", "e[1]/f.go", "top.go"}},
+		{pattern: "a/**/z.*", expect: []string{"a/b/c/z.go", "a/b/c/z.txt"}},
+		{pattern: "a/**", expect: []string{"a/b", "a/x.go"}},
+		{pattern: "*/x.go", expect: []string{"a/x.go", "d/x.go"}},
+		{pattern: `e\[1\]/*`, expect: []string{"e[1]/f.go"}},
+		{pattern: "missing/*"},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			g, err := newCopyGlob(testCase.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			matches, err := g.Walk(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(testCase.expect, matches) {
+				t.Errorf("unexpected matches for %q:\nexpected: %v\nfound:    %v", testCase.pattern, testCase.expect, matches)
+			}
+		})
+	}
+}
+
+// TestCopyGlobSources checks that a pattern selects the same files whether
+// they're read from a directory, a context archive, or a container.
+func TestCopyGlobSources(t *testing.T) {
+	names := []string{
+		"top.go",
+		"a/x.go",
+		"a/b/y.go",
+		"a/b/c/z.go",
+		"a/b/c/z.txt",
+		"d/x.go",
+		"e[1]/f.go",
+	}
+	dir := writeGlobTree(t, names)
+	rc, err := archive.Tar(dir, archive.Uncompressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contextArchive := filepath.Join(t.TempDir(), "context.tar")
+	f, err := os.Create(contextArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(f, rc)
+	rc.Close()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := newArchiveIndex(contextArchive, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	readNames := func(r io.Reader) []string {
+		var found []string
+		tr := tar.NewReader(r)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Typeflag != tar.TypeDir {
+				found = append(found, strings.TrimPrefix(h.Name, "/"))
+			}
+		}
+		sort.Strings(found)
+		return found
+	}
+
+	testCases := []struct {
+		src    string
+		opts   copyOptions
+		expect []string
+	}{
+		{src: "**/*.go", expect: []string{"out/f.go", "out/top.go", "out/x.go", "out/x.go", "out/y.go", "out/z.go"}},
+		{src: "a/**/z.*", expect: []string{"out/z.go", "out/z.txt"}},
+		{src: "*/x.go", expect: []string{"out/x.go", "out/x.go"}},
+		{src: "a/*/c/*.txt", expect: []string{"out/z.txt"}},
+		{src: `e\[1\]/*`, expect: []string{"out/f.go"}},
+		{src: "e[[]1]/*.go", expect: []string{"out/f.go"}},
+		{src: "a/**/*.go", opts: copyOptions{Parents: true}, expect: []string{"out/a/b/c/z.go", "out/a/b/y.go", "out/a/x.go"}},
+		{src: "./**/x.go", opts: copyOptions{Parents: true}, expect: []string{"out/a/x.go", "out/d/x.go"}},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			r, c, err := archiveFromDisk(dir, testCase.src, "/out/", false, nil, testDirectoryCheck(nil), testCase.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found := readNames(r); !reflect.DeepEqual(testCase.expect, found) {
+				t.Errorf("unexpected files from directory:\nexpected: %v\nfound:    %v", testCase.expect, found)
+			}
+			c.Close()
+
+			r, c, err = archiveFromIndex(index, testCase.src, "/out/", nil, testDirectoryCheck(nil), testCase.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found := readNames(r); !reflect.DeepEqual(testCase.expect, found) {
+				t.Errorf("unexpected files from context archive:\nexpected: %v\nfound:    %v", testCase.expect, found)
+			}
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the daemon is asked for the deepest directory which can't be
+			// affected by wildcards, and names entries after its base name
+			_, src := splitParentsPivot(testCase.src)
+			g, err := newCopyGlob(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gen := newArchiveGenerator()
+			for _, name := range names {
+				if root := g.root(); root != "" {
+					if !strings.HasPrefix(name, root+"/") {
+						continue
+					}
+					name = path.Join(path.Base(root), strings.TrimPrefix(name, root+"/"))
+				}
+				gen.File(name)
+			}
+			rc, archiveRoot, err := archiveFromContainer(gen.Reader(), "/"+testCase.src, "/out/", nil, testDirectoryCheck(nil), nil, false, testCase.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := path.Join("/", g.root()); path.Clean(archiveRoot) != expected {
+				t.Errorf("expected the container to be asked for %q, got %q", expected, archiveRoot)
+			}
+			if found := readNames(rc); !reflect.DeepEqual(testCase.expect, found) {
+				t.Errorf("unexpected files from container:\nexpected: %v\nfound:    %v", testCase.expect, found)
+			}
+			if err := rc.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"fmt"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"go.podman.io/storage/pkg/idtools"
+)
+
+// ParseIDMappings returns the ID mappings described by uidMap and gidMap, each
+// a comma separated list of container-ID:host-ID:size triples. If only one of
+// them is set, it is used for both user and group IDs.
+func ParseIDMappings(uidMap, gidMap string) (*idtools.IDMappings, error) {
+	if uidMap == "" {
+		uidMap = gidMap
+	}
+	if gidMap == "" {
+		gidMap = uidMap
+	}
+	uids, err := idtools.ParseIDMap(strings.Split(uidMap, ","), "UID map")
+	if err != nil {
+		return nil, err
+	}
+	gids, err := idtools.ParseIDMap(strings.Split(gidMap, ","), "GID map")
+	if err != nil {
+		return nil, err
+	}
+	return idtools.NewIDMappingsFromMaps(uids, gids), nil
+}
+
+// DaemonRemapsIDs returns true if the daemon described by info runs containers
+// in a user namespace of its own, as dockerd does with --userns-remap. Such a
+// daemon translates the ownership of files in archives it's sent and returns,
+// so they must not be translated again.
+func DaemonRemapsIDs(info *docker.DockerInfo) bool {
+	for _, option := range info.SecurityOptions {
+		for _, field := range strings.Split(option, ",") {
+			if field == "name=userns" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mapToHost replaces the owner of h, an ID in the build container, with the
+// ID which the daemon stores it as. Nothing is changed if mappings is nil.
+func mapToHost(mappings *idtools.IDMappings, h *tar.Header) error {
+	if mappings == nil || mappings.Empty() {
+		return nil
+	}
+	ids, err := mappings.ToHost(idtools.IDPair{UID: h.Uid, GID: h.Gid})
+	if err != nil {
+		return fmt.Errorf("unable to map the owner %d:%d of %s outside of the container: %v", h.Uid, h.Gid, h.Name, err)
+	}
+	h.Uid, h.Gid = ids.UID, ids.GID
+	if (h.Uid > 0x1fffff || h.Gid > 0x1fffff) && h.Format == tar.FormatUSTAR {
+		h.Format = tar.FormatPAX
+	}
+	return nil
+}
+
+// mapToContainer replaces the owner of h, an ID which the daemon stores it
+// as, with the ID it has in the build container. Nothing is changed if
+// mappings is nil.
+func mapToContainer(mappings *idtools.IDMappings, h *tar.Header) error {
+	if mappings == nil || mappings.Empty() {
+		return nil
+	}
+	uid, gid, err := mappings.ToContainer(idtools.IDPair{UID: h.Uid, GID: h.Gid})
+	if err != nil {
+		return fmt.Errorf("unable to map the owner %d:%d of %s into the container: %v", h.Uid, h.Gid, h.Name, err)
+	}
+	h.Uid, h.Gid = uid, gid
+	return nil
+}
@@ -0,0 +1,224 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"go.podman.io/storage/pkg/idtools"
+
+	"github.com/openshift/imagebuilder"
+)
+
+func TestParseIDMappings(t *testing.T) {
+	testCases := []struct {
+		uidMap, gidMap string
+		uids, gids     []idtools.IDMap
+		err            bool
+	}{
+		{
+			uidMap: "0:100000:65536",
+			uids:   []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+			gids:   []idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		},
+		{
+			uidMap: "0:1000:1,1:100000:65535",
+			gidMap: "0:2000:1",
+			uids:   []idtools.IDMap{{ContainerID: 0, HostID: 1000, Size: 1}, {ContainerID: 1, HostID: 100000, Size: 65535}},
+			gids:   []idtools.IDMap{{ContainerID: 0, HostID: 2000, Size: 1}},
+		},
+		{
+			gidMap: "0:2000:1",
+			uids:   []idtools.IDMap{{ContainerID: 0, HostID: 2000, Size: 1}},
+			gids:   []idtools.IDMap{{ContainerID: 0, HostID: 2000, Size: 1}},
+		},
+		{uidMap: "0:100000", err: true},
+		{uidMap: "root:100000:1", err: true},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			mappings, err := ParseIDMappings(testCase.uidMap, testCase.gidMap)
+			if testCase.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %#v", mappings)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(testCase.uids, mappings.UIDs()) || !reflect.DeepEqual(testCase.gids, mappings.GIDs()) {
+				t.Errorf("unexpected mappings: %v %v", mappings.UIDs(), mappings.GIDs())
+			}
+		})
+	}
+}
+
+func TestDaemonRemapsIDs(t *testing.T) {
+	testCases := []struct {
+		options []string
+		expect  bool
+	}{
+		{options: []string{"name=seccomp,profile=builtin"}},
+		{options: []string{"name=seccomp,profile=builtin", "name=userns"}, expect: true},
+		{options: []string{"name=rootless"}},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			if DaemonRemapsIDs(&docker.DockerInfo{SecurityOptions: testCase.options}) != testCase.expect {
+				t.Errorf("expected %t for %v", testCase.expect, testCase.options)
+			}
+		})
+	}
+}
+
+func TestArchiveFromContainerMapsOwners(t *testing.T) {
+	mappings := idtools.NewIDMappingsFromMaps(
+		[]idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		[]idtools.IDMap{{ContainerID: 0, HostID: 200000, Size: 65536}},
+	)
+	gen := &archiveGenerator{Headers: []*tar.Header{
+		{Name: "src/", Typeflag: tar.TypeDir, Uid: 100000, Gid: 200000},
+		{Name: "src/file", Typeflag: tar.TypeReg, Uid: 101000, Gid: 201000},
+	}}
+	r, _, err := archiveFromContainer(gen.Reader(), "/src/", "/dst/", nil, testDirectoryCheck(nil), nil, false, copyOptions{idMappings: mappings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var owners []string
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		owners = append(owners, fmt.Sprintf("%s %d:%d", h.Name, h.Uid, h.Gid))
+	}
+	if expect := []string{"/dst 0:0", "/dst/file 1000:1000"}; !reflect.DeepEqual(expect, owners) {
+		t.Errorf("unexpected owners:\nexpected: %v\nfound:    %v", expect, owners)
+	}
+
+	// an owner which isn't mapped into the container can't be copied
+	gen = &archiveGenerator{Headers: []*tar.Header{{Name: "src/file", Typeflag: tar.TypeReg, Uid: 0, Gid: 0}}}
+	r, _, err = archiveFromContainer(gen.Reader(), "/src/", "/dst/", nil, testDirectoryCheck(nil), nil, false, copyOptions{idMappings: mappings})
+	if err == nil {
+		_, err = io.Copy(io.Discard, r)
+	}
+	if err == nil || !strings.Contains(err.Error(), "unable to map the owner") {
+		t.Errorf("expected an unmapped owner to be rejected, got %v", err)
+	}
+}
+
+func TestIDMappingsUploads(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	var uploaded []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/containers/build/archive") {
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+			return
+		}
+		if r.Method != http.MethodPut {
+			http.NotFound(w, r)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		tr := tar.NewReader(r.Body)
+		for {
+			h, err := tr.Next()
+			if err != nil {
+				return
+			}
+			uploaded = append(uploaded, fmt.Sprintf("%s %d:%d", strings.Trim(h.Name, "/"), h.Uid, h.Gid))
+		}
+	}))
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+
+	testCases := []struct {
+		run    func(e *ClientExecutor) error
+		expect []string
+		err    string
+	}{
+		{
+			run: func(e *ClientExecutor) error {
+				return e.CopyContext(context.Background(), nil, imagebuilder.Copy{Src: []string{"file"}, Dest: "/dst/"})
+			},
+			expect: []string{"dst/file 100000:200000"},
+		},
+		{
+			run: func(e *ClientExecutor) error {
+				return e.CopyContext(context.Background(), nil, imagebuilder.Copy{Src: []string{"file"}, Dest: "/dst/", Chown: "1000:1001"})
+			},
+			// the missing parents of the destination are created with the
+			// same owner
+			expect: []string{" 101000:201001", "dst 101000:201001", "dst/file 101000:201001"},
+		},
+		{
+			run: func(e *ClientExecutor) error {
+				return e.CopyContext(context.Background(), nil, imagebuilder.Copy{Src: []string{"file"}, Dest: "/dst/", Chown: "70000:0"})
+			},
+			err: "unable to map the owner 70000:0",
+		},
+		{
+			run: func(e *ClientExecutor) error {
+				return e.EnsureContainerPathAs("/work", "1000:1001", nil)
+			},
+			expect: []string{" 101000:201001", "work 101000:201001"},
+		},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			lock.Lock()
+			uploaded = nil
+			lock.Unlock()
+			e := NewClientExecutor(client)
+			e.Directory = dir
+			e.Container = &docker.Container{ID: "build"}
+			e.IDMappings = idtools.NewIDMappingsFromMaps(
+				[]idtools.IDMap{{ContainerID: 0, HostID: 100000, Size: 65536}},
+				[]idtools.IDMap{{ContainerID: 0, HostID: 200000, Size: 65536}},
+			)
+			err := testCase.run(e)
+			if err == nil {
+				err = e.flushUploads()
+			}
+			if testCase.err != "" {
+				if err == nil || !strings.Contains(err.Error(), testCase.err) {
+					t.Fatalf("expected an error containing %q, got %v", testCase.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if !reflect.DeepEqual(testCase.expect, uploaded) {
+				t.Errorf("unexpected uploads:\nexpected: %v\nfound:    %v", testCase.expect, uploaded)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package dockerclient
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// keepaliveDir is where the volume containing the keepalive process is
+// mounted in the build container. /dev is a tmpfs, so the mount point is
+// never part of the container's filesystem, and can't be committed.
+const keepaliveDir = "/dev/.imagebuilder"
+
+// keepaliveUploadDir is where the volume containing the keepalive process is
+// mounted in the container which is used to write the process into it.
+const keepaliveUploadDir = "/.imagebuilder-keepalive"
+
+// keepaliveName is the name of the keepalive process in keepaliveDir.
+const keepaliveName = "keepalive"
+
+// keepaliveCode is the machine code for each architecture which loops forever
+// waiting for a signal, without using any memory or libraries.
+var keepaliveCode = map[string]struct {
+	machine uint16
+	code    []byte
+}{
+	"amd64": {
+		machine: 62, // EM_X86_64
+		code: []byte{
+			0xb8, 0x22, 0x00, 0x00, 0x00, // mov eax, 34 (pause)
+			0x0f, 0x05, // syscall
+			0xeb, 0xf7, // jmp to the start
+		},
+	},
+	"arm64": {
+		machine: 183, // EM_AARCH64
+		code: arm64Code(
+			0xd2800000, // mov x0, #0
+			0xd2800001, // mov x1, #0
+			0xd2800002, // mov x2, #0
+			0xd2800003, // mov x3, #0
+			0xd2800928, // mov x8, #73 (ppoll)
+			0xd4000001, // svc #0
+			0x17fffffa, // b to the start
+		),
+	},
+}
+
+func arm64Code(instructions ...uint32) []byte {
+	code := make([]byte, 4*len(instructions))
+	for i, instruction := range instructions {
+		binary.LittleEndian.PutUint32(code[4*i:], instruction)
+	}
+	return code
+}
+
+// keepaliveBinary returns a static Linux executable for the architecture
+// which waits until it is killed, or nil if there isn't one for the platform.
+// The build container runs it instead of a command from the image, so that
+// the image doesn't need to contain a shell or sleep.
+func keepaliveBinary(os, arch string) []byte {
+	if os != "" && os != "linux" {
+		return nil
+	}
+	if arch == "" {
+		arch = "amd64"
+	}
+	keepalive, ok := keepaliveCode[arch]
+	if !ok {
+		return nil
+	}
+
+	// a 64-bit little-endian ELF header, followed by a single program
+	// header which loads the whole file, followed by the code
+	const (
+		vaddr      = 0x400000
+		headerSize = 64
+		phSize     = 56
+	)
+	size := uint64(headerSize + phSize + len(keepalive.code))
+	buf := &bytes.Buffer{}
+	buf.Write([]byte{0x7f, 'E', 'L', 'F', 2, 1, 1, 0})
+	buf.Write(make([]byte, 8))
+	for _, v := range []interface{}{
+		uint16(2), // ET_EXEC
+		keepalive.machine,
+		uint32(1),                           // EV_CURRENT
+		uint64(vaddr + headerSize + phSize), // entry point
+		uint64(headerSize),                  // program header offset
+		uint64(0),                           // section header offset
+		uint32(0),                           // flags
+		uint16(headerSize),
+		uint16(phSize),
+		uint16(1), // program header count
+		uint16(0), // section header size
+		uint16(0), // section header count
+		uint16(0), // section name table index
+		uint32(1), // PT_LOAD
+		uint32(5), // PF_R|PF_X
+		uint64(0), // offset
+		uint64(vaddr),
+		uint64(vaddr),
+		size, // size in file
+		size, // size in memory
+		uint64(0x10000),
+	} {
+		binary.Write(buf, binary.LittleEndian, v)
+	}
+	buf.Write(keepalive.code)
+	return buf.Bytes()
+}
@@ -0,0 +1,82 @@
+package dockerclient
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveBinary(t *testing.T) {
+	testCases := []struct {
+		os, arch string
+		machine  elf.Machine
+	}{
+		{os: "linux", arch: "amd64", machine: elf.EM_X86_64},
+		{os: "", arch: "", machine: elf.EM_X86_64},
+		{os: "linux", arch: "arm64", machine: elf.EM_AARCH64},
+		{os: "linux", arch: "s390x"},
+		{os: "windows", arch: "amd64"},
+	}
+	for i, test := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			data := keepaliveBinary(test.os, test.arch)
+			if test.machine == 0 {
+				if data != nil {
+					t.Fatalf("expected no keepalive process for %s/%s", test.os, test.arch)
+				}
+				return
+			}
+			f, err := elf.NewFile(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Machine != test.machine || f.Type != elf.ET_EXEC || f.Class != elf.ELFCLASS64 {
+				t.Errorf("unexpected header: %#v", f.FileHeader)
+			}
+			if len(f.Progs) != 1 {
+				t.Fatalf("expected one program header, got %d", len(f.Progs))
+			}
+			prog := f.Progs[0]
+			if prog.Type != elf.PT_LOAD || prog.Filesz != uint64(len(data)) || f.Entry < prog.Vaddr || f.Entry >= prog.Vaddr+prog.Memsz {
+				t.Errorf("entry point %x is not in the loaded segment %#v", f.Entry, prog.ProgHeader)
+			}
+		})
+	}
+}
+
+func TestKeepaliveRuns(t *testing.T) {
+	data := keepaliveBinary(runtime.GOOS, runtime.GOARCH)
+	if data == nil {
+		t.Skipf("no keepalive process for %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+	name := filepath.Join(t.TempDir(), keepaliveName)
+	if err := os.WriteFile(name, data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(name)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		t.Fatalf("keepalive process exited: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("keepalive process did not exit when it was signalled")
+	}
+}
@@ -0,0 +1,568 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"k8s.io/klog"
+
+	"github.com/openshift/imagebuilder"
+)
+
+// imageArchiveManifest is an entry in the manifest.json file of an archive
+// produced by "docker save" or consumed by "docker load".
+type imageArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// imageRootFS describes the layers of an image in its configuration blob.
+type imageRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// imageHistory is an entry in the history of an image's configuration blob.
+type imageHistory struct {
+	Created    time.Time `json:"created"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+// copyLinked performs an ADD or COPY with --link. Rather than copying content
+// into the build container, where the result would depend on what's already
+// there, the content is copied into an otherwise empty container, and the
+// layer that produces is stacked on top of the build container's filesystem.
+// Since the layer doesn't depend on anything below it, its digest stays the
+// same when the base image changes.
+func (e *ClientExecutor) copyLinked(ctx context.Context, excludes []string, c imagebuilder.Copy) error {
+	// the build container is committed, so it needs any content which is
+	// still being uploaded
+	if err := e.flushUploads(); err != nil {
+		return err
+	}
+	if c.Chown != "" {
+		// names have to be resolved using the build container's
+		// contents, since the container we copy into will be empty
+		uid, gid, err := e.getUser(ctx, c.Chown)
+		if err != nil {
+			return fmt.Errorf("--chown=%s: %w", c.Chown, err)
+		}
+		c.Chown = fmt.Sprintf("%d:%d", uid, gid)
+	}
+	layer, diffID, err := e.buildLinkedLayer(ctx, excludes, c)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(layer)
+	createdBy := fmt.Sprintf("%s --link %s %s", linkedInstruction(c), strings.Join(c.Src, " "), c.Dest)
+	return e.stackLayer(ctx, layer, diffID, createdBy)
+}
+
+// linkedInstruction returns the name of the instruction which requested c.
+func linkedInstruction(c imagebuilder.Copy) string {
+	if c.Download {
+		return "ADD"
+	}
+	return "COPY"
+}
+
+// buildLinkedLayer copies content into an empty container and returns the
+// location of a file containing the resulting layer, along with its diffID.
+func (e *ClientExecutor) buildLinkedLayer(ctx context.Context, excludes []string, c imagebuilder.Copy) (string, string, error) {
+	scratch, err := e.createScratchImage(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to create a scratch image for --link: %v", err)
+	}
+	defer e.removeImage(scratch)
+	container, err := e.Client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image: scratch,
+			Cmd:   []string{"#(imagebuilder)"},
+		},
+		Context: ctx,
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("unable to create a container for --link: %v", err)
+	}
+	defer e.removeContainer(container.ID)
+
+	// any path checks made while copying should be made against the empty
+	// container, not the build container
+	linked := *e
+	linked.Container = container
+	linked.Deferred = nil
+	linked.Volumes = nil
+	linked.paths = nil
+	linked.uploads = nil
+	linked.batchUploads = false
+	err = linked.copyContainer(ctx, container, excludes, c)
+	e.Deferred = append(linked.Deferred, e.Deferred...)
+	if err != nil {
+		return "", "", err
+	}
+
+	image, err := e.Client.CommitContainer(docker.CommitContainerOptions{
+		Container: container.ID,
+		Context:   ctx,
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("unable to commit --link content: %v", err)
+	}
+	defer e.removeImage(image.ID)
+
+	saved, err := ioutil.TempFile(e.TempDir, "linked-image")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(saved.Name())
+	err = e.Client.ExportImage(docker.ExportImageOptions{
+		Name:         image.ID,
+		OutputStream: saved,
+		Context:      ctx,
+	})
+	if err := saved.Close(); err != nil {
+		return "", "", err
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("unable to export --link content: %v", err)
+	}
+	return extractTopLayer(saved.Name(), e.TempDir)
+}
+
+// stackLayer commits the build container, adds the layer to the resulting
+// image, with a history entry which records createdBy, and replaces the build
+// container with one based on that image.
+func (e *ClientExecutor) stackLayer(ctx context.Context, layer, diffID, createdBy string) error {
+	base, err := e.commitBuildContainer(ctx)
+	if err != nil {
+		return err
+	}
+	// the configuration is rebuilt from the daemon's description of the
+	// image, so that the new image keeps the history and any fields which
+	// the daemon reports that we don't know about
+	baseConfig, _, err := e.imageConfig(ctx, base.ID, false)
+	if err != nil {
+		return fmt.Errorf("unable to read configuration of build container image: %v", err)
+	}
+
+	image, err := e.loadImageArchive(ctx, "imagebuilder-link-", func(w io.Writer, tag string) error {
+		return writeStackedImageArchive(w, baseConfig, layer, diffID, createdBy, tag)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to load image with --link content: %v", err)
+	}
+	klog.V(4).Infof("Stacked layer %s on top of %s as %s", diffID, base.ID, image.ID)
+	return e.replaceBuildContainer(ctx, image.ID)
+}
+
+// commitBuildContainer commits the build container as an intermediate image,
+// which is removed when the build is released.
+func (e *ClientExecutor) commitBuildContainer(ctx context.Context) (*docker.Image, error) {
+	image, err := e.Client.CommitContainer(docker.CommitContainerOptions{
+		Container: e.Container.ID,
+		Context:   ctx,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to commit build container: %v", err)
+	}
+	// as with other intermediate images, removing this one will fail if it
+	// ends up being an ancestor of the final image, so ignore errors
+	e.Deferred = append([]func() error{func() error { e.removeImage(image.ID); return nil }}, e.Deferred...)
+	return image, nil
+}
+
+// replaceBuildContainer replaces the build container with one based on image,
+// and starts it if the build container was running.
+func (e *ClientExecutor) replaceBuildContainer(ctx context.Context, image string) error {
+	opts := e.containerOptionsFor(image)
+	opts.Context = ctx
+	container, err := e.Client.CreateContainer(opts)
+	if err != nil {
+		return fmt.Errorf("unable to create build container: %v", err)
+	}
+	e.Deferred = append([]func() error{func() error { return e.removeContainer(container.ID) }}, e.Deferred...)
+	running := e.Container.State.Running
+	container.Config = e.Container.Config
+	if err := e.removeContainer(e.Container.ID); err != nil {
+		return err
+	}
+	e.Container = container
+	if running {
+		if err := e.Client.StartContainerWithContext(e.Container.ID, nil, ctx); err != nil {
+			return fmt.Errorf("unable to start build container: %v", err)
+		}
+		e.Container.State.Running = true
+	}
+	return nil
+}
+
+// containerOptionsFor returns options for creating a replacement for the build
+// container, based on the specified image.
+func (e *ClientExecutor) containerOptionsFor(image string) docker.CreateContainerOptions {
+	var opts docker.CreateContainerOptions
+	if e.containerOptions != nil {
+		opts = *e.containerOptions
+		config := *opts.Config
+		opts.Config = &config
+	} else {
+		// we didn't create the container, so do our best to imitate it
+		opts.Config = &docker.Config{}
+		if e.Container.Config != nil {
+			opts.Config.Cmd = e.Container.Config.Cmd
+			opts.Config.Entrypoint = e.Container.Config.Entrypoint
+		}
+		opts.HostConfig = e.Container.HostConfig
+	}
+	opts.Config.Image = image
+	return opts
+}
+
+// loadImageArchive loads the image which write writes an archive of, in the
+// format expected by "docker load", into the daemon and returns it. The image
+// is tagged with prefix followed by a random string, which write is passed as
+// the tag to use in the archive, and is untagged when the build is released.
+func (e *ClientExecutor) loadImageArchive(ctx context.Context, prefix string, write func(w io.Writer, tag string) error) (*docker.Image, error) {
+	random, err := randSeq(imageSafeCharacters, 24)
+	if err != nil {
+		return nil, err
+	}
+	tag := prefix + random + ":latest"
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(write(pw, tag))
+	}()
+	err = e.Client.LoadImage(docker.LoadImageOptions{
+		InputStream:  pr,
+		OutputStream: ioutil.Discard,
+		Context:      ctx,
+	})
+	pr.Close()
+	if err != nil {
+		return nil, err
+	}
+	// as with other intermediate images, removing this one will fail if it
+	// ends up being an ancestor of the final image, so ignore errors
+	e.Deferred = append([]func() error{func() error { e.removeImage(tag); return nil }}, e.Deferred...)
+	return e.Client.InspectImage(tag)
+}
+
+// imageConfig returns a configuration blob for an image and the image's
+// layers. The blob is built from what the daemon reports when the image is
+// inspected, so none of the image's layers have to be read. If dropVolumes is
+// set, the volumes which the image declares are left out.
+func (e *ClientExecutor) imageConfig(ctx context.Context, image string, dropVolumes bool) ([]byte, []string, error) {
+	inspect, err := e.inspectImageRaw(ctx, image)
+	if err != nil {
+		return nil, nil, err
+	}
+	if data, ok := inspect["Config"]; ok && dropVolumes && string(data) != "null" {
+		var runConfig map[string]json.RawMessage
+		if err := json.Unmarshal(data, &runConfig); err != nil {
+			return nil, nil, fmt.Errorf("unable to parse image configuration: %v", err)
+		}
+		delete(runConfig, "Volumes")
+		if inspect["Config"], err = json.Marshal(runConfig); err != nil {
+			return nil, nil, err
+		}
+	}
+	history, err := e.Client.ImageHistory(image)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read history of image: %v", err)
+	}
+	return imageConfigFromInspect(inspect, history)
+}
+
+// inspectImageRaw returns the daemon's description of image as it was sent,
+// so that fields which the client doesn't know about are kept.
+func (e *ClientExecutor) inspectImageRaw(ctx context.Context, image string) (map[string]json.RawMessage, error) {
+	if e.Client.HTTPClient == nil {
+		return nil, fmt.Errorf("the client has no HTTP client")
+	}
+	u, err := apiURL(e.Client, "/images/"+url.PathEscape(image)+"/json")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := e.Client.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to inspect image %s: unexpected status %q from the daemon", image, resp.Status)
+	}
+	var inspect map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return nil, fmt.Errorf("unable to parse description of image %s: %v", image, err)
+	}
+	return inspect, nil
+}
+
+// inspectConfigFields maps the fields of the daemon's description of an image
+// to the fields of the image's configuration blob which they were read from.
+var inspectConfigFields = map[string]string{
+	"Architecture":  "architecture",
+	"Variant":       "variant",
+	"Os":            "os",
+	"OsVersion":     "os.version",
+	"OsFeatures":    "os.features",
+	"Created":       "created",
+	"Author":        "author",
+	"Comment":       "comment",
+	"DockerVersion": "docker_version",
+}
+
+// imageConfigFromInspect returns an image configuration blob built from
+// inspect, the daemon's description of an image, and history, the entries
+// which it reports as the image's history, newest first. The image's layers
+// are returned along with it.
+func imageConfigFromInspect(inspect map[string]json.RawMessage, history []docker.ImageHistory) ([]byte, []string, error) {
+	raw := make(map[string]json.RawMessage)
+	for from, to := range inspectConfigFields {
+		if data, ok := inspect[from]; ok && string(data) != "null" && string(data) != `""` {
+			raw[to] = data
+		}
+	}
+	if data, ok := inspect["Config"]; ok && string(data) != "null" {
+		raw["config"] = data
+	}
+	var rootFS struct {
+		Type   string
+		Layers []string
+	}
+	if data, ok := inspect["RootFS"]; ok {
+		if err := json.Unmarshal(data, &rootFS); err != nil {
+			return nil, nil, fmt.Errorf("unable to parse layers of image: %v", err)
+		}
+	}
+	if rootFS.Type == "" {
+		rootFS.Type = "layers"
+	}
+
+	// the daemon only reports the size of each entry's layer, so an entry
+	// with an empty layer is taken to have none, and no more entries than
+	// there are layers can have one
+	entries := make([]imageHistory, 0, len(history))
+	layers := 0
+	for i := len(history) - 1; i >= 0; i-- {
+		h := history[i]
+		empty := h.Size == 0 || layers == len(rootFS.Layers)
+		if !empty {
+			layers++
+		}
+		entries = append(entries, imageHistory{
+			Created:    time.Unix(h.Created, 0).UTC(),
+			CreatedBy:  h.CreatedBy,
+			Comment:    h.Comment,
+			EmptyLayer: empty,
+		})
+	}
+	var err error
+	if raw["rootfs"], err = json.Marshal(imageRootFS{Type: rootFS.Type, DiffIDs: rootFS.Layers}); err != nil {
+		return nil, nil, err
+	}
+	if len(entries) > 0 {
+		if raw["history"], err = json.Marshal(entries); err != nil {
+			return nil, nil, err
+		}
+	}
+	config, err := json.Marshal(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, rootFS.Layers, nil
+}
+
+// extractTopLayer reads the archive of a saved image and writes its topmost
+// layer to a temporary file, returning the file's location and the layer's
+// diffID.
+func extractTopLayer(savedImage, tempDir string) (string, string, error) {
+	find := func(name string, fn func(*tar.Header, io.Reader) error) error {
+		f, err := os.Open(savedImage)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		tr := tar.NewReader(f)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				return fmt.Errorf("%s not found in saved image: %w", name, os.ErrNotExist)
+			}
+			if err != nil {
+				return err
+			}
+			if path.Clean(h.Name) == name {
+				return fn(h, tr)
+			}
+		}
+	}
+
+	var manifest []imageArchiveManifest
+	if err := find("manifest.json", func(_ *tar.Header, r io.Reader) error {
+		return json.NewDecoder(r).Decode(&manifest)
+	}); err != nil {
+		return "", "", fmt.Errorf("unable to read manifest of saved image: %v", err)
+	}
+	if len(manifest) != 1 || len(manifest[0].Layers) == 0 {
+		return "", "", fmt.Errorf("unexpected manifest in saved image: %#v", manifest)
+	}
+
+	f, err := ioutil.TempFile(tempDir, "linked-layer")
+	if err != nil {
+		return "", "", err
+	}
+	digester := sha256.New()
+	name := path.Clean(manifest[0].Layers[len(manifest[0].Layers)-1])
+	// newer versions of the daemon may write the layer once and link to it
+	for hops := 0; hops < 8 && name != ""; hops++ {
+		err = find(name, func(h *tar.Header, r io.Reader) error {
+			if h.Typeflag == tar.TypeSymlink {
+				name = path.Join(path.Dir(name), h.Linkname)
+				return nil
+			}
+			name = ""
+			_, err := io.Copy(io.MultiWriter(f, digester), r)
+			return err
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil && name != "" {
+		err = fmt.Errorf("too many levels of symbolic links in saved image")
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", "", fmt.Errorf("unable to read layer from saved image: %v", err)
+	}
+	return f.Name(), "sha256:" + hex.EncodeToString(digester.Sum(nil)), nil
+}
+
+// writeStackedImageArchive writes an archive in the format expected by "docker
+// load", describing an image which consists of the layers of the image whose
+// configuration blob is baseConfig, followed by the layer stored in the file
+// at layerPath. The new image's configuration is the base image's, with the
+// layer and a history entry for it, which records createdBy, appended. Only
+// the new layer is included in the archive; the daemon reuses the ones which
+// it already has.
+func writeStackedImageArchive(w io.Writer, baseConfig []byte, layerPath, diffID, createdBy, tag string) error {
+	// fields we don't need to change are passed through untouched
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(baseConfig, &raw); err != nil {
+		return fmt.Errorf("unable to parse base image configuration: %v", err)
+	}
+	var rootFS imageRootFS
+	if data, ok := raw["rootfs"]; ok {
+		if err := json.Unmarshal(data, &rootFS); err != nil {
+			return fmt.Errorf("unable to parse layers of base image: %v", err)
+		}
+	}
+	var history []json.RawMessage
+	if data, ok := raw["history"]; ok {
+		if err := json.Unmarshal(data, &history); err != nil {
+			return fmt.Errorf("unable to parse history of base image: %v", err)
+		}
+	}
+	created := time.Now().UTC()
+	rootFS.Type = "layers"
+	rootFS.DiffIDs = append(append([]string{}, rootFS.DiffIDs...), diffID)
+	entry, err := json.Marshal(imageHistory{Created: created, CreatedBy: createdBy})
+	if err != nil {
+		return err
+	}
+	history = append(history, entry)
+	for key, value := range map[string]interface{}{"created": created, "rootfs": rootFS, "history": history} {
+		if raw[key], err = json.Marshal(value); err != nil {
+			return err
+		}
+	}
+	configBytes, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return writeImageArchive(w, configBytes, rootFS.DiffIDs, tag, layerPath)
+}
+
+// writeImageArchive writes an archive in the format expected by "docker load",
+// describing an image with the configuration blob config and the layers
+// diffIDs, and tagged tag. If layerPath is set, the file there is included as
+// the last of the layers, which the daemon doesn't have yet. The daemon reuses
+// the other layers, which it already has.
+func writeImageArchive(w io.Writer, config []byte, diffIDs []string, tag, layerPath string) error {
+	configSum := sha256.Sum256(config)
+	manifest := []imageArchiveManifest{{
+		Config:   hex.EncodeToString(configSum[:]) + ".json",
+		RepoTags: []string{tag},
+	}}
+	for _, layer := range diffIDs {
+		manifest[0].Layers = append(manifest[0].Layers, strings.TrimPrefix(layer, "sha256:")+"/layer.tar")
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if layerPath != "" {
+		if len(diffIDs) == 0 {
+			return fmt.Errorf("no diffID for the layer in %s", layerPath)
+		}
+		layer, err := os.Open(layerPath)
+		if err != nil {
+			return err
+		}
+		defer layer.Close()
+		info, err := layer.Stat()
+		if err != nil {
+			return err
+		}
+		layerDir := strings.TrimPrefix(diffIDs[len(diffIDs)-1], "sha256:") + "/"
+		if err := tw.WriteHeader(&tar.Header{Name: layerDir, Typeflag: tar.TypeDir, Mode: 0o755}); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: layerDir + "layer.tar", Typeflag: tar.TypeReg, Mode: 0o644, Size: info.Size()}); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, layer); err != nil {
+			return err
+		}
+	}
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{name: manifest[0].Config, data: config},
+		{name: "manifest.json", data: manifestBytes},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: file.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(file.data))}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
@@ -0,0 +1,383 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+
+	"github.com/openshift/imagebuilder"
+)
+
+type testArchiveEntry struct {
+	name     string
+	data     string
+	linkname string
+}
+
+func writeTestArchive(t *testing.T, name string, entries []testArchiveEntry) {
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, entry := range entries {
+		h := &tar.Header{Name: entry.name, Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(entry.data))}
+		if entry.linkname != "" {
+			h.Typeflag, h.Linkname, h.Size = tar.TypeSymlink, entry.linkname, 0
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_extractTopLayer(t *testing.T) {
+	layer := "layer contents"
+	sum := sha256.Sum256([]byte(layer))
+	diffID := "sha256:" + hex.EncodeToString(sum[:])
+	testCases := []struct {
+		entries []testArchiveEntry
+		err     bool
+	}{
+		{
+			// the older format, with a directory per layer
+			entries: []testArchiveEntry{
+				{name: "aaaa/layer.tar", data: "base layer"},
+				{name: "bbbb/layer.tar", data: layer},
+				{name: "manifest.json", data: `[{"Config":"cccc.json","Layers":["aaaa/layer.tar","bbbb/layer.tar"]}]`},
+			},
+		},
+		{
+			// the newer format, with the manifest first and layers stored as blobs
+			entries: []testArchiveEntry{
+				{name: "manifest.json", data: `[{"Config":"blobs/sha256/cccc","Layers":["blobs/sha256/aaaa","blobs/sha256/bbbb"]}]`},
+				{name: "blobs/sha256/aaaa", data: "base layer"},
+				{name: "blobs/sha256/bbbb", data: layer},
+			},
+		},
+		{
+			// the newer format, with compatibility links to blobs
+			entries: []testArchiveEntry{
+				{name: "blobs/sha256/bbbb", data: layer},
+				{name: "bbbb/layer.tar", linkname: "../blobs/sha256/bbbb"},
+				{name: "manifest.json", data: `[{"Config":"cccc.json","Layers":["bbbb/layer.tar"]}]`},
+			},
+		},
+		{
+			entries: []testArchiveEntry{
+				{name: "manifest.json", data: `[{"Config":"cccc.json","Layers":["bbbb/layer.tar"]}]`},
+			},
+			err: true,
+		},
+		{
+			entries: []testArchiveEntry{
+				{name: "bbbb/layer.tar", data: layer},
+			},
+			err: true,
+		},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			dir := t.TempDir()
+			saved := filepath.Join(dir, "saved.tar")
+			writeTestArchive(t, saved, testCase.entries)
+			extracted, digest, err := extractTopLayer(saved, dir)
+			if testCase.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", extracted)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(extracted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != layer {
+				t.Errorf("expected layer %q, got %q", layer, string(data))
+			}
+			if digest != diffID {
+				t.Errorf("expected diffID %s, got %s", diffID, digest)
+			}
+		})
+	}
+}
+
+func Test_imageConfigFromInspect(t *testing.T) {
+	inspect := map[string]json.RawMessage{
+		"Id":           json.RawMessage(`"sha256:image"`),
+		"Architecture": json.RawMessage(`"arm64"`),
+		"Variant":      json.RawMessage(`"v8"`),
+		"Os":           json.RawMessage(`"linux"`),
+		"OsVersion":    json.RawMessage(`""`),
+		"Created":      json.RawMessage(`"2020-01-02T03:04:05Z"`),
+		"Author":       json.RawMessage(`null`),
+		"Config":       json.RawMessage(`{"Env":["PATH=/bin"],"Volumes":{"/data":{}},"Labels":{"a":"b"}}`),
+		"RootFS":       json.RawMessage(`{"Type":"layers","Layers":["sha256:aaaa","sha256:bbbb"]}`),
+	}
+	testCases := []struct {
+		history []docker.ImageHistory
+		expect  []imageHistory
+	}{
+		{
+			// newest first, as the daemon reports it
+			history: []docker.ImageHistory{
+				{Created: 30, CreatedBy: "/bin/sh -c #(nop) VOLUME [/data]"},
+				{Created: 20, CreatedBy: "/bin/sh -c make", Size: 10},
+				{Created: 10, CreatedBy: "/bin/sh -c #(nop) ADD file:base in /", Size: 20, Comment: "base"},
+			},
+			expect: []imageHistory{
+				{Created: time.Unix(10, 0).UTC(), CreatedBy: "/bin/sh -c #(nop) ADD file:base in /", Comment: "base"},
+				{Created: time.Unix(20, 0).UTC(), CreatedBy: "/bin/sh -c make"},
+				{Created: time.Unix(30, 0).UTC(), CreatedBy: "/bin/sh -c #(nop) VOLUME [/data]", EmptyLayer: true},
+			},
+		},
+		{
+			// no more entries than there are layers are given one
+			history: []docker.ImageHistory{
+				{Created: 30, Size: 1},
+				{Created: 20, Size: 1},
+				{Created: 10, Size: 1},
+			},
+			expect: []imageHistory{
+				{Created: time.Unix(10, 0).UTC()},
+				{Created: time.Unix(20, 0).UTC()},
+				{Created: time.Unix(30, 0).UTC(), EmptyLayer: true},
+			},
+		},
+		{
+			history: nil,
+		},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			data, diffIDs, err := imageConfigFromInspect(inspect, testCase.history)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(diffIDs, []string{"sha256:aaaa", "sha256:bbbb"}) {
+				t.Errorf("unexpected layers %v", diffIDs)
+			}
+			var config struct {
+				Architecture string         `json:"architecture"`
+				Variant      string         `json:"variant"`
+				OS           string         `json:"os"`
+				OSVersion    *string        `json:"os.version"`
+				Author       *string        `json:"author"`
+				Created      time.Time      `json:"created"`
+				Config       docker.Config  `json:"config"`
+				RootFS       imageRootFS    `json:"rootfs"`
+				History      []imageHistory `json:"history"`
+			}
+			if err := json.Unmarshal(data, &config); err != nil {
+				t.Fatalf("unable to parse %s: %v", data, err)
+			}
+			if config.Architecture != "arm64" || config.Variant != "v8" || config.OS != "linux" || !config.Created.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+				t.Errorf("unexpected platform or creation time: %s", data)
+			}
+			if config.OSVersion != nil || config.Author != nil || bytes.Contains(data, []byte(`"Id"`)) {
+				t.Errorf("unexpected fields: %s", data)
+			}
+			if !reflect.DeepEqual(config.Config.Env, []string{"PATH=/bin"}) || len(config.Config.Volumes) != 1 || config.Config.Labels["a"] != "b" {
+				t.Errorf("unexpected run configuration: %#v", config.Config)
+			}
+			if !reflect.DeepEqual(config.RootFS, imageRootFS{Type: "layers", DiffIDs: diffIDs}) {
+				t.Errorf("unexpected root filesystem: %#v", config.RootFS)
+			}
+			if !reflect.DeepEqual(config.History, testCase.expect) {
+				t.Errorf("unexpected history:\n%#v\n%#v", testCase.expect, config.History)
+			}
+		})
+	}
+}
+
+func Test_writeStackedImageArchive(t *testing.T) {
+	dir := t.TempDir()
+	layerPath := filepath.Join(dir, "layer.tar")
+	if err := os.WriteFile(layerPath, []byte("layer contents"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	baseConfig := []byte(`{
+		"architecture": "arm64",
+		"variant": "v8",
+		"os": "linux",
+		"os.version": "10.0",
+		"moby.example": {"kept": true},
+		"created": "2020-01-01T00:00:00Z",
+		"config": {"Env": ["A=B"], "Cmd": ["/bin/true"]},
+		"rootfs": {"type": "layers", "diff_ids": ["sha256:1111", "sha256:2222"]},
+		"history": [
+			{"created": "2020-01-01T00:00:00Z", "created_by": "ADD rootfs.tar /"},
+			{"created": "2020-01-01T00:00:00Z", "created_by": "ENV A=B", "empty_layer": true},
+			{"created": "2020-01-01T00:00:00Z", "created_by": "RUN make"}
+		]
+	}`)
+	var buf bytes.Buffer
+	if err := writeStackedImageArchive(&buf, baseConfig, layerPath, "sha256:3333", "COPY --link bin/tool /usr/local/bin/", "stacked:latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(&buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[h.Name] = data
+	}
+
+	var manifest []imageArchiveManifest
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 1 {
+		t.Fatalf("expected one manifest entry, got %#v", manifest)
+	}
+	expectLayers := []string{"1111/layer.tar", "2222/layer.tar", "3333/layer.tar"}
+	if !reflect.DeepEqual(expectLayers, manifest[0].Layers) {
+		t.Errorf("unexpected layers:\n%v\n%v", expectLayers, manifest[0].Layers)
+	}
+	if !reflect.DeepEqual([]string{"stacked:latest"}, manifest[0].RepoTags) {
+		t.Errorf("unexpected tags: %v", manifest[0].RepoTags)
+	}
+	if string(files["3333/layer.tar"]) != "layer contents" {
+		t.Errorf("unexpected layer contents %q", string(files["3333/layer.tar"]))
+	}
+	for _, layer := range expectLayers[:2] {
+		if _, ok := files[layer]; ok {
+			t.Errorf("did not expect base layer %s to be included", layer)
+		}
+	}
+
+	configBytes, ok := files[manifest[0].Config]
+	if !ok {
+		t.Fatalf("config %s not found in archive", manifest[0].Config)
+	}
+	configSum := sha256.Sum256(configBytes)
+	if hex.EncodeToString(configSum[:])+".json" != manifest[0].Config {
+		t.Errorf("config name %s does not match its digest", manifest[0].Config)
+	}
+	var config struct {
+		Architecture string          `json:"architecture"`
+		Variant      string          `json:"variant"`
+		OSVersion    string          `json:"os.version"`
+		Unknown      json.RawMessage `json:"moby.example"`
+		Config       docker.Config   `json:"config"`
+		RootFS       imageRootFS     `json:"rootfs"`
+		History      []imageHistory  `json:"history"`
+	}
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		t.Fatal(err)
+	}
+	expectDiffIDs := []string{"sha256:1111", "sha256:2222", "sha256:3333"}
+	if !reflect.DeepEqual(expectDiffIDs, config.RootFS.DiffIDs) {
+		t.Errorf("unexpected diffIDs:\n%v\n%v", expectDiffIDs, config.RootFS.DiffIDs)
+	}
+	if config.Architecture != "arm64" || config.Variant != "v8" || config.OSVersion != "10.0" || string(config.Unknown) != `{"kept":true}` ||
+		!reflect.DeepEqual([]string{"A=B"}, config.Config.Env) {
+		t.Errorf("unexpected config %s", configBytes)
+	}
+	var createdBy []string
+	var layers int
+	for _, entry := range config.History {
+		createdBy = append(createdBy, entry.CreatedBy)
+		if !entry.EmptyLayer {
+			layers++
+		}
+	}
+	expectCreatedBy := []string{"ADD rootfs.tar /", "ENV A=B", "RUN make", "COPY --link bin/tool /usr/local/bin/"}
+	if !reflect.DeepEqual(expectCreatedBy, createdBy) {
+		t.Errorf("unexpected history:\n%v\n%v", expectCreatedBy, createdBy)
+	}
+	if layers != len(config.RootFS.DiffIDs) {
+		t.Errorf("expected a history entry for each of %d layers, got %d", len(config.RootFS.DiffIDs), layers)
+	}
+}
+
+func TestCopyLinkedWithoutPartialLoads(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var uploaded []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/info"):
+			fmt.Fprint(w, `{"Driver":"overlayfs","DriverStatus":[["driver-type","io.containerd.snapshotter.v1"]]}`)
+		case r.Method == http.MethodHead && strings.HasSuffix(r.URL.Path, "/containers/build/archive"):
+			http.NotFound(w, r)
+		case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/containers/build/archive"):
+			tr := tar.NewReader(r.Body)
+			for {
+				h, err := tr.Next()
+				if err != nil {
+					break
+				}
+				uploaded = append(uploaded, h.Name)
+			}
+		default:
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+
+	var warnings []string
+	e := NewClientExecutor(client)
+	e.TempDir = t.TempDir()
+	e.Directory = dir
+	e.Container = &docker.Container{ID: "build"}
+	e.EventFn = func(event Event) {
+		if event.Type == EventWarning {
+			warnings = append(warnings, event.Message)
+		}
+	}
+	defer e.Release()
+	// the content is copied into the build container, rather than into a
+	// layer which the daemon couldn't load
+	if err := e.CopyContext(context.Background(), nil, imagebuilder.Copy{Src: []string{"file"}, Dest: "/linked/file", Link: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string{"linked/file"}, uploaded) {
+		t.Errorf("unexpected content: %q", uploaded)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "COPY --link file is copied without --link") {
+		t.Errorf("unexpected warnings: %q", warnings)
+	}
+}
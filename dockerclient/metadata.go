@@ -0,0 +1,167 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"fmt"
+	"strings"
+
+	"go.podman.io/storage/pkg/archive"
+)
+
+// XattrPolicy controls which extended attributes of the content copied by ADD
+// and COPY instructions are kept in the image. From a build context directory,
+// file capabilities (security.capability), IMA signatures (security.ima) and
+// user.* attributes are read. From archives, including a context archive, and
+// from other stages and images, every attribute which the archive records is
+// read, including ACLs.
+type XattrPolicy int
+
+const (
+	// XattrsKeep keeps extended attributes, except for SELinux labels
+	// (security.selinux), which describe the host that content was read
+	// from rather than the image, and which the daemon ignores.
+	XattrsKeep XattrPolicy = iota
+	// XattrsStrip removes every extended attribute, including file
+	// capabilities.
+	XattrsStrip
+)
+
+// ParseXattrPolicy returns the XattrPolicy named "keep" or "strip".
+func ParseXattrPolicy(s string) (XattrPolicy, error) {
+	switch s {
+	case "keep", "":
+		return XattrsKeep, nil
+	case "strip":
+		return XattrsStrip, nil
+	default:
+		return XattrsKeep, fmt.Errorf("unrecognized xattr policy %q, must be keep or strip", s)
+	}
+}
+
+func (p XattrPolicy) String() string {
+	switch p {
+	case XattrsKeep:
+		return "keep"
+	case XattrsStrip:
+		return "strip"
+	default:
+		return fmt.Sprintf("XattrPolicy(%d)", int(p))
+	}
+}
+
+// apply removes the extended attributes of h which the policy doesn't keep.
+// Attributes are moved from the deprecated Xattrs field into PAXRecords, so
+// that there is only one copy of them to change, and a header which still has
+// any is written in the PAX format, which is the only one that can hold them.
+func (p XattrPolicy) apply(h *tar.Header) {
+	for name, value := range h.Xattrs {
+		if h.PAXRecords == nil {
+			h.PAXRecords = make(map[string]string)
+		}
+		h.PAXRecords[archive.PaxSchilyXattr+name] = value
+	}
+	h.Xattrs = nil
+	kept := false
+	for key := range h.PAXRecords {
+		name, ok := strings.CutPrefix(key, archive.PaxSchilyXattr)
+		if !ok {
+			continue
+		}
+		if p == XattrsStrip || name == "security.selinux" {
+			delete(h.PAXRecords, key)
+			continue
+		}
+		kept = true
+	}
+	if kept {
+		h.Format = tar.FormatPAX
+	}
+}
+
+// copyXattrs replaces the extended attributes of h with those of from.
+func copyXattrs(h, from *tar.Header) {
+	h.Xattrs = nil
+	for key := range h.PAXRecords {
+		if strings.HasPrefix(key, archive.PaxSchilyXattr) {
+			delete(h.PAXRecords, key)
+		}
+	}
+	for key, value := range from.PAXRecords {
+		if strings.HasPrefix(key, archive.PaxSchilyXattr) {
+			if h.PAXRecords == nil {
+				h.PAXRecords = make(map[string]string)
+			}
+			h.PAXRecords[key] = value
+		}
+	}
+	for name, value := range from.Xattrs {
+		if h.PAXRecords == nil {
+			h.PAXRecords = make(map[string]string)
+		}
+		h.PAXRecords[archive.PaxSchilyXattr+name] = value
+	}
+	if len(h.PAXRecords) > 0 {
+		h.Format = tar.FormatPAX
+	}
+}
+
+// hardlinks keeps files which are hard links to one another where an ADD or
+// COPY instruction copies them from linked once they're copied, even when
+// different sources of the instruction select them. A file is identified by
+// its device and inode when it is read from a directory, and by its location
+// when it is read from an archive or a container.
+type hardlinks struct {
+	// names maps the identity of each file which was copied to the name
+	// it was first copied to.
+	names map[string]string
+	// linked is the set of identities of files which are known to have
+	// more than one name.
+	linked map[string]bool
+}
+
+func newHardlinks() *hardlinks {
+	return &hardlinks{
+		names:  make(map[string]string),
+		linked: make(map[string]bool),
+	}
+}
+
+// copied records that the file identified by id was copied to name, unless
+// it was already copied somewhere else, and whether it has more than one
+// name.
+func (l *hardlinks) copied(id, name string, linked bool) {
+	if l == nil {
+		return
+	}
+	if _, ok := l.names[id]; !ok {
+		l.names[id] = name
+	}
+	if linked {
+		l.linked[id] = true
+	}
+}
+
+// target returns the name which a file identified by id, which is about to
+// be copied to name, should be a hard link to instead: the name it was already
+// copied to, if it has more than one name, or if linked is set because the
+// caller knows that it does.
+func (l *hardlinks) target(id, name string, linked bool) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+	target, ok := l.names[id]
+	if !ok || target == name || !(linked || l.linked[id]) {
+		return "", false
+	}
+	l.linked[id] = true
+	return target, true
+}
+
+// makeHardlink turns h into a hard link to target. The extended attributes
+// of the file are left to the entry which target was written from.
+func makeHardlink(h *tar.Header, target string) {
+	h.Typeflag = tar.TypeLink
+	h.Linkname = target
+	h.Size = 0
+	copyXattrs(h, &tar.Header{})
+}
@@ -0,0 +1,286 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+
+	"github.com/openshift/imagebuilder"
+)
+
+func TestXattrPolicy(t *testing.T) {
+	testCases := []struct {
+		policy   XattrPolicy
+		header   tar.Header
+		expect   map[string]string
+		noneKept bool
+	}{
+		{
+			policy: XattrsKeep,
+			header: tar.Header{
+				Xattrs: map[string]string{"user.a": "1"},
+				PAXRecords: map[string]string{
+					"SCHILY.xattr.security.capability":     "cap",
+					"SCHILY.xattr.security.selinux":        "system_u:object_r:container_file_t:s0",
+					"SCHILY.xattr.system.posix_acl_access": "acl",
+					"comment":                              "kept",
+				},
+			},
+			expect: map[string]string{
+				"SCHILY.xattr.user.a":                  "1",
+				"SCHILY.xattr.security.capability":     "cap",
+				"SCHILY.xattr.system.posix_acl_access": "acl",
+				"comment":                              "kept",
+			},
+		},
+		{
+			policy: XattrsStrip,
+			header: tar.Header{
+				Xattrs:     map[string]string{"user.a": "1"},
+				PAXRecords: map[string]string{"SCHILY.xattr.security.capability": "cap", "comment": "kept"},
+			},
+			expect:   map[string]string{"comment": "kept"},
+			noneKept: true,
+		},
+		{
+			policy:   XattrsKeep,
+			header:   tar.Header{PAXRecords: map[string]string{"SCHILY.xattr.security.selinux": "label"}},
+			expect:   map[string]string{},
+			noneKept: true,
+		},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			h := testCase.header
+			h.Name, h.Typeflag, h.Mode = "file", tar.TypeReg, 0o755
+			testCase.policy.apply(&h)
+			if h.Xattrs != nil {
+				t.Errorf("expected attributes to be moved to PAX records, got %v", h.Xattrs)
+			}
+			if !reflect.DeepEqual(testCase.expect, h.PAXRecords) {
+				t.Errorf("unexpected PAX records:\nexpected: %v\nfound:    %v", testCase.expect, h.PAXRecords)
+			}
+			if (h.Format == tar.FormatPAX) == testCase.noneKept {
+				t.Errorf("unexpected format %v", h.Format)
+			}
+			// whatever is kept can be written
+			if err := tar.NewWriter(io.Discard).WriteHeader(&h); err != nil {
+				t.Errorf("unable to write header: %v", err)
+			}
+		})
+	}
+
+	for _, name := range []string{"keep", "strip"} {
+		policy, err := ParseXattrPolicy(name)
+		if err != nil || policy.String() != name {
+			t.Errorf("expected to parse %q, got %v: %v", name, policy, err)
+		}
+	}
+	if _, err := ParseXattrPolicy("all"); err == nil {
+		t.Error("expected an unknown policy to be rejected")
+	}
+}
+
+type copiedEntry struct {
+	name, linkname string
+	typeflag       byte
+	content        string
+	xattrs         map[string]string
+}
+
+func readCopiedEntries(t *testing.T, r io.Reader) []copiedEntry {
+	var entries []copiedEntry
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := copiedEntry{name: strings.TrimPrefix(h.Name, "/"), linkname: strings.TrimPrefix(h.Linkname, "/"), typeflag: h.Typeflag, content: string(content)}
+		for key, value := range h.PAXRecords {
+			if name, ok := strings.CutPrefix(key, "SCHILY.xattr."); ok {
+				if entry.xattrs == nil {
+					entry.xattrs = make(map[string]string)
+				}
+				entry.xattrs[name] = value
+			}
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func TestHardlinksFromDisk(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"a": "linked", "sub/other": "other", "d/x": "excluded"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"sub/b": "a", "d/y": "d/x"} {
+		if err := os.Link(filepath.Join(dir, target), filepath.Join(dir, link)); err != nil {
+			t.Skipf("unable to create hard links: %v", err)
+		}
+	}
+
+	copyAll := func(excludes []string, srcs ...string) []copiedEntry {
+		var entries []copiedEntry
+		links := newHardlinks()
+		for _, src := range srcs {
+			r, c, err := archiveFromDisk(dir, src, "/dst/", false, excludes, testDirectoryCheck(nil), copyOptions{links: links})
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, readCopiedEntries(t, r)...)
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return entries
+	}
+
+	// names of the same file selected by different sources stay linked
+	entries := copyAll(nil, "a", "sub/b", "sub/other")
+	expect := []copiedEntry{
+		{name: "dst/a", typeflag: tar.TypeReg, content: "linked"},
+		{name: "dst/b", typeflag: tar.TypeLink, linkname: "dst/a"},
+		{name: "dst/other", typeflag: tar.TypeReg, content: "other"},
+	}
+	if !reflect.DeepEqual(expect, entries) {
+		t.Errorf("unexpected entries:\nexpected: %+v\nfound:    %+v", expect, entries)
+	}
+
+	// a link to a name which was excluded gets the content instead
+	entries = copyAll([]string{"d/x"}, "d")
+	var found []string
+	for _, entry := range entries {
+		found = append(found, fmt.Sprintf("%s %c %q", entry.name, entry.typeflag, entry.content))
+	}
+	sort.Strings(found)
+	if expect := []string{`dst/ 5 ""`, `dst/y 0 "excluded"`}; !reflect.DeepEqual(expect, found) {
+		t.Errorf("unexpected entries:\nexpected: %v\nfound:    %v", expect, found)
+	}
+}
+
+func TestCopyPreservesMetadata(t *testing.T) {
+	contextArchive := filepath.Join(t.TempDir(), "context.tar")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0o755, Size: 4, PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": "\x01\x00\x00\x02",
+			"SCHILY.xattr.security.selinux":    "system_u:object_r:bin_t:s0",
+		}},
+		{Name: "bin/tool2", Typeflag: tar.TypeLink, Linkname: "bin/tool"},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Size > 0 {
+			tw.Write([]byte("tool"))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(contextArchive, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	var uploaded []copiedEntry
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || !strings.HasSuffix(r.URL.Path, "/containers/build/archive") {
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		uploaded = append(uploaded, readCopiedEntries(t, r.Body)...)
+	}))
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+
+	testCases := []struct {
+		policy XattrPolicy
+		srcs   []string
+		expect []copiedEntry
+	}{
+		{
+			// the link is copied first, so it has to be given the
+			// content, and the file it linked to becomes a link to it
+			policy: XattrsKeep,
+			srcs:   []string{"bin/tool2", "bin/tool"},
+			expect: []copiedEntry{
+				{name: "usr/bin/tool2", typeflag: tar.TypeReg, content: "tool", xattrs: map[string]string{"security.capability": "\x01\x00\x00\x02"}},
+				{name: "usr/bin/tool", typeflag: tar.TypeLink, linkname: "usr/bin/tool2"},
+			},
+		},
+		{
+			policy: XattrsKeep,
+			srcs:   []string{"bin/tool", "bin/tool2"},
+			expect: []copiedEntry{
+				{name: "usr/bin/tool", typeflag: tar.TypeReg, content: "tool", xattrs: map[string]string{"security.capability": "\x01\x00\x00\x02"}},
+				{name: "usr/bin/tool2", typeflag: tar.TypeLink, linkname: "usr/bin/tool"},
+			},
+		},
+		{
+			policy: XattrsStrip,
+			srcs:   []string{"bin/tool2"},
+			expect: []copiedEntry{
+				{name: "usr/bin/tool2", typeflag: tar.TypeReg, content: "tool"},
+			},
+		},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			lock.Lock()
+			uploaded = nil
+			lock.Unlock()
+			e := NewClientExecutor(client)
+			e.ContextArchive = contextArchive
+			e.Container = &docker.Container{ID: "build"}
+			e.Xattrs = testCase.policy
+			defer func() {
+				for _, fn := range e.Deferred {
+					fn()
+				}
+			}()
+			if err := e.CopyContext(context.Background(), nil, imagebuilder.Copy{Src: testCase.srcs, Dest: "/usr/bin/"}); err != nil {
+				t.Fatal(err)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if !reflect.DeepEqual(testCase.expect, uploaded) {
+				t.Errorf("unexpected upload:\nexpected: %+v\nfound:    %+v", testCase.expect, uploaded)
+			}
+		})
+	}
+}
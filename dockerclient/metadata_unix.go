@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package dockerclient
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// hardlinkID returns the device and inode of a file which has more than one
+// name, or false if it has only one.
+func hardlinkID(info os.FileInfo) (string, bool) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 && !info.IsDir() {
+		return fmt.Sprintf("%d:%d", uint64(stat.Dev), uint64(stat.Ino)), true
+	}
+	return "", false
+}
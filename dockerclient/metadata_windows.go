@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package dockerclient
+
+import (
+	"os"
+)
+
+// hardlinkID would return the identity of a file which has more than one
+// name, but hard links aren't detected on Windows.
+func hardlinkID(info os.FileInfo) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,397 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"k8s.io/klog"
+)
+
+const (
+	// dockerImageContextPrefix introduces a named context which is an image.
+	dockerImageContextPrefix = "docker-image://"
+	// ociLayoutContextPrefix introduces a named context which is an image
+	// in an OCI image layout.
+	ociLayoutContextPrefix = "oci-layout://"
+
+	ociImageIndexMediaType = "application/vnd.oci.image.index.v1+json"
+	dockerManifestListType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	ociRefNameAnnotation   = "org.opencontainers.image.ref.name"
+)
+
+// NamedContext is a build context, in addition to the main one, which FROM
+// and COPY --from can refer to by name. A named context takes precedence over
+// any stage or image with the same name. Exactly one of Directory, Archive,
+// Image and OCILayout is set.
+type NamedContext struct {
+	// Directory is a directory on the local system.
+	Directory string
+	// Archive is a tar archive on the local system, either uncompressed or
+	// compressed with any of the formats the daemon accepts for layers.
+	Archive string
+	// Image is a reference to an image, which is pulled if the daemon
+	// doesn't have it and pulling is allowed.
+	Image string
+	// OCILayout is a directory holding an OCI image layout, which is loaded
+	// into the daemon the first time it is used.
+	OCILayout string
+	// OCIRef selects an image in OCILayout, by the tag it is annotated with
+	// or by its digest. It may be empty if the layout holds only one image.
+	OCIRef string
+
+	lock sync.Mutex
+	// images are the images which were created or loaded for the context,
+	// by platform, once it has been used as one.
+	images map[string]string
+}
+
+// ParseNamedContext parses the value of a named context, which is either
+// docker-image://REFERENCE, oci-layout://DIRECTORY optionally followed by
+// :TAG or @DIGEST, or the path of a directory or archive on the local system.
+func ParseNamedContext(value string) (*NamedContext, error) {
+	switch {
+	case value == "":
+		return nil, fmt.Errorf("no build context specified")
+	case strings.HasPrefix(value, dockerImageContextPrefix):
+		image := strings.TrimPrefix(value, dockerImageContextPrefix)
+		if image == "" {
+			return nil, fmt.Errorf("invalid build context %q: no image specified", value)
+		}
+		return &NamedContext{Image: image}, nil
+	case strings.HasPrefix(value, ociLayoutContextPrefix):
+		layout := strings.TrimPrefix(value, ociLayoutContextPrefix)
+		var ref string
+		if i := strings.LastIndex(layout, "@"); i >= 0 {
+			layout, ref = layout[:i], layout[i+1:]
+		} else if i := strings.LastIndex(layout, ":"); i > strings.LastIndexAny(layout, `/\`) && i > 1 {
+			// a colon in the last element of the path separates the tag,
+			// unless it follows a drive letter
+			layout, ref = layout[:i], layout[i+1:]
+		}
+		if layout == "" {
+			return nil, fmt.Errorf("invalid build context %q: no directory specified", value)
+		}
+		if _, err := os.Stat(filepath.Join(layout, "index.json")); err != nil {
+			return nil, fmt.Errorf("invalid build context %q: %s is not an OCI image layout: %v", value, layout, err)
+		}
+		return &NamedContext{OCILayout: layout, OCIRef: ref}, nil
+	}
+	fi, err := os.Stat(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid build context %q: %v", value, err)
+	}
+	if fi.IsDir() {
+		return &NamedContext{Directory: value}, nil
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("invalid build context %q: not a directory or an archive", value)
+	}
+	return &NamedContext{Archive: value}, nil
+}
+
+// isLocal returns true if the context is a directory or an archive, which
+// COPY --from reads from directly instead of from an image.
+func (n *NamedContext) isLocal() bool {
+	return len(n.Directory) > 0 || len(n.Archive) > 0
+}
+
+// archiveFromNamedContext returns an archive of src, read from the directory
+// or archive of the named context, placed under dst.
+func (e *ClientExecutor) archiveFromNamedContext(ctx context.Context, named *NamedContext, src, dst string, containerID string, opts copyOptions) (io.Reader, io.Closer, error) {
+	check := newDirectoryCheck(ctx, e.Client, e.pathCache(), containerID)
+	if len(named.Archive) > 0 {
+		klog.V(5).Infof("Archiving %s %s -> %s from named context archive", named.Archive, src, dst)
+		index, err := e.archiveIndex(named.Archive)
+		if err != nil {
+			return nil, nil, err
+		}
+		return archiveFromIndex(index, src, dst, nil, check, opts)
+	}
+	klog.V(5).Infof("Archiving %q %q -> %q from named context", named.Directory, src, dst)
+	return archiveFromDisk(named.Directory, src, dst, false, nil, check, opts)
+}
+
+// namedContextImage returns the image to use for the named context name when
+// it is used as a base image, or when content is copied from it. A directory
+// or archive is imported as an image with its content at the root, and an
+// OCI image layout is loaded into the daemon, the first time this is done.
+func (e *ClientExecutor) namedContextImage(ctx context.Context, name string, named *NamedContext, platform string) (string, error) {
+	if len(named.Image) > 0 {
+		return named.Image, nil
+	}
+	// an image layout may hold an image for each platform, but the
+	// content of a directory or archive is the same for all of them
+	if named.isLocal() {
+		platform = ""
+	} else if platform == "" {
+		platform = runtime.GOOS + "/" + runtime.GOARCH
+	}
+	named.lock.Lock()
+	defer named.lock.Unlock()
+	if image, ok := named.images[platform]; ok {
+		return image, nil
+	}
+	var image string
+	var err error
+	if named.isLocal() {
+		image, err = e.importNamedContext(ctx, named)
+	} else {
+		image, err = e.loadOCILayout(ctx, named.OCILayout, named.OCIRef, platform)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to create an image from the build context %s: %v", name, err)
+	}
+	klog.V(4).Infof("Using image %s for the build context %s", image, name)
+	if named.images == nil {
+		named.images = make(map[string]string)
+	}
+	named.images[platform] = image
+	return image, nil
+}
+
+// importNamedContext imports the directory or archive of a named context as
+// an image, which is untagged when the build is released.
+func (e *ClientExecutor) importNamedContext(ctx context.Context, named *NamedContext) (string, error) {
+	var r io.Reader
+	if len(named.Archive) > 0 {
+		f, err := os.Open(named.Archive)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		r = f
+	} else {
+		ar, closer, err := archiveFromDisk(named.Directory, ".", "/", false, nil, nil, copyOptions{})
+		if err != nil {
+			return "", err
+		}
+		defer closer.Close()
+		r = ar
+	}
+	random, err := randSeq(imageSafeCharacters, 24)
+	if err != nil {
+		return "", err
+	}
+	name := "imagebuilder-context-" + random
+	if err := e.Client.ImportImage(docker.ImportImageOptions{
+		Repository:  name,
+		Source:      "-",
+		InputStream: r,
+		Context:     ctx,
+	}); err != nil {
+		return "", err
+	}
+	// as with other intermediate images, removing this one will fail if it
+	// is an ancestor of the final image, so ignore errors
+	e.Deferred = append([]func() error{func() error { e.removeImage(name); return nil }}, e.Deferred...)
+	return name, nil
+}
+
+// ociDescriptor is the part of an OCI content descriptor which is needed to
+// find an image in a layout.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant,omitempty"`
+	} `json:"platform,omitempty"`
+}
+
+// ociIndex is an OCI image index, such as the index.json of a layout.
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// ociManifest is an OCI image manifest.
+type ociManifest struct {
+	Config ociDescriptor   `json:"config"`
+	Layers []ociDescriptor `json:"layers"`
+}
+
+// loadOCILayout loads the image in the OCI image layout in dir which ref
+// names, or the only one in it if ref is empty, into the daemon, and returns
+// its ID. If the image is an index, the manifest for platform is used.
+func (e *ClientExecutor) loadOCILayout(ctx context.Context, dir, ref, platform string) (string, error) {
+	var index ociIndex
+	if err := readOCIBlob(dir, "", &index); err != nil {
+		return "", err
+	}
+	var candidates []ociDescriptor
+	for _, desc := range index.Manifests {
+		switch {
+		case ref == "",
+			ref == desc.Digest,
+			ref == desc.Annotations[ociRefNameAnnotation]:
+			candidates = append(candidates, desc)
+		}
+	}
+	switch {
+	case len(candidates) == 0 && ref != "":
+		return "", fmt.Errorf("no image named %s was found in %s", ref, dir)
+	case len(candidates) == 0:
+		return "", fmt.Errorf("no images were found in %s", dir)
+	case len(candidates) > 1:
+		return "", fmt.Errorf("%s holds more than one image, so one must be named with :TAG or @DIGEST", dir)
+	}
+	desc := candidates[0]
+	if desc.MediaType == ociImageIndexMediaType || desc.MediaType == dockerManifestListType {
+		var platforms ociIndex
+		if err := readOCIBlob(dir, desc.Digest, &platforms); err != nil {
+			return "", err
+		}
+		found := false
+		for _, manifest := range platforms.Manifests {
+			if manifest.Platform == nil {
+				continue
+			}
+			p := manifest.Platform.OS + "/" + manifest.Platform.Architecture
+			if platform == p || platform == p+"/"+manifest.Platform.Variant {
+				desc, found = manifest, true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("no image for the platform %s was found in %s", platform, dir)
+		}
+	}
+	var manifest ociManifest
+	if err := readOCIBlob(dir, desc.Digest, &manifest); err != nil {
+		return "", err
+	}
+
+	random, err := randSeq(imageSafeCharacters, 24)
+	if err != nil {
+		return "", err
+	}
+	tag := "imagebuilder-context-" + random + ":latest"
+	// the daemon loads an archive with a manifest.json that names the
+	// configuration and layers of each image, which it decompresses itself
+	archiveManifest := []imageArchiveManifest{{RepoTags: []string{tag}}}
+	var blobs []string
+	for i, digest := range append([]string{manifest.Config.Digest}, layerDigests(manifest)...) {
+		blob, err := ociBlobPath(digest)
+		if err != nil {
+			return "", fmt.Errorf("%v in %s", err, dir)
+		}
+		if i == 0 {
+			archiveManifest[0].Config = blob
+		} else {
+			archiveManifest[0].Layers = append(archiveManifest[0].Layers, blob)
+		}
+		blobs = append(blobs, blob)
+	}
+	manifestBytes, err := json.Marshal(archiveManifest)
+	if err != nil {
+		return "", err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(func() error {
+			tw := tar.NewWriter(pw)
+			if err := tw.WriteHeader(&tar.Header{Name: "manifest.json", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(manifestBytes))}); err != nil {
+				return err
+			}
+			if _, err := tw.Write(manifestBytes); err != nil {
+				return err
+			}
+			for _, blob := range blobs {
+				if err := writeOCIBlob(tw, dir, blob); err != nil {
+					return err
+				}
+			}
+			return tw.Close()
+		}())
+	}()
+	err = e.Client.LoadImage(docker.LoadImageOptions{
+		InputStream:  pr,
+		OutputStream: ioutil.Discard,
+		Context:      ctx,
+	})
+	pr.Close()
+	if err != nil {
+		return "", fmt.Errorf("unable to load image: %v", err)
+	}
+	// removing the image will fail if it is an ancestor of the final image,
+	// so only its tag is certain to be removed
+	e.Deferred = append([]func() error{func() error { e.removeImage(tag); return nil }}, e.Deferred...)
+	image, err := e.Client.InspectImage(tag)
+	if err != nil {
+		return "", fmt.Errorf("unable to find the loaded image: %v", err)
+	}
+	return image.ID, nil
+}
+
+// layerDigests returns the digests of the layers of manifest.
+func layerDigests(manifest ociManifest) []string {
+	var digests []string
+	for _, layer := range manifest.Layers {
+		digests = append(digests, layer.Digest)
+	}
+	return digests
+}
+
+// ociBlobPath returns the slash-separated path of the blob with the given
+// digest in an OCI image layout.
+func ociBlobPath(digest string) (string, error) {
+	algorithm, encoded, ok := strings.Cut(digest, ":")
+	if !ok || algorithm == "" || encoded == "" || strings.ContainsAny(digest, `/\.`) {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return path.Join("blobs", algorithm, encoded), nil
+}
+
+// readOCIBlob decodes the blob in the OCI image layout in dir with the given
+// digest, or its index.json if digest is empty, into v.
+func readOCIBlob(dir, digest string, v interface{}) error {
+	name := "index.json"
+	if digest != "" {
+		blob, err := ociBlobPath(digest)
+		if err != nil {
+			return fmt.Errorf("%v in %s", err, dir)
+		}
+		name = blob
+	}
+	name = filepath.Join(dir, filepath.FromSlash(name))
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("unable to parse %s: %v", name, err)
+	}
+	return nil
+}
+
+// writeOCIBlob writes the blob at name, a slash-separated path in the OCI
+// image layout in dir, to tw.
+func writeOCIBlob(tw *tar.Writer, dir, name string) error {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o644, Size: fi.Size()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,342 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+
+	"github.com/openshift/imagebuilder"
+)
+
+func TestParseNamedContext(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "context.tar")
+	if err := os.WriteFile(archive, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	layout := filepath.Join(dir, "layout")
+	if err := os.MkdirAll(layout, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(layout, "index.json"), []byte(`{"manifests":[]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		value  string
+		expect *NamedContext
+		err    bool
+	}{
+		{value: dir, expect: &NamedContext{Directory: dir}},
+		{value: archive, expect: &NamedContext{Archive: archive}},
+		{value: "docker-image://alpine:3.20", expect: &NamedContext{Image: "alpine:3.20"}},
+		{value: "docker-image://registry.example.com:5000/app@sha256:abcd", expect: &NamedContext{Image: "registry.example.com:5000/app@sha256:abcd"}},
+		{value: "oci-layout://" + layout, expect: &NamedContext{OCILayout: layout}},
+		{value: "oci-layout://" + layout + ":v1", expect: &NamedContext{OCILayout: layout, OCIRef: "v1"}},
+		{value: "oci-layout://" + layout + "@sha256:abcd", expect: &NamedContext{OCILayout: layout, OCIRef: "sha256:abcd"}},
+		{value: "oci-layout://" + dir, err: true},
+		{value: "docker-image://", err: true},
+		{value: filepath.Join(dir, "missing"), err: true},
+		{value: "", err: true},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			named, err := ParseNamedContext(testCase.value)
+			if testCase.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %#v", named)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if named.Directory != testCase.expect.Directory || named.Archive != testCase.expect.Archive || named.Image != testCase.expect.Image ||
+				named.OCILayout != testCase.expect.OCILayout || named.OCIRef != testCase.expect.OCIRef {
+				t.Errorf("unexpected context for %q: %#v", testCase.value, named)
+			}
+		})
+	}
+}
+
+func TestCopyFromNamedContext(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bin", "tool"), []byte("tool"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(t.TempDir(), "artifacts.tar.gz")
+	if err := os.WriteFile(archive, contextTestArchive(t), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	var uploaded []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/containers/build/archive") {
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+			return
+		}
+		if r.Method != http.MethodPut {
+			http.NotFound(w, r)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		tr := tar.NewReader(r.Body)
+		for {
+			h, err := tr.Next()
+			if err != nil {
+				return
+			}
+			uploaded = append(uploaded, strings.Trim(h.Name, "/"))
+		}
+	}))
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+
+	testCases := []struct {
+		copy   imagebuilder.Copy
+		expect []string
+	}{
+		{
+			copy:   imagebuilder.Copy{From: "tools", Src: []string{"bin/tool"}, Dest: "/usr/local/bin/"},
+			expect: []string{"usr/local/bin/tool"},
+		},
+		{
+			copy:   imagebuilder.Copy{From: "artifacts", Src: []string{"build/"}, Dest: "/build/"},
+			expect: []string{"build/Dockerfile.custom", "build/Dockerfile.custom.dockerignore"},
+		},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			lock.Lock()
+			uploaded = nil
+			lock.Unlock()
+			e := NewClientExecutor(client)
+			e.TempDir = t.TempDir()
+			e.Container = &docker.Container{ID: "build"}
+			e.NamedContexts = map[string]*NamedContext{
+				"tools":     {Directory: dir},
+				"artifacts": {Archive: archive},
+			}
+			// a named context takes precedence over a stage with the same
+			// name, which couldn't be copied from since it hasn't been built
+			e.WithName("tools", 0)
+			defer e.Release()
+			err := e.CopyContext(context.Background(), nil, testCase.copy)
+			if err == nil {
+				err = e.flushUploads()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			sort.Strings(uploaded)
+			if !reflect.DeepEqual(testCase.expect, uploaded) {
+				t.Errorf("unexpected uploads:\nexpected: %v\nfound:    %v", testCase.expect, uploaded)
+			}
+		})
+	}
+}
+
+// ociTestLayout writes an OCI image layout to dir with an index of an image
+// for linux/amd64 and one for linux/arm64, tagged v1, and an image with no
+// index, tagged v2, and returns the digests of the configurations of the
+// arm64 image and the untagged one.
+func ociTestLayout(t *testing.T, dir string) (string, string) {
+	writeBlob := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		encoded := hex.EncodeToString(sum[:])
+		if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "blobs", "sha256", encoded), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return "sha256:" + encoded
+	}
+	image := func(arch string) (string, string) {
+		layer := writeBlob(map[string]string{"layer": arch})
+		config := writeBlob(map[string]string{"architecture": arch})
+		manifest := writeBlob(map[string]interface{}{
+			"config": map[string]string{"digest": config},
+			"layers": []map[string]string{{"digest": layer}},
+		})
+		return manifest, config
+	}
+	amd64, _ := image("amd64")
+	arm64, arm64Config := image("arm64")
+	index := writeBlob(map[string]interface{}{
+		"manifests": []map[string]interface{}{
+			{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": amd64, "platform": map[string]string{"os": "linux", "architecture": "amd64"}},
+			{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": arm64, "platform": map[string]string{"os": "linux", "architecture": "arm64", "variant": "v8"}},
+		},
+	})
+	single, singleConfig := image("s390x")
+	data, err := json.Marshal(map[string]interface{}{
+		"manifests": []map[string]interface{}{
+			{"mediaType": ociImageIndexMediaType, "digest": index, "annotations": map[string]string{ociRefNameAnnotation: "v1"}},
+			{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": single, "annotations": map[string]string{ociRefNameAnnotation: "v2"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "index.json"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return arm64Config, singleConfig
+}
+
+func TestNamedContextImage(t *testing.T) {
+	layout := t.TempDir()
+	arm64Config, singleConfig := ociTestLayout(t, layout)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	var requests []string
+	var received [][]string
+	var manifests []imageArchiveManifest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		path := r.URL.Path[strings.Index(r.URL.Path, "/images/"):]
+		requests = append(requests, r.Method+" "+strings.SplitN(path, "/", 4)[2])
+		switch {
+		case r.Method == http.MethodPost && (path == "/images/create" || path == "/images/load"):
+			var names []string
+			tr := tar.NewReader(r.Body)
+			for {
+				h, err := tr.Next()
+				if err != nil {
+					break
+				}
+				names = append(names, strings.Trim(h.Name, "/"))
+				if h.Name == "manifest.json" {
+					var manifest []imageArchiveManifest
+					if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+					manifests = append(manifests, manifest...)
+				}
+			}
+			received = append(received, names)
+			fmt.Fprint(w, "{}")
+		case r.Method == http.MethodGet && strings.HasSuffix(path, "/json"):
+			fmt.Fprint(w, `{"Id":"sha256:loaded"}`)
+		case r.Method == http.MethodDelete:
+			fmt.Fprint(w, "[]")
+		default:
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+
+	e := NewClientExecutor(client)
+	e.TempDir = t.TempDir()
+	ctx := context.Background()
+
+	// an image is used as it is
+	if image, err := e.namedContextImage(ctx, "base", &NamedContext{Image: "alpine:3.20"}, ""); err != nil || image != "alpine:3.20" {
+		t.Errorf("unexpected image %q: %v", image, err)
+	}
+
+	// a directory is imported once
+	named := &NamedContext{Directory: dir}
+	for i := 0; i < 2; i++ {
+		image, err := e.namedContextImage(ctx, "files", named, "linux/amd64")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(image, "imagebuilder-context-") {
+			t.Errorf("unexpected imported image %q", image)
+		}
+	}
+
+	// an image in a layout is loaded for each platform it's used for
+	named = &NamedContext{OCILayout: layout, OCIRef: "v1"}
+	for _, platform := range []string{"linux/arm64", "linux/arm64/v8"} {
+		if image, err := e.namedContextImage(ctx, "layout", named, platform); err != nil || image != "sha256:loaded" {
+			t.Errorf("unexpected image %q: %v", image, err)
+		}
+	}
+	if _, err := e.namedContextImage(ctx, "layout", named, "linux/ppc64le"); err == nil || !strings.Contains(err.Error(), "linux/ppc64le") {
+		t.Errorf("expected a missing platform to be reported, got %v", err)
+	}
+	if _, err := e.namedContextImage(ctx, "layout", &NamedContext{OCILayout: layout, OCIRef: "v2"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.namedContextImage(ctx, "layout", &NamedContext{OCILayout: layout}, ""); err == nil || !strings.Contains(err.Error(), "more than one image") {
+		t.Errorf("expected an image to have to be named, got %v", err)
+	}
+	if _, err := e.namedContextImage(ctx, "layout", &NamedContext{OCILayout: layout, OCIRef: "v3"}, ""); err == nil {
+		t.Error("expected a missing tag to be reported")
+	}
+	if errs := e.Release(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	blob := func(digest string) string { return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:") }
+	if len(received) != 4 || !reflect.DeepEqual(received[0], []string{"file"}) {
+		t.Fatalf("unexpected archives: %v", received)
+	}
+	if len(manifests) != 3 || manifests[0].Config != blob(arm64Config) || manifests[2].Config != blob(singleConfig) ||
+		len(manifests[0].Layers) != 1 || len(manifests[0].RepoTags) != 1 {
+		t.Errorf("unexpected manifests: %#v", manifests)
+	}
+	for i, manifest := range manifests {
+		if expect := append([]string{"manifest.json", manifest.Config}, manifest.Layers...); !reflect.DeepEqual(expect, received[i+1]) {
+			t.Errorf("expected an archive of %v, got %v", expect, received[i+1])
+		}
+	}
+	// the images are untagged when the build is released
+	if expect := []string{"POST create", "POST load", "GET " + manifests[0].RepoTags[0], "POST load"}; !reflect.DeepEqual(expect, requests[:4]) {
+		t.Errorf("unexpected requests: %v", requests)
+	}
+	deleted := 0
+	for _, request := range requests {
+		if strings.HasPrefix(request, "DELETE ") {
+			deleted++
+		}
+	}
+	if deleted != 4 {
+		t.Errorf("expected each image to be removed, got %v", requests)
+	}
+}
@@ -0,0 +1,340 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"k8s.io/klog"
+
+	"github.com/openshift/imagebuilder"
+	"github.com/openshift/imagebuilder/dockerfile/command"
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+)
+
+// runMountDir is where the volumes which hold the content of RUN --mount
+// options are mounted in the build container. /dev is a tmpfs, so, as with
+// keepaliveDir, nothing beneath it is ever committed.
+const runMountDir = "/dev/.imagebuilder-mounts"
+
+// runMountUploadDir is where a volume which holds the content of RUN --mount
+// options is mounted while it is being populated.
+const runMountUploadDir = "/.imagebuilder-mount"
+
+// runMount is a bind mount requested with RUN --mount.
+type runMount struct {
+	// From is the named context, stage or image which the content is read
+	// from, or empty for the build context.
+	From string
+	// Source is the path in From which is mounted.
+	Source string
+	// Target is the absolute path at which the content is mounted.
+	Target string
+	// ReadWrite allows the command to change the content, although the
+	// changes are discarded once it finishes.
+	ReadWrite bool
+}
+
+// parseRunMount parses the value of a RUN --mount option, which is a comma
+// separated list of KEY=VALUE fields. Only bind mounts are supported. A
+// relative target is resolved against workingDir.
+func parseRunMount(spec, workingDir string) (runMount, error) {
+	mountType := "bind"
+	var mount runMount
+	for _, field := range strings.Split(spec, ",") {
+		key, value, hasValue := strings.Cut(field, "=")
+		key = strings.ToLower(key)
+		switch key {
+		case "type":
+			mountType = value
+		case "from":
+			mount.From = value
+		case "source", "src":
+			mount.Source = value
+		case "target", "dst", "destination":
+			mount.Target = value
+		case "readonly", "ro", "rw", "readwrite":
+			set := true
+			if hasValue {
+				var err error
+				if set, err = strconv.ParseBool(value); err != nil {
+					return runMount{}, fmt.Errorf("invalid value %q for %s in RUN --mount=%s", value, key, spec)
+				}
+			}
+			mount.ReadWrite = set == (key == "rw" || key == "readwrite")
+		default:
+			return runMount{}, fmt.Errorf("unsupported option %q in RUN --mount=%s", key, spec)
+		}
+	}
+	if mountType != "bind" {
+		return runMount{}, fmt.Errorf("RUN --mount=type=%s is not supported", mountType)
+	}
+	if mount.Target == "" {
+		return runMount{}, fmt.Errorf("no target specified in RUN --mount=%s", spec)
+	}
+	if !path.IsAbs(mount.Target) {
+		mount.Target = path.Join("/", workingDir, mount.Target)
+	}
+	if mount.Source == "" {
+		mount.Source = "/"
+		if mount.From == "" {
+			mount.Source = "."
+		}
+	}
+	return mount, nil
+}
+
+// requiresRunMounts returns true if any RUN instruction in node has --mount
+// options, so that the build container needs volumes to hold their content.
+func requiresRunMounts(node *parser.Node) bool {
+	for _, child := range node.Children {
+		if child.Value != command.Run {
+			continue
+		}
+		for _, flag := range child.Flags {
+			if strings.HasPrefix(flag, "--mount=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runMountVolumes are the volumes which hold the content of RUN --mount
+// options. They are mounted beneath runMountDir in the build container.
+type runMountVolumes struct {
+	// ReadOnly holds content which is mounted read-only.
+	ReadOnly string
+	// ReadWrite holds content which the command can change.
+	ReadWrite string
+}
+
+// createRunMountVolumes creates the volumes which hold the content of RUN
+// --mount options, and returns them along with the binds which mount them in
+// the build container.
+func (e *ClientExecutor) createRunMountVolumes(ctx context.Context) (*runMountVolumes, []string, error) {
+	readOnly, _, err := e.createTemporaryVolume(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create volume for RUN --mount: %v", err)
+	}
+	readWrite, _, err := e.createTemporaryVolume(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to create volume for RUN --mount: %v", err)
+	}
+	binds := []string{
+		readOnly + ":" + path.Join(runMountDir, "ro") + ":ro",
+		readWrite + ":" + path.Join(runMountDir, "rw"),
+	}
+	return &runMountVolumes{ReadOnly: readOnly, ReadWrite: readWrite}, binds, nil
+}
+
+// placedRunMount records what was done to the build container to make the
+// content of a RUN --mount option appear at its target, so that it can be
+// undone.
+type placedRunMount struct {
+	// Target is where the content appears.
+	Target string
+	// Snapshot is an archive of what was at Target beforehand, if
+	// anything was.
+	Snapshot string
+	// Created is the topmost path which was created, if Target didn't
+	// exist beforehand.
+	Created string
+}
+
+// runWithMounts runs a command with RUN --mount options. Mounts can only be
+// added to a container when it is created, so the content of each mount is
+// copied into one of the volumes which the build container was created with,
+// and a symbolic link to it is placed at the mount's target. The link, and
+// any directories which had to be created for it, are removed once the
+// command succeeds, and whatever was at the target is restored, so nothing
+// is left in the image. If the command fails, the links are left in place
+// for the debug shell.
+func (e *ClientExecutor) runWithMounts(ctx context.Context, run imagebuilder.Run, config docker.Config) error {
+	if e.runMounts == nil {
+		return fmt.Errorf("RUN --mount is only supported in build containers which imagebuilder creates")
+	}
+	var mounts []runMount
+	for _, spec := range run.Mounts {
+		mount, err := parseRunMount(spec, config.WorkingDir)
+		if err != nil {
+			return err
+		}
+		mounts = append(mounts, mount)
+	}
+	if err := e.flushUploads(); err != nil {
+		return err
+	}
+	// preserved paths are archived before anything is placed beneath
+	// them, so that restoring them doesn't bring it back
+	if err := e.Volumes.Save(e.Container.ID, e.TempDir, e.Client); err != nil {
+		return err
+	}
+	var placed []placedRunMount
+	for _, mount := range mounts {
+		p, err := e.placeRunMount(ctx, mount)
+		if err != nil {
+			return err
+		}
+		placed = append(placed, p)
+	}
+
+	run.Mounts = nil
+	if err := e.RunContext(ctx, run, config); err != nil {
+		return err
+	}
+	return e.removeRunMounts(ctx, placed)
+}
+
+// placeRunMount copies the content of mount into a volume and links to it
+// from the mount's target in the build container.
+func (e *ClientExecutor) placeRunMount(ctx context.Context, mount runMount) (placedRunMount, error) {
+	placed := placedRunMount{Target: path.Clean(mount.Target)}
+	if placed.Target == "/" || strings.HasPrefix(placed.Target+"/", runMountDir+"/") {
+		return placed, fmt.Errorf("RUN --mount can't be used with target %s", mount.Target)
+	}
+	name, err := randSeq(imageSafeCharacters, 24)
+	if err != nil {
+		return placed, err
+	}
+	volume, dir := e.runMounts.ReadOnly, "ro"
+	if mount.ReadWrite {
+		volume, dir = e.runMounts.ReadWrite, "rw"
+	}
+	if err := e.populateRunMount(ctx, volume, name, mount); err != nil {
+		return placed, err
+	}
+
+	// the link replaces whatever is at the target, which is archived so
+	// that it can be restored, or otherwise the directories it is created
+	// in, which have to be removed
+	info, err := e.pathCache().stat(ctx, e.Client, e.Container.ID, placed.Target)
+	if err != nil {
+		return placed, err
+	}
+	if info.exists {
+		if placed.Snapshot, err = snapshotContainerPath(placed.Target, e.Container.ID, e.TempDir, e.Client); err != nil {
+			return placed, fmt.Errorf("unable to archive %s to mount over it: %v", placed.Target, err)
+		}
+		snapshot := placed.Snapshot
+		e.Deferred = append([]func() error{func() error { os.Remove(snapshot); return nil }}, e.Deferred...)
+	} else {
+		placed.Created = placed.Target
+		for parent := path.Dir(placed.Created); parent != "/"; parent = path.Dir(parent) {
+			info, err := e.pathCache().stat(ctx, e.Client, e.Container.ID, parent)
+			if err != nil {
+				return placed, err
+			}
+			if info.exists {
+				break
+			}
+			placed.Created = parent
+		}
+	}
+
+	link := &tar.Header{
+		Name:     strings.TrimPrefix(placed.Target, "/"),
+		Typeflag: tar.TypeSymlink,
+		Linkname: path.Join(runMountDir, dir, name),
+		Mode:     0o777,
+	}
+	if err := mapToHost(e.IDMappings, link); err != nil {
+		return placed, err
+	}
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(link); err != nil {
+		return placed, err
+	}
+	if err := tw.Close(); err != nil {
+		return placed, err
+	}
+	klog.V(4).Infof("Linking %s to %s for RUN --mount", placed.Target, link.Linkname)
+	defer e.pathCache().invalidate()
+	if err := e.Client.UploadToContainer(e.Container.ID, docker.UploadToContainerOptions{
+		InputStream: buf,
+		Path:        "/",
+		Context:     ctx,
+	}); err != nil {
+		return placed, fmt.Errorf("unable to mount content at %s: %v", placed.Target, err)
+	}
+	return placed, nil
+}
+
+// removeRunMounts undoes what placeRunMount did to the build container. The
+// daemon can't remove paths from a container, so anything which had to be
+// created is removed by running rm in the container.
+func (e *ClientExecutor) removeRunMounts(ctx context.Context, placed []placedRunMount) error {
+	defer e.pathCache().invalidate()
+	var created []string
+	for _, p := range placed {
+		if p.Snapshot == "" {
+			created = append(created, p.Created)
+			continue
+		}
+		klog.V(4).Infof("Restoring %s after RUN --mount", p.Target)
+		if err := restorePath(p.Target, p.Snapshot, true, e.IDMappings, e.Container.ID, e.Client); err != nil {
+			return err
+		}
+	}
+	if len(created) == 0 {
+		return nil
+	}
+	klog.V(4).Infof("Removing %v after RUN --mount", created)
+	exec, err := e.Client.CreateExec(docker.CreateExecOptions{
+		Cmd:          append([]string{"rm", "-rf", "--"}, created...),
+		Container:    e.Container.ID,
+		AttachStderr: true,
+		User:         "0",
+		Context:      ctx,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to remove %s, which was created for RUN --mount: %v", strings.Join(created, ", "), err)
+	}
+	stderr := &bytes.Buffer{}
+	if err := e.Client.StartExec(exec.ID, docker.StartExecOptions{ErrorStream: stderr, Context: ctx}); err != nil {
+		return fmt.Errorf("unable to remove %s, which was created for RUN --mount: %v", strings.Join(created, ", "), err)
+	}
+	status, err := e.Client.InspectExec(exec.ID)
+	if err != nil {
+		return err
+	}
+	if status.ExitCode != 0 {
+		return fmt.Errorf("unable to remove %s, which was created for RUN --mount, rm failed with exit code %d: %s", strings.Join(created, ", "), status.ExitCode, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// populateRunMount copies the content of mount into volume, as name, using a
+// container which has the volume mounted.
+func (e *ClientExecutor) populateRunMount(ctx context.Context, volume, name string, mount runMount) error {
+	container, err := e.Client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image: e.containerOptions.Config.Image,
+			Cmd:   []string{"#(imagebuilder)"},
+		},
+		HostConfig: &docker.HostConfig{
+			Binds: []string{volume + ":" + runMountUploadDir},
+		},
+		Context: ctx,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create container to populate RUN --mount: %v", err)
+	}
+	defer e.removeContainer(container.ID)
+
+	// the content is copied as COPY --from would copy it, so that a file
+	// is written as name rather than into it
+	dest := path.Join(runMountUploadDir, name)
+	copy := imagebuilder.Copy{From: mount.From, Src: []string{mount.Source}, Dest: dest}
+	if err := e.copyContainer(ctx, container, e.Excludes, copy); err != nil {
+		return fmt.Errorf("unable to copy content for RUN --mount: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+
+	"github.com/openshift/imagebuilder"
+)
+
+func Test_parseRunMount(t *testing.T) {
+	testCases := []struct {
+		spec       string
+		workingDir string
+		expect     runMount
+		err        bool
+	}{
+		{spec: "from=tools,target=/tools", expect: runMount{From: "tools", Source: "/", Target: "/tools"}},
+		{spec: "type=bind,from=tools,source=bin,dst=/usr/local/bin,ro", expect: runMount{From: "tools", Source: "bin", Target: "/usr/local/bin"}},
+		{spec: "from=tools,src=/bin,target=bin,rw", workingDir: "/work", expect: runMount{From: "tools", Source: "/bin", Target: "/work/bin", ReadWrite: true}},
+		{spec: "from=tools,target=/tools,readonly=false", expect: runMount{From: "tools", Source: "/", Target: "/tools", ReadWrite: true}},
+		{spec: "from=tools,target=/tools,rw=false", expect: runMount{From: "tools", Source: "/", Target: "/tools"}},
+		// the build context
+		{spec: "target=/src", expect: runMount{Source: ".", Target: "/src"}},
+		{spec: "from=tools", err: true},
+		{spec: "from=tools,target=/tools,ro=maybe", err: true},
+		{spec: "from=tools,target=/tools,bogus=1", err: true},
+		{spec: "type=cache,target=/root/.cache", err: true},
+		{spec: "type=secret,id=token", err: true},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			mount, err := parseRunMount(testCase.spec, testCase.workingDir)
+			if testCase.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %#v", mount)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mount != testCase.expect {
+				t.Errorf("unexpected mount for %q: %#v", testCase.spec, mount)
+			}
+		})
+	}
+}
+
+func TestPopulateRunMount(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "empty"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bin", "tool"), []byte("tool"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		mount  runMount
+		expect []string
+	}{
+		{
+			mount:  runMount{From: "tools", Source: "/bin", Target: "/tools"},
+			expect: []string{".imagebuilder-mount/content", ".imagebuilder-mount/content/tool"},
+		},
+		{
+			// a file is mounted as itself
+			mount:  runMount{From: "tools", Source: "/bin/tool", Target: "/usr/bin/tool", ReadWrite: true},
+			expect: []string{".imagebuilder-mount/content"},
+		},
+		{
+			mount:  runMount{From: "tools", Source: "/empty", Target: "/empty"},
+			expect: []string{".imagebuilder-mount/content"},
+		},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			var lock sync.Mutex
+			var created docker.CreateContainerOptions
+			var uploaded []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				defer lock.Unlock()
+				switch {
+				case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/containers/create"):
+					var body struct {
+						docker.Config
+						HostConfig *docker.HostConfig
+					}
+					json.NewDecoder(r.Body).Decode(&body)
+					created = docker.CreateContainerOptions{Config: &body.Config, HostConfig: body.HostConfig}
+					fmt.Fprint(w, `{"Id":"populate"}`)
+				case r.Method == http.MethodHead && strings.HasSuffix(r.URL.Path, "/containers/populate/archive"):
+					http.NotFound(w, r)
+				case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/containers/populate/archive"):
+					tr := tar.NewReader(r.Body)
+					for {
+						h, err := tr.Next()
+						if err != nil {
+							break
+						}
+						uploaded = append(uploaded, strings.Trim(h.Name, "/"))
+					}
+				case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/containers/populate/stop"):
+				case r.Method == http.MethodDelete:
+				default:
+					http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+				}
+			}))
+			defer server.Close()
+			client, err := docker.NewClient(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.SkipServerVersionCheck = true
+
+			e := NewClientExecutor(client)
+			e.TempDir = t.TempDir()
+			e.Container = &docker.Container{ID: "build"}
+			e.containerOptions = &docker.CreateContainerOptions{Config: &docker.Config{Image: "sha256:base"}}
+			e.NamedContexts = map[string]*NamedContext{"tools": {Directory: dir}}
+			defer e.Release()
+			if err := e.populateRunMount(context.Background(), "mounts", "content", testCase.mount); err != nil {
+				t.Fatal(err)
+			}
+			if created.Config.Image != "sha256:base" || created.HostConfig == nil || !reflect.DeepEqual(created.HostConfig.Binds, []string{"mounts:" + runMountUploadDir}) {
+				t.Errorf("unexpected container to populate the mount: %#v %#v", created.Config, created.HostConfig)
+			}
+			if !reflect.DeepEqual(testCase.expect, uploaded) {
+				t.Errorf("unexpected content:\n%q\n%q", testCase.expect, uploaded)
+			}
+		})
+	}
+}
+
+func TestRequiresRunMounts(t *testing.T) {
+	testCases := []struct {
+		dockerfile string
+		expect     bool
+	}{
+		{dockerfile: "FROM busybox\nRUN --mount=from=tools,target=/tools ls /tools\n", expect: true},
+		{dockerfile: "FROM busybox\nRUN --network=none --mount=target=/src ls /src\n", expect: true},
+		{dockerfile: "FROM busybox\nRUN --network=none ls\n"},
+		{dockerfile: "FROM busybox\nCOPY --link . /\n"},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			node, err := imagebuilder.ParseDockerfile(strings.NewReader(testCase.dockerfile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if requiresRunMounts(node) != testCase.expect {
+				t.Errorf("expected %t for %q", testCase.expect, testCase.dockerfile)
+			}
+		})
+	}
+}
+
+func TestPlaceRunMount(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bin", "tool"), []byte("tool"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	var populated []string
+	var uploaded []string
+	var removed docker.CreateExecOptions
+	existing := map[string]bool{"/": true, "/usr": true, "/existing": true}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		readArchive := func() []string {
+			var names []string
+			tr := tar.NewReader(r.Body)
+			for {
+				h, err := tr.Next()
+				if err != nil {
+					return names
+				}
+				name := h.Name
+				if h.Typeflag == tar.TypeSymlink {
+					name += " -> " + h.Linkname
+				}
+				names = append(names, name)
+			}
+		}
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/containers/create"):
+			var body struct {
+				HostConfig *docker.HostConfig
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			populated = append(populated, body.HostConfig.Binds...)
+			fmt.Fprint(w, `{"Id":"populate"}`)
+		case r.Method == http.MethodHead && strings.HasSuffix(r.URL.Path, "/containers/populate/archive"):
+			http.NotFound(w, r)
+		case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/containers/populate/archive"):
+			populated = append(populated, readArchive()...)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/containers/populate/stop"):
+		case r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, "/containers/populate"):
+		case r.Method == http.MethodHead && strings.HasSuffix(r.URL.Path, "/containers/build/archive"):
+			if !existing[r.URL.Query().Get("path")] {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString([]byte(`{"name":"existing","mode":2147484141}`)))
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/containers/build/archive"):
+			if r.URL.Query().Get("path") != "/existing" {
+				http.Error(w, "unexpected path", http.StatusBadRequest)
+				return
+			}
+			tw := tar.NewWriter(w)
+			tw.WriteHeader(&tar.Header{Name: "existing/", Typeflag: tar.TypeDir, Mode: 0o755})
+			tw.WriteHeader(&tar.Header{Name: "existing/file", Typeflag: tar.TypeReg, Mode: 0o644})
+			tw.Close()
+		case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/containers/build/archive"):
+			uploaded = append(uploaded, readArchive()...)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/containers/build/exec"):
+			json.NewDecoder(r.Body).Decode(&removed)
+			fmt.Fprint(w, `{"Id":"rm"}`)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/exec/rm/start"):
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
+			conn.Close()
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/exec/rm/json"):
+			fmt.Fprint(w, `{"ID":"rm","Running":false,"ExitCode":0}`)
+		default:
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.Path, http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+
+	e := NewClientExecutor(client)
+	e.TempDir = t.TempDir()
+	e.Container = &docker.Container{ID: "build"}
+	e.containerOptions = &docker.CreateContainerOptions{Config: &docker.Config{Image: "sha256:base"}}
+	e.runMounts = &runMountVolumes{ReadOnly: "ro-volume", ReadWrite: "rw-volume"}
+	e.NamedContexts = map[string]*NamedContext{"tools": {Directory: dir}}
+	defer e.Release()
+
+	ctx := context.Background()
+	// what was at the target is kept, so that it can be restored
+	replaced, err := e.placeRunMount(ctx, runMount{From: "tools", Source: "/bin", Target: "/existing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the directories the link is created in are removed afterwards
+	created, err := e.placeRunMount(ctx, runMount{From: "tools", Source: "/bin/tool", Target: "/usr/local/lib/tool", ReadWrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.Snapshot == "" || replaced.Created != "" || created.Snapshot != "" || created.Created != "/usr/local" {
+		t.Errorf("unexpected mounts: %#v %#v", replaced, created)
+	}
+	if len(uploaded) != 2 || !strings.HasPrefix(uploaded[0], "existing -> "+runMountDir+"/ro/") || !strings.HasPrefix(uploaded[1], "usr/local/lib/tool -> "+runMountDir+"/rw/") {
+		t.Fatalf("unexpected links: %q", uploaded)
+	}
+	roName, rwName := path.Base(uploaded[0]), path.Base(uploaded[1])
+	expect := []string{
+		"ro-volume:" + runMountUploadDir, ".imagebuilder-mount/" + roName + "/", ".imagebuilder-mount/" + roName + "/tool",
+		"rw-volume:" + runMountUploadDir, ".imagebuilder-mount/" + rwName,
+	}
+	if !reflect.DeepEqual(expect, populated) {
+		t.Errorf("unexpected content:\n%q\n%q", expect, populated)
+	}
+
+	uploaded = nil
+	if err := e.removeRunMounts(ctx, []placedRunMount{replaced, created}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string{"existing", "existing/", "existing/file"}, uploaded) {
+		t.Errorf("unexpected restored content: %q", uploaded)
+	}
+	if !reflect.DeepEqual([]string{"rm", "-rf", "--", "/usr/local"}, removed.Cmd) || removed.User != "0" {
+		t.Errorf("unexpected removal: %#v", removed)
+	}
+}
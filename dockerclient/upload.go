@@ -0,0 +1,178 @@
+package dockerclient
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"k8s.io/klog"
+
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+)
+
+// uploadBatch streams the content copied by one or more COPY instructions
+// into a container through a single upload.
+type uploadBatch struct {
+	containerID  string
+	pw           *io.PipeWriter
+	tw           *tar.Writer
+	done         chan error
+	destinations []string
+}
+
+// startUpload starts uploading an archive to the root of a container, which
+// entries are written to until the batch is flushed.
+func startUpload(ctx context.Context, client *docker.Client, containerID string) *uploadBatch {
+	pr, pw := io.Pipe()
+	batch := &uploadBatch{
+		containerID: containerID,
+		pw:          pw,
+		tw:          tar.NewWriter(pw),
+		done:        make(chan error, 1),
+	}
+	go func() {
+		err := client.UploadToContainer(containerID, docker.UploadToContainerOptions{
+			InputStream: pr,
+			Path:        "/",
+			Context:     ctx,
+		})
+		// anything still writing to the batch has to find out that the
+		// upload is over
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			pr.CloseWithError(io.ErrClosedPipe)
+		}
+		batch.done <- err
+	}()
+	return batch
+}
+
+// upload adds the entries of the archive in r to the batch of content being
+// uploaded to container, starting a batch if necessary, and returns the
+// number of bytes read from r. If reading r fails between entries, the error
+// is returned as is, and the batch can still be used.
+func (e *ClientExecutor) upload(ctx context.Context, container *docker.Container, dest string, r io.Reader) (int64, error) {
+	if e.uploads != nil && e.uploads.containerID != container.ID {
+		if err := e.flushUploads(); err != nil {
+			return 0, err
+		}
+	}
+	if e.uploads == nil {
+		klog.V(4).Infof("Starting upload to %s", container.ID)
+		e.uploads = startUpload(ctx, e.Client, container.ID)
+	}
+	// what is copied may describe users
+	e.users.Invalidate()
+	batch := e.uploads
+	if len(batch.destinations) == 0 || batch.destinations[len(batch.destinations)-1] != dest {
+		batch.destinations = append(batch.destinations, dest)
+	}
+
+	counter := &countingReader{Reader: r}
+	tr := tar.NewReader(counter)
+	w := &writeErrorWrapper{Writer: batch.tw}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return counter.n, nil
+		}
+		if err != nil {
+			return counter.n, err
+		}
+		e.Xattrs.apply(h)
+		if err := mapToHost(e.IDMappings, h); err != nil {
+			return counter.n, err
+		}
+		if err := batch.tw.WriteHeader(h); err != nil {
+			return counter.n, e.uploadFailed(err)
+		}
+		if _, err := io.Copy(w, tr); err != nil {
+			if w.err != nil {
+				return counter.n, e.uploadFailed(w.err)
+			}
+			// the entry is incomplete, so nothing more can be added
+			// to the archive
+			e.abortUploads(err)
+			return counter.n, err
+		}
+		e.pathCache().wrote(container.ID, "/"+h.Name, h.Typeflag)
+	}
+}
+
+// uploadFailed returns the reason that the daemon stopped reading the batch
+// of content being uploaded, given the error writing to it.
+func (e *ClientExecutor) uploadFailed(err error) error {
+	if flushErr := e.flushUploads(); flushErr != nil {
+		return flushErr
+	}
+	return err
+}
+
+type writeErrorWrapper struct {
+	io.Writer
+	err error
+}
+
+func (w *writeErrorWrapper) Write(p []byte) (n int, err error) {
+	n, w.err = w.Writer.Write(p)
+	return n, w.err
+}
+
+// flushUploads finishes the batch of content being uploaded to a container,
+// if there is one, and waits for the daemon to extract it.
+func (e *ClientExecutor) flushUploads() error {
+	batch := e.uploads
+	if batch == nil {
+		return nil
+	}
+	e.uploads = nil
+	err := batch.tw.Close()
+	batch.pw.CloseWithError(err)
+	if uploadErr := <-batch.done; uploadErr != nil {
+		err = uploadErr
+	}
+	if err != nil {
+		// what was uploaded before the error is unknown
+		e.pathCache().invalidate()
+		if apiErr, ok := err.(*docker.Error); ok && apiErr.Status == 404 {
+			klog.V(4).Infof("path did not exist in container %s: %v", batch.containerID, err)
+		}
+		return fmt.Errorf("unable to copy content to %s: %w", strings.Join(batch.destinations, ", "), err)
+	}
+	klog.V(4).Infof("Finished upload to %s", batch.containerID)
+	return nil
+}
+
+// abortUploads abandons the batch of content being uploaded to a container,
+// if there is one.
+func (e *ClientExecutor) abortUploads(err error) {
+	batch := e.uploads
+	if batch == nil {
+		return
+	}
+	e.uploads = nil
+	batch.pw.CloseWithError(err)
+	<-batch.done
+	e.pathCache().invalidate()
+}
+
+// uploadsContinue returns true if another COPY or ADD instruction is among
+// the instructions in nodes, with only instructions which change the
+// configuration of the image before it, so that content being uploaded
+// doesn't need to be in the container until that instruction is done.
+func uploadsContinue(nodes []*parser.Node) bool {
+	for _, node := range nodes {
+		switch strings.ToLower(node.Value) {
+		case "copy", "add":
+			return true
+		case "arg", "env", "label", "maintainer", "expose", "user", "cmd", "entrypoint", "healthcheck", "stopsignal", "shell", "onbuild":
+		default:
+			return false
+		}
+	}
+	return false
+}
@@ -278,6 +278,22 @@ func newNodeFromLine(line string, directive *Directive) (*Node, error) {
 	}, nil
 }
 
+// ParseError is returned when a Dockerfile can't be parsed. It records which
+// lines of the Dockerfile contained the problem.
+type ParseError struct {
+	StartLine int
+	EndLine   int
+	Err       error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("parse error on line %d: %v", e.StartLine, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
 // Result is the result of parsing a Dockerfile
 type Result struct {
 	AST         *Node
@@ -316,7 +332,7 @@ func Parse(rwc io.Reader) (*Result, error) {
 		}
 		bytesRead, err = processLine(d, bytesRead, true)
 		if err != nil {
-			return nil, err
+			return nil, &ParseError{StartLine: currentLine + 1, EndLine: currentLine + 1, Err: err}
 		}
 		currentLine++
 
@@ -330,7 +346,7 @@ func Parse(rwc io.Reader) (*Result, error) {
 		for !isEndOfLine && scanner.Scan() {
 			bytesRead, err := processLine(d, scanner.Bytes(), false)
 			if err != nil {
-				return nil, err
+				return nil, &ParseError{StartLine: startLine, EndLine: currentLine + 1, Err: err}
 			}
 			currentLine++
 
@@ -351,13 +367,13 @@ func Parse(rwc io.Reader) (*Result, error) {
 
 		child, err := newNodeFromLine(line, d)
 		if err != nil {
-			return nil, err
+			return nil, &ParseError{StartLine: startLine, EndLine: currentLine, Err: err}
 		}
 
 		if child.canContainHeredoc() {
 			heredocs, err := heredocsFromLine(line)
 			if err != nil {
-				return nil, err
+				return nil, &ParseError{StartLine: startLine, EndLine: currentLine, Err: err}
 			}
 
 			for _, heredoc := range heredocs {
@@ -379,7 +395,7 @@ func Parse(rwc io.Reader) (*Result, error) {
 					heredoc.Content += string(bytesRead)
 				}
 				if !terminated {
-					return nil, fmt.Errorf("%s: unterminated heredoc", heredoc.Name)
+					return nil, &ParseError{StartLine: startLine, EndLine: currentLine, Err: fmt.Errorf("%s: unterminated heredoc", heredoc.Name)}
 				}
 
 				child.Heredocs = append(child.Heredocs, heredoc)
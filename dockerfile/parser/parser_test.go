@@ -164,3 +164,36 @@ RUN another \
 	assert.Contains(t, warnings[1], "RUN another     thing")
 	assert.Contains(t, warnings[2], "will become errors in a future release")
 }
+
+func TestParseErrorIncludesLineNumbers(t *testing.T) {
+	testCases := []struct {
+		dockerfile string
+		startLine  int
+		endLine    int
+		message    string
+	}{
+		{
+			dockerfile: "FROM busybox\nRUN <<EOF\necho hello\n",
+			startLine:  2,
+			endLine:    3,
+			message:    "parse error on line 2: EOF: unterminated heredoc",
+		},
+		{
+			dockerfile: "FROM busybox\n\nRUN true\nENV A\n",
+			startLine:  4,
+			endLine:    4,
+			message:    "parse error on line 4: ENV must have two arguments",
+		},
+	}
+	for i, test := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			_, err := Parse(bytes.NewBufferString(test.dockerfile))
+			require.Error(t, err)
+			var parseErr *ParseError
+			require.ErrorAs(t, err, &parseErr)
+			assert.Equal(t, test.startLine, parseErr.StartLine)
+			assert.Equal(t, test.endLine, parseErr.EndLine)
+			assert.Equal(t, test.message, err.Error())
+		})
+	}
+}
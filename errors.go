@@ -0,0 +1,78 @@
+package imagebuilder
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// StepError is returned when an instruction can't be evaluated or executed.
+// It wraps the error which caused the failure, and records where in the
+// Dockerfile the instruction was found.
+type StepError struct {
+	// Stage is the name of the stage containing the instruction, and
+	// Position is the stage's position in the Dockerfile, if known.
+	Stage    string
+	Position int
+	// StartLine and EndLine are the first and last lines of the Dockerfile
+	// which the instruction occupied, or zero if they aren't known.
+	StartLine int
+	EndLine   int
+	// Original is the instruction as it appeared in the Dockerfile.
+	Original string
+	// ExitCode is the exit status of the command for a RUN instruction
+	// which failed because its command failed, and zero otherwise.
+	ExitCode int
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *StepError) Error() string {
+	location := e.Original
+	if e.StartLine > 0 {
+		location = fmt.Sprintf("%s (line %d)", e.Original, e.StartLine)
+	}
+	if location == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", location, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// newStepError wraps err in a StepError describing an instruction, unless err
+// already describes one.
+func newStepError(original string, startLine, endLine int, err error) error {
+	if err == nil {
+		return nil
+	}
+	var stepErr *StepError
+	if errors.As(err, &stepErr) {
+		return err
+	}
+	stepErr = &StepError{
+		StartLine: startLine,
+		EndLine:   endLine,
+		Original:  original,
+		Err:       err,
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		stepErr.ExitCode = exitErr.ExitCode
+	}
+	return stepErr
+}
+
+// ExitError is returned by an executor when the command for a RUN
+// instruction exits with a non-zero status.
+type ExitError struct {
+	// Args is the command as it was specified in the instruction.
+	Args     []string
+	ExitCode int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("running '%s' failed with exit code %d", strings.Join(e.Args, " "), e.ExitCode)
+}
@@ -62,6 +62,10 @@ type Step struct {
 	Message  string
 	Heredocs []buildkitparser.Heredoc
 	Original string
+
+	// startLine and endLine locate the instruction in the Dockerfile, for
+	// errors which are reported when it is run.
+	startLine, endLine int
 }
 
 // Resolve transforms a parsed Dockerfile line into a command to execute,
@@ -79,7 +83,14 @@ type Step struct {
 // such as `RUN` in ONBUILD RUN foo. There is special case logic in here to
 // deal with that, at least until it becomes more of a general concern with new
 // features.
+//
+// Errors are returned as a *StepError.
 func (b *Step) Resolve(ast *parser.Node) error {
+	return newStepError(ast.Original, ast.StartLine, ast.EndLine, b.resolve(ast))
+}
+
+func (b *Step) resolve(ast *parser.Node) error {
+	b.startLine, b.endLine = ast.StartLine, ast.EndLine
 	b.Heredocs = ast.Heredocs
 	cmd := ast.Value
 	upperCasedCmd := strings.ToUpper(cmd)
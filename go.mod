@@ -9,6 +9,7 @@ require (
 	github.com/docker/docker v28.5.1+incompatible
 	github.com/fsouza/go-dockerclient v1.11.2
 	github.com/moby/buildkit v0.23.2
+	github.com/moby/term v0.5.2
 	github.com/stretchr/testify v1.11.1
 	go.podman.io/storage v1.60.0
 	k8s.io/klog v1.0.0
@@ -34,7 +35,6 @@ require (
 	github.com/moby/sys/sequential v0.6.0 // indirect
 	github.com/moby/sys/user v0.4.0 // indirect
 	github.com/moby/sys/userns v0.1.0 // indirect
-	github.com/moby/term v0.5.2 // indirect
 	github.com/morikuni/aec v1.0.0 // indirect
 	github.com/opencontainers/go-digest v1.0.0 // indirect
 	github.com/opencontainers/image-spec v1.1.1 // indirect
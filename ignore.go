@@ -0,0 +1,58 @@
+package imagebuilder
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.podman.io/storage/pkg/fileutils"
+)
+
+// IgnoreMatcher decides which paths in a build context are excluded by the
+// patterns read from an ignore file.
+type IgnoreMatcher struct {
+	patterns []string
+	matchers []*fileutils.PatternMatcher
+}
+
+// NewIgnoreMatcher returns a matcher for patterns, as returned by
+// ParseIgnoreReader.
+func NewIgnoreMatcher(patterns []string) (*IgnoreMatcher, error) {
+	m := &IgnoreMatcher{}
+	for _, pattern := range patterns {
+		matcher, err := fileutils.NewPatternMatcher([]string{pattern})
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern %q: %v", pattern, err)
+		}
+		if len(matcher.Patterns()) == 0 {
+			continue
+		}
+		m.patterns = append(m.patterns, pattern)
+		m.matchers = append(m.matchers, matcher)
+	}
+	return m, nil
+}
+
+// Included returns true if path, relative to the root of the build context,
+// is included in the context, along with the pattern which decided that. A
+// pattern matches a path if it matches the path or any of its parents, and
+// the last pattern which matches decides, so that a pattern starting with !
+// can include something which an earlier pattern excluded. The pattern is
+// empty if none of them matched, in which case the path is included.
+func (m *IgnoreMatcher) Included(path string) (bool, string, error) {
+	path = strings.TrimLeft(filepath.Clean(filepath.FromSlash(path)), string(filepath.Separator))
+	if path == "" || path == "." {
+		return true, "", nil
+	}
+	included, decided := true, ""
+	for i, matcher := range m.matchers {
+		result, err := matcher.MatchesResult(path)
+		if err != nil {
+			return false, "", fmt.Errorf("unable to match %q against %q: %v", path, m.patterns[i], err)
+		}
+		if result.Matches() > 0 || result.Excludes() > 0 {
+			included, decided = !result.IsMatched(), m.patterns[i]
+		}
+	}
+	return included, decided, nil
+}
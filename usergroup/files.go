@@ -0,0 +1,143 @@
+package usergroup
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks is the number of symbolic links which are followed while
+// finding a file, as with MAXSYMLINKS.
+const maxSymlinks = 40
+
+// DirectoryFiles returns Files which reads from the root filesystem of a
+// container in root. Symbolic links are followed as they would be inside the
+// container, so they never lead outside of root.
+func DirectoryFiles(root string) Files {
+	return func(ctx context.Context, name string) ([]byte, error) {
+		resolved, err := resolveInDirectory(root, name)
+		if err != nil {
+			return nil, err
+		}
+		return os.ReadFile(filepath.Join(root, filepath.FromSlash(resolved)))
+	}
+}
+
+// resolveInDirectory returns name, relative to root, with every symbolic link
+// in it replaced by what it points to, treating root as the root directory.
+func resolveInDirectory(root, name string) (string, error) {
+	var resolved []string
+	pending := strings.Split(strings.Trim(path.Clean("/"+name), "/"), "/")
+	links := 0
+	for len(pending) > 0 {
+		component := pending[0]
+		pending = pending[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		resolved = append(resolved, component)
+		current := filepath.Join(root, filepath.FromSlash(path.Join(resolved...)))
+		fi, err := os.Lstat(current)
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", name)
+		}
+		target, err := os.Readlink(current)
+		if err != nil {
+			return "", err
+		}
+		target = filepath.ToSlash(target)
+		resolved = resolved[:len(resolved)-1]
+		if path.IsAbs(target) {
+			resolved = nil
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return path.Join(resolved...), nil
+}
+
+// LayerFiles returns Files which reads from an image layer, an uncompressed
+// archive which open returns a new reader for each time it is called. Links
+// are followed within the layer, and a file which is missing from the layer,
+// or which the layer deletes, doesn't exist.
+func LayerFiles(open func() (io.ReadCloser, error)) Files {
+	return func(ctx context.Context, name string) ([]byte, error) {
+		name = strings.TrimPrefix(path.Clean("/"+name), "/")
+		for links := 0; links <= maxSymlinks; links++ {
+			h, data, err := readLayerEntry(open, name)
+			if err != nil {
+				return nil, err
+			}
+			switch h.Typeflag {
+			case tar.TypeReg, tar.TypeRegA:
+				return data, nil
+			case tar.TypeLink:
+				name = strings.TrimPrefix(path.Clean("/"+h.Linkname), "/")
+			case tar.TypeSymlink:
+				target := h.Linkname
+				if !path.IsAbs(target) {
+					target = path.Join(path.Dir("/"+name), target)
+				}
+				name = strings.TrimPrefix(path.Clean("/"+target), "/")
+			default:
+				return nil, fmt.Errorf("%s is not a regular file", name)
+			}
+		}
+		return nil, fmt.Errorf("%s: too many levels of links", name)
+	}
+}
+
+// readLayerEntry returns the header of the entry in a layer named name, and
+// its content if it is a regular file.
+func readLayerEntry(open func() (io.ReadCloser, error), name string) (*tar.Header, []byte, error) {
+	rc, err := open()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rc.Close()
+	whiteout := path.Join(path.Dir(name), ".wh."+path.Base(name))
+	var found *tar.Header
+	var data []byte
+	tr := tar.NewReader(rc)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		switch strings.TrimPrefix(path.Clean("/"+h.Name), "/") {
+		case whiteout:
+			found, data = nil, nil
+		case name:
+			found, data = h, nil
+			if h.Typeflag == tar.TypeReg || h.Typeflag == tar.TypeRegA {
+				if data, err = io.ReadAll(tr); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+	if found == nil {
+		return nil, nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return found, data, nil
+}
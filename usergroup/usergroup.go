@@ -0,0 +1,328 @@
+// Package usergroup resolves user specifications, such as those given to the
+// USER instruction and to COPY --chown, against the user and group databases
+// of a container filesystem or an image layer.
+package usergroup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	passwdPath = "/etc/passwd"
+	groupPath  = "/etc/group"
+)
+
+var (
+	// ErrUnknownUser is wrapped by the error returned when a user name
+	// isn't listed in /etc/passwd.
+	ErrUnknownUser = errors.New("no such user")
+	// ErrUnknownGroup is wrapped by the error returned when a group name
+	// isn't listed in /etc/group.
+	ErrUnknownGroup = errors.New("no such group")
+)
+
+// Files reads the file named by an absolute path from a container filesystem.
+// It returns an error which wraps fs.ErrNotExist if there is no such file.
+type Files func(ctx context.Context, path string) ([]byte, error)
+
+// User is what a user specification resolves to.
+type User struct {
+	// Name is the name of the user, if it is listed in /etc/passwd.
+	Name string
+	// UID and GID are the user ID and primary group ID.
+	UID, GID int
+	// Groups are the IDs of the groups in /etc/group which list the user
+	// as a member. They're only set when the specification doesn't name a
+	// group, since one which does replaces all of the user's groups.
+	Groups []int
+	// Home is the home directory of the user, if it is listed in
+	// /etc/passwd.
+	Home string
+}
+
+type passwdEntry struct {
+	name     string
+	uid, gid int
+	home     string
+}
+
+type groupEntry struct {
+	name    string
+	gid     int
+	members []string
+}
+
+// Resolver resolves user specifications against the databases read from a
+// container filesystem. The databases are parsed the first time they're
+// needed, and kept until Invalidate is called, so a Resolver should be
+// invalidated whenever the filesystem may have changed.
+type Resolver struct {
+	files Files
+
+	lock   sync.Mutex
+	passwd []passwdEntry
+	groups []groupEntry
+	// read records which of the databases have been read, so that a file
+	// which doesn't exist isn't asked for again.
+	read map[string]bool
+}
+
+// NewResolver returns a Resolver which reads the databases with files.
+func NewResolver(files Files) *Resolver {
+	return &Resolver{files: files, read: make(map[string]bool)}
+}
+
+// Invalidate discards the databases which have been read, so that they'll be
+// read again the next time they're needed.
+func (r *Resolver) Invalidate() {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.passwd, r.groups = nil, nil
+	r.read = make(map[string]bool)
+}
+
+// Resolve resolves spec, which is a user name or ID, optionally followed by a
+// colon and a group name or ID, the way the user a process runs as is chosen.
+// A user ID which isn't listed in /etc/passwd is allowed, and is given the
+// group ID 0 unless a group is named. The empty specification is root. The
+// databases are only read when spec names a user or group which is not an ID,
+// or when a user's groups have to be found.
+func (r *Resolver) Resolve(ctx context.Context, spec string) (*User, error) {
+	return r.resolve(ctx, spec, false)
+}
+
+// Owner resolves spec the way the owner of files copied by COPY --chown is
+// chosen: as Resolve does, except that a user ID with no group has the same
+// group ID, and supplementary groups aren't looked up. An owner given entirely
+// as IDs is resolved without reading either database.
+func (r *Resolver) Owner(ctx context.Context, spec string) (uid, gid int, err error) {
+	u, err := r.resolve(ctx, spec, true)
+	if err != nil {
+		return -1, -1, err
+	}
+	return u.UID, u.GID, nil
+}
+
+func (r *Resolver) resolve(ctx context.Context, spec string, owner bool) (*User, error) {
+	userPart, groupPart, _ := strings.Cut(spec, ":")
+	if userPart == "" {
+		userPart = "0"
+	}
+	u := &User{}
+
+	uid, err := parseID(userPart)
+	switch {
+	case err == nil && owner && groupPart == "":
+		// the group ID is the same as the user ID
+		u.UID, u.GID = uid, uid
+		return u, nil
+	case err == nil:
+		u.UID = uid
+		if groupPart == "" {
+			entry, err := r.lookupPasswd(ctx, func(e passwdEntry) bool { return e.uid == uid })
+			if err != nil {
+				return nil, err
+			}
+			if entry != nil {
+				u.Name, u.GID, u.Home = entry.name, entry.gid, entry.home
+			}
+		}
+	case isNumeric(userPart):
+		return nil, err
+	default:
+		entry, err := r.lookupPasswd(ctx, func(e passwdEntry) bool { return e.name == userPart })
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			return nil, fmt.Errorf("unable to find user %s in %s: %w", userPart, passwdPath, ErrUnknownUser)
+		}
+		u.Name, u.UID, u.GID, u.Home = entry.name, entry.uid, entry.gid, entry.home
+	}
+
+	if groupPart != "" {
+		gid, err := parseID(groupPart)
+		switch {
+		case err == nil:
+			u.GID = gid
+		case isNumeric(groupPart):
+			return nil, err
+		default:
+			groups, err := r.lookupGroups(ctx, func(e groupEntry) bool { return e.name == groupPart })
+			if err != nil {
+				return nil, err
+			}
+			if len(groups) == 0 {
+				return nil, fmt.Errorf("unable to find group %s in %s: %w", groupPart, groupPath, ErrUnknownGroup)
+			}
+			u.GID = groups[0].gid
+		}
+		return u, nil
+	}
+
+	if !owner && u.Name != "" {
+		groups, err := r.lookupGroups(ctx, func(e groupEntry) bool {
+			for _, member := range e.members {
+				if member == u.Name {
+					return true
+				}
+			}
+			return false
+		})
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[int]bool)
+		for _, group := range groups {
+			if !seen[group.gid] {
+				seen[group.gid] = true
+				u.Groups = append(u.Groups, group.gid)
+			}
+		}
+	}
+	return u, nil
+}
+
+// parseID parses a user or group ID.
+func parseID(s string) (int, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return -1, fmt.Errorf("invalid ID %q: %w", s, err)
+	}
+	return int(id), nil
+}
+
+// isNumeric returns true if s consists of digits, in which case it can only
+// be an ID, even one which is out of range.
+func isNumeric(s string) bool {
+	return strings.Trim(s, "0123456789") == ""
+}
+
+// lookupPasswd returns the first entry in /etc/passwd which match selects,
+// or nil if there isn't one.
+func (r *Resolver) lookupPasswd(ctx context.Context, match func(passwdEntry) bool) (*passwdEntry, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.read[passwdPath] {
+		data, err := r.readFile(ctx, passwdPath)
+		if err != nil {
+			return nil, err
+		}
+		r.passwd = parsePasswd(data)
+		r.read[passwdPath] = true
+	}
+	for i := range r.passwd {
+		if match(r.passwd[i]) {
+			entry := r.passwd[i]
+			return &entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// lookupGroups returns the entries in /etc/group which match selects.
+func (r *Resolver) lookupGroups(ctx context.Context, match func(groupEntry) bool) ([]groupEntry, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.read[groupPath] {
+		data, err := r.readFile(ctx, groupPath)
+		if err != nil {
+			return nil, err
+		}
+		r.groups = parseGroup(data)
+		r.read[groupPath] = true
+	}
+	var groups []groupEntry
+	for _, entry := range r.groups {
+		if match(entry) {
+			groups = append(groups, entry)
+		}
+	}
+	return groups, nil
+}
+
+// readFile reads a database, which is treated as being empty if it doesn't
+// exist.
+func (r *Resolver) readFile(ctx context.Context, path string) ([]byte, error) {
+	data, err := r.files(ctx, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// databaseLines calls fn with the fields of each line of data which describes
+// an entry. Comments, and the + and - entries which the compat NSS module
+// uses to include entries from other sources, which can't be consulted from
+// outside of the container, are left out, as are lines with fewer than
+// minFields fields, or an ID which isn't a number, as the C library does.
+func databaseLines(data []byte, minFields int, fn func(fields []string)) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '+' || line[0] == '-' {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < minFields {
+			continue
+		}
+		fn(fields)
+	}
+}
+
+func parsePasswd(data []byte) []passwdEntry {
+	var entries []passwdEntry
+	// name:password:UID:GID:GECOS:directory:shell
+	databaseLines(data, 4, func(fields []string) {
+		uid, err := parseID(fields[2])
+		if err != nil {
+			return
+		}
+		gid, err := parseID(fields[3])
+		if err != nil {
+			return
+		}
+		entry := passwdEntry{name: fields[0], uid: uid, gid: gid}
+		if len(fields) > 5 {
+			entry.home = fields[5]
+		}
+		entries = append(entries, entry)
+	})
+	return entries
+}
+
+func parseGroup(data []byte) []groupEntry {
+	var entries []groupEntry
+	// name:password:GID:members
+	databaseLines(data, 3, func(fields []string) {
+		gid, err := parseID(fields[2])
+		if err != nil {
+			return
+		}
+		entry := groupEntry{name: fields[0], gid: gid}
+		if len(fields) > 3 {
+			for _, member := range strings.Split(fields[3], ",") {
+				if member = strings.TrimSpace(member); member != "" {
+					entry.members = append(entry.members, member)
+				}
+			}
+		}
+		entries = append(entries, entry)
+	})
+	return entries
+}
@@ -0,0 +1,269 @@
+package usergroup
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testPasswd = `root:x:0:0:root:/root:/bin/sh
+# a comment
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+app:x:1000:1000::/home/app:/bin/sh
+broken:x:notanumber:0::/:/bin/sh
++nisuser::::::
++@netgroup
+-excluded
++
+short:x:1001:1001
+`
+
+const testGroup = `root:x:0:
+daemon:x:1:app
+app:x:1000:
+wheel:x:10:root,app
+audio:x:29: app , other
++
+-excluded
+`
+
+// testRoot creates a container filesystem with the given files.
+func testRoot(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for name, content := range files {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestResolve(t *testing.T) {
+	root := testRoot(t, map[string]string{"etc/passwd": testPasswd, "etc/group": testGroup})
+	testCases := []struct {
+		spec   string
+		expect User
+		// err is set if resolving spec must fail with it, and fails if
+		// it must fail with any error
+		err   error
+		fails bool
+	}{
+		{spec: "", expect: User{Name: "root", Home: "/root", Groups: []int{10}}},
+		{spec: "root", expect: User{Name: "root", Home: "/root", Groups: []int{10}}},
+		{spec: "app", expect: User{Name: "app", UID: 1000, GID: 1000, Home: "/home/app", Groups: []int{1, 10, 29}}},
+		{spec: "app:", expect: User{Name: "app", UID: 1000, GID: 1000, Home: "/home/app", Groups: []int{1, 10, 29}}},
+		{spec: "1000", expect: User{Name: "app", UID: 1000, GID: 1000, Home: "/home/app", Groups: []int{1, 10, 29}}},
+		// a group replaces all of the user's groups
+		{spec: "app:wheel", expect: User{Name: "app", UID: 1000, GID: 10, Home: "/home/app"}},
+		{spec: "app:55", expect: User{Name: "app", UID: 1000, GID: 55, Home: "/home/app"}},
+		{spec: "1000:daemon", expect: User{UID: 1000, GID: 1}},
+		// an ID which isn't listed is still valid
+		{spec: "4242", expect: User{UID: 4242}},
+		{spec: "4242:4343", expect: User{UID: 4242, GID: 4343}},
+		{spec: "short", expect: User{Name: "short", UID: 1001, GID: 1001}},
+		{spec: "missing", err: ErrUnknownUser},
+		{spec: "app:missing", err: ErrUnknownGroup},
+		// entries which refer to other sources aren't users
+		{spec: "+nisuser", err: ErrUnknownUser},
+		{spec: "broken", err: ErrUnknownUser},
+		{spec: "99999999999", fails: true},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			u, err := NewResolver(DirectoryFiles(root)).Resolve(context.Background(), testCase.spec)
+			if testCase.err != nil || testCase.fails {
+				if err == nil || (testCase.err != nil && !errors.Is(err, testCase.err)) {
+					t.Fatalf("expected an error resolving %q, got %#v %v", testCase.spec, u, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(testCase.expect, *u) {
+				t.Errorf("unexpected user for %q:\nexpected: %#v\nfound:    %#v", testCase.spec, testCase.expect, *u)
+			}
+		})
+	}
+}
+
+func TestOwner(t *testing.T) {
+	root := testRoot(t, map[string]string{"etc/passwd": testPasswd, "etc/group": testGroup})
+	testCases := []struct {
+		spec     string
+		uid, gid int
+		err      error
+	}{
+		{spec: "1000", uid: 1000, gid: 1000},
+		// the group ID is the same as the user ID, even if the user is
+		// listed with another one
+		{spec: "1", uid: 1, gid: 1},
+		{spec: "4242", uid: 4242, gid: 4242},
+		{spec: "app", uid: 1000, gid: 1000},
+		{spec: "app:", uid: 1000, gid: 1000},
+		{spec: "daemon:wheel", uid: 1, gid: 10},
+		{spec: "12:34", uid: 12, gid: 34},
+		{spec: "missing:0", err: ErrUnknownUser},
+	}
+	for i, testCase := range testCases {
+		t.Run(fmt.Sprintf("%d", i), func(t *testing.T) {
+			uid, gid, err := NewResolver(DirectoryFiles(root)).Owner(context.Background(), testCase.spec)
+			if testCase.err != nil {
+				if !errors.Is(err, testCase.err) {
+					t.Fatalf("expected %v, got %v", testCase.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uid != testCase.uid || gid != testCase.gid {
+				t.Errorf("expected %d:%d for %q, got %d:%d", testCase.uid, testCase.gid, testCase.spec, uid, gid)
+			}
+		})
+	}
+}
+
+func TestResolverCache(t *testing.T) {
+	reads := map[string]int{}
+	passwd := testPasswd
+	files := func(ctx context.Context, path string) ([]byte, error) {
+		reads[path]++
+		switch path {
+		case "/etc/passwd":
+			return []byte(passwd), nil
+		default:
+			return nil, fmt.Errorf("%s: %w", path, fs.ErrNotExist)
+		}
+	}
+	r := NewResolver(files)
+	ctx := context.Background()
+
+	// IDs don't need either database
+	if _, _, err := r.Owner(ctx, "1:2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(reads) != 0 {
+		t.Fatalf("expected nothing to be read, got %v", reads)
+	}
+	for i := 0; i < 3; i++ {
+		u, err := r.Resolve(ctx, "app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a missing group database has no members
+		if u.Groups != nil {
+			t.Errorf("unexpected groups %v", u.Groups)
+		}
+	}
+	if expect := map[string]int{"/etc/passwd": 1, "/etc/group": 1}; !reflect.DeepEqual(expect, reads) {
+		t.Errorf("expected each database to be read once, got %v", reads)
+	}
+
+	passwd += "added:x:2000:2000::/:/bin/sh\n"
+	if _, err := r.Resolve(ctx, "added"); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("expected the cached database to be used, got %v", err)
+	}
+	r.Invalidate()
+	if u, err := r.Resolve(ctx, "added"); err != nil || u.UID != 2000 {
+		t.Errorf("expected the database to be read again, got %#v %v", u, err)
+	}
+
+	failing := NewResolver(func(ctx context.Context, path string) ([]byte, error) {
+		return nil, errors.New("daemon unavailable")
+	})
+	if _, err := failing.Resolve(ctx, "app"); err == nil || errors.Is(err, ErrUnknownUser) {
+		t.Errorf("expected the read error to be returned, got %v", err)
+	}
+}
+
+func TestDirectoryFiles(t *testing.T) {
+	root := testRoot(t, map[string]string{"data/passwd": "inside\n"})
+	outside := filepath.Join(filepath.Dir(root), filepath.Base(root)+"-outside")
+	if err := os.MkdirAll(filepath.Join(outside, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "etc", "passwd"), []byte("outside\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// links are resolved inside the root, however they're written
+	for name, target := range map[string]string{
+		"etc/passwd": "/data/passwd",
+		"etc/group":  "../../../../data/passwd",
+		"etc/shadow": filepath.Join(outside, "etc", "passwd"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := DirectoryFiles(root)
+	for _, name := range []string{"/etc/passwd", "/etc/group"} {
+		data, err := files(context.Background(), name)
+		if err != nil || string(data) != "inside\n" {
+			t.Errorf("unexpected contents of %s: %q %v", name, data, err)
+		}
+	}
+	if data, err := files(context.Background(), "/etc/shadow"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a link to an absolute path to stay inside the root, got %q %v", data, err)
+	}
+}
+
+func TestLayerFiles(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range []struct {
+		h       tar.Header
+		content string
+	}{
+		{h: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0o755}},
+		{h: tar.Header{Name: "etc/passwd.real", Typeflag: tar.TypeReg, Mode: 0o644}, content: "app:x:1000:1000::/:/bin/sh\n"},
+		{h: tar.Header{Name: "etc/passwd", Typeflag: tar.TypeSymlink, Linkname: "passwd.real"}},
+		{h: tar.Header{Name: "etc/group", Typeflag: tar.TypeLink, Linkname: "etc/group.real"}},
+		{h: tar.Header{Name: "./etc/group.real", Typeflag: tar.TypeReg, Mode: 0o644}, content: "staff:x:50:app\n"},
+		{h: tar.Header{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0o600}, content: "removed"},
+		{h: tar.Header{Name: "etc/.wh.shadow", Typeflag: tar.TypeReg}},
+	} {
+		entry.h.Size = int64(len(entry.content))
+		if err := tw.WriteHeader(&entry.h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := LayerFiles(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+
+	u, err := NewResolver(files).Resolve(context.Background(), "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := (User{Name: "app", UID: 1000, GID: 1000, Home: "/", Groups: []int{50}}); !reflect.DeepEqual(expect, *u) {
+		t.Errorf("unexpected user:\nexpected: %#v\nfound:    %#v", expect, *u)
+	}
+	for _, name := range []string{"/etc/shadow", "/etc/missing"} {
+		if _, err := files(context.Background(), name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("expected %s not to exist, got %v", name, err)
+		}
+	}
+}